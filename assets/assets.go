@@ -0,0 +1,132 @@
+// Package assets renders derived assets such as thumbnails and subtitle
+// tracks from media objects with ffmpeg and stores them in R2. Recording them
+// in the database is left to the caller.
+package assets
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// ErrNoStream is returned when the source has no stream to generate an asset
+// from, e.g. a video without subtitles or an audio-only file.
+var ErrNoStream = errors.New("no suitable stream")
+
+// sourceURLExpiry is how long ffmpeg may keep reading a presigned source URL.
+const sourceURLExpiry = 30 * time.Minute
+
+// Runner runs an external command such as ffmpeg or ffprobe, writing its
+// standard output to stdout. Tests can substitute a fake.
+type Runner interface {
+	Run(ctx context.Context, name string, args []string, stdout io.Writer) error
+}
+
+// ExecRunner runs commands as subprocesses, killing them when ctx is done.
+type ExecRunner struct{}
+
+// noStreamMessages are ffmpeg errors meaning there was nothing to extract.
+var noStreamMessages = []string{
+	"does not contain any stream",
+	"matches no streams",
+	"Output file is empty",
+}
+
+func (ExecRunner) Run(ctx context.Context, name string, args []string, stdout io.Writer) error {
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Stdout = stdout
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	if err == nil {
+		return nil
+	}
+	if ctx.Err() != nil {
+		return fmt.Errorf("%s: %w", name, ctx.Err())
+	}
+
+	out := strings.TrimSpace(stderr.String())
+	last := out
+	if i := strings.LastIndex(out, "\n"); i >= 0 {
+		last = out[i+1:]
+	}
+	for _, msg := range noStreamMessages {
+		if strings.Contains(out, msg) {
+			return fmt.Errorf("%w: %s", ErrNoStream, last)
+		}
+	}
+	return fmt.Errorf("%s failed: %w: %s", name, err, last)
+}
+
+// DefaultRunner is the Runner used by generators created with NewGenerator
+// and by ffprobe calls.
+var DefaultRunner Runner = ExecRunner{}
+
+// Object is an asset stored in the bucket.
+type Object struct {
+	Key         string
+	ContentType string
+	Data        []byte
+}
+
+// Generator renders assets with its profiles and stores them in a bucket.
+type Generator struct {
+	Runner     Runner
+	Client     *s3.Client
+	Bucket     string
+	Thumbnails ThumbnailProfile
+	Subtitles  SubtitleProfile
+	Trickplay  TrickplayProfile
+	Preview    PreviewProfile
+	Waveform   WaveformProfile
+}
+
+// NewGenerator returns a generator using the default runner and the
+// profiles from the configuration.
+func NewGenerator(client *s3.Client, bucket string) *Generator {
+	return &Generator{
+		Runner:     DefaultRunner,
+		Client:     client,
+		Bucket:     bucket,
+		Thumbnails: DefaultThumbnailProfile(),
+		Subtitles:  DefaultSubtitleProfile(),
+		Trickplay:  DefaultTrickplayProfile(),
+		Preview:    DefaultPreviewProfile(),
+		Waveform:   DefaultWaveformProfile(),
+	}
+}
+
+// SourceURL returns a presigned URL ffmpeg can read an object from.
+func (g *Generator) SourceURL(ctx context.Context, key string) (string, error) {
+	presigned, err := s3.NewPresignClient(g.Client).PresignGetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(g.Bucket),
+		Key:    aws.String(key),
+	}, s3.WithPresignExpires(sourceURLExpiry))
+	if err != nil {
+		return "", err
+	}
+	return presigned.URL, nil
+}
+
+// Put uploads an asset to the bucket.
+func (g *Generator) Put(ctx context.Context, obj Object) error {
+	_, err := manager.NewUploader(g.Client).Upload(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(g.Bucket),
+		Key:         aws.String(obj.Key),
+		Body:        bytes.NewReader(obj.Data),
+		ContentType: aws.String(obj.ContentType),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to upload %s: %w", obj.Key, err)
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+package assets
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fakeRunner records the commands it is asked to run. Each call is answered
+// by the next of its steps, which may write the outputs ffmpeg would have.
+type fakeRunner struct {
+	calls [][]string
+	steps []func(args []string) error
+}
+
+func (r *fakeRunner) Run(ctx context.Context, name string, args []string, stdout io.Writer) error {
+	r.calls = append(r.calls, append([]string{name}, args...))
+	if len(r.steps) == 0 {
+		return nil
+	}
+	step := r.steps[0]
+	r.steps = r.steps[1:]
+	return step(args)
+}
+
+// writeOutputs writes data to every argument that is a path to a file with
+// one of the given extensions.
+func writeOutputs(data string, exts ...string) func(args []string) error {
+	return func(args []string) error {
+		for _, arg := range args {
+			if !filepath.IsAbs(arg) {
+				continue
+			}
+			for _, ext := range exts {
+				if strings.HasSuffix(arg, ext) {
+					if err := os.WriteFile(arg, []byte(data), 0o644); err != nil {
+						return err
+					}
+				}
+			}
+		}
+		return nil
+	}
+}
+
+func fail(err error) func([]string) error {
+	return func([]string) error { return err }
+}
+
+// hasArgs reports whether args contains want as a contiguous sequence.
+func hasArgs(args []string, want ...string) bool {
+	for i := 0; i+len(want) <= len(args); i++ {
+		match := true
+		for j, w := range want {
+			if args[i+j] != w {
+				match = false
+				break
+			}
+		}
+		if match {
+			return true
+		}
+	}
+	return false
+}
+
+func TestExecRunnerErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		script   string
+		wantErr  bool
+		noStream bool
+	}{
+		{"success", "exit 0", false, false},
+		{"no stream", "echo 'Output #0 does not contain any stream' >&2; exit 1", true, true},
+		{"no match", "echo 'Stream map 0:s matches no streams.' >&2; exit 1", true, true},
+		{"empty output", "echo 'Output file is empty, nothing was encoded' >&2; exit 1", true, true},
+		{"other failure", "echo 'Invalid data found when processing input' >&2; exit 1", true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ExecRunner{}.Run(context.Background(), "sh", []string{"-c", tt.script}, nil)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Run error = %v, want error %v", err, tt.wantErr)
+			}
+			if errors.Is(err, ErrNoStream) != tt.noStream {
+				t.Errorf("errors.Is(%v, ErrNoStream) = %v, want %v", err, !tt.noStream, tt.noStream)
+			}
+		})
+	}
+}
+
+func TestExecRunnerStdout(t *testing.T) {
+	var out strings.Builder
+	if err := (ExecRunner{}).Run(context.Background(), "sh", []string{"-c", "printf hello"}, &out); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if out.String() != "hello" {
+		t.Errorf("stdout = %q, want %q", out.String(), "hello")
+	}
+}
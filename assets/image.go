@@ -0,0 +1,294 @@
+package assets
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// imageInfoTimeout bounds a single exiftool run.
+const imageInfoTimeout = time.Minute
+
+// ImageInfo is the EXIF metadata of a photo. Missing values are zero or nil.
+type ImageInfo struct {
+	Make  string
+	Model string
+	Lens  string
+	// TakenAt is the wall-clock time the photo was taken, in the camera's
+	// time zone; TakenAtOffset is that zone's offset, e.g. "+02:00", when the
+	// camera recorded it.
+	TakenAt       *time.Time
+	TakenAtOffset string
+	Latitude      *float64
+	Longitude     *float64
+	// Width and Height are the dimensions of the upright image.
+	Width       int
+	Height      int
+	Orientation int // EXIF orientation, 1 (upright) to 8
+}
+
+// exifDateLayout is the layout of EXIF date/time values.
+const exifDateLayout = "2006:01:02 15:04:05"
+
+// ReadImageInfo reads the EXIF metadata of an image in a local file with
+// exiftool.
+func (g *Generator) ReadImageInfo(ctx context.Context, file string) (*ImageInfo, error) {
+	release, err := Acquire(ctx, WeightProbe)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	ctx, cancel := context.WithTimeout(ctx, imageInfoTimeout)
+	defer cancel()
+
+	// -n prints numbers instead of descriptions, so GPS positions come out
+	// as signed degrees and the orientation as its EXIF value.
+	var stdout bytes.Buffer
+	err = g.Runner.Run(ctx, "exiftool", []string{
+		"-json", "-n",
+		"-Make", "-Model", "-LensModel",
+		"-DateTimeOriginal", "-CreateDate", "-OffsetTimeOriginal",
+		"-GPSLatitude", "-GPSLongitude",
+		"-ImageWidth", "-ImageHeight", "-Orientation",
+		file,
+	}, &stdout)
+	if err != nil {
+		return nil, err
+	}
+
+	var tags []map[string]any
+	if err := json.Unmarshal(stdout.Bytes(), &tags); err != nil {
+		return nil, fmt.Errorf("failed to parse exiftool output: %w", err)
+	}
+	if len(tags) == 0 {
+		return nil, fmt.Errorf("exiftool printed no metadata")
+	}
+	t := tags[0]
+
+	info := &ImageInfo{
+		Make:          exifString(t["Make"]),
+		Model:         exifString(t["Model"]),
+		Lens:          exifString(t["LensModel"]),
+		TakenAtOffset: exifString(t["OffsetTimeOriginal"]),
+		Width:         int(exifNumber(t["ImageWidth"])),
+		Height:        int(exifNumber(t["ImageHeight"])),
+		Orientation:   int(exifNumber(t["Orientation"])),
+	}
+	for _, tag := range []string{"DateTimeOriginal", "CreateDate"} {
+		// Cameras without a clock write all zeros.
+		if taken, err := time.Parse(exifDateLayout, exifString(t[tag])); err == nil && taken.Year() > 1 {
+			info.TakenAt = &taken
+			break
+		}
+	}
+	if lat, ok := t["GPSLatitude"]; ok {
+		if lon, ok := t["GPSLongitude"]; ok {
+			la, lo := exifNumber(lat), exifNumber(lon)
+			if la >= -90 && la <= 90 && lo >= -180 && lo <= 180 && (la != 0 || lo != 0) {
+				info.Latitude, info.Longitude = &la, &lo
+			}
+		}
+	}
+	if info.Orientation < 1 || info.Orientation > 8 {
+		info.Orientation = 1
+	}
+	if info.Orientation >= 5 {
+		// Orientations 5-8 turn the image by a quarter.
+		info.Width, info.Height = info.Height, info.Width
+	}
+	return info, nil
+}
+
+// exifString returns a tag value as a string; exiftool prints some text tags
+// as numbers.
+func exifString(v any) string {
+	switch v := v.(type) {
+	case string:
+		return strings.TrimSpace(v)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	return ""
+}
+
+// exifNumber returns a numeric tag value, or 0.
+func exifNumber(v any) float64 {
+	switch v := v.(type) {
+	case float64:
+		return v
+	case string:
+		f, _ := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		return f
+	}
+	return 0
+}
+
+// orientationFilter returns the ffmpeg filters turning an image with the
+// given EXIF orientation upright, or "" for upright images.
+func orientationFilter(orientation int) string {
+	switch orientation {
+	case 2:
+		return "hflip"
+	case 3:
+		return "hflip,vflip"
+	case 4:
+		return "vflip"
+	case 5:
+		return "transpose=cclock_flip"
+	case 6:
+		return "transpose=clock"
+	case 7:
+		return "transpose=clock_flip"
+	case 8:
+		return "transpose=cclock"
+	}
+	return ""
+}
+
+// RenderImage renders every thumbnail variant of a still image in a local
+// file, turned upright according to its EXIF orientation.
+func (g *Generator) RenderImage(ctx context.Context, file string, orientation int) (map[ThumbnailVariant][]byte, error) {
+	return g.renderThumbnail(ctx, file, max(orientation, 1), func(context.Context) (time.Duration, bool) {
+		return 0, false
+	})
+}
+
+// IsHEIF reports whether an object is a HEIC/HEIF image, which browsers
+// can't display.
+func IsHEIF(objectKey string) bool {
+	ext := strings.ToLower(path.Ext(objectKey))
+	return ext == ".heic" || ext == ".heif"
+}
+
+// DisplayKey is the object key of the JPEG rendition of an image browsers
+// can't display: thumbnails/<image path without extension>@display.jpg
+func DisplayKey(objectKey string) string {
+	return "thumbnails/" + strings.TrimSuffix(objectKey, path.Ext(objectKey)) + "@display.jpg"
+}
+
+// convertHEIF converts a HEIC/HEIF image to an upright JPEG with
+// heif-convert, which applies the rotation and mirroring stored in the file.
+func (g *Generator) convertHEIF(ctx context.Context, input, output string) error {
+	release, err := Acquire(ctx, WeightThumbnail)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	if g.Thumbnails.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, g.Thumbnails.Timeout)
+		defer cancel()
+	}
+	if err := g.Runner.Run(ctx, "heif-convert", []string{"-q", "90", input, output}, nil); err != nil {
+		return err
+	}
+	if _, err := os.Stat(output); err == nil {
+		return nil
+	}
+	// Files with several top-level images are written as <name>-1.jpg, ...;
+	// the first is the primary image.
+	first := strings.TrimSuffix(output, ".jpg") + "-1.jpg"
+	if err := os.Rename(first, output); err != nil {
+		return fmt.Errorf("heif-convert wrote no image: %w", err)
+	}
+	return nil
+}
+
+// ImageAssets are the assets generated from a photo.
+type ImageAssets struct {
+	Info       ImageInfo
+	Thumbnails []Object // The default variant first
+	Display    *Object  // JPEG rendition of images browsers can't display
+}
+
+// Image reads the EXIF metadata of an image object, renders its thumbnail
+// variants upright and, for HEIC/HEIF images, a full-size JPEG, and stores
+// them.
+func (g *Generator) Image(ctx context.Context, objectKey string) (*ImageAssets, error) {
+	tmpDir, err := os.MkdirTemp("", "image-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	// exiftool and heif-convert only read local files.
+	source := filepath.Join(tmpDir, "source"+strings.ToLower(path.Ext(objectKey)))
+	if err := g.download(ctx, objectKey, source); err != nil {
+		return nil, err
+	}
+
+	info, err := g.ReadImageInfo(ctx, source)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read image metadata: %w", err)
+	}
+	result := &ImageAssets{Info: *info}
+
+	input, orientation := source, info.Orientation
+	if IsHEIF(objectKey) {
+		input = filepath.Join(tmpDir, "display.jpg")
+		if err := g.convertHEIF(ctx, source, input); err != nil {
+			return nil, fmt.Errorf("failed to convert image: %w", err)
+		}
+		// The conversion is already upright.
+		orientation = 1
+	}
+
+	images, err := g.RenderImage(ctx, input, orientation)
+	if err != nil {
+		return nil, err
+	}
+	if result.Thumbnails, err = g.PutThumbnail(ctx, objectKey, images); err != nil {
+		return nil, err
+	}
+
+	if IsHEIF(objectKey) {
+		data, err := os.ReadFile(input)
+		if err != nil {
+			return nil, err
+		}
+		display := Object{Key: DisplayKey(objectKey), ContentType: "image/jpeg", Data: data}
+		if err := g.Put(ctx, display); err != nil {
+			return nil, err
+		}
+		result.Display = &display
+	}
+	return result, nil
+}
+
+// download copies an object to a local file.
+func (g *Generator) download(ctx context.Context, key, file string) error {
+	out, err := g.Client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(g.Bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to download %s: %w", key, err)
+	}
+	defer out.Body.Close()
+
+	f, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, out.Body)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to download %s: %w", key, err)
+	}
+	return nil
+}
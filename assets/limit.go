@@ -0,0 +1,75 @@
+package assets
+
+import (
+	"context"
+	"media-server/config"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/sync/semaphore"
+	"golang.org/x/sync/singleflight"
+)
+
+// Weights of ffmpeg work against the shared budget. Subtitle extraction,
+// trickplay and waveforms read the whole file, a thumbnail or a probe only a
+// few seconds of it. Previews read little but encode video.
+const (
+	WeightProbe     = 1
+	WeightThumbnail = 1
+	WeightSubtitles = 2
+	WeightTrickplay = 2
+	WeightPreview   = 2
+	WeightWaveform  = 2
+)
+
+var (
+	budgetOnce sync.Once
+	budget     *semaphore.Weighted
+	capacity   int64
+	demand     atomic.Int64 // Weight held plus weight waited for
+)
+
+func initBudget() {
+	budgetOnce.Do(func() {
+		capacity = int64(max(config.FFmpegConcurrency, 1))
+		budget = semaphore.NewWeighted(capacity)
+	})
+}
+
+// Acquire reserves weight of the ffmpeg budget shared by every process this
+// server starts, waiting until it is free or ctx is done. release must be
+// called once the process has exited.
+func Acquire(ctx context.Context, weight int64) (release func(), err error) {
+	initBudget()
+	weight = min(weight, capacity)
+	demand.Add(weight)
+	if err := budget.Acquire(ctx, weight); err != nil {
+		demand.Add(-weight)
+		return nil, err
+	}
+	return func() {
+		budget.Release(weight)
+		demand.Add(-weight)
+	}, nil
+}
+
+// Saturated reports whether new ffmpeg work would have to wait for a slot.
+func Saturated() bool {
+	initBudget()
+	return demand.Load() >= capacity
+}
+
+var flights singleflight.Group
+
+// Start runs fn in the background unless a run for key is already in flight,
+// and returns a channel receiving the outcome. fn gets a context detached
+// from the caller, so an abandoned request doesn't cancel work others are
+// waiting for; it is cancelled after timeout instead.
+func Start(key string, timeout time.Duration, fn func(ctx context.Context) (any, error)) <-chan singleflight.Result {
+	return flights.DoChan(key, func() (any, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		return fn(ctx)
+	})
+}
@@ -0,0 +1,134 @@
+package assets
+
+import (
+	"context"
+	"fmt"
+	"media-server/config"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// PreviewProfile controls the silent preview loops shown when hovering a
+// video in the grid.
+type PreviewProfile struct {
+	Clips      int           // Clips sampled across the video; 0 disables previews
+	ClipLength time.Duration // Length of each clip
+	Width      int           // Output width in pixels
+	FPS        int           // Output frame rate
+	Timeout    time.Duration // Upper bound for one ffmpeg run
+}
+
+// DefaultPreviewProfile returns the profile configured through the
+// PREVIEW_* environment variables, as wide as the default thumbnail.
+func DefaultPreviewProfile() PreviewProfile {
+	width := 320
+	if len(config.ThumbnailSizes) > 0 {
+		width = config.ThumbnailSizes[0].Width
+	}
+	return PreviewProfile{
+		Clips:      config.PreviewClips,
+		ClipLength: config.PreviewClipLength,
+		Width:      width,
+		FPS:        15,
+		Timeout:    config.PreviewTimeout,
+	}
+}
+
+// PreviewKey is the object key of the preview loop of a video, next to its
+// thumbnail: thumbnails/<video path without extension>@preview.mp4
+func PreviewKey(objectKey string) string {
+	return "thumbnails/" + strings.TrimSuffix(objectKey, path.Ext(objectKey)) + "@preview.mp4"
+}
+
+// clipStarts spreads the clips evenly across the video, away from its very
+// start and end. Videos too short for that get a single clip from the start.
+func (p PreviewProfile) clipStarts(duration time.Duration) []time.Duration {
+	total := time.Duration(p.Clips) * p.ClipLength
+	if duration < 2*total {
+		return []time.Duration{0}
+	}
+	starts := make([]time.Duration, p.Clips)
+	for i := range starts {
+		starts[i] = duration * time.Duration(i+1) / time.Duration(p.Clips+1)
+	}
+	return starts
+}
+
+// RenderPreview renders the preview loop of a video read from input, a URL
+// or local path, as a small H.264 MP4 without audio. duration is the probed
+// duration, or 0 if unknown.
+func (g *Generator) RenderPreview(ctx context.Context, input string, duration time.Duration) ([]byte, error) {
+	p := g.Preview
+	release, err := Acquire(ctx, WeightPreview)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	if p.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.Timeout)
+		defer cancel()
+	}
+
+	tmpDir, err := os.MkdirTemp("", "preview-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmpDir)
+	output := filepath.Join(tmpDir, "preview.mp4")
+
+	starts := p.clipStarts(duration)
+	clipLength := p.ClipLength
+	if len(starts) == 1 {
+		clipLength = time.Duration(p.Clips) * p.ClipLength
+	}
+
+	// Each clip is its own input so ffmpeg seeks to it with range requests
+	// instead of decoding the video in between.
+	args := []string{"-v", "error", "-y"}
+	var graph, inputs strings.Builder
+	for i, start := range starts {
+		args = append(args, "-ss", seconds(start), "-t", seconds(clipLength), "-i", input)
+		fmt.Fprintf(&graph, "[%d:v]scale=%d:-2,setsar=1,fps=%d,setpts=PTS-STARTPTS[c%d];", i, p.Width, p.FPS, i)
+		fmt.Fprintf(&inputs, "[c%d]", i)
+	}
+	fmt.Fprintf(&graph, "%sconcat=n=%d:v=1:a=0[out]", inputs.String(), len(starts))
+	args = append(args,
+		"-filter_complex", graph.String(),
+		"-map", "[out]", "-an",
+		"-c:v", "libx264", "-preset", "veryfast", "-crf", "30", "-pix_fmt", "yuv420p",
+		"-movflags", "+faststart",
+		"-f", "mp4", output,
+	)
+	if err := g.Runner.Run(ctx, "ffmpeg", args, nil); err != nil {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(output)
+	if err != nil || len(data) == 0 {
+		return nil, fmt.Errorf("%w: no video frames for a preview", ErrNoStream)
+	}
+	return data, nil
+}
+
+// PreviewLoop renders the preview loop of a video object and stores it at
+// PreviewKey.
+func (g *Generator) PreviewLoop(ctx context.Context, objectKey string, duration time.Duration) (Object, error) {
+	if g.Preview.Clips <= 0 {
+		return Object{}, fmt.Errorf("previews are disabled")
+	}
+	url, err := g.SourceURL(ctx, objectKey)
+	if err != nil {
+		return Object{}, err
+	}
+	data, err := g.RenderPreview(ctx, url, duration)
+	if err != nil {
+		return Object{}, err
+	}
+	obj := Object{Key: PreviewKey(objectKey), ContentType: "video/mp4", Data: data}
+	return obj, g.Put(ctx, obj)
+}
@@ -0,0 +1,90 @@
+package assets
+
+import (
+	"context"
+	"fmt"
+	"media-server/config"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// SubtitleProfile controls which subtitle streams are extracted.
+type SubtitleProfile struct {
+	Codecs  map[string]bool // Codecs converted to WebVTT
+	Timeout time.Duration   // Upper bound for one ffmpeg run
+}
+
+// DefaultSubtitleProfile extracts every text codec ffmpeg can convert to
+// WebVTT. Bitmap formats (PGS, VobSub, DVB) would need OCR and are skipped.
+func DefaultSubtitleProfile() SubtitleProfile {
+	return SubtitleProfile{
+		Codecs: map[string]bool{
+			"subrip":   true,
+			"srt":      true,
+			"ass":      true,
+			"ssa":      true,
+			"webvtt":   true,
+			"mov_text": true,
+			"text":     true,
+		},
+		Timeout: config.SubtitleTimeout,
+	}
+}
+
+// SubtitleTrackKey is the object key of an embedded track:
+// subtitles/<video path without extension>.<stream index>.vtt
+//
+// The key depends on nothing but the stream, so that it stays the same when
+// a re-probe reports different tags.
+func SubtitleTrackKey(objectKey string, streamIndex int) string {
+	base := strings.TrimSuffix(objectKey, filepath.Ext(objectKey))
+	return fmt.Sprintf("subtitles/%s.%d.vtt", base, streamIndex)
+}
+
+// RenderSubtitles converts the given subtitle streams of input to WebVTT in
+// a single ffmpeg run, so the video is only read once. Streams that produced
+// no output are missing from the result.
+func (g *Generator) RenderSubtitles(ctx context.Context, input string, streams []int) (map[int][]byte, error) {
+	if len(streams) == 0 {
+		return nil, fmt.Errorf("%w: no text subtitle streams", ErrNoStream)
+	}
+	release, err := Acquire(ctx, WeightSubtitles)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	if g.Subtitles.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, g.Subtitles.Timeout)
+		defer cancel()
+	}
+
+	tmpDir, err := os.MkdirTemp("", "subtitles-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	output := func(index int) string {
+		return filepath.Join(tmpDir, fmt.Sprintf("%d.vtt", index))
+	}
+	args := []string{"-v", "error", "-y", "-i", input}
+	for _, index := range streams {
+		args = append(args, "-map", fmt.Sprintf("0:%d", index), "-c:s", "webvtt", "-f", "webvtt", output(index))
+	}
+	if err := g.Runner.Run(ctx, "ffmpeg", args, nil); err != nil {
+		return nil, err
+	}
+
+	tracks := make(map[int][]byte, len(streams))
+	for _, index := range streams {
+		data, err := os.ReadFile(output(index))
+		if err == nil && len(data) > 0 {
+			tracks[index] = data
+		}
+	}
+	return tracks, nil
+}
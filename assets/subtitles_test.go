@@ -0,0 +1,86 @@
+package assets
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestRenderSubtitles(t *testing.T) {
+	tests := []struct {
+		name      string
+		streams   []int
+		step      func([]string) error
+		wantCalls int
+		want      []int
+		wantErr   error
+	}{
+		{
+			name:      "every stream in one run",
+			streams:   []int{2, 5},
+			step:      writeOutputs("WEBVTT\n", ".vtt"),
+			wantCalls: 1,
+			want:      []int{2, 5},
+		},
+		{
+			name:      "empty outputs are skipped",
+			streams:   []int{3},
+			step:      writeOutputs(""),
+			wantCalls: 1,
+		},
+		{
+			name:      "no text streams",
+			wantCalls: 0,
+			wantErr:   ErrNoStream,
+		},
+		{
+			name:      "ffmpeg error",
+			streams:   []int{2},
+			step:      fail(ErrNoStream),
+			wantCalls: 1,
+			wantErr:   ErrNoStream,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			runner := &fakeRunner{}
+			if tt.step != nil {
+				runner.steps = append(runner.steps, tt.step)
+			}
+			g := &Generator{Runner: runner, Subtitles: DefaultSubtitleProfile()}
+			tracks, err := g.RenderSubtitles(context.Background(), "in.mkv", tt.streams)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("RenderSubtitles error = %v, want %v", err, tt.wantErr)
+			}
+			if len(runner.calls) != tt.wantCalls {
+				t.Fatalf("ran ffmpeg %d times, want %d", len(runner.calls), tt.wantCalls)
+			}
+			if tt.wantCalls > 0 {
+				args := runner.calls[0]
+				if !hasArgs(args, "ffmpeg", "-v", "error", "-y", "-i", "in.mkv") {
+					t.Errorf("args %q don't read in.mkv", args)
+				}
+				for _, index := range tt.streams {
+					if !hasArgs(args, "-map", fmt.Sprintf("0:%d", index), "-c:s", "webvtt", "-f", "webvtt") {
+						t.Errorf("args %q don't map stream %d", args, index)
+					}
+				}
+			}
+			if len(tracks) != len(tt.want) {
+				t.Errorf("got %d tracks, want %d", len(tracks), len(tt.want))
+			}
+			for _, index := range tt.want {
+				if string(tracks[index]) != "WEBVTT\n" {
+					t.Errorf("track %d = %q", index, tracks[index])
+				}
+			}
+		})
+	}
+}
+
+func TestSubtitleTrackKey(t *testing.T) {
+	if got, want := SubtitleTrackKey("Shows/a.mkv", 3), "subtitles/Shows/a.3.vtt"; got != want {
+		t.Errorf("SubtitleTrackKey = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,413 @@
+package assets
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"media-server/config"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ThumbnailSize is a named thumbnail width.
+type ThumbnailSize = config.ThumbnailSize
+
+// ThumbnailProfile controls how thumbnails are rendered.
+type ThumbnailProfile struct {
+	Position   float64         // Position of the frame as a fraction of the duration
+	Seek       time.Duration   // Position used when the duration is unknown
+	Candidates int             // Frames scored to pick the thumbnail; 1 takes Position as is
+	Sizes      []ThumbnailSize // Widths rendered; the first is the default
+	Formats    []string        // Image formats rendered; the first is the default
+	Quality    int             // JPEG quality scale, from 2 (best) to 31
+	Timeout    time.Duration   // Upper bound for one ffmpeg run
+}
+
+// DefaultThumbnailProfile returns the profile configured through the
+// THUMBNAIL_* environment variables.
+func DefaultThumbnailProfile() ThumbnailProfile {
+	return ThumbnailProfile{
+		Position:   config.ThumbnailPosition,
+		Seek:       config.ThumbnailSeek,
+		Candidates: config.ThumbnailCandidates,
+		Sizes:      config.ThumbnailSizes,
+		Formats:    config.ThumbnailFormats,
+		Quality:    2,
+		Timeout:    config.ThumbnailTimeout,
+	}
+}
+
+// thumbnailFormats maps formats to their extension, content type and the
+// ffmpeg arguments encoding a single image.
+var thumbnailFormats = map[string]struct {
+	ext         string
+	contentType string
+	args        func(quality int) []string
+}{
+	"jpeg": {".jpg", "image/jpeg", func(quality int) []string {
+		return []string{"-c:v", "mjpeg", "-q:v", strconv.Itoa(quality), "-f", "image2"}
+	}},
+	"webp": {".webp", "image/webp", func(int) []string {
+		return []string{"-c:v", "libwebp", "-quality", "80", "-f", "webp"}
+	}},
+	"avif": {".avif", "image/avif", func(int) []string {
+		return []string{"-c:v", "libaom-av1", "-still-picture", "1", "-crf", "32", "-f", "avif"}
+	}},
+}
+
+// ThumbnailContentType returns the content type of a thumbnail object from
+// its extension.
+func ThumbnailContentType(ext string) string {
+	for _, f := range thumbnailFormats {
+		if f.ext == ext {
+			return f.contentType
+		}
+	}
+	return "application/octet-stream"
+}
+
+// ThumbnailVariant is one rendered size and format of a thumbnail.
+type ThumbnailVariant struct {
+	Size   string
+	Width  int
+	Format string
+}
+
+// ContentType is the MIME type of the variant.
+func (v ThumbnailVariant) ContentType() string {
+	return thumbnailFormats[v.Format].contentType
+}
+
+// Variants lists every size and format rendered, the default first.
+func (p ThumbnailProfile) Variants() []ThumbnailVariant {
+	var variants []ThumbnailVariant
+	for _, size := range p.Sizes {
+		for _, format := range p.Formats {
+			variants = append(variants, ThumbnailVariant{Size: size.Name, Width: size.Width, Format: format})
+		}
+	}
+	return variants
+}
+
+// Variant looks up a variant by size and format; empty values select the
+// defaults.
+func (p ThumbnailProfile) Variant(size, format string) (ThumbnailVariant, bool) {
+	for _, v := range p.Variants() {
+		if (size == "" || v.Size == size) && (format == "" || v.Format == format) {
+			return v, true
+		}
+	}
+	return ThumbnailVariant{}, false
+}
+
+// Key is the object key of a variant of the thumbnail of a video. The
+// default variant lives at ThumbnailKey; the others at
+// thumbnails/<video path without extension>@<size>.<ext>
+func (p ThumbnailProfile) Key(objectKey string, v ThumbnailVariant) string {
+	if len(p.Sizes) > 0 && len(p.Formats) > 0 && v.Size == p.Sizes[0].Name && v.Format == p.Formats[0] {
+		return ThumbnailKey(objectKey)
+	}
+	base := strings.TrimSuffix(objectKey, path.Ext(objectKey))
+	return "thumbnails/" + base + "@" + v.Size + thumbnailFormats[v.Format].ext
+}
+
+// ThumbnailKey is the object key of the default thumbnail of a video:
+// thumbnails/<video path without extension>.jpg
+func ThumbnailKey(objectKey string) string {
+	return "thumbnails/" + strings.TrimSuffix(objectKey, path.Ext(objectKey)) + ".jpg"
+}
+
+// maxCandidatePosition keeps candidates clear of end credits.
+const maxCandidatePosition = 0.9
+
+// candidates returns the positions considered for the thumbnail of a video:
+// Position, 2*Position, ... up to Candidates of them. Without a duration only
+// Seek is considered.
+func (p ThumbnailProfile) candidates(duration time.Duration) []time.Duration {
+	if duration <= 0 {
+		return []time.Duration{p.Seek}
+	}
+	var positions []time.Duration
+	for i := 1; i <= max(p.Candidates, 1); i++ {
+		f := p.Position * float64(i)
+		if i > 1 && f > maxCandidatePosition {
+			break
+		}
+		positions = append(positions, time.Duration(float64(duration)*min(f, maxCandidatePosition)))
+	}
+	return positions
+}
+
+func seconds(d time.Duration) string {
+	return strconv.FormatFloat(d.Seconds(), 'f', 3, 64)
+}
+
+// args builds the ffmpeg command line writing every variant into dir.
+// Seeking before -i lets ffmpeg jump to the nearest keyframe with range
+// requests instead of decoding from the start, and is frame accurate. The
+// frame is decoded once and scaled per variant, never above the source width.
+// A non-zero orientation is the EXIF orientation of a still image, applied
+// instead of ffmpeg's own rotation.
+func (p ThumbnailProfile) args(input string, at time.Duration, orientation int, variants []ThumbnailVariant, dir string) []string {
+	var graph strings.Builder
+	graph.WriteString("[0:v]")
+	if filter := orientationFilter(orientation); filter != "" {
+		graph.WriteString(filter + ",")
+	}
+	fmt.Fprintf(&graph, "split=%d", len(variants))
+	for i := range variants {
+		fmt.Fprintf(&graph, "[v%d]", i)
+	}
+	for i, v := range variants {
+		fmt.Fprintf(&graph, ";[v%d]scale='min(%d,iw)':-2[o%d]", i, v.Width, i)
+	}
+
+	args := []string{"-v", "error", "-y", "-ss", seconds(at)}
+	if orientation > 0 {
+		args = append(args, "-noautorotate")
+	}
+	args = append(args, "-i", input, "-filter_complex", graph.String())
+	for i, v := range variants {
+		args = append(args, "-map", fmt.Sprintf("[o%d]", i), "-frames:v", "1")
+		args = append(args, thumbnailFormats[v.Format].args(p.Quality)...)
+		args = append(args, variantFile(dir, v))
+	}
+	return args
+}
+
+func variantFile(dir string, v ThumbnailVariant) string {
+	return filepath.Join(dir, v.Size+thumbnailFormats[v.Format].ext)
+}
+
+// RenderThumbnail renders every variant of the thumbnail of a video read
+// from input, a URL or local path. duration is the probed duration, or 0 if
+// unknown; with it the frame is picked among several candidates so logos and
+// fades to black are skipped, and clips shorter than Seek still get a
+// thumbnail. Variants that failed to encode are missing from the result, but
+// the default one is always there.
+func (g *Generator) RenderThumbnail(ctx context.Context, input string, duration time.Duration) (map[ThumbnailVariant][]byte, error) {
+	return g.renderThumbnail(ctx, input, 0, func(ctx context.Context) (time.Duration, bool) {
+		positions := g.Thumbnails.candidates(duration)
+		if len(positions) == 1 {
+			return positions[0], true
+		}
+		best, err := g.bestFrame(ctx, input, positions)
+		if err != nil {
+			// Scoring is an improvement, not a requirement.
+			best = 0
+		}
+		return positions[best], true
+	})
+}
+
+// RenderFrame renders every variant of a thumbnail showing the frame of
+// input at exactly at. Still images are better rendered with RenderImage.
+func (g *Generator) RenderFrame(ctx context.Context, input string, at time.Duration) (map[ThumbnailVariant][]byte, error) {
+	return g.renderThumbnail(ctx, input, 0, func(context.Context) (time.Duration, bool) {
+		return at, false
+	})
+}
+
+// renderThumbnail renders the variants at the position chosen by pick, see
+// args for orientation. When pick allows it and that position has no frame,
+// the first frame is used.
+func (g *Generator) renderThumbnail(ctx context.Context, input string, orientation int, pick func(ctx context.Context) (at time.Duration, fallback bool)) (map[ThumbnailVariant][]byte, error) {
+	variants := g.Thumbnails.Variants()
+	if len(variants) == 0 {
+		return nil, fmt.Errorf("thumbnail profile has no sizes or formats")
+	}
+	release, err := Acquire(ctx, WeightThumbnail)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	if g.Thumbnails.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, g.Thumbnails.Timeout)
+		defer cancel()
+	}
+
+	at, fallback := pick(ctx)
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	tmpDir, err := os.MkdirTemp("", "thumbnails-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	removeOutputs := func() {
+		for _, v := range variants {
+			os.Remove(variantFile(tmpDir, v))
+		}
+	}
+	render := func(at time.Duration) (map[ThumbnailVariant][]byte, error) {
+		removeOutputs()
+		err := g.Runner.Run(ctx, "ffmpeg", g.Thumbnails.args(input, at, orientation, variants, tmpDir), nil)
+		if err != nil && ctx.Err() == nil && !errors.Is(err, ErrNoStream) {
+			// An encoder missing from this ffmpeg build fails the whole
+			// run; fall back to the default format alone.
+			log.Printf("Thumbnail variants failed, retrying with %s only: %v", variants[0].Format, err)
+			var fallback []ThumbnailVariant
+			for _, v := range variants {
+				if v.Format == variants[0].Format {
+					fallback = append(fallback, v)
+				}
+			}
+			removeOutputs()
+			err = g.Runner.Run(ctx, "ffmpeg", g.Thumbnails.args(input, at, orientation, fallback, tmpDir), nil)
+		}
+		if err != nil {
+			return nil, err
+		}
+		images := make(map[ThumbnailVariant][]byte, len(variants))
+		for _, v := range variants {
+			if data, err := os.ReadFile(variantFile(tmpDir, v)); err == nil && len(data) > 0 {
+				images[v] = data
+			}
+		}
+		return images, nil
+	}
+	images, err := render(at)
+	if err != nil {
+		return nil, err
+	}
+	if images[variants[0]] == nil && at > 0 && fallback {
+		// The clip may be shorter than Seek, or its duration wrong.
+		at = 0
+		if images, err = render(at); err != nil {
+			return nil, err
+		}
+	}
+	if images[variants[0]] == nil {
+		return nil, fmt.Errorf("%w: no video frame at %s", ErrNoStream, at)
+	}
+	return images, nil
+}
+
+// Size of the grayscale frames candidates are scored on.
+const (
+	scoreWidth  = 64
+	scoreHeight = 36
+)
+
+// bestFrame decodes one small grayscale frame at each position in a single
+// ffmpeg run, stacked side by side, and returns the index of the position
+// with the highest frameScore.
+func (g *Generator) bestFrame(ctx context.Context, input string, positions []time.Duration) (int, error) {
+	args := []string{"-v", "error"}
+	var filters, stack strings.Builder
+	for i, at := range positions {
+		args = append(args, "-ss", seconds(at), "-i", input)
+		fmt.Fprintf(&filters, "[%d:v]trim=end_frame=1,scale=%d:%d,setsar=1,format=gray[c%d];", i, scoreWidth, scoreHeight, i)
+		fmt.Fprintf(&stack, "[c%d]", i)
+	}
+	filters.WriteString(stack.String())
+	fmt.Fprintf(&filters, "hstack=inputs=%d", len(positions))
+	args = append(args, "-filter_complex", filters.String(), "-frames:v", "1", "-f", "rawvideo", "pipe:1")
+
+	var buf bytes.Buffer
+	if err := g.Runner.Run(ctx, "ffmpeg", args, &buf); err != nil {
+		return 0, err
+	}
+	stride := scoreWidth * len(positions)
+	if buf.Len() != stride*scoreHeight {
+		return 0, fmt.Errorf("unexpected candidate frame size %d", buf.Len())
+	}
+
+	pix := buf.Bytes()
+	best, bestScore := 0, -1.0
+	frame := make([]byte, 0, scoreWidth*scoreHeight)
+	for i := range positions {
+		frame = frame[:0]
+		for y := 0; y < scoreHeight; y++ {
+			row := y*stride + i*scoreWidth
+			frame = append(frame, pix[row:row+scoreWidth]...)
+		}
+		// Earlier candidates win ties, staying close to Position.
+		if score := frameScore(frame); score > bestScore {
+			best, bestScore = i, score
+		}
+	}
+	return best, nil
+}
+
+// frameScore rates a grayscale frame by its luminance standard deviation, so
+// detailed frames beat flat ones. Nearly black, white or uniform frames score
+// 0.
+func frameScore(pix []byte) float64 {
+	if len(pix) == 0 {
+		return 0
+	}
+	var sum, sumSq float64
+	for _, p := range pix {
+		v := float64(p)
+		sum += v
+		sumSq += v * v
+	}
+	n := float64(len(pix))
+	mean := sum / n
+	stddev := math.Sqrt(max(sumSq/n-mean*mean, 0))
+	if mean < 24 || mean > 232 || stddev < 10 {
+		return 0
+	}
+	return stddev
+}
+
+// Thumbnail renders every variant of the thumbnail of a video object and
+// stores them. duration is the probed duration, or 0 if unknown. The default
+// variant comes first.
+func (g *Generator) Thumbnail(ctx context.Context, objectKey string, duration time.Duration) ([]Object, error) {
+	url, err := g.SourceURL(ctx, objectKey)
+	if err != nil {
+		return nil, err
+	}
+	images, err := g.RenderThumbnail(ctx, url, duration)
+	if err != nil {
+		return nil, err
+	}
+	return g.PutThumbnail(ctx, objectKey, images)
+}
+
+// CoverArt renders the picture embedded in an audio object into every
+// thumbnail variant and stores them. ffmpeg sees the picture as a one-frame
+// video stream; without one it fails with ErrNoStream.
+func (g *Generator) CoverArt(ctx context.Context, objectKey string) ([]Object, error) {
+	url, err := g.SourceURL(ctx, objectKey)
+	if err != nil {
+		return nil, err
+	}
+	images, err := g.RenderFrame(ctx, url, 0)
+	if err != nil {
+		return nil, err
+	}
+	return g.PutThumbnail(ctx, objectKey, images)
+}
+
+// PutThumbnail stores rendered variants as the thumbnail of a video object,
+// replacing the previous ones. The default variant comes first.
+func (g *Generator) PutThumbnail(ctx context.Context, objectKey string, images map[ThumbnailVariant][]byte) ([]Object, error) {
+	var objects []Object
+	for _, v := range g.Thumbnails.Variants() {
+		data, ok := images[v]
+		if !ok {
+			continue
+		}
+		obj := Object{Key: g.Thumbnails.Key(objectKey, v), ContentType: v.ContentType(), Data: data}
+		if err := g.Put(ctx, obj); err != nil {
+			return nil, err
+		}
+		objects = append(objects, obj)
+	}
+	return objects, nil
+}
@@ -0,0 +1,205 @@
+package assets
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+)
+
+func testThumbnailProfile() ThumbnailProfile {
+	return ThumbnailProfile{
+		Position:   0.1,
+		Seek:       5 * time.Second,
+		Candidates: 1,
+		Sizes:      []ThumbnailSize{{Name: "small", Width: 320}, {Name: "large", Width: 1280}},
+		Formats:    []string{"jpeg", "webp"},
+		Quality:    2,
+	}
+}
+
+func TestThumbnailArgs(t *testing.T) {
+	p := testThumbnailProfile()
+	variants := p.Variants()
+	tests := []struct {
+		name        string
+		orientation int
+		want        [][]string
+		graph       string
+	}{
+		{
+			name: "video",
+			want: [][]string{
+				{"-ss", "12.500", "-i", "in.mp4"},
+				{"-map", "[o0]", "-frames:v", "1", "-c:v", "mjpeg", "-q:v", "2", "-f", "image2", "/tmp/x/small.jpg"},
+				{"-map", "[o1]", "-frames:v", "1", "-c:v", "libwebp", "-quality", "80", "-f", "webp", "/tmp/x/small.webp"},
+				{"-map", "[o3]", "-frames:v", "1", "-c:v", "libwebp", "-quality", "80", "-f", "webp", "/tmp/x/large.webp"},
+			},
+			graph: "[0:v]split=4[v0][v1][v2][v3];[v0]scale='min(320,iw)':-2[o0];[v1]scale='min(320,iw)':-2[o1];" +
+				"[v2]scale='min(1280,iw)':-2[o2];[v3]scale='min(1280,iw)':-2[o3]",
+		},
+		{
+			name:        "rotated photo",
+			orientation: 6,
+			want:        [][]string{{"-ss", "12.500", "-noautorotate", "-i", "in.mp4"}},
+			graph: "[0:v]transpose=clock,split=4[v0][v1][v2][v3];[v0]scale='min(320,iw)':-2[o0];[v1]scale='min(320,iw)':-2[o1];" +
+				"[v2]scale='min(1280,iw)':-2[o2];[v3]scale='min(1280,iw)':-2[o3]",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := p.args("in.mp4", 12500*time.Millisecond, tt.orientation, variants, "/tmp/x")
+			for _, want := range tt.want {
+				if !hasArgs(args, want...) {
+					t.Errorf("args %q lack %q", args, want)
+				}
+			}
+			if !hasArgs(args, "-filter_complex", tt.graph) {
+				t.Errorf("args %q lack filter graph %q", args, tt.graph)
+			}
+		})
+	}
+}
+
+func TestThumbnailCandidates(t *testing.T) {
+	tests := []struct {
+		name       string
+		position   float64
+		candidates int
+		duration   time.Duration
+		want       []time.Duration
+	}{
+		{"unknown duration", 0.1, 3, 0, []time.Duration{5 * time.Second}},
+		{"single", 0.1, 1, 100 * time.Second, []time.Duration{10 * time.Second}},
+		{"several", 0.1, 3, 100 * time.Second, []time.Duration{10 * time.Second, 20 * time.Second, 30 * time.Second}},
+		{"stops before credits", 0.4, 5, 100 * time.Second, []time.Duration{40 * time.Second, 80 * time.Second}},
+		{"clamped", 0.95, 1, 100 * time.Second, []time.Duration{90 * time.Second}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := testThumbnailProfile()
+			p.Position, p.Candidates = tt.position, tt.candidates
+			if got := p.candidates(tt.duration); !slices.Equal(got, tt.want) {
+				t.Errorf("candidates = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRenderThumbnail(t *testing.T) {
+	encoderMissing := errors.New("ffmpeg failed: exit status 1: Unknown encoder 'libwebp'")
+	tests := []struct {
+		name      string
+		steps     []func([]string) error
+		wantCalls int
+		wantSeeks []string
+		wantCount int
+		wantErr   error
+		noWebP    bool // The last run encodes the default format only
+	}{
+		{
+			name:      "all variants",
+			steps:     []func([]string) error{writeOutputs("img", ".jpg", ".webp")},
+			wantCalls: 1,
+			wantSeeks: []string{"10.000"},
+			wantCount: 4,
+		},
+		{
+			name:      "missing encoder falls back to the default format",
+			steps:     []func([]string) error{fail(encoderMissing), writeOutputs("img", ".jpg", ".webp")},
+			wantCalls: 2,
+			wantSeeks: []string{"10.000", "10.000"},
+			wantCount: 2,
+			noWebP:    true,
+		},
+		{
+			name:      "short clip falls back to the first frame",
+			steps:     []func([]string) error{writeOutputs(""), writeOutputs("img", ".jpg")},
+			wantCalls: 2,
+			wantSeeks: []string{"10.000", "0.000"},
+			wantCount: 2,
+		},
+		{
+			name:      "no video stream",
+			steps:     []func([]string) error{fail(fmt.Errorf("%w: matches no streams", ErrNoStream))},
+			wantCalls: 1,
+			wantSeeks: []string{"10.000"},
+			wantErr:   ErrNoStream,
+		},
+		{
+			name:      "no frame at all",
+			steps:     []func([]string) error{writeOutputs(""), writeOutputs("")},
+			wantCalls: 2,
+			wantSeeks: []string{"10.000", "0.000"},
+			wantErr:   ErrNoStream,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			runner := &fakeRunner{steps: tt.steps}
+			g := &Generator{Runner: runner, Thumbnails: testThumbnailProfile()}
+			images, err := g.RenderThumbnail(context.Background(), "in.mp4", 100*time.Second)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("RenderThumbnail error = %v, want %v", err, tt.wantErr)
+				}
+			} else if err != nil {
+				t.Fatalf("RenderThumbnail: %v", err)
+			}
+			if len(images) != tt.wantCount {
+				t.Errorf("rendered %d variants, want %d", len(images), tt.wantCount)
+			}
+			if len(runner.calls) != tt.wantCalls {
+				t.Fatalf("ran ffmpeg %d times, want %d: %q", len(runner.calls), tt.wantCalls, runner.calls)
+			}
+			for i, seek := range tt.wantSeeks {
+				if !hasArgs(runner.calls[i], "-ss", seek) {
+					t.Errorf("call %d %q doesn't seek to %s", i, runner.calls[i], seek)
+				}
+			}
+			if last := runner.calls[len(runner.calls)-1]; tt.noWebP && hasArgs(last, "-c:v", "libwebp") {
+				t.Errorf("fallback call %q still encodes webp", last)
+			}
+		})
+	}
+}
+
+func TestThumbnailKey(t *testing.T) {
+	p := testThumbnailProfile()
+	tests := []struct {
+		variant ThumbnailVariant
+		want    string
+	}{
+		{ThumbnailVariant{Size: "small", Width: 320, Format: "jpeg"}, "thumbnails/Movies/a.b.jpg"},
+		{ThumbnailVariant{Size: "small", Width: 320, Format: "webp"}, "thumbnails/Movies/a.b@small.webp"},
+		{ThumbnailVariant{Size: "large", Width: 1280, Format: "jpeg"}, "thumbnails/Movies/a.b@large.jpg"},
+	}
+	for _, tt := range tests {
+		if got := p.Key("Movies/a.b.mkv", tt.variant); got != tt.want {
+			t.Errorf("Key(%+v) = %q, want %q", tt.variant, got, tt.want)
+		}
+	}
+}
+
+func TestFrameScore(t *testing.T) {
+	flat := func(v byte) []byte { return []byte{v, v, v, v} }
+	tests := []struct {
+		name string
+		pix  []byte
+		want float64
+	}{
+		{"empty", nil, 0},
+		{"black", flat(0), 0},
+		{"white", flat(255), 0},
+		{"flat grey", flat(128), 0},
+		{"detailed", []byte{78, 178, 78, 178}, 50},
+		{"detailed but dark", []byte{0, 40, 0, 40}, 0},
+	}
+	for _, tt := range tests {
+		if got := frameScore(tt.pix); got != tt.want {
+			t.Errorf("%s: frameScore = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,183 @@
+package assets
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"media-server/config"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TrickplayPrefix holds seek-preview sprite sheets and their WebVTT index.
+// Like thumbnails/ and subtitles/ it is never synced as media.
+const TrickplayPrefix = "trickplay/"
+
+// TrickplayProfile controls how seek-preview sprite sheets are rendered.
+type TrickplayProfile struct {
+	Interval  time.Duration // Time between preview frames; 0 disables trickplay
+	TileWidth int           // Width of one preview frame in pixels
+	Columns   int           // Frames per sheet row
+	Rows      int           // Frame rows per sheet
+	Quality   int           // JPEG quality scale, from 2 (best) to 31
+	Timeout   time.Duration // Upper bound for one ffmpeg run
+}
+
+// DefaultTrickplayProfile returns the profile configured through the
+// TRICKPLAY_* environment variables.
+func DefaultTrickplayProfile() TrickplayProfile {
+	return TrickplayProfile{
+		Interval:  config.TrickplayInterval,
+		TileWidth: 160,
+		Columns:   10,
+		Rows:      10,
+		Quality:   5,
+		Timeout:   config.TrickplayTimeout,
+	}
+}
+
+// TrickplayIndexKey is the object key of the WebVTT index of a video's
+// sprite sheets: trickplay/<video path without extension>/index.vtt
+func TrickplayIndexKey(objectKey string) string {
+	return trickplayDir(objectKey) + "index.vtt"
+}
+
+func trickplayDir(objectKey string) string {
+	return TrickplayPrefix + strings.TrimSuffix(objectKey, path.Ext(objectKey)) + "/"
+}
+
+// tileHeight keeps the aspect ratio of the video, assuming 16:9 when its
+// dimensions are unknown. Frames are letterboxed into the tile so every
+// tile has the same size.
+func (p TrickplayProfile) tileHeight(width, height int) int {
+	if width <= 0 || height <= 0 {
+		width, height = 16, 9
+	}
+	return max(int(float64(p.TileWidth)*float64(height)/float64(width)/2+0.5)*2, 2)
+}
+
+// RenderTrickplay renders the sprite sheets of a video read from input. Only
+// keyframes are decoded, so each preview shows the keyframe nearest to its
+// time, which keeps rendering fast enough for long videos.
+func (g *Generator) RenderTrickplay(ctx context.Context, input string, tileHeight int) ([][]byte, error) {
+	p := g.Trickplay
+	release, err := Acquire(ctx, WeightTrickplay)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	if p.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.Timeout)
+		defer cancel()
+	}
+
+	tmpDir, err := os.MkdirTemp("", "trickplay-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	filter := fmt.Sprintf(
+		"fps=1/%s,scale=%d:%d:force_original_aspect_ratio=decrease,pad=%d:%d:(ow-iw)/2:(oh-ih)/2,tile=%dx%d",
+		strconv.FormatFloat(p.Interval.Seconds(), 'f', 3, 64),
+		p.TileWidth, tileHeight, p.TileWidth, tileHeight, p.Columns, p.Rows)
+	args := []string{
+		"-v", "error", "-y",
+		"-skip_frame", "nokey",
+		"-i", input,
+		"-map", "0:v:0",
+		"-vf", filter,
+		"-q:v", strconv.Itoa(p.Quality),
+		"-f", "image2",
+		filepath.Join(tmpDir, "%03d.jpg"),
+	}
+	if err := g.Runner.Run(ctx, "ffmpeg", args, nil); err != nil {
+		return nil, err
+	}
+
+	var sheets [][]byte
+	for i := 1; ; i++ {
+		data, err := os.ReadFile(filepath.Join(tmpDir, fmt.Sprintf("%03d.jpg", i)))
+		if err != nil || len(data) == 0 {
+			break
+		}
+		sheets = append(sheets, data)
+	}
+	if len(sheets) == 0 {
+		return nil, fmt.Errorf("%w: no video frames", ErrNoStream)
+	}
+	return sheets, nil
+}
+
+// trickplayIndex maps every Interval of the video to its tile, as
+// <sheet url>#xywh=x,y,w,h cues.
+func (p TrickplayProfile) trickplayIndex(sheetURLs []string, duration time.Duration, tileHeight int) []byte {
+	perSheet := p.Columns * p.Rows
+	frames := min(int((duration+p.Interval-1)/p.Interval), len(sheetURLs)*perSheet)
+
+	var buf bytes.Buffer
+	buf.WriteString("WEBVTT\n")
+	for i := 0; i < frames; i++ {
+		start := time.Duration(i) * p.Interval
+		end := min(start+p.Interval, duration)
+		tile := i % perSheet
+		fmt.Fprintf(&buf, "\n%s --> %s\n%s#xywh=%d,%d,%d,%d\n",
+			vttTimestamp(start), vttTimestamp(end), sheetURLs[i/perSheet],
+			(tile%p.Columns)*p.TileWidth, (tile/p.Columns)*tileHeight, p.TileWidth, tileHeight)
+	}
+	return buf.Bytes()
+}
+
+func vttTimestamp(d time.Duration) string {
+	ms := d.Milliseconds()
+	return fmt.Sprintf("%02d:%02d:%02d.%03d", ms/3600000, ms/60000%60, ms/1000%60, ms%1000)
+}
+
+// Sprites renders the sprite sheets of a video object and stores them with
+// their WebVTT index, which is uploaded last so that its presence means the
+// set is complete. duration must be known; width and height are the video's
+// dimensions, or 0 if unknown. The index is the last object returned.
+func (g *Generator) Sprites(ctx context.Context, objectKey string, duration time.Duration, width, height int) ([]Object, error) {
+	if g.Trickplay.Interval <= 0 {
+		return nil, fmt.Errorf("trickplay is disabled")
+	}
+	if duration <= 0 {
+		return nil, fmt.Errorf("%w: unknown duration", ErrNoStream)
+	}
+	url, err := g.SourceURL(ctx, objectKey)
+	if err != nil {
+		return nil, err
+	}
+	tileHeight := g.Trickplay.tileHeight(width, height)
+	sheets, err := g.RenderTrickplay(ctx, url, tileHeight)
+	if err != nil {
+		return nil, err
+	}
+
+	var objects []Object
+	var sheetURLs []string
+	for i, data := range sheets {
+		obj := Object{Key: fmt.Sprintf("%s%03d.jpg", trickplayDir(objectKey), i+1), ContentType: "image/jpeg", Data: data}
+		if err := g.Put(ctx, obj); err != nil {
+			return nil, err
+		}
+		objects = append(objects, obj)
+		sheetURLs = append(sheetURLs, config.CloudflarePublicDevURL+"/"+obj.Key)
+	}
+
+	index := Object{
+		Key:         TrickplayIndexKey(objectKey),
+		ContentType: "text/vtt",
+		Data:        g.Trickplay.trickplayIndex(sheetURLs, duration, tileHeight),
+	}
+	if err := g.Put(ctx, index); err != nil {
+		return nil, err
+	}
+	return append(objects, index), nil
+}
@@ -0,0 +1,95 @@
+package assets
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func testTrickplayProfile() TrickplayProfile {
+	return TrickplayProfile{Interval: 10 * time.Second, TileWidth: 160, Columns: 2, Rows: 2, Quality: 5}
+}
+
+func TestRenderTrickplay(t *testing.T) {
+	writeSheets := func(n int) func([]string) error {
+		return func(args []string) error {
+			pattern := args[len(args)-1]
+			for i := 1; i <= n; i++ {
+				name := fmt.Sprintf(pattern, i)
+				if err := os.WriteFile(name, []byte("jpeg"), 0o644); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+	}
+	tests := []struct {
+		name    string
+		step    func([]string) error
+		want    int
+		wantErr error
+	}{
+		{"sheets", writeSheets(3), 3, nil},
+		{"no frames", writeSheets(0), 0, ErrNoStream},
+		{"ffmpeg error", fail(ErrNoStream), 0, ErrNoStream},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			runner := &fakeRunner{steps: []func([]string) error{tt.step}}
+			g := &Generator{Runner: runner, Trickplay: testTrickplayProfile()}
+			sheets, err := g.RenderTrickplay(context.Background(), "in.mp4", 90)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("RenderTrickplay error = %v, want %v", err, tt.wantErr)
+			}
+			if len(sheets) != tt.want {
+				t.Errorf("got %d sheets, want %d", len(sheets), tt.want)
+			}
+			args := runner.calls[0]
+			filter := "fps=1/10.000,scale=160:90:force_original_aspect_ratio=decrease,pad=160:90:(ow-iw)/2:(oh-ih)/2,tile=2x2"
+			for _, want := range [][]string{
+				{"-skip_frame", "nokey", "-i", "in.mp4"},
+				{"-map", "0:v:0", "-vf", filter, "-q:v", "5", "-f", "image2"},
+			} {
+				if !hasArgs(args, want...) {
+					t.Errorf("args %q lack %q", args, want)
+				}
+			}
+			if filepath.Base(args[len(args)-1]) != "%03d.jpg" {
+				t.Errorf("output pattern = %q", args[len(args)-1])
+			}
+		})
+	}
+}
+
+func TestTrickplayTileHeight(t *testing.T) {
+	p := testTrickplayProfile()
+	tests := []struct{ width, height, want int }{
+		{1920, 1080, 90},
+		{0, 0, 90},
+		{1080, 1920, 284},
+		{1440, 1080, 120},
+	}
+	for _, tt := range tests {
+		if got := p.tileHeight(tt.width, tt.height); got != tt.want {
+			t.Errorf("tileHeight(%d, %d) = %d, want %d", tt.width, tt.height, got, tt.want)
+		}
+	}
+}
+
+func TestTrickplayIndex(t *testing.T) {
+	p := testTrickplayProfile()
+	got := string(p.trickplayIndex([]string{"https://cdn/001.jpg", "https://cdn/002.jpg"}, 45*time.Second, 90))
+	want := "WEBVTT\n" +
+		"\n00:00:00.000 --> 00:00:10.000\nhttps://cdn/001.jpg#xywh=0,0,160,90\n" +
+		"\n00:00:10.000 --> 00:00:20.000\nhttps://cdn/001.jpg#xywh=160,0,160,90\n" +
+		"\n00:00:20.000 --> 00:00:30.000\nhttps://cdn/001.jpg#xywh=0,90,160,90\n" +
+		"\n00:00:30.000 --> 00:00:40.000\nhttps://cdn/001.jpg#xywh=160,90,160,90\n" +
+		"\n00:00:40.000 --> 00:00:45.000\nhttps://cdn/002.jpg#xywh=0,0,160,90\n"
+	if got != want {
+		t.Errorf("trickplayIndex =\n%s\nwant\n%s", got, want)
+	}
+}
@@ -0,0 +1,208 @@
+package assets
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"media-server/config"
+	"path"
+	"strings"
+	"time"
+)
+
+// waveformSampleRate is the rate audio is decoded at to compute peaks. The
+// envelope of the signal doesn't need more.
+const waveformSampleRate = 16000
+
+// WaveformProfile controls the peak data computed for waveform displays.
+type WaveformProfile struct {
+	PeaksPerSecond int           // Resolution of the stored peaks; 0 disables waveforms
+	Timeout        time.Duration // Upper bound for one ffmpeg run
+}
+
+// DefaultWaveformProfile returns the profile configured through the
+// WAVEFORM_* environment variables.
+func DefaultWaveformProfile() WaveformProfile {
+	return WaveformProfile{
+		PeaksPerSecond: config.WaveformResolution,
+		Timeout:        config.WaveformTimeout,
+	}
+}
+
+// WaveformKey is the object key of the peak data of a file, next to its
+// thumbnail: thumbnails/<path without extension>@waveform.dat
+func WaveformKey(objectKey string) string {
+	return "thumbnails/" + strings.TrimSuffix(objectKey, path.Ext(objectKey)) + "@waveform.dat"
+}
+
+// Waveform is the peak data of an audio track, every channel mixed down: the
+// minimum and maximum 16-bit sample of each bucket of SamplesPerPixel
+// samples, as in audiowaveform's data format.
+type Waveform struct {
+	SampleRate      int
+	SamplesPerPixel int
+	Data            []int16 // Minimum and maximum of each bucket, in turn
+}
+
+// Length is the number of buckets.
+func (w *Waveform) Length() int {
+	return len(w.Data) / 2
+}
+
+// Resample merges every factor buckets into one.
+func (w *Waveform) Resample(factor int) *Waveform {
+	if factor <= 1 {
+		return w
+	}
+	out := &Waveform{SampleRate: w.SampleRate, SamplesPerPixel: w.SamplesPerPixel * factor}
+	for i := 0; i < len(w.Data); i += 2 * factor {
+		end := min(i+2*factor, len(w.Data))
+		lo, hi := w.Data[i], w.Data[i+1]
+		for j := i + 2; j < end; j += 2 {
+			lo, hi = min(lo, w.Data[j]), max(hi, w.Data[j+1])
+		}
+		out.Data = append(out.Data, lo, hi)
+	}
+	return out
+}
+
+// waveformHeaderSize is the size of a version 1 audiowaveform header.
+const waveformHeaderSize = 20
+
+// MarshalBinary encodes the waveform as a version 1, 16-bit audiowaveform
+// .dat file.
+func (w *Waveform) MarshalBinary() ([]byte, error) {
+	buf := make([]byte, waveformHeaderSize, waveformHeaderSize+2*len(w.Data))
+	binary.LittleEndian.PutUint32(buf[0:], 1) // Version
+	binary.LittleEndian.PutUint32(buf[4:], 0) // Flags: 16-bit samples
+	binary.LittleEndian.PutUint32(buf[8:], uint32(w.SampleRate))
+	binary.LittleEndian.PutUint32(buf[12:], uint32(w.SamplesPerPixel))
+	binary.LittleEndian.PutUint32(buf[16:], uint32(w.Length()))
+	for _, v := range w.Data {
+		buf = binary.LittleEndian.AppendUint16(buf, uint16(v))
+	}
+	return buf, nil
+}
+
+// ParseWaveform decodes a version 1, 16-bit audiowaveform .dat file as
+// written by MarshalBinary.
+func ParseWaveform(data []byte) (*Waveform, error) {
+	if len(data) < waveformHeaderSize {
+		return nil, errors.New("waveform data is truncated")
+	}
+	if version, flags := binary.LittleEndian.Uint32(data[0:]), binary.LittleEndian.Uint32(data[4:]); version != 1 || flags != 0 {
+		return nil, fmt.Errorf("unsupported waveform data version %d, flags %d", version, flags)
+	}
+	w := &Waveform{
+		SampleRate:      int(binary.LittleEndian.Uint32(data[8:])),
+		SamplesPerPixel: int(binary.LittleEndian.Uint32(data[12:])),
+	}
+	length := int(binary.LittleEndian.Uint32(data[16:]))
+	if len(data) != waveformHeaderSize+4*length || w.SampleRate <= 0 || w.SamplesPerPixel <= 0 {
+		return nil, errors.New("waveform data is corrupt")
+	}
+	w.Data = make([]int16, 2*length)
+	for i := range w.Data {
+		w.Data[i] = int16(binary.LittleEndian.Uint16(data[waveformHeaderSize+2*i:]))
+	}
+	return w, nil
+}
+
+// peakWriter computes the peaks of the signed 16-bit little-endian mono
+// samples written to it.
+type peakWriter struct {
+	w       *Waveform
+	lo, hi  int16
+	n       int    // Samples in the current bucket
+	partial []byte // Half a sample left over from the last write
+}
+
+func (p *peakWriter) Write(b []byte) (int, error) {
+	written := len(b)
+	if len(p.partial) > 0 {
+		b = append(p.partial, b...)
+		p.partial = nil
+	}
+	for ; len(b) >= 2; b = b[2:] {
+		v := int16(binary.LittleEndian.Uint16(b))
+		if p.n == 0 {
+			p.lo, p.hi = v, v
+		} else {
+			p.lo, p.hi = min(p.lo, v), max(p.hi, v)
+		}
+		p.n++
+		if p.n == p.w.SamplesPerPixel {
+			p.flush()
+		}
+	}
+	if len(b) > 0 {
+		p.partial = []byte{b[0]}
+	}
+	return written, nil
+}
+
+// flush ends the current bucket, if it has samples.
+func (p *peakWriter) flush() {
+	if p.n > 0 {
+		p.w.Data = append(p.w.Data, p.lo, p.hi)
+		p.n = 0
+	}
+}
+
+// RenderWaveform decodes the first audio stream of input, a URL or local
+// path, and computes its peaks. Files without audio fail with ErrNoStream.
+func (g *Generator) RenderWaveform(ctx context.Context, input string) (*Waveform, error) {
+	p := g.Waveform
+	release, err := Acquire(ctx, WeightWaveform)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	if p.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.Timeout)
+		defer cancel()
+	}
+
+	w := &Waveform{SampleRate: waveformSampleRate, SamplesPerPixel: waveformSampleRate / max(p.PeaksPerSecond, 1)}
+	peaks := &peakWriter{w: w}
+	err = g.Runner.Run(ctx, "ffmpeg", []string{
+		"-v", "error",
+		"-i", input,
+		"-map", "0:a:0", "-vn", "-sn", "-dn",
+		"-ac", "1", "-ar", fmt.Sprint(waveformSampleRate),
+		"-c:a", "pcm_s16le", "-f", "s16le", "pipe:1",
+	}, peaks)
+	if err != nil {
+		return nil, err
+	}
+	peaks.flush()
+	if w.Length() == 0 {
+		return nil, fmt.Errorf("%w: no audio samples for a waveform", ErrNoStream)
+	}
+	return w, nil
+}
+
+// WaveformPeaks computes the peaks of an object and stores them at
+// WaveformKey.
+func (g *Generator) WaveformPeaks(ctx context.Context, objectKey string) (Object, error) {
+	if g.Waveform.PeaksPerSecond <= 0 {
+		return Object{}, fmt.Errorf("waveforms are disabled")
+	}
+	url, err := g.SourceURL(ctx, objectKey)
+	if err != nil {
+		return Object{}, err
+	}
+	w, err := g.RenderWaveform(ctx, url)
+	if err != nil {
+		return Object{}, err
+	}
+	data, err := w.MarshalBinary()
+	if err != nil {
+		return Object{}, err
+	}
+	obj := Object{Key: WaveformKey(objectKey), ContentType: "application/octet-stream", Data: data}
+	return obj, g.Put(ctx, obj)
+}
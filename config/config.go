@@ -3,7 +3,10 @@ package config
 import (
 	"log"
 	"os"
+	"runtime"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/joho/godotenv"
 )
@@ -21,6 +24,43 @@ var (
 	CloudflareR2SecretAccessKey string
 	CloudflareR2BucketName     string
 	CloudflarePublicDevURL     string
+
+	// --- Upload Configuration ---
+	MaxUploadSize      int64    // Largest single file accepted, in bytes (0 = unlimited)
+	UserQuotaBytes     int64    // Default storage quota per user, in bytes (0 = unlimited)
+	UploadAllowedTypes []string // MIME patterns accepted by /upload, e.g. "video/*"
+	UploadDeniedTypes  []string // MIME patterns always rejected by /upload
+	RejectTypeMismatch bool     // Reject files whose content doesn't match their extension
+
+	// --- Asset Generation Configuration ---
+	AssetMaxAttempts   int           // Automatic attempts before a failed asset needs a manual requeue
+	AssetRetryInterval time.Duration // How often failed assets are retried (0 = only at startup)
+
+	// --- FFmpeg Configuration ---
+	ThumbnailSizes      []ThumbnailSize // Thumbnail widths; the first is the default
+	ThumbnailFormats    []string        // Thumbnail image formats; jpeg is always included
+	ThumbnailSeek       time.Duration   // Position of the thumbnail frame when the duration is unknown
+	ThumbnailPosition   float64         // Position of the thumbnail frame as a fraction of the duration
+	ThumbnailCandidates int             // Frames scored to pick the thumbnail (1 = no scoring)
+	ThumbnailTimeout    time.Duration   // Upper bound for rendering one thumbnail
+	SubtitleTimeout     time.Duration   // Upper bound for extracting the subtitles of one video
+	TrickplayInterval   time.Duration   // Time between seek-preview frames (0 = no trickplay)
+	TrickplayTimeout    time.Duration   // Upper bound for rendering the sprite sheets of one video
+	PreviewClips        int             // Clips in a hover preview loop (0 = no previews)
+	PreviewClipLength   time.Duration   // Length of each hover preview clip
+	PreviewTimeout      time.Duration   // Upper bound for rendering one hover preview
+	WaveformResolution  int             // Waveform peaks stored per second of audio (0 = no waveforms)
+	WaveformTimeout     time.Duration   // Upper bound for computing the waveform of one file
+
+	FFmpegConcurrency int           // Weighted budget of concurrent ffmpeg/ffprobe processes
+	AssetJobTimeout   time.Duration // Upper bound for one generation job, including waiting for a slot
+	AssetRequestWait  time.Duration // How long a request waits for an asset before answering 202
+
+	// --- Admin Configuration ---
+	AdminUserIDs []string // JWT subjects allowed to use /admin endpoints
+
+	// --- Feed Configuration ---
+	PublicBaseURL string // External URL of this server, used for links in podcast feeds (empty = taken from the request)
 )
 
 func Init() {
@@ -76,6 +116,139 @@ func Init() {
 		log.Fatal("FATAL: CF_PUBLIC_DEV_URL environment variable is not set.")
 	}
 
+	// --- Load Upload Configuration ---
+	MaxUploadSize = int64FromEnv("MAX_UPLOAD_SIZE_MB", 10240) * 1024 * 1024
+	UserQuotaBytes = int64FromEnv("USER_QUOTA_MB", 0) * 1024 * 1024
+	UploadAllowedTypes = listFromEnv("UPLOAD_ALLOWED_TYPES", "video/*,audio/*,image/*,text/vtt,application/x-subrip,text/x-ssa,text/xml,application/xml")
+	UploadDeniedTypes = listFromEnv("UPLOAD_DENIED_TYPES", "")
+
+	switch mismatch := os.Getenv("UPLOAD_TYPE_MISMATCH"); mismatch {
+	case "", "reject":
+		RejectTypeMismatch = true
+	case "flag":
+		RejectTypeMismatch = false
+	default:
+		log.Fatalf("FATAL: Invalid UPLOAD_TYPE_MISMATCH value: '%s'. Must be 'reject' or 'flag'.", mismatch)
+	}
+
+	// --- Load Asset Generation Configuration ---
+	AssetMaxAttempts = int(int64FromEnv("ASSET_MAX_ATTEMPTS", 5))
+	if AssetMaxAttempts < 1 {
+		log.Fatal("FATAL: ASSET_MAX_ATTEMPTS must be at least 1.")
+	}
+	AssetRetryInterval = time.Duration(int64FromEnv("ASSET_RETRY_INTERVAL_MINUTES", 15)) * time.Minute
+
+	// --- Load FFmpeg Configuration ---
+	ThumbnailSizes = thumbnailSizesFromEnv("THUMBNAIL_SIZES", "small:320,medium:640,large:1280")
+	ThumbnailFormats = []string{"jpeg"}
+	for _, format := range listFromEnv("THUMBNAIL_FORMATS", "jpeg,webp") {
+		switch format = strings.ToLower(format); format {
+		case "jpeg":
+		case "webp", "avif":
+			ThumbnailFormats = append(ThumbnailFormats, format)
+		default:
+			log.Fatalf("FATAL: Invalid THUMBNAIL_FORMATS entry: '%s'. Must be jpeg, webp or avif.", format)
+		}
+	}
+	ThumbnailSeek = time.Duration(int64FromEnv("THUMBNAIL_SEEK_SECONDS", 5)) * time.Second
+	ThumbnailPosition = float64(int64FromEnv("THUMBNAIL_POSITION_PERCENT", 10)) / 100
+	if ThumbnailPosition > 0.9 {
+		log.Fatal("FATAL: THUMBNAIL_POSITION_PERCENT must be at most 90.")
+	}
+	ThumbnailCandidates = int(int64FromEnv("THUMBNAIL_CANDIDATES", 5))
+	if ThumbnailCandidates < 1 {
+		log.Fatal("FATAL: THUMBNAIL_CANDIDATES must be at least 1.")
+	}
+	ThumbnailTimeout = time.Duration(int64FromEnv("THUMBNAIL_TIMEOUT_SECONDS", 60)) * time.Second
+	SubtitleTimeout = time.Duration(int64FromEnv("SUBTITLE_TIMEOUT_SECONDS", 600)) * time.Second
+	TrickplayInterval = time.Duration(int64FromEnv("TRICKPLAY_INTERVAL_SECONDS", 10)) * time.Second
+	TrickplayTimeout = time.Duration(int64FromEnv("TRICKPLAY_TIMEOUT_SECONDS", 1800)) * time.Second
+	PreviewClips = int(int64FromEnv("PREVIEW_CLIPS", 4))
+	PreviewClipLength = time.Duration(int64FromEnv("PREVIEW_CLIP_SECONDS", 1)) * time.Second
+	if PreviewClips > 0 && PreviewClipLength == 0 {
+		log.Fatal("FATAL: PREVIEW_CLIP_SECONDS must be at least 1.")
+	}
+	PreviewTimeout = time.Duration(int64FromEnv("PREVIEW_TIMEOUT_SECONDS", 300)) * time.Second
+	WaveformResolution = int(int64FromEnv("WAVEFORM_PEAKS_PER_SECOND", 100))
+	if WaveformResolution > 1000 {
+		log.Fatal("FATAL: WAVEFORM_PEAKS_PER_SECOND must be at most 1000.")
+	}
+	WaveformTimeout = time.Duration(int64FromEnv("WAVEFORM_TIMEOUT_SECONDS", 600)) * time.Second
+
+	FFmpegConcurrency = int(int64FromEnv("FFMPEG_CONCURRENCY", int64(runtime.NumCPU())))
+	if FFmpegConcurrency < 1 {
+		log.Fatal("FATAL: FFMPEG_CONCURRENCY must be at least 1.")
+	}
+	AssetJobTimeout = time.Duration(int64FromEnv("ASSET_JOB_TIMEOUT_MINUTES", 30)) * time.Minute
+	if AssetJobTimeout == 0 {
+		log.Fatal("FATAL: ASSET_JOB_TIMEOUT_MINUTES must be at least 1.")
+	}
+	AssetRequestWait = time.Duration(int64FromEnv("ASSET_REQUEST_WAIT_SECONDS", 10)) * time.Second
+
+	// --- Load Admin Configuration ---
+	AdminUserIDs = listFromEnv("ADMIN_USER_IDS", "")
+
+	// --- Load Feed Configuration ---
+	PublicBaseURL = strings.TrimSuffix(os.Getenv("PUBLIC_BASE_URL"), "/")
+
 	// The MediaRoot variable has been removed as it's no longer needed.
 	log.Println("Configuration loaded successfully.")
-}
\ No newline at end of file
+}
+
+// int64FromEnv reads a non-negative integer variable, falling back to def when
+// it is unset.
+func int64FromEnv(name string, def int64) int64 {
+	str := os.Getenv(name)
+	if str == "" {
+		return def
+	}
+	v, err := strconv.ParseInt(str, 10, 64)
+	if err != nil || v < 0 {
+		log.Fatalf("FATAL: Invalid %s value: '%s'. Must be a non-negative integer.", name, str)
+	}
+	return v
+}
+
+// listFromEnv reads a comma-separated variable, falling back to def when it is
+// unset. Empty entries are dropped.
+func listFromEnv(name, def string) []string {
+	str, ok := os.LookupEnv(name)
+	if !ok {
+		str = def
+	}
+	var list []string
+	for _, item := range strings.Split(str, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// ThumbnailSize is a named thumbnail width, as in small:320.
+type ThumbnailSize struct {
+	Name  string
+	Width int
+}
+
+// thumbnailSizesFromEnv reads a list of name:width pairs.
+func thumbnailSizesFromEnv(name, def string) []ThumbnailSize {
+	var sizes []ThumbnailSize
+	for _, entry := range listFromEnv(name, def) {
+		sizeName, width, ok := strings.Cut(entry, ":")
+		w, err := strconv.Atoi(width)
+		if !ok || sizeName == "" || strings.ContainsAny(sizeName, "./@") || err != nil || w <= 0 {
+			log.Fatalf("FATAL: Invalid %s entry: '%s'. Must be name:width.", name, entry)
+		}
+		for _, s := range sizes {
+			if s.Name == sizeName {
+				log.Fatalf("FATAL: Duplicate %s entry: '%s'.", name, sizeName)
+			}
+		}
+		sizes = append(sizes, ThumbnailSize{Name: sizeName, Width: w})
+	}
+	if len(sizes) == 0 {
+		log.Fatalf("FATAL: %s must list at least one size.", name)
+	}
+	return sizes
+}
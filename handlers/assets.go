@@ -0,0 +1,156 @@
+package handlers
+
+import (
+	"context"
+	"log"
+	"media-server/assets"
+	"media-server/config"
+	dbstore "media-server/storage"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/sync/singleflight"
+)
+
+const (
+	defaultAssetStatuses = 100
+	maxAssetStatuses     = 1000
+)
+
+// assetQueuedRetryAfter is the Retry-After, in seconds, sent with 202
+// responses for assets still being generated.
+const assetQueuedRetryAfter = 5
+
+// waitForAsset starts generating an asset with start and waits for it up to
+// config.AssetRequestWait. When ffmpeg is saturated it doesn't wait at all.
+// done is false if generation is still running; it carries on in the
+// background and later requests join it.
+func waitForAsset(ctx context.Context, start func() <-chan singleflight.Result) (url *string, done bool, err error) {
+	wait := config.AssetRequestWait
+	if assets.Saturated() {
+		wait = 0
+	}
+	results := start()
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case r := <-results:
+		url, _ := r.Val.(*string)
+		return url, true, r.Err
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+	return nil, false, nil
+}
+
+// respondAssetQueued tells the client an asset is being generated and when
+// to ask again.
+func respondAssetQueued(c *gin.Context, what string) {
+	c.Header("Retry-After", strconv.Itoa(assetQueuedRetryAfter))
+	c.JSON(http.StatusAccepted, gin.H{"status": "generating", "message": what + " are being generated."})
+}
+
+// respondAssetUnavailable explains why a derived asset can't be served:
+// the file has no stream for it (404), a retry is scheduled (503 with
+// Retry-After), or its retries are used up until an admin requeues it (404).
+func respondAssetUnavailable(c *gin.Context, status dbstore.AssetStatus, what string) {
+	switch {
+	case status.Status == dbstore.AssetStatusNoStream:
+		c.JSON(http.StatusNotFound, gin.H{"error": what + " are not available for this file."})
+	case status.Status == dbstore.AssetStatusError && !status.Exhausted():
+		retryAfter := 1
+		if status.NextAttemptAt != nil {
+			retryAfter = max(int(time.Until(*status.NextAttemptAt).Seconds())+1, 1)
+		}
+		c.Header("Retry-After", strconv.Itoa(retryAfter))
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": what + " generation failed and will be retried.", "status": status})
+	case status.Status == dbstore.AssetStatusError:
+		c.JSON(http.StatusNotFound, gin.H{"error": what + " generation failed.", "status": status})
+	default:
+		c.JSON(http.StatusNotFound, gin.H{"error": what + " not found."})
+	}
+}
+
+// ListAssetStatuses returns the generation status of derived assets, for
+// admins to see what failed and why.
+//
+// Query parameters: status, kind, path, limit.
+func ListAssetStatuses(c *gin.Context) {
+	if db == nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "DB not initialized"})
+		return
+	}
+
+	limit, err := boundedIntParam(c.Query("limit"), defaultAssetStatuses, maxAssetStatuses)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid limit"})
+		return
+	}
+	filter := dbstore.AssetStatusFilter{
+		Status: c.Query("status"),
+		Kind:   c.Query("kind"),
+		Path:   strings.TrimPrefix(c.Query("path"), "/"),
+	}
+
+	statuses, err := dbstore.ListAssetStatuses(db, filter, limit)
+	if err != nil {
+		log.Printf("Error listing asset statuses: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list asset statuses"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"assets": statuses})
+}
+
+// RequeueRequest is the body of POST /admin/assets/requeue. Empty fields
+// match every asset.
+type RequeueRequest struct {
+	FileIDs []int64 `json:"file_ids"`
+	Path    string  `json:"path"`
+	Kind    string  `json:"kind"`
+	Status  string  `json:"status"`
+}
+
+// RequeueAssets resets derived assets that failed or had no stream to pending
+// and starts generating them in the background.
+func RequeueAssets(c *gin.Context) {
+	if db == nil || r2Client == nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Service not initialized"})
+		return
+	}
+
+	var req RequeueRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid requeue request"})
+		return
+	}
+	if strings.Contains(req.Path, "..") {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid path"})
+		return
+	}
+	switch req.Status {
+	case "", dbstore.AssetStatusPending, dbstore.AssetStatusNoStream, dbstore.AssetStatusError:
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid status"})
+		return
+	}
+
+	n, err := dbstore.RequeueAssets(db, dbstore.AssetStatusFilter{
+		FileIDs: req.FileIDs,
+		Path:    strings.TrimPrefix(req.Path, "/"),
+		Kind:    req.Kind,
+		Status:  req.Status,
+	})
+	if err != nil {
+		log.Printf("Error requeueing assets: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to requeue assets"})
+		return
+	}
+	if n > 0 {
+		go dbstore.RetryDueAssets(db, r2Client, config.CloudflareR2BucketName)
+	}
+	c.JSON(http.StatusAccepted, gin.H{"requeued": n})
+}
@@ -0,0 +1,331 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	dbstore "media-server/storage"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// seasonOrder sorts seasons with specials, season 0, last.
+const seasonOrder = `e.season = 0, e.season`
+
+// ListShows lists the TV series recognized in the library by title, one page
+// at a time, with their number of seasons and episodes. The thumbnail is the
+// poster of the series folder, or else the first episode's.
+//
+// Query parameters: q (substring of the title), limit, cursor.
+func ListShows(c *gin.Context) {
+	if db == nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "DB not initialized"})
+		return
+	}
+	limit, err := parseLimit(c.Query("limit"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid limit"})
+		return
+	}
+
+	where := []string{"TRUE"}
+	var args []any
+	arg := func(v any) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+	if q := strings.TrimSpace(c.Query("q")); q != "" {
+		where = append(where, "strpos(s.title_key, lower("+arg(q)+")) > 0")
+	}
+	if raw := c.Query("cursor"); raw != "" {
+		p, err := decodeCursor(raw)
+		if err != nil || p.Sort != "show" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid cursor"})
+			return
+		}
+		where = append(where, fmt.Sprintf("(s.title_key, s.id) > (CAST(%s AS text), %s)", arg(p.Value), arg(p.ID)))
+	}
+
+	rows, err := db.QueryContext(c.Request.Context(), fmt.Sprintf(`
+		SELECT s.id, s.title, s.title_key, s.year,
+			COUNT(DISTINCT e.season), COUNT(*), MAX(f.created_at),
+			COALESCE(
+				(SELECT p.url FROM artwork_table a JOIN files_table p ON p.id = a.sidecar_id
+					WHERE a.folder_id = s.folder_id AND a.kind = 'poster' ORDER BY a.sidecar_id LIMIT 1),
+				(array_agg(f.thumbnail_url ORDER BY `+seasonOrder+`, e.episode, f.id) FILTER (WHERE f.thumbnail_url IS NOT NULL))[1])
+		FROM shows_table s
+		JOIN episodes_table e ON e.show_id = s.id
+		JOIN files_table f ON f.id = e.file_id AND NOT f.hidden
+		WHERE %s
+		GROUP BY s.id
+		ORDER BY s.title_key, s.id
+		LIMIT %s`, strings.Join(where, " AND "), arg(limit+1)), args...)
+	if err != nil {
+		log.Printf("Error querying shows: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to query shows"})
+		return
+	}
+	defer rows.Close()
+
+	shows := []gin.H{}
+	var next *string
+	var lastID int64
+	var lastKey string
+	for rows.Next() {
+		if len(shows) == limit {
+			cursor := pageCursor{Sort: "show", Order: "asc", Value: lastKey, ID: lastID}.encode()
+			next = &cursor
+			break
+		}
+		var id, year, seasons, episodes int64
+		var title, key string
+		var updatedAt time.Time
+		var thumbnail sql.NullString
+		if err := rows.Scan(&id, &title, &key, &year, &seasons, &episodes, &updatedAt, &thumbnail); err != nil {
+			log.Printf("Error scanning show: %v", err)
+			continue
+		}
+		show := gin.H{
+			"id":            id,
+			"title":         title,
+			"season_count":  seasons,
+			"episode_count": episodes,
+			"updated_at":    updatedAt,
+			"thumbnail_url": thumbnail.String, // Will be "" if NULL
+		}
+		if year > 0 {
+			show["year"] = year
+		}
+		shows = append(shows, show)
+		lastID, lastKey = id, key
+	}
+	if err := rows.Err(); err != nil {
+		log.Printf("Error reading shows: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to query shows"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"shows": shows, "next_cursor": next})
+}
+
+// GetShowSeasons returns a TV series with its episodes grouped by season, in
+// order, specials last.
+func GetShowSeasons(c *gin.Context) {
+	if db == nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "DB not initialized"})
+		return
+	}
+	id, ok := idParam(c)
+	if !ok {
+		return
+	}
+
+	var title string
+	var year int64
+	var folderID sql.NullInt64
+	err := db.QueryRowContext(c.Request.Context(), "SELECT title, year, folder_id FROM shows_table WHERE id = $1", id).Scan(&title, &year, &folderID)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Show not found"})
+		return
+	}
+	if err != nil {
+		log.Printf("Error querying show %d: %v", id, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to query show"})
+		return
+	}
+
+	rows, err := db.QueryContext(c.Request.Context(), `
+		SELECT `+mediaFileColumns+`, e.season, e.episode, e.episode_end, e.title
+		FROM episodes_table e
+		JOIN files_table f ON f.id = e.file_id AND NOT f.hidden
+		WHERE e.show_id = $1
+		ORDER BY `+seasonOrder+`, e.episode, f.name, f.id`, id)
+	if err != nil {
+		log.Printf("Error querying episodes of show %d: %v", id, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to query episodes"})
+		return
+	}
+	defer rows.Close()
+
+	type seasonEpisodes struct {
+		season   int64
+		episodes []gin.H
+	}
+	var groups []*seasonEpisodes
+	all := []gin.H{}
+	for rows.Next() {
+		var season, number int64
+		var end sql.NullInt64
+		var episodeTitle string
+		f, err := scanMediaFile(rows, &season, &number, &end, &episodeTitle)
+		if err != nil {
+			log.Printf("Error scanning episode: %v", err)
+			continue
+		}
+		episode := gin.H{"season": season, "episode": number, "title": episodeTitle}
+		if end.Valid {
+			episode["episode_end"] = end.Int64
+		}
+		entry := f.entry()
+		entry["episode"] = episode
+		if len(groups) == 0 || groups[len(groups)-1].season != season {
+			groups = append(groups, &seasonEpisodes{season: season})
+		}
+		groups[len(groups)-1].episodes = append(groups[len(groups)-1].episodes, entry)
+		all = append(all, entry)
+	}
+	if err := rows.Err(); err != nil {
+		log.Printf("Error reading episodes of show %d: %v", id, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to query episodes"})
+		return
+	}
+	addThumbnailSources(c.Request.Context(), all)
+	addSidecarMetadata(c.Request.Context(), all, false)
+
+	seasons := make([]gin.H, len(groups))
+	for i, g := range groups {
+		seasons[i] = gin.H{"season": g.season, "episode_count": len(g.episodes), "episodes": g.episodes}
+	}
+	show := gin.H{"id": id, "title": title}
+	if year > 0 {
+		show["year"] = year
+	}
+	if folderID.Valid {
+		// The series folder's tvshow.nfo and artwork describe the show.
+		folder := gin.H{"id": folderID.Int64}
+		addSidecarMetadata(c.Request.Context(), []gin.H{folder}, true)
+		for _, key := range []string{"nfo", "artwork"} {
+			if v, ok := folder[key]; ok {
+				show[key] = v
+			}
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"show": show, "seasons": seasons})
+}
+
+// ListMovies lists the movies recognized in the library by title, one page
+// at a time.
+//
+// Query parameters: q (substring of the title), year, limit, cursor.
+func ListMovies(c *gin.Context) {
+	if db == nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "DB not initialized"})
+		return
+	}
+	limit, err := parseLimit(c.Query("limit"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid limit"})
+		return
+	}
+
+	where := []string{"TRUE"}
+	var args []any
+	arg := func(v any) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+	if q := strings.TrimSpace(c.Query("q")); q != "" {
+		where = append(where, "strpos(m.title_key, lower("+arg(q)+")) > 0")
+	}
+	if v := c.Query("year"); v != "" {
+		year, err := strconv.Atoi(v)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid year"})
+			return
+		}
+		where = append(where, "m.year = "+arg(year))
+	}
+	if raw := c.Query("cursor"); raw != "" {
+		p, err := decodeCursor(raw)
+		if err != nil || p.Sort != "movie" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid cursor"})
+			return
+		}
+		where = append(where, fmt.Sprintf("(m.title_key, m.file_id) > (CAST(%s AS text), %s)", arg(p.Value), arg(p.ID)))
+	}
+
+	rows, err := db.QueryContext(c.Request.Context(), fmt.Sprintf(`
+		SELECT %s, m.title, m.title_key, m.year
+		FROM movies_table m
+		JOIN files_table f ON f.id = m.file_id AND NOT f.hidden
+		WHERE %s
+		ORDER BY m.title_key, m.file_id
+		LIMIT %s`, mediaFileColumns, strings.Join(where, " AND "), arg(limit+1)), args...)
+	if err != nil {
+		log.Printf("Error querying movies: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to query movies"})
+		return
+	}
+	defer rows.Close()
+
+	movies := []gin.H{}
+	var next *string
+	var lastID int64
+	var lastKey string
+	for rows.Next() {
+		if len(movies) == limit {
+			cursor := pageCursor{Sort: "movie", Order: "asc", Value: lastKey, ID: lastID}.encode()
+			next = &cursor
+			break
+		}
+		var title, key string
+		var year sql.NullInt64
+		f, err := scanMediaFile(rows, &title, &key, &year)
+		if err != nil {
+			log.Printf("Error scanning movie: %v", err)
+			continue
+		}
+		movie := gin.H{"title": title}
+		if year.Valid {
+			movie["year"] = year.Int64
+		}
+		entry := f.entry()
+		entry["movie"] = movie
+		movies = append(movies, entry)
+		lastID, lastKey = f.ID, key
+	}
+	if err := rows.Err(); err != nil {
+		log.Printf("Error reading movies: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to query movies"})
+		return
+	}
+	addThumbnailSources(c.Request.Context(), movies)
+	addSidecarMetadata(c.Request.Context(), movies, false)
+
+	c.JSON(http.StatusOK, gin.H{"movies": movies, "next_cursor": next})
+}
+
+// addSidecarMetadata adds "nfo" and "artwork" to listing entries of videos,
+// or of folders with ofFolders, described by NFO or artwork sidecars.
+func addSidecarMetadata(ctx context.Context, entries []gin.H, ofFolders bool) {
+	var ids []int64
+	for _, e := range entries {
+		ids = append(ids, e["id"].(int64))
+	}
+	lookup := dbstore.SidecarMetadataOfFiles
+	if ofFolders {
+		lookup = dbstore.SidecarMetadataOfFolders
+	}
+	metadata, err := lookup(ctx, db, ids)
+	if err != nil {
+		log.Printf("Failed to list sidecar metadata: %v", err)
+		return
+	}
+	for _, e := range entries {
+		m := metadata[e["id"].(int64)]
+		if m == nil {
+			continue
+		}
+		if m.NFO != nil {
+			e["nfo"] = m.NFO
+		}
+		if len(m.Artwork) > 0 {
+			e["artwork"] = m.Artwork
+		}
+	}
+}
@@ -0,0 +1,35 @@
+package handlers
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+)
+
+// pageCursor is the position after the last item of a page, for keyset
+// pagination. It is handed to clients as an opaque base64 string.
+type pageCursor struct {
+	Sort  string `json:"s"`
+	Order string `json:"o"`
+	Value string `json:"v"`
+	ID    int64  `json:"id"`
+}
+
+var errInvalidCursor = errors.New("invalid cursor")
+
+func (p pageCursor) encode() string {
+	data, _ := json.Marshal(p)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeCursor(s string) (pageCursor, error) {
+	var p pageCursor
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return p, errInvalidCursor
+	}
+	if err := json.Unmarshal(data, &p); err != nil {
+		return p, errInvalidCursor
+	}
+	return p, nil
+}
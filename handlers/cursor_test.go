@@ -0,0 +1,57 @@
+package handlers
+
+import (
+	"encoding/base64"
+	"errors"
+	"testing"
+)
+
+func TestPageCursor(t *testing.T) {
+	cursors := []pageCursor{
+		{Sort: "name", Order: "asc", Value: "Ä/b c?&=", ID: 42},
+		{Sort: "rank", Order: "desc", Value: "0.0607927", ID: 7},
+		{},
+	}
+	for _, want := range cursors {
+		got, err := decodeCursor(want.encode())
+		if err != nil {
+			t.Errorf("decodeCursor(%+v.encode()): %v", want, err)
+			continue
+		}
+		if got != want {
+			t.Errorf("decodeCursor(encode()) = %+v, want %+v", got, want)
+		}
+	}
+
+	for _, bad := range []string{"not base64!", base64.RawURLEncoding.EncodeToString([]byte("{")), "e30="} {
+		if _, err := decodeCursor(bad); !errors.Is(err, errInvalidCursor) {
+			t.Errorf("decodeCursor(%q) error = %v, want %v", bad, err, errInvalidCursor)
+		}
+	}
+}
+
+func TestParseSortValue(t *testing.T) {
+	tests := []struct {
+		sort, value string
+		valid       bool
+	}{
+		{"name", "anything ' goes", true},
+		{"size", "1048576", true},
+		{"size", "1e6", false},
+		{"size", "1; DROP TABLE files_table", false},
+		{"created_at", "2024-05-01T12:30:00.123456Z", true},
+		{"created_at", "2024-05-01", false},
+		{"duration", "5400.25", true},
+		{"duration", "0", true},
+		{"duration", "long", false},
+		{"rank", "0.0607927", true},
+		{"rank", "1e-3", true},
+		{"rank", "0.06 OR 1=1", false},
+	}
+	for _, tt := range tests {
+		_, err := parseSortValue(tt.sort, tt.value)
+		if (err == nil) != tt.valid {
+			t.Errorf("parseSortValue(%q, %q) error = %v, want valid %v", tt.sort, tt.value, err, tt.valid)
+		}
+	}
+}
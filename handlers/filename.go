@@ -0,0 +1,102 @@
+package handlers
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// maxFileNameBytes matches the common filesystem limit so that objects can be
+// mirrored to disk without truncation.
+const maxFileNameBytes = 255
+
+// reservedNameChars are replaced in uploaded names; they are either path
+// separators or characters that Windows clients refuse to create.
+const reservedNameChars = `/\:*?"<>|`
+
+// sanitizeFileName turns a client-supplied file name into a single, safe path
+// segment. It returns "" when nothing usable is left.
+func sanitizeFileName(name string) string {
+	name = norm.NFC.String(name)
+
+	// Some browsers send the full client path; keep only the last element.
+	name = path.Base(strings.ReplaceAll(name, "\\", "/"))
+
+	var b strings.Builder
+	for _, r := range name {
+		switch {
+		case r == utf8.RuneError || unicode.IsControl(r) || unicode.Is(unicode.Cf, r):
+			// Drop control and invisible formatting runes (e.g. RTL overrides).
+			continue
+		case strings.ContainsRune(reservedNameChars, r):
+			b.WriteRune('_')
+		default:
+			b.WriteRune(r)
+		}
+	}
+
+	// Leading dots would hide the file from sync, trailing dots and spaces
+	// are stripped by Windows.
+	name = strings.TrimSpace(b.String())
+	name = strings.TrimLeft(name, ". ")
+	name = strings.TrimRight(name, ". ")
+
+	return truncateFileName(name, maxFileNameBytes)
+}
+
+// truncateFileName shortens name to at most max bytes, keeping the extension.
+func truncateFileName(name string, max int) string {
+	if len(name) <= max {
+		return name
+	}
+	ext := path.Ext(name)
+	if len(ext) >= max {
+		ext = ""
+	}
+	return strings.TrimSpace(truncateUTF8(strings.TrimSuffix(name, ext), max-len(ext))) + ext
+}
+
+// truncateUTF8 cuts s to at most max bytes without splitting a UTF-8 sequence.
+func truncateUTF8(s string, max int) string {
+	if len(s) <= max {
+		return s
+	}
+	for max > 0 && !utf8.RuneStart(s[max]) {
+		max--
+	}
+	return s[:max]
+}
+
+// sanitizeFolderPath normalizes a slash-separated folder path, sanitizing each
+// segment. ".." segments are rejected rather than resolved.
+func sanitizeFolderPath(p string) (string, error) {
+	p = strings.ReplaceAll(p, "\\", "/")
+	var segments []string
+	for _, seg := range strings.Split(p, "/") {
+		if seg == "" || seg == "." {
+			continue
+		}
+		if seg == ".." {
+			return "", fmt.Errorf("path traversal is not allowed")
+		}
+		clean := sanitizeFileName(seg)
+		if clean == "" {
+			return "", fmt.Errorf("invalid folder name %q", seg)
+		}
+		segments = append(segments, clean)
+	}
+	return strings.Join(segments, "/"), nil
+}
+
+// numberedFileName returns "name (n).ext", shortening name if the suffix would
+// push it over the length limit.
+func numberedFileName(name string, n int) string {
+	ext := path.Ext(name)
+	suffix := fmt.Sprintf(" (%d)", n)
+	base := truncateUTF8(strings.TrimSuffix(name, ext), maxFileNameBytes-len(ext)-len(suffix))
+	return base + suffix + ext
+}
@@ -0,0 +1,87 @@
+package handlers
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestSanitizeFileName(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"movie.mkv", "movie.mkv"},
+		{`C:\Users\me\Videos\clip.mp4`, "clip.mp4"},
+		{"../../etc/passwd", "passwd"},
+		{"a:b*c?.mp4", "a_b_c_.mp4"},
+		{"bad\x00\x1fname\u202e.mp4", "badname.mp4"},
+		{".hidden.mp4", "hidden.mp4"},
+		{"trailing. . ", "trailing"},
+		{"e\u0301te\u0301.mp3", "\u00e9t\u00e9.mp3"},
+		{"...", ""},
+		{"\u200b", ""},
+	}
+	for _, tt := range tests {
+		if got := sanitizeFileName(tt.in); got != tt.want {
+			t.Errorf("sanitizeFileName(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+
+	long := sanitizeFileName(strings.Repeat("é", 200) + ".mkv")
+	if len(long) > maxFileNameBytes || !strings.HasSuffix(long, ".mkv") {
+		t.Errorf("long name sanitized to %d bytes %q, want at most %d ending in .mkv", len(long), long, maxFileNameBytes)
+	}
+}
+
+func TestSanitizeFolderPath(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    string
+		wantErr bool
+	}{
+		{"", "", false},
+		{"/Movies//Heat (1995)/", "Movies/Heat (1995)", false},
+		{`Shows\Lost\.`, "Shows/Lost", false},
+		{"Movies/../secret", "", true},
+		{"Movies/...", "", true},
+	}
+	for _, tt := range tests {
+		got, err := sanitizeFolderPath(tt.in)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("sanitizeFolderPath(%q) = %q, %v, want %q, error %v", tt.in, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestNumberedFileName(t *testing.T) {
+	tests := []struct {
+		name string
+		n    int
+		want string
+	}{
+		{"movie.mkv", 1, "movie (1).mkv"},
+		{"movie.tar.gz", 12, "movie.tar (12).gz"},
+		{"README", 2, "README (2)"},
+	}
+	for _, tt := range tests {
+		if got := numberedFileName(tt.name, tt.n); got != tt.want {
+			t.Errorf("numberedFileName(%q, %d) = %q, want %q", tt.name, tt.n, got, tt.want)
+		}
+	}
+
+	long := strings.Repeat("a", maxFileNameBytes-4) + ".mkv"
+	got := numberedFileName(long, 3)
+	if len(got) != maxFileNameBytes || !strings.HasSuffix(got, " (3).mkv") {
+		t.Errorf("numberedFileName of a %d-byte name = %q (%d bytes), want %d bytes ending in \" (3).mkv\"",
+			len(long), got, len(got), maxFileNameBytes)
+	}
+}
+
+func TestObjectTakenClaimed(t *testing.T) {
+	// Keys written earlier in the request are taken without asking the DB.
+	taken, err := objectTaken(context.Background(), "Movies/a.mkv", map[string]bool{"Movies/a.mkv": true})
+	if err != nil || !taken {
+		t.Errorf("objectTaken of a claimed key = %v, %v, want true", taken, err)
+	}
+}
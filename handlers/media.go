@@ -1,16 +1,26 @@
 package handlers
 
 import (
+	"context"
 	"database/sql"
+	"errors"
+	"fmt"
+	"io"
 	"log"
 	"media-server/config"
+	"media-server/mediatype"
+	dbstore "media-server/storage"
 	"net/http"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
 )
 
 var db *sql.DB
@@ -27,7 +37,139 @@ func SetR2Client(client *s3.Client) {
 }
 
 
-// ListMedia is updated to use PG placeholders and the correct URL prefix trim.
+const (
+	defaultPageSize = 100
+	maxPageSize     = 500
+)
+
+// sortColumn is an orderable files_table expression and the SQL type cursor
+// values are cast to when compared against it.
+type sortColumn struct {
+	expr string
+	cast string
+}
+
+// mediaSortColumns maps the `sort` parameter of /media to its column.
+var mediaSortColumns = map[string]sortColumn{
+	"name":       {"f.name", "text"},
+	"size":       {"f.size", "bigint"},
+	"created_at": {"f.created_at", "timestamp"},
+	"duration":   {"COALESCE(f.duration, 0)", "double precision"},
+}
+
+// mediaTypeExtensions maps the `type` filter of /media to file extensions.
+var mediaTypeExtensions = map[string][]string{
+	"video": dbstore.VideoExtensions,
+	"audio": dbstore.AudioExtensions,
+	"image": dbstore.ImageExtensions,
+}
+
+// mediaFileColumns are the files_table columns (aliased as f) read by
+// scanMediaFile.
+const mediaFileColumns = `f.id, f.name, f.size, f.url, f.type, f.created_at, f.thumbnail_url, f.subtitle_url, f.duration, f.width, f.height, f.preview_url, f.thumbnail_source, f.display_url`
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+// mediaFile is a files_table row as listed by /media.
+type mediaFile struct {
+	ID              int64
+	Name            string
+	Size            int64
+	URL             string
+	Type            string
+	CreatedAt       time.Time
+	ThumbnailURL    sql.NullString
+	SubtitleURL     sql.NullString
+	Duration        sql.NullFloat64
+	Width           sql.NullInt64
+	Height          sql.NullInt64
+	PreviewURL      sql.NullString
+	ThumbnailSource string
+	DisplayURL      sql.NullString
+}
+
+// scanMediaFile reads a row selected with mediaFileColumns, followed by the
+// columns scanned into extra.
+func scanMediaFile(row rowScanner, extra ...any) (*mediaFile, error) {
+	var f mediaFile
+	dest := []any{&f.ID, &f.Name, &f.Size, &f.URL, &f.Type, &f.CreatedAt,
+		&f.ThumbnailURL, &f.SubtitleURL, &f.Duration, &f.Width, &f.Height, &f.PreviewURL, &f.ThumbnailSource, &f.DisplayURL}
+	err := row.Scan(append(dest, extra...)...)
+	if err != nil {
+		return nil, err
+	}
+	return &f, nil
+}
+
+// entry renders the file in the JSON shape shared by the listing endpoints.
+func (f *mediaFile) entry() gin.H {
+	entry := gin.H{
+		"id":               f.ID,
+		"name":             f.Name,
+		"size":             f.Size,
+		"path":             strings.TrimPrefix(f.URL, config.CloudflarePublicDevURL+"/"), // This is the object key, used for other API calls
+		"type":             f.Type,
+		"url":              f.URL,
+		"created_at":       f.CreatedAt,
+		"thumbnail_url":    f.ThumbnailURL.String, // Will be "" if NULL
+		"subtitle_url":     f.SubtitleURL.String,  // Will be "" if NULL
+		"preview_url":      f.PreviewURL.String,   // Will be "" if NULL
+		"thumbnail_source": f.ThumbnailSource,
+	}
+	if f.Duration.Valid {
+		entry["duration"] = f.Duration.Float64
+	}
+	if f.Width.Valid && f.Height.Valid {
+		entry["width"] = f.Width.Int64
+		entry["height"] = f.Height.Int64
+	}
+	if f.DisplayURL.Valid {
+		// Browsers can't show the original, e.g. a HEIC photo.
+		entry["display_url"] = f.DisplayURL.String
+	}
+	return entry
+}
+
+// sortValue returns the value of the sort column as stored in a cursor.
+func (f *mediaFile) sortValue(sort string) string {
+	switch sort {
+	case "size":
+		return strconv.FormatInt(f.Size, 10)
+	case "created_at":
+		return f.CreatedAt.Format(time.RFC3339Nano)
+	case "duration":
+		return strconv.FormatFloat(f.Duration.Float64, 'g', -1, 64)
+	default:
+		return f.Name
+	}
+}
+
+// parseSortValue parses a cursor value written by sortValue (or the rank of
+// a search result), so that a tampered cursor is rejected instead of failing
+// the cast in the query.
+func parseSortValue(sort, value string) (any, error) {
+	switch sort {
+	case "size":
+		return strconv.ParseInt(value, 10, 64)
+	case "created_at":
+		return time.Parse(time.RFC3339Nano, value)
+	case "duration":
+		return strconv.ParseFloat(value, 64)
+	case "rank":
+		return strconv.ParseFloat(value, 32)
+	default:
+		return value, nil
+	}
+}
+
+// ListMedia lists a folder: its subfolders on the first page, then its files
+// one page at a time.
+//
+// Query parameters: path, sort (name|size|created_at|duration), order
+// (asc|desc), limit, cursor, type (video,audio,image), min_size, max_size,
+// from and to (RFC 3339 or YYYY-MM-DD, applied to created_at).
 func ListMedia(c *gin.Context) {
 	if db == nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "DB not initialized"})
@@ -35,88 +177,314 @@ func ListMedia(c *gin.Context) {
 	}
 
 	subPath := c.Query("path")
-	// ... (path cleaning logic is the same)
 	if strings.Contains(subPath, "..") {
-         c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid Path, Not Allowed"})
-         return
-     }
-     subPath = filepath.ToSlash(filepath.Clean(subPath))
-     if subPath == "." || subPath == string(filepath.Separator){
-         subPath = ""
-     }
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid Path, Not Allowed"})
+		return
+	}
+	subPath = filepath.ToSlash(filepath.Clean(subPath))
+	if subPath == "." || subPath == "/" {
+		subPath = ""
+	}
+
+	// Paging and sorting
+	sort := c.DefaultQuery("sort", "name")
+	column, ok := mediaSortColumns[sort]
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid sort, expected name, size, created_at or duration"})
+		return
+	}
+	order := strings.ToLower(c.DefaultQuery("order", "asc"))
+	if order != "asc" && order != "desc" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid order, expected asc or desc"})
+		return
+	}
+	limit, err := parseLimit(c.Query("limit"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid limit"})
+		return
+	}
+	var cursor *pageCursor
+	var cursorValue any
+	if raw := c.Query("cursor"); raw != "" {
+		p, err := decodeCursor(raw)
+		if err == nil {
+			cursorValue, err = parseSortValue(p.Sort, p.Value)
+		}
+		if err != nil || p.Sort != sort || p.Order != order {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid cursor for this sort order"})
+			return
+		}
+		cursor = &p
+	}
 
 	var folderID int64
-    // Use $1 for PostgreSQL
-	err := db.QueryRow("SELECT id FROM folders_table WHERE path = $1", subPath).Scan(&folderID)
+	err = db.QueryRow("SELECT id FROM folders_table WHERE path = $1", subPath).Scan(&folderID)
 	if err != nil {
-		// ... (error handling is the same)
 		c.JSON(http.StatusNotFound, gin.H{"error": "Folder not Found"})
 		return
 	}
 
-	// Query subfolders (use $1)
-	folders := []string{}
-	rows, err := db.Query("SELECT name FROM folders_table WHERE parent = $1 AND name != ''", folderID)
-    // ... (rest of folder logic is the same)
+	// Build the file query from the filters; hidden files are sidecars
+	// already attached to a video.
+	where := []string{"f.parent = $1", "NOT f.hidden"}
+	args := []any{folderID}
+	arg := func(v any) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+
+	if types := c.Query("type"); types != "" {
+		var exts []string
+		for _, t := range strings.Split(types, ",") {
+			list, ok := mediaTypeExtensions[strings.TrimSpace(t)]
+			if !ok {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid type, expected video, audio or image"})
+				return
+			}
+			exts = append(exts, list...)
+		}
+		where = append(where, "LOWER(f.type) = ANY("+arg(pq.Array(exts))+")")
+	}
+	for param, op := range map[string]string{"min_size": ">=", "max_size": "<="} {
+		if v := c.Query(param); v != "" {
+			size, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || size < 0 {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid " + param})
+				return
+			}
+			where = append(where, "f.size "+op+" "+arg(size))
+		}
+	}
+	if v := c.Query("from"); v != "" {
+		from, _, err := parseTimeParam(v)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid from date"})
+			return
+		}
+		where = append(where, "f.created_at >= "+arg(from))
+	}
+	if v := c.Query("to"); v != "" {
+		to, dateOnly, err := parseTimeParam(v)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid to date"})
+			return
+		}
+		if dateOnly {
+			// A bare date includes the whole day.
+			where = append(where, "f.created_at < "+arg(to.AddDate(0, 0, 1)))
+		} else {
+			where = append(where, "f.created_at <= "+arg(to))
+		}
+	}
+
+	cmp := ">"
+	if order == "desc" {
+		cmp = "<"
+	}
+	if cursor != nil {
+		where = append(where, fmt.Sprintf("(%s, f.id) %s (CAST(%s AS %s), %s)",
+			column.expr, cmp, arg(cursorValue), column.cast, arg(cursor.ID)))
+	}
+
+	query := fmt.Sprintf(`
+		SELECT %s
+		FROM files_table f
+		WHERE %s
+		ORDER BY %s %s, f.id %s
+		LIMIT %s`,
+		mediaFileColumns, strings.Join(where, " AND "), column.expr, order, order, arg(limit+1))
+
+	rows, err := db.Query(query, args...)
 	if err != nil {
-		log.Printf("Error querying subfolders for folder %d: %v", folderID, err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to query subfolders"})
+		log.Printf("Error querying files for folder %d: %v", folderID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to query files"})
 		return
 	}
 	defer rows.Close()
+
+	files := []gin.H{}
+	var last *mediaFile
+	hasMore := false
 	for rows.Next() {
-		var name string
-		if err := rows.Scan(&name); err != nil {
-			log.Printf("Error scanning folder name: %v", err)
+		if len(files) == limit {
+			hasMore = true
+			break
+		}
+		f, err := scanMediaFile(rows)
+		if err != nil {
+			log.Printf("Error Scanning file in folder %d: %v", folderID, err)
 			continue
 		}
-		folders = append(folders, name)
+		files = append(files, f.entry())
+		last = f
 	}
+	if err := rows.Err(); err != nil {
+		log.Printf("Error reading files for folder %d: %v", folderID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to query files"})
+		return
+	}
+	addFileDetails(c.Request.Context(), files)
 
+	var nextCursor *string
+	if hasMore && last != nil {
+		next := pageCursor{Sort: sort, Order: order, Value: last.sortValue(sort), ID: last.ID}.encode()
+		nextCursor = &next
+	}
 
-	// Query Files (use $1)
-	files := []gin.H{}
-	rows, err = db.Query(`
-        SELECT name, size, url, type, created_at, thumbnail_url, subtitle_url 
-        FROM files_table WHERE parent = $1
-    `, folderID)
-    if err != nil {
-        log.Printf("Error querying files for folder %d: %v", folderID, err)
-        c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to query files"})
-        return
-    }
-    defer rows.Close()
+	// Subfolders are only listed on the first page.
+	folders := []gin.H{}
+	if cursor == nil {
+		folders, err = listSubfolders(folderID)
+		if err != nil {
+			log.Printf("Error querying subfolders for folder %d: %v", folderID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to query subfolders"})
+			return
+		}
+		addSidecarMetadata(c.Request.Context(), folders, true)
+	}
+	folder := gin.H{"id": folderID, "path": subPath}
+	addSidecarMetadata(c.Request.Context(), []gin.H{folder}, true)
+
+	c.JSON(http.StatusOK, gin.H{
+		"folder":      folder,
+		"folders":     folders,
+		"files":       files,
+		"next_cursor": nextCursor,
+	})
+}
+
+// addFileDetails adds what lives outside files_table to entries rendered with
+// mediaFile.entry, so every file listing has the same shape.
+func addFileDetails(ctx context.Context, entries []gin.H) {
+	addThumbnailSources(ctx, entries)
+	addExif(ctx, entries)
+	addSidecarMetadata(ctx, entries, false)
+}
+
+// listSubfolders returns the direct subfolders of a folder with their number
+// of direct children and the total size of every file beneath them. Hidden
+// files count towards neither.
+func listSubfolders(folderID int64) ([]gin.H, error) {
+	rows, err := db.Query(`
+		WITH children AS (
+			SELECT id, name, path FROM folders_table WHERE parent = $1 AND name != ''
+		)
+		SELECT c.id, c.name, c.path, COALESCE(files.n, 0) + COALESCE(subs.n, 0), COALESCE(sizes.total, 0)
+		FROM children c
+		LEFT JOIN (
+			SELECT parent, COUNT(*) AS n FROM files_table
+			WHERE parent IN (SELECT id FROM children) AND NOT hidden
+			GROUP BY parent
+		) files ON files.parent = c.id
+		LEFT JOIN (
+			SELECT parent, COUNT(*) AS n FROM folders_table
+			WHERE parent IN (SELECT id FROM children)
+			GROUP BY parent
+		) subs ON subs.parent = c.id
+		LEFT JOIN (
+			SELECT c.id, SUM(f.size) AS total
+			FROM children c
+			-- Every path beginning with c.path || '/' sorts between it and
+			-- c.path || '0' ('0' follows '/'); this is the range a LIKE prefix
+			-- is planned as, but works for a per-row prefix and doesn't treat
+			-- '_' or '%' in folder names as wildcards.
+			JOIN folders_table p ON p.id = c.id
+				OR (p.path ~>=~ c.path || '/' AND p.path ~<~ c.path || '0')
+			JOIN files_table f ON f.parent = p.id AND NOT f.hidden
+			GROUP BY c.id
+		) sizes ON sizes.id = c.id
+		ORDER BY c.name
+	`, folderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
 
+	folders := []gin.H{}
 	for rows.Next() {
-		var name, url, typ string
-		var size int64 // Use int64 for BIGINT
-		var createdAt time.Time
-		var thumbnailURL, subtitleURL sql.NullString
-		if err := rows.Scan(&name, &size, &url, &typ, &createdAt, &thumbnailURL, &subtitleURL); err != nil {
-            log.Printf("Error Scanning file %s : %v", name, err)
-            continue
-        }
-        // The path is now derived by trimming the public R2 URL
-		path := strings.TrimPrefix(url, config.CloudflarePublicDevURL+"/")
-		files = append(files, gin.H{
+		var id, itemCount, totalSize int64
+		var name, path string
+		if err := rows.Scan(&id, &name, &path, &itemCount, &totalSize); err != nil {
+			log.Printf("Error scanning folder: %v", err)
+			continue
+		}
+		folders = append(folders, gin.H{
+			"id":         id,
 			"name":       name,
-			"size":       size,
-			"path":       path, // This is the object key, used for other API calls
-			"type":       typ,
-			"url" :       url,
-			"created_at": createdAt,
-			"thumbnail_url": thumbnailURL.String, // Will be "" if NULL
-            "subtitle_url":  subtitleURL.String,  // Will be "" if NULL
+			"path":       path,
+			"item_count": itemCount,
+			"total_size": totalSize,
 		})
 	}
-	// ... (error checking on rows.Err() is the same)
+	return folders, rows.Err()
+}
 
-	c.JSON(http.StatusOK, gin.H{
-		"folders": folders,
-		"files":   files,
-	})
+// addExif adds "exif" to listing entries of photos with EXIF metadata.
+func addExif(ctx context.Context, entries []gin.H) {
+	var ids []int64
+	for _, e := range entries {
+		ids = append(ids, e["id"].(int64))
+	}
+	if len(ids) == 0 {
+		return
+	}
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT file_id, camera_make, camera_model, lens, taken_at, taken_at_offset, latitude, longitude
+		FROM exif_table WHERE file_id = ANY($1)
+	`, pq.Array(ids))
+	if err != nil {
+		log.Printf("Failed to list EXIF metadata: %v", err)
+		return
+	}
+	defer rows.Close()
+	exif := map[int64]gin.H{}
+	for rows.Next() {
+		var id int64
+		var cameraMake, cameraModel, lens, offset sql.NullString
+		var takenAt sql.NullTime
+		var lat, lon sql.NullFloat64
+		if err := rows.Scan(&id, &cameraMake, &cameraModel, &lens, &takenAt, &offset, &lat, &lon); err != nil {
+			log.Printf("Failed to read EXIF metadata: %v", err)
+			return
+		}
+		e := gin.H{
+			"camera_make":  cameraMake.String,
+			"camera_model": cameraModel.String,
+			"lens":         lens.String,
+		}
+		if takenAt.Valid {
+			// The camera's wall-clock time, with its offset when known.
+			e["taken_at"] = takenAt.Time.Format("2006-01-02T15:04:05") + offset.String
+		}
+		if lat.Valid && lon.Valid {
+			e["latitude"] = lat.Float64
+			e["longitude"] = lon.Float64
+		}
+		exif[id] = e
+	}
+
+	for _, e := range entries {
+		if x, ok := exif[e["id"].(int64)]; ok {
+			e["exif"] = x
+		}
+	}
 }
 
+// parseLimit parses a page size, applying the default and maximum.
+func parseLimit(v string) (int, error) {
+	return boundedIntParam(v, defaultPageSize, maxPageSize)
+}
+
+// parseTimeParam accepts RFC 3339 timestamps or bare YYYY-MM-DD dates, and
+// reports which form was used.
+func parseTimeParam(v string) (time.Time, bool, error) {
+	if t, err := time.Parse("2006-01-02", v); err == nil {
+		return t, true, nil
+	}
+	t, err := time.Parse(time.RFC3339, v)
+	return t, false, err
+}
 
 // ServeMedia is now a redirector, not a file streamer.
 func ServeMedia(c *gin.Context) {
@@ -152,4 +520,49 @@ func ServeMedia(c *gin.Context) {
 	// Redirect the client to the public R2 URL
 	log.Printf("Redirecting client to: %s", dbURL)
 	c.Redirect(http.StatusFound, dbURL)
-}
\ No newline at end of file
+}
+
+// streamObject proxies an object from R2, passing the Range header through so
+// clients can seek. fileType is the extension the content type falls back to
+// when R2 only knows a generic one. Nothing is written when the object can't
+// be fetched.
+func streamObject(c *gin.Context, key, fileType string) error {
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(config.CloudflareR2BucketName),
+		Key:    aws.String(key),
+	}
+	if rng := c.GetHeader("Range"); rng != "" {
+		input.Range = aws.String(rng)
+	}
+	obj, err := r2Client.GetObject(c.Request.Context(), input)
+	var respErr *awshttp.ResponseError
+	if errors.As(err, &respErr) && respErr.HTTPStatusCode() == http.StatusRequestedRangeNotSatisfiable {
+		c.Status(http.StatusRequestedRangeNotSatisfiable)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer obj.Body.Close()
+
+	contentType := mediatype.ByExtension(fileType)
+	if obj.ContentType != nil && !mediatype.IsGeneric(*obj.ContentType) {
+		contentType = *obj.ContentType
+	}
+	header := c.Writer.Header()
+	header.Set("Content-Type", contentType)
+	header.Set("Accept-Ranges", "bytes")
+	if obj.ContentLength != nil {
+		header.Set("Content-Length", strconv.FormatInt(*obj.ContentLength, 10))
+	}
+	status := http.StatusOK
+	if obj.ContentRange != nil {
+		header.Set("Content-Range", *obj.ContentRange)
+		status = http.StatusPartialContent
+	}
+	c.Status(status)
+	if c.Request.Method != http.MethodHead {
+		io.Copy(c.Writer, obj.Body)
+	}
+	return nil
+}
@@ -0,0 +1,477 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// trackColumns are the tracks_table columns (aliased as t, with its artist as
+// ar and album as al) read by scanTrack after mediaFileColumns.
+const trackColumns = `t.title, t.artist_id, ar.name, t.album_id, al.title,
+	t.track_number, t.track_total, t.disc_number, t.disc_total, t.year, t.genre`
+
+// trackTables joins every table trackColumns and mediaFileColumns read.
+const trackTables = `tracks_table t
+	JOIN files_table f ON f.id = t.file_id AND NOT f.hidden
+	LEFT JOIN artists_table ar ON ar.id = t.artist_id
+	LEFT JOIN albums_table al ON al.id = t.album_id`
+
+// trackOrder sorts the tracks of an album.
+const trackOrder = `t.disc_number NULLS LAST, t.track_number NULLS LAST, lower(t.title), f.id`
+
+// scanTrack reads a row selected with mediaFileColumns and trackColumns into
+// a listing entry with a "track" object.
+func scanTrack(row rowScanner) (*mediaFile, gin.H, error) {
+	var title string
+	var artistID, albumID, trackNumber, trackTotal, discNumber, discTotal, year sql.NullInt64
+	var artist, album, genre sql.NullString
+	f, err := scanMediaFile(row, &title, &artistID, &artist, &albumID, &album,
+		&trackNumber, &trackTotal, &discNumber, &discTotal, &year, &genre)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	track := gin.H{"title": title}
+	for key, v := range map[string]sql.NullInt64{
+		"artist_id": artistID, "album_id": albumID,
+		"track_number": trackNumber, "track_total": trackTotal,
+		"disc_number": discNumber, "disc_total": discTotal, "year": year,
+	} {
+		if v.Valid {
+			track[key] = v.Int64
+		}
+	}
+	for key, v := range map[string]sql.NullString{"artist": artist, "album": album, "genre": genre} {
+		if v.Valid {
+			track[key] = v.String
+		}
+	}
+	entry := f.entry()
+	entry["track"] = track
+	return f, entry, nil
+}
+
+// albumQuery selects albums with at least one visible track, their artist,
+// track count, total duration, when their first track was added and the
+// thumbnail of their first track with one. %s is the WHERE condition; ORDER BY and LIMIT go after it.
+const albumQuery = `
+	SELECT al.id, al.title, al.title_key, al.artist_id, ar.name, al.year,
+		COUNT(*), COALESCE(SUM(f.duration), 0), MIN(f.created_at),
+		(array_agg(f.thumbnail_url ORDER BY ` + trackOrder + `) FILTER (WHERE f.thumbnail_url IS NOT NULL))[1]
+	FROM albums_table al
+	JOIN tracks_table t ON t.album_id = al.id
+	JOIN files_table f ON f.id = t.file_id AND NOT f.hidden
+	LEFT JOIN artists_table ar ON ar.id = al.artist_id
+	WHERE %s
+	GROUP BY al.id, ar.name`
+
+// scanAlbum reads a row selected with albumQuery and returns its sort key.
+func scanAlbum(row rowScanner) (gin.H, string, error) {
+	var id int64
+	var title, titleKey string
+	var artistID, year sql.NullInt64
+	var artist, thumbnail sql.NullString
+	var tracks int64
+	var duration float64
+	var createdAt time.Time
+	err := row.Scan(&id, &title, &titleKey, &artistID, &artist, &year, &tracks, &duration, &createdAt, &thumbnail)
+	if err != nil {
+		return nil, "", err
+	}
+	album := gin.H{
+		"id":            id,
+		"title":         title,
+		"track_count":   tracks,
+		"duration":      duration,
+		"created_at":    createdAt,
+		"thumbnail_url": thumbnail.String, // Will be "" if NULL
+	}
+	if artistID.Valid {
+		album["artist_id"] = artistID.Int64
+		album["artist"] = artist.String
+	}
+	if year.Valid {
+		album["year"] = year.Int64
+	}
+	return album, titleKey, nil
+}
+
+// idParam parses the :id route parameter.
+func idParam(c *gin.Context) (int64, bool) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil || id < 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid id"})
+		return 0, false
+	}
+	return id, true
+}
+
+// ListArtists lists the artists of tracks or albums, by name, one page at a
+// time.
+//
+// Query parameters: q (substring of the name), limit, cursor.
+func ListArtists(c *gin.Context) {
+	if db == nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "DB not initialized"})
+		return
+	}
+	limit, err := parseLimit(c.Query("limit"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid limit"})
+		return
+	}
+
+	where := []string{`(EXISTS (SELECT 1 FROM tracks_table t JOIN files_table f ON f.id = t.file_id AND NOT f.hidden WHERE t.artist_id = a.id)
+		OR EXISTS (SELECT 1 FROM albums_table al JOIN tracks_table t ON t.album_id = al.id JOIN files_table f ON f.id = t.file_id AND NOT f.hidden
+			WHERE al.artist_id = a.id))`}
+	var args []any
+	arg := func(v any) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+	if q := strings.TrimSpace(c.Query("q")); q != "" {
+		where = append(where, "strpos(a.name_key, lower("+arg(q)+")) > 0")
+	}
+	if raw := c.Query("cursor"); raw != "" {
+		p, err := decodeCursor(raw)
+		if err != nil || p.Sort != "artist" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid cursor"})
+			return
+		}
+		where = append(where, fmt.Sprintf("(a.name_key, a.id) > (CAST(%s AS text), %s)", arg(p.Value), arg(p.ID)))
+	}
+
+	rows, err := db.QueryContext(c.Request.Context(), fmt.Sprintf(`
+		SELECT a.id, a.name, a.name_key,
+			(SELECT COUNT(*) FROM albums_table al WHERE al.artist_id = a.id
+				AND EXISTS (SELECT 1 FROM tracks_table t WHERE t.album_id = al.id)),
+			(SELECT COUNT(*) FROM tracks_table t WHERE t.artist_id = a.id)
+		FROM artists_table a
+		WHERE %s
+		ORDER BY a.name_key, a.id
+		LIMIT %s`, strings.Join(where, " AND "), arg(limit+1)), args...)
+	if err != nil {
+		log.Printf("Error querying artists: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to query artists"})
+		return
+	}
+	defer rows.Close()
+
+	artists := []gin.H{}
+	var next *string
+	var lastID int64
+	var lastKey string
+	for rows.Next() {
+		if len(artists) == limit {
+			cursor := pageCursor{Sort: "artist", Order: "asc", Value: lastKey, ID: lastID}.encode()
+			next = &cursor
+			break
+		}
+		var id, albums, tracks int64
+		var name, key string
+		if err := rows.Scan(&id, &name, &key, &albums, &tracks); err != nil {
+			log.Printf("Error scanning artist: %v", err)
+			continue
+		}
+		artists = append(artists, gin.H{"id": id, "name": name, "album_count": albums, "track_count": tracks})
+		lastID, lastKey = id, key
+	}
+	if err := rows.Err(); err != nil {
+		log.Printf("Error reading artists: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to query artists"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"artists": artists, "next_cursor": next})
+}
+
+// GetArtist returns an artist with their albums, oldest first, and the
+// tracks they perform that belong to no album.
+func GetArtist(c *gin.Context) {
+	if db == nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "DB not initialized"})
+		return
+	}
+	id, ok := idParam(c)
+	if !ok {
+		return
+	}
+
+	var name string
+	err := db.QueryRowContext(c.Request.Context(), "SELECT name FROM artists_table WHERE id = $1", id).Scan(&name)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Artist not found"})
+		return
+	}
+	if err != nil {
+		log.Printf("Error querying artist %d: %v", id, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to query artist"})
+		return
+	}
+
+	rows, err := db.QueryContext(c.Request.Context(),
+		fmt.Sprintf(albumQuery, "al.artist_id = $1")+" ORDER BY al.year NULLS LAST, al.title_key, al.id", id)
+	if err != nil {
+		log.Printf("Error querying albums of artist %d: %v", id, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to query albums"})
+		return
+	}
+	defer rows.Close()
+	albums := []gin.H{}
+	for rows.Next() {
+		album, _, err := scanAlbum(rows)
+		if err != nil {
+			log.Printf("Error scanning album: %v", err)
+			continue
+		}
+		albums = append(albums, album)
+	}
+	if err := rows.Err(); err != nil {
+		log.Printf("Error reading albums of artist %d: %v", id, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to query albums"})
+		return
+	}
+
+	singles, err := queryTracks(c, "t.artist_id = $1 AND t.album_id IS NULL ORDER BY lower(t.title), f.id", id)
+	if err != nil {
+		log.Printf("Error querying tracks of artist %d: %v", id, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to query tracks"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"artist": gin.H{"id": id, "name": name},
+		"albums": albums,
+		"tracks": singles,
+	})
+}
+
+// ListAlbums lists albums by title, one page at a time.
+//
+// Query parameters: artist_id, q (substring of the title), limit, cursor.
+func ListAlbums(c *gin.Context) {
+	if db == nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "DB not initialized"})
+		return
+	}
+	limit, err := parseLimit(c.Query("limit"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid limit"})
+		return
+	}
+
+	where := []string{"TRUE"}
+	var args []any
+	arg := func(v any) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+	if v := c.Query("artist_id"); v != "" {
+		artistID, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid artist_id"})
+			return
+		}
+		where = append(where, "al.artist_id = "+arg(artistID))
+	}
+	if q := strings.TrimSpace(c.Query("q")); q != "" {
+		where = append(where, "strpos(al.title_key, lower("+arg(q)+")) > 0")
+	}
+	if raw := c.Query("cursor"); raw != "" {
+		p, err := decodeCursor(raw)
+		if err != nil || p.Sort != "album" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid cursor"})
+			return
+		}
+		where = append(where, fmt.Sprintf("(al.title_key, al.id) > (CAST(%s AS text), %s)", arg(p.Value), arg(p.ID)))
+	}
+
+	query := fmt.Sprintf(albumQuery, strings.Join(where, " AND ")) + " ORDER BY al.title_key, al.id LIMIT " + arg(limit+1)
+	rows, err := db.QueryContext(c.Request.Context(), query, args...)
+	if err != nil {
+		log.Printf("Error querying albums: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to query albums"})
+		return
+	}
+	defer rows.Close()
+
+	albums := []gin.H{}
+	var next *string
+	var lastID int64
+	var lastKey string
+	for rows.Next() {
+		if len(albums) == limit {
+			cursor := pageCursor{Sort: "album", Order: "asc", Value: lastKey, ID: lastID}.encode()
+			next = &cursor
+			break
+		}
+		album, key, err := scanAlbum(rows)
+		if err != nil {
+			log.Printf("Error scanning album: %v", err)
+			continue
+		}
+		albums = append(albums, album)
+		lastID, lastKey = album["id"].(int64), key
+	}
+	if err := rows.Err(); err != nil {
+		log.Printf("Error reading albums: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to query albums"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"albums": albums, "next_cursor": next})
+}
+
+// GetAlbum returns an album with its tracks in disc and track order.
+func GetAlbum(c *gin.Context) {
+	if db == nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "DB not initialized"})
+		return
+	}
+	id, ok := idParam(c)
+	if !ok {
+		return
+	}
+
+	album, _, err := scanAlbum(db.QueryRowContext(c.Request.Context(), fmt.Sprintf(albumQuery, "al.id = $1"), id))
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Album not found"})
+		return
+	}
+	if err != nil {
+		log.Printf("Error querying album %d: %v", id, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to query album"})
+		return
+	}
+
+	tracks, err := queryTracks(c, "t.album_id = $1 ORDER BY "+trackOrder, id)
+	if err != nil {
+		log.Printf("Error querying tracks of album %d: %v", id, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to query tracks"})
+		return
+	}
+
+	album["tracks"] = tracks
+	c.JSON(http.StatusOK, album)
+}
+
+// queryTracks lists the tracks matching a WHERE condition followed by its
+// ORDER BY.
+func queryTracks(c *gin.Context, where string, args ...any) ([]gin.H, error) {
+	rows, err := db.QueryContext(c.Request.Context(),
+		"SELECT "+mediaFileColumns+", "+trackColumns+" FROM "+trackTables+" WHERE "+where, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tracks := []gin.H{}
+	for rows.Next() {
+		_, entry, err := scanTrack(rows)
+		if err != nil {
+			log.Printf("Error scanning track: %v", err)
+			continue
+		}
+		tracks = append(tracks, entry)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	addThumbnailSources(c.Request.Context(), tracks)
+	return tracks, nil
+}
+
+// ListTracks lists tracks by title, one page at a time.
+//
+// Query parameters: artist_id, album_id, genre, q (substring of the title),
+// limit, cursor.
+func ListTracks(c *gin.Context) {
+	if db == nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "DB not initialized"})
+		return
+	}
+	limit, err := parseLimit(c.Query("limit"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid limit"})
+		return
+	}
+
+	where := []string{"TRUE"}
+	var args []any
+	arg := func(v any) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+	for param, column := range map[string]string{"artist_id": "t.artist_id", "album_id": "t.album_id"} {
+		if v := c.Query(param); v != "" {
+			id, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid " + param})
+				return
+			}
+			where = append(where, column+" = "+arg(id))
+		}
+	}
+	if genre := strings.TrimSpace(c.Query("genre")); genre != "" {
+		where = append(where, "lower(t.genre) = lower("+arg(genre)+")")
+	}
+	if q := strings.TrimSpace(c.Query("q")); q != "" {
+		where = append(where, "strpos(lower(t.title), lower("+arg(q)+")) > 0")
+	}
+	if raw := c.Query("cursor"); raw != "" {
+		p, err := decodeCursor(raw)
+		if err != nil || p.Sort != "title" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid cursor"})
+			return
+		}
+		where = append(where, fmt.Sprintf("(lower(t.title), f.id) > (lower(CAST(%s AS text)), %s)", arg(p.Value), arg(p.ID)))
+	}
+
+	rows, err := db.QueryContext(c.Request.Context(), fmt.Sprintf(`
+		SELECT %s, %s
+		FROM %s
+		WHERE %s
+		ORDER BY lower(t.title), f.id
+		LIMIT %s`,
+		mediaFileColumns, trackColumns, trackTables, strings.Join(where, " AND "), arg(limit+1)), args...)
+	if err != nil {
+		log.Printf("Error querying tracks: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to query tracks"})
+		return
+	}
+	defer rows.Close()
+
+	tracks := []gin.H{}
+	var next *string
+	var last *mediaFile
+	var lastTitle string
+	for rows.Next() {
+		if len(tracks) == limit {
+			cursor := pageCursor{Sort: "title", Order: "asc", Value: lastTitle, ID: last.ID}.encode()
+			next = &cursor
+			break
+		}
+		f, entry, err := scanTrack(rows)
+		if err != nil {
+			log.Printf("Error scanning track: %v", err)
+			continue
+		}
+		tracks = append(tracks, entry)
+		last, lastTitle = f, entry["track"].(gin.H)["title"].(string)
+	}
+	if err := rows.Err(); err != nil {
+		log.Printf("Error reading tracks: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to query tracks"})
+		return
+	}
+	addThumbnailSources(c.Request.Context(), tracks)
+
+	c.JSON(http.StatusOK, gin.H{"tracks": tracks, "next_cursor": next})
+}
@@ -0,0 +1,367 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"encoding/xml"
+	"fmt"
+	"log"
+	"media-server/config"
+	"media-server/mediatype"
+	"media-server/middleware"
+	dbstore "media-server/storage"
+	"net/http"
+	"net/url"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+)
+
+// maxFeedItems bounds the episodes listed in a feed, newest first.
+const maxFeedItems = 500
+
+// rssFeed is an RSS 2.0 document with the iTunes podcast extensions.
+type rssFeed struct {
+	XMLName xml.Name   `xml:"rss"`
+	Version string     `xml:"version,attr"`
+	ITunes  string     `xml:"xmlns:itunes,attr"`
+	Channel rssChannel `xml:"channel"`
+}
+
+type rssChannel struct {
+	Title          string       `xml:"title"`
+	Link           string       `xml:"link"`
+	Description    string       `xml:"description"`
+	LastBuildDate  string       `xml:"lastBuildDate,omitempty"`
+	Image          *rssImage    `xml:"image,omitempty"`
+	ITunesImage    *itunesImage `xml:"itunes:image,omitempty"`
+	ITunesExplicit string       `xml:"itunes:explicit"`
+	Items          []rssItem    `xml:"item"`
+}
+
+type rssImage struct {
+	URL   string `xml:"url"`
+	Title string `xml:"title"`
+	Link  string `xml:"link"`
+}
+
+type itunesImage struct {
+	Href string `xml:"href,attr"`
+}
+
+type rssItem struct {
+	Title          string       `xml:"title"`
+	GUID           rssGUID      `xml:"guid"`
+	PubDate        string       `xml:"pubDate"`
+	Enclosure      rssEnclosure `xml:"enclosure"`
+	ITunesAuthor   string       `xml:"itunes:author,omitempty"`
+	ITunesDuration string       `xml:"itunes:duration,omitempty"`
+	ITunesImage    *itunesImage `xml:"itunes:image,omitempty"`
+}
+
+type rssGUID struct {
+	IsPermaLink bool   `xml:"isPermaLink,attr"`
+	Value       string `xml:",chardata"`
+}
+
+type rssEnclosure struct {
+	URL    string `xml:"url,attr"`
+	Length int64  `xml:"length,attr"`
+	Type   string `xml:"type,attr"`
+}
+
+// publicBaseURL is the URL podcast apps reach this server at: PUBLIC_BASE_URL,
+// or the scheme and host of the request behind a proxy or not.
+func publicBaseURL(c *gin.Context) string {
+	if config.PublicBaseURL != "" {
+		return config.PublicBaseURL
+	}
+	scheme := "http"
+	if c.Request.TLS != nil {
+		scheme = "https"
+	}
+	if proto := c.GetHeader("X-Forwarded-Proto"); proto != "" {
+		scheme = strings.TrimSpace(strings.Split(proto, ",")[0])
+	}
+	return scheme + "://" + c.Request.Host
+}
+
+// feedURL is the subscription URL of a feed.
+func feedURL(base string, feed *dbstore.Feed) string {
+	return base + "/feeds/" + feed.Token + "/rss"
+}
+
+// feedEntry renders a feed with its subscription URL.
+func feedEntry(c *gin.Context, feed *dbstore.Feed) gin.H {
+	return gin.H{
+		"id":         feed.ID,
+		"folder_id":  feed.FolderID,
+		"path":       feed.Path,
+		"title":      feed.Title,
+		"url":        feedURL(publicBaseURL(c), feed),
+		"created_at": feed.CreatedAt,
+	}
+}
+
+// formatITunesDuration formats seconds as H:MM:SS.
+func formatITunesDuration(seconds float64) string {
+	s := int64(seconds + 0.5)
+	return fmt.Sprintf("%d:%02d:%02d", s/3600, s/60%60, s%60)
+}
+
+// ListFeeds lists the podcast feeds of the current user.
+func ListFeeds(c *gin.Context) {
+	if db == nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "DB not initialized"})
+		return
+	}
+	feeds, err := dbstore.ListFeeds(c.Request.Context(), db, middleware.UserID(c))
+	if err != nil {
+		log.Printf("Error listing feeds: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list feeds"})
+		return
+	}
+	entries := make([]gin.H, len(feeds))
+	for i := range feeds {
+		entries[i] = feedEntry(c, &feeds[i])
+	}
+	c.JSON(http.StatusOK, gin.H{"feeds": entries})
+}
+
+// CreateFeedRequest is the body of POST /feeds.
+type CreateFeedRequest struct {
+	Path  string `json:"path"`
+	Title string `json:"title"`
+}
+
+// CreateFeed creates a podcast feed of a folder for the current user. The
+// returned URL carries the feed's token, so it works in apps that can't send
+// an Authorization header; deleting the feed revokes it.
+func CreateFeed(c *gin.Context) {
+	if db == nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "DB not initialized"})
+		return
+	}
+	var req CreateFeedRequest
+	if err := c.ShouldBindJSON(&req); err != nil || strings.Contains(req.Path, "..") {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid feed request"})
+		return
+	}
+	folderPath := filepath.ToSlash(filepath.Clean(req.Path))
+	if folderPath == "." || folderPath == "/" {
+		folderPath = ""
+	}
+
+	var folderID int64
+	err := db.QueryRow("SELECT id FROM folders_table WHERE path = $1", folderPath).Scan(&folderID)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Folder not Found"})
+		return
+	}
+	if err != nil {
+		log.Printf("Error looking up folder %s: %v", folderPath, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "DB error"})
+		return
+	}
+
+	feed, err := dbstore.CreateFeed(c.Request.Context(), db, middleware.UserID(c), folderID, strings.TrimSpace(req.Title))
+	if err != nil {
+		log.Printf("Error creating feed of folder %d: %v", folderID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create feed"})
+		return
+	}
+	c.JSON(http.StatusCreated, feedEntry(c, feed))
+}
+
+// DeleteFeed revokes a podcast feed of the current user.
+func DeleteFeed(c *gin.Context) {
+	if db == nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "DB not initialized"})
+		return
+	}
+	id, ok := idParam(c)
+	if !ok {
+		return
+	}
+	found, err := dbstore.DeleteFeed(c.Request.Context(), db, middleware.UserID(c), id)
+	if err != nil {
+		log.Printf("Error deleting feed %d: %v", id, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete feed"})
+		return
+	}
+	if !found {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Feed not found"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": fmt.Sprintf("Feed %d revoked", id)})
+}
+
+// feedFromToken looks up the feed of the :token parameter and writes an
+// error response when there is none.
+func feedFromToken(c *gin.Context) (*dbstore.Feed, bool) {
+	if db == nil {
+		c.String(http.StatusInternalServerError, "DB not initialized")
+		return nil, false
+	}
+	feed, err := dbstore.FeedByToken(c.Request.Context(), db, c.Param("token"))
+	if err == sql.ErrNoRows {
+		c.String(http.StatusNotFound, "Feed not found")
+		return nil, false
+	}
+	if err != nil {
+		log.Printf("Error looking up feed: %v", err)
+		c.String(http.StatusInternalServerError, "DB error")
+		return nil, false
+	}
+	return feed, true
+}
+
+// GetFeed renders the RSS document of a feed: the audio and video files
+// directly in its folder, newest first, as episodes. Enclosures point at
+// GetFeedMedia under the same token.
+func GetFeed(c *gin.Context) {
+	feed, ok := feedFromToken(c)
+	if !ok {
+		return
+	}
+	base := publicBaseURL(c)
+	items, err := feedItems(c.Request.Context(), base, feed)
+	if err != nil {
+		log.Printf("Error listing episodes of feed %d: %v", feed.ID, err)
+		c.String(http.StatusInternalServerError, "Failed to query episodes")
+		return
+	}
+
+	title := feed.Title
+	if title == "" {
+		title = path.Base("/" + feed.Path)
+		if title == "/" {
+			title = "Library"
+		}
+	}
+	channel := rssChannel{
+		Title:          title,
+		Link:           feedURL(base, feed),
+		Description:    "Audio and video files in /" + feed.Path,
+		ITunesExplicit: "false",
+		Items:          items,
+	}
+	if len(items) > 0 {
+		channel.LastBuildDate = items[0].PubDate
+	}
+	// The artwork of the newest episode that has one stands for the show.
+	for _, item := range items {
+		if item.ITunesImage != nil {
+			channel.Image = &rssImage{URL: item.ITunesImage.Href, Title: title, Link: channel.Link}
+			channel.ITunesImage = item.ITunesImage
+			break
+		}
+	}
+
+	out, err := xml.MarshalIndent(rssFeed{
+		Version: "2.0",
+		ITunes:  "http://www.itunes.com/dtds/podcast-1.0.dtd",
+		Channel: channel,
+	}, "", "  ")
+	if err != nil {
+		log.Printf("Error encoding feed %d: %v", feed.ID, err)
+		c.String(http.StatusInternalServerError, "Failed to encode feed")
+		return
+	}
+	c.Data(http.StatusOK, "application/rss+xml; charset=utf-8", append([]byte(xml.Header), out...))
+}
+
+// feedItems lists the episodes of a feed.
+func feedItems(ctx context.Context, base string, feed *dbstore.Feed) ([]rssItem, error) {
+	exts := append(append([]string{}, dbstore.AudioExtensions...), dbstore.VideoExtensions...)
+	rows, err := db.QueryContext(ctx, `
+		SELECT f.id, f.name, f.size, f.type, f.created_at, f.duration, f.thumbnail_url, t.title, ar.name
+		FROM files_table f
+		LEFT JOIN tracks_table t ON t.file_id = f.id
+		LEFT JOIN artists_table ar ON ar.id = t.artist_id
+		WHERE f.parent = $1 AND NOT f.hidden AND LOWER(f.type) = ANY($2)
+		ORDER BY f.created_at DESC, f.id DESC
+		LIMIT $3
+	`, feed.FolderID, pq.Array(exts), maxFeedItems)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	items := []rssItem{}
+	for rows.Next() {
+		var id, size int64
+		var name, fileType string
+		var createdAt time.Time
+		var duration sql.NullFloat64
+		var thumbnailURL, title, artist sql.NullString
+		if err := rows.Scan(&id, &name, &size, &fileType, &createdAt, &duration, &thumbnailURL, &title, &artist); err != nil {
+			return nil, err
+		}
+		item := rssItem{
+			Title:   strings.TrimSuffix(name, path.Ext(name)),
+			GUID:    rssGUID{Value: fmt.Sprintf("media-server-file-%d", id)},
+			PubDate: createdAt.UTC().Format(time.RFC1123Z),
+			Enclosure: rssEnclosure{
+				URL:    fmt.Sprintf("%s/feeds/%s/media/%d/%s", base, feed.Token, id, url.PathEscape(name)),
+				Length: size,
+				Type:   mediatype.ByExtension(fileType),
+			},
+			ITunesAuthor: artist.String,
+		}
+		if title.String != "" {
+			item.Title = title.String
+		}
+		if duration.Valid {
+			item.ITunesDuration = formatITunesDuration(duration.Float64)
+		}
+		if thumbnailURL.Valid {
+			item.ITunesImage = &itunesImage{Href: thumbnailURL.String}
+		}
+		items = append(items, item)
+	}
+	return items, rows.Err()
+}
+
+// GetFeedMedia streams an episode of a feed. Only files directly in the
+// feed's folder are served; the trailing file name is there for apps that
+// guess the format from the URL and is ignored.
+func GetFeedMedia(c *gin.Context) {
+	feed, ok := feedFromToken(c)
+	if !ok {
+		return
+	}
+	if r2Client == nil {
+		c.String(http.StatusInternalServerError, "Storage not initialized")
+		return
+	}
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil || id < 1 {
+		c.String(http.StatusBadRequest, "Invalid episode id")
+		return
+	}
+
+	var fileURL, fileType string
+	err = db.QueryRowContext(c.Request.Context(),
+		"SELECT url, type FROM files_table WHERE id = $1 AND parent = $2 AND NOT hidden", id, feed.FolderID).Scan(&fileURL, &fileType)
+	if err == sql.ErrNoRows || (err == nil && !dbstore.IsAudioFile(fileType) && !dbstore.IsVideoFile(fileType)) {
+		c.String(http.StatusNotFound, "Episode not found")
+		return
+	}
+	if err != nil {
+		log.Printf("Error querying file %d: %v", id, err)
+		c.String(http.StatusInternalServerError, "DB error")
+		return
+	}
+
+	key := strings.TrimPrefix(fileURL, config.CloudflarePublicDevURL+"/")
+	if err := streamObject(c, key, fileType); err != nil {
+		log.Printf("Failed to fetch file %d from R2: %v", id, err)
+		c.String(http.StatusNotFound, "Episode not found in storage")
+	}
+}
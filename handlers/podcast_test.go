@@ -0,0 +1,67 @@
+package handlers
+
+import (
+	"crypto/tls"
+	"media-server/config"
+	dbstore "media-server/storage"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestFormatITunesDuration(t *testing.T) {
+	tests := []struct {
+		seconds float64
+		want    string
+	}{
+		{0, "0:00:00"},
+		{59.4, "0:00:59"},
+		{59.5, "0:01:00"},
+		{3599, "0:59:59"},
+		{3723, "1:02:03"},
+		{36000, "10:00:00"},
+	}
+	for _, tt := range tests {
+		if got := formatITunesDuration(tt.seconds); got != tt.want {
+			t.Errorf("formatITunesDuration(%v) = %q, want %q", tt.seconds, got, tt.want)
+		}
+	}
+}
+
+func TestPublicBaseURL(t *testing.T) {
+	defer func(u string) { config.PublicBaseURL = u }(config.PublicBaseURL)
+
+	tests := []struct {
+		name       string
+		configured string
+		tls        bool
+		proto      string
+		want       string
+	}{
+		{"plain", "", false, "", "http://media.example:8080"},
+		{"tls", "", true, "", "https://media.example:8080"},
+		{"behind a proxy", "", false, "https", "https://media.example:8080"},
+		{"behind proxies", "", false, " https , http", "https://media.example:8080"},
+		{"configured", "https://podcasts.example", false, "http", "https://podcasts.example"},
+	}
+	for _, tt := range tests {
+		config.PublicBaseURL = tt.configured
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request = httptest.NewRequest("GET", "http://media.example:8080/feeds/x/rss", nil)
+		if tt.tls {
+			c.Request.TLS = &tls.ConnectionState{}
+		}
+		if tt.proto != "" {
+			c.Request.Header.Set("X-Forwarded-Proto", tt.proto)
+		}
+		if got := publicBaseURL(c); got != tt.want {
+			t.Errorf("%s: publicBaseURL = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+
+	feed := &dbstore.Feed{Token: "abc"}
+	if got, want := feedURL("https://podcasts.example", feed), "https://podcasts.example/feeds/abc/rss"; got != want {
+		t.Errorf("feedURL = %q, want %q", got, want)
+	}
+}
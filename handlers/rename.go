@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"log"
 	"media-server/config"
+	dbstore "media-server/storage"
 	"net/http"
 	"path/filepath"
 	"strings"
@@ -98,6 +99,12 @@ func RenameFile(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "DB update failed"})
 		return
 	}
+	if err := dbstore.RefreshSearchDocument(db, fileID); err != nil {
+		log.Printf("Search index update failed: %v", err)
+	}
+	if err := dbstore.RecognizeMedia(c.Request.Context(), db, fileID, newKey); err != nil {
+		log.Printf("Failed to recognize %s: %v", newKey, err)
+	}
 
 	c.JSON(http.StatusOK, gin.H{
 		"status":  "renamed",
@@ -0,0 +1,375 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"media-server/config"
+	dbstore "media-server/storage"
+	"media-server/vtt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// maxSearchFolders caps the folder matches returned with the first page.
+const maxSearchFolders = 20
+
+// searchHeadlineOptions configures the <mark>-highlighted snippets.
+const searchHeadlineOptions = "StartSel=<mark>, StopSel=</mark>, MaxFragments=2, MaxWords=12, MinWords=3"
+
+// escapeHTMLSQL wraps a SQL text expression so it is HTML-escaped before
+// ts_headline adds its <mark> tags. Highlights are then safe to render as
+// HTML even when a file name or cue contains markup.
+func escapeHTMLSQL(expr string) string {
+	return fmt.Sprintf(`replace(replace(replace(replace(%s, '&', '&amp;'), '<', '&lt;'), '>', '&gt;'), '"', '&quot;')`, expr)
+}
+
+// Search finds files across the whole library by name, folder path, tags and
+// probed metadata, ranked by relevance.
+//
+// Query parameters: q, limit, cursor.
+func Search(c *gin.Context) {
+	if db == nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "DB not initialized"})
+		return
+	}
+
+	q := strings.TrimSpace(c.Query("q"))
+	if q == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Missing search query"})
+		return
+	}
+	limit, err := parseLimit(c.Query("limit"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid limit"})
+		return
+	}
+	var cursor *pageCursor
+	var cursorRank any
+	if raw := c.Query("cursor"); raw != "" {
+		p, err := decodeCursor(raw)
+		if err == nil {
+			cursorRank, err = parseSortValue("rank", p.Value)
+		}
+		if err != nil || p.Sort != "rank" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid cursor"})
+			return
+		}
+		cursor = &p
+	}
+
+	// Full-text matches always count; fuzzy matching catches partial words
+	// and typos when pg_trgm is installed.
+	match := "f.search_vector @@ query"
+	rank := "ts_rank(f.search_vector, query)"
+	if dbstore.TrigramSearch {
+		match += " OR $1 <% f.search_document"
+		rank += " + word_similarity($1, f.search_document)"
+	} else {
+		match += " OR strpos(lower(f.search_document), lower($1)) > 0"
+	}
+
+	args := []any{q}
+	arg := func(v any) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+
+	pageFilter := ""
+	if cursor != nil {
+		pageFilter = fmt.Sprintf("WHERE (rank, id) < (CAST(%s AS real), %s)", arg(cursorRank), arg(cursor.ID))
+	}
+
+	// Page the matches first so that only the returned rows are highlighted.
+	query := fmt.Sprintf(`
+		SELECT %s, p.rank,
+			ts_headline('simple', %s, websearch_to_tsquery('simple', $1), '%s') AS highlight
+		FROM (
+			SELECT * FROM (
+				SELECT f.id, CAST(%s AS real) AS rank
+				FROM files_table f, websearch_to_tsquery('simple', $1) query
+				WHERE NOT f.hidden AND (%s)
+			) s
+			%s
+			ORDER BY rank DESC, id DESC
+			LIMIT %s
+		) p
+		JOIN files_table f ON f.id = p.id
+		ORDER BY p.rank DESC, p.id DESC`,
+		mediaFileColumns, escapeHTMLSQL("COALESCE(f.search_document, f.name)"), searchHeadlineOptions, rank, match, pageFilter, arg(limit+1))
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		log.Printf("Error searching for %q: %v", q, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Search failed"})
+		return
+	}
+	defer rows.Close()
+
+	files := []gin.H{}
+	var next *string
+	var lastRank float32
+	var lastID int64
+	for rows.Next() {
+		if len(files) == limit {
+			cursor := pageCursor{Sort: "rank", Order: "desc", Value: strconv.FormatFloat(float64(lastRank), 'g', -1, 32), ID: lastID}.encode()
+			next = &cursor
+			break
+		}
+		var highlight string
+		f, err := scanMediaFile(rows, &lastRank, &highlight)
+		if err != nil {
+			log.Printf("Error scanning search result: %v", err)
+			continue
+		}
+		lastID = f.ID
+
+		entry := f.entry()
+		entry["rank"] = lastRank
+		entry["highlight"] = highlight
+		files = append(files, entry)
+	}
+	if err := rows.Err(); err != nil {
+		log.Printf("Error reading search results for %q: %v", q, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Search failed"})
+		return
+	}
+	addFileDetails(c.Request.Context(), files)
+
+	// Matching folders are only returned with the first page.
+	folders := []gin.H{}
+	if cursor == nil {
+		folders, err = searchFolders(q)
+		if err != nil {
+			log.Printf("Error searching folders for %q: %v", q, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Search failed"})
+			return
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"query":       q,
+		"folders":     folders,
+		"files":       files,
+		"next_cursor": next,
+	})
+}
+
+// searchFolders returns folders whose path contains q, shallowest first.
+func searchFolders(q string) ([]gin.H, error) {
+	match := "strpos(lower(path), lower($1)) > 0"
+	if dbstore.TrigramSearch {
+		match += " OR $1 <% path"
+	}
+	rows, err := db.Query(fmt.Sprintf(`
+		SELECT id, name, path FROM folders_table
+		WHERE name != '' AND (%s)
+		ORDER BY length(path), path
+		LIMIT %d
+	`, match, maxSearchFolders), q)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	folders := []gin.H{}
+	for rows.Next() {
+		var id int64
+		var name, path string
+		if err := rows.Scan(&id, &name, &path); err != nil {
+			log.Printf("Error scanning folder: %v", err)
+			continue
+		}
+		folders = append(folders, gin.H{"id": id, "name": name, "path": path})
+	}
+	return folders, rows.Err()
+}
+
+// TagsRequest is the body of PUT /media/tags.
+type TagsRequest struct {
+	Tags []string `json:"tags"`
+}
+
+// SetTags replaces the tags of the file at ?path=, which are indexed by search.
+func SetTags(c *gin.Context) {
+	if db == nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "DB not initialized"})
+		return
+	}
+
+	path := c.Query("path")
+	if path == "" || strings.Contains(path, "..") {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid path"})
+		return
+	}
+	var req TagsRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid tags"})
+		return
+	}
+
+	var fileID int64
+	err := db.QueryRow("SELECT id FROM files_table WHERE url = $1", config.CloudflarePublicDevURL+"/"+path).Scan(&fileID)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
+		return
+	}
+	if err != nil {
+		log.Printf("Error looking up %s: %v", path, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to query file"})
+		return
+	}
+
+	tags, err := dbstore.SetFileTags(db, fileID, req.Tags)
+	if err != nil {
+		log.Printf("Error setting tags of %s: %v", path, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save tags"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"path": path, "tags": tags})
+}
+
+const (
+	defaultDialogueFiles = 20
+	maxDialogueFiles     = 100
+	defaultCuesPerFile   = 5
+	maxCuesPerFile       = 50
+)
+
+// SearchDialogue finds videos whose subtitles contain the query and returns
+// the matching cues with timestamps, so the player can jump to the scene.
+//
+// Query parameters: q, limit (videos), cues (cues per video), lang (only
+// search subtitle tracks in this language).
+func SearchDialogue(c *gin.Context) {
+	if db == nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "DB not initialized"})
+		return
+	}
+
+	q := strings.TrimSpace(c.Query("q"))
+	if q == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Missing search query"})
+		return
+	}
+	limit, err := boundedIntParam(c.Query("limit"), defaultDialogueFiles, maxDialogueFiles)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid limit"})
+		return
+	}
+	perFile, err := boundedIntParam(c.Query("cues"), defaultCuesPerFile, maxCuesPerFile)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid cues"})
+		return
+	}
+	lang := ""
+	if v := c.Query("lang"); v != "" {
+		lang = dbstore.NormalizeLanguage(v)
+	}
+
+	// Rank cues per file, keep the best files and their best cues, then
+	// return those cues in playback order. Only the returned cues are
+	// highlighted.
+	rows, err := db.Query(`
+		WITH hits AS (
+			SELECT c.file_id, c.start_ms, c.end_ms, c.track_id, c.text,
+				COALESCE(t.language, 'und') AS language,
+				ts_rank(c.text_vector, query) AS rank
+			FROM subtitle_cues_table c
+			CROSS JOIN websearch_to_tsquery('simple', $1) query
+			LEFT JOIN subtitle_tracks_table t ON t.id = c.track_id
+			WHERE c.text_vector @@ query AND ($4 = '' OR t.language = $4)
+		),
+		ranked AS (
+			SELECT h.*,
+				row_number() OVER (PARTITION BY h.file_id ORDER BY h.rank DESC, h.start_ms) AS n,
+				count(*) OVER (PARTITION BY h.file_id) AS matches,
+				max(h.rank) OVER (PARTITION BY h.file_id) AS file_rank
+			FROM hits h
+		),
+		top_files AS (
+			SELECT file_id FROM ranked
+			GROUP BY file_id
+			ORDER BY max(file_rank) DESC, max(matches) DESC, file_id
+			LIMIT $2
+		)
+		SELECT `+mediaFileColumns+`, r.matches, r.file_rank, r.start_ms, r.end_ms, r.track_id, r.language,
+			ts_headline('simple', `+escapeHTMLSQL("r.text")+`, websearch_to_tsquery('simple', $1), 'StartSel=<mark>, StopSel=</mark>, HighlightAll=true')
+		FROM ranked r
+		JOIN top_files t ON t.file_id = r.file_id
+		JOIN files_table f ON f.id = r.file_id
+		WHERE r.n <= $3
+		ORDER BY r.file_rank DESC, r.matches DESC, f.id, r.start_ms
+	`, q, limit, perFile, lang)
+	if err != nil {
+		log.Printf("Error searching dialogue for %q: %v", q, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Dialogue search failed"})
+		return
+	}
+	defer rows.Close()
+
+	results := []gin.H{}
+	var current gin.H
+	var currentID int64
+	for rows.Next() {
+		var matches, startMS, endMS int64
+		var rank float32
+		var trackID *int64
+		var language, highlight string
+		f, err := scanMediaFile(rows, &matches, &rank, &startMS, &endMS, &trackID, &language, &highlight)
+		if err != nil {
+			log.Printf("Error scanning dialogue result: %v", err)
+			continue
+		}
+
+		if current == nil || f.ID != currentID {
+			current = f.entry()
+			current["rank"] = rank
+			current["match_count"] = matches
+			current["cues"] = []gin.H{}
+			currentID = f.ID
+			results = append(results, current)
+		}
+
+		start := float64(startMS) / 1000
+		current["cues"] = append(current["cues"].([]gin.H), gin.H{
+			"start":     start,
+			"end":       float64(endMS) / 1000,
+			"timestamp": vtt.FormatTimestamp(time.Duration(startMS) * time.Millisecond),
+			"text":      highlight,
+			"track_id":  trackID,
+			"language":  language,
+			// Media fragment URL that starts playback at the cue.
+			"deep_link": fmt.Sprintf("%s#t=%.3f", f.URL, start),
+		})
+	}
+	if err := rows.Err(); err != nil {
+		log.Printf("Error reading dialogue results for %q: %v", q, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Dialogue search failed"})
+		return
+	}
+	addFileDetails(c.Request.Context(), results)
+
+	c.JSON(http.StatusOK, gin.H{
+		"query":   q,
+		"results": results,
+	})
+}
+
+// boundedIntParam parses a positive integer parameter, applying a default and
+// a maximum.
+func boundedIntParam(v string, def, max int) (int, error) {
+	if v == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 1 {
+		return 0, fmt.Errorf("invalid value %q", v)
+	}
+	return min(n, max), nil
+}
@@ -0,0 +1,533 @@
+package handlers
+
+import (
+	"crypto/md5"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"log"
+	"media-server/middleware"
+	dbstore "media-server/storage"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// subsonicAPIVersion is the Subsonic REST API version implemented under /rest.
+const subsonicAPIVersion = "1.16.1"
+
+// Subsonic error codes.
+const (
+	subsonicErrGeneric          = 0
+	subsonicErrMissingParameter = 10
+	subsonicErrWrongCredentials = 40
+	subsonicErrInvalidAPIKey    = 44
+	subsonicErrNotAuthorized    = 50
+	subsonicErrNotFound         = 70
+)
+
+// subsonicResponse is the envelope of every /rest response. It is written as
+// XML, or as JSON when the client asks for f=json.
+type subsonicResponse struct {
+	XMLName      xml.Name `xml:"subsonic-response" json:"-"`
+	Xmlns        string   `xml:"xmlns,attr" json:"-"`
+	Status       string   `xml:"status,attr" json:"status"`
+	Version      string   `xml:"version,attr" json:"version"`
+	Type         string   `xml:"type,attr" json:"type"`
+	OpenSubsonic bool     `xml:"openSubsonic,attr" json:"openSubsonic"`
+
+	Error                  *subsonicError           `xml:"error,omitempty" json:"error,omitempty"`
+	License                *subsonicLicense         `xml:"license,omitempty" json:"license,omitempty"`
+	OpenSubsonicExtensions []subsonicExtension      `xml:"openSubsonicExtensions,omitempty" json:"openSubsonicExtensions,omitempty"`
+	MusicFolders           *subsonicMusicFolders    `xml:"musicFolders,omitempty" json:"musicFolders,omitempty"`
+	Indexes                *subsonicIndexes         `xml:"indexes,omitempty" json:"indexes,omitempty"`
+	Directory              *subsonicDirectory       `xml:"directory,omitempty" json:"directory,omitempty"`
+	Artists                *subsonicArtists         `xml:"artists,omitempty" json:"artists,omitempty"`
+	Artist                 *subsonicArtistAlbums    `xml:"artist,omitempty" json:"artist,omitempty"`
+	Album                  *subsonicAlbumSongs      `xml:"album,omitempty" json:"album,omitempty"`
+	Song                   *subsonicChild           `xml:"song,omitempty" json:"song,omitempty"`
+	SearchResult3          *subsonicSearchResult    `xml:"searchResult3,omitempty" json:"searchResult3,omitempty"`
+	Playlists              *subsonicPlaylists       `xml:"playlists,omitempty" json:"playlists,omitempty"`
+	Playlist               *subsonicPlaylistEntries `xml:"playlist,omitempty" json:"playlist,omitempty"`
+}
+
+type subsonicError struct {
+	Code    int    `xml:"code,attr" json:"code"`
+	Message string `xml:"message,attr" json:"message"`
+}
+
+type subsonicLicense struct {
+	Valid bool `xml:"valid,attr" json:"valid"`
+}
+
+type subsonicExtension struct {
+	Name     string `xml:"name,attr" json:"name"`
+	Versions []int  `xml:"versions" json:"versions"`
+}
+
+// subsonicChild is a song or a directory.
+type subsonicChild struct {
+	ID          string `xml:"id,attr" json:"id"`
+	Parent      string `xml:"parent,attr,omitempty" json:"parent,omitempty"`
+	IsDir       bool   `xml:"isDir,attr" json:"isDir"`
+	Title       string `xml:"title,attr" json:"title"`
+	Album       string `xml:"album,attr,omitempty" json:"album,omitempty"`
+	Artist      string `xml:"artist,attr,omitempty" json:"artist,omitempty"`
+	Track       int    `xml:"track,attr,omitempty" json:"track,omitempty"`
+	DiscNumber  int    `xml:"discNumber,attr,omitempty" json:"discNumber,omitempty"`
+	Year        int    `xml:"year,attr,omitempty" json:"year,omitempty"`
+	Genre       string `xml:"genre,attr,omitempty" json:"genre,omitempty"`
+	CoverArt    string `xml:"coverArt,attr,omitempty" json:"coverArt,omitempty"`
+	Size        int64  `xml:"size,attr,omitempty" json:"size,omitempty"`
+	ContentType string `xml:"contentType,attr,omitempty" json:"contentType,omitempty"`
+	Suffix      string `xml:"suffix,attr,omitempty" json:"suffix,omitempty"`
+	Duration    int    `xml:"duration,attr,omitempty" json:"duration,omitempty"`
+	Path        string `xml:"path,attr,omitempty" json:"path,omitempty"`
+	Type        string `xml:"type,attr,omitempty" json:"type,omitempty"`
+	AlbumID     string `xml:"albumId,attr,omitempty" json:"albumId,omitempty"`
+	ArtistID    string `xml:"artistId,attr,omitempty" json:"artistId,omitempty"`
+	Created     string `xml:"created,attr,omitempty" json:"created,omitempty"`
+}
+
+type subsonicMusicFolders struct {
+	MusicFolder []subsonicMusicFolder `xml:"musicFolder" json:"musicFolder"`
+}
+
+type subsonicMusicFolder struct {
+	ID   int    `xml:"id,attr" json:"id"`
+	Name string `xml:"name,attr" json:"name"`
+}
+
+// subsonicIndexes lists the top-level folders by their first letter, and the
+// songs next to them.
+type subsonicIndexes struct {
+	LastModified    int64           `xml:"lastModified,attr" json:"lastModified"`
+	IgnoredArticles string          `xml:"ignoredArticles,attr" json:"ignoredArticles"`
+	Index           []subsonicIndex `xml:"index" json:"index,omitempty"`
+	Child           []subsonicChild `xml:"child" json:"child,omitempty"`
+}
+
+type subsonicIndex struct {
+	Name   string                `xml:"name,attr" json:"name"`
+	Artist []subsonicIndexFolder `xml:"artist" json:"artist"`
+}
+
+type subsonicIndexFolder struct {
+	ID   string `xml:"id,attr" json:"id"`
+	Name string `xml:"name,attr" json:"name"`
+}
+
+type subsonicDirectory struct {
+	ID     string          `xml:"id,attr" json:"id"`
+	Parent string          `xml:"parent,attr,omitempty" json:"parent,omitempty"`
+	Name   string          `xml:"name,attr" json:"name"`
+	Child  []subsonicChild `xml:"child" json:"child,omitempty"`
+}
+
+// subsonicArtists lists the artists of tags by their first letter.
+type subsonicArtists struct {
+	IgnoredArticles string                `xml:"ignoredArticles,attr" json:"ignoredArticles"`
+	Index           []subsonicArtistIndex `xml:"index" json:"index,omitempty"`
+}
+
+type subsonicArtistIndex struct {
+	Name   string           `xml:"name,attr" json:"name"`
+	Artist []subsonicArtist `xml:"artist" json:"artist"`
+}
+
+type subsonicArtist struct {
+	ID         string `xml:"id,attr" json:"id"`
+	Name       string `xml:"name,attr" json:"name"`
+	AlbumCount int    `xml:"albumCount,attr" json:"albumCount"`
+}
+
+type subsonicArtistAlbums struct {
+	subsonicArtist
+	Album []subsonicAlbum `xml:"album" json:"album,omitempty"`
+}
+
+type subsonicAlbum struct {
+	ID        string `xml:"id,attr" json:"id"`
+	Name      string `xml:"name,attr" json:"name"`
+	Artist    string `xml:"artist,attr,omitempty" json:"artist,omitempty"`
+	ArtistID  string `xml:"artistId,attr,omitempty" json:"artistId,omitempty"`
+	CoverArt  string `xml:"coverArt,attr,omitempty" json:"coverArt,omitempty"`
+	SongCount int    `xml:"songCount,attr" json:"songCount"`
+	Duration  int    `xml:"duration,attr" json:"duration"`
+	Created   string `xml:"created,attr" json:"created"`
+	Year      int    `xml:"year,attr,omitempty" json:"year,omitempty"`
+}
+
+type subsonicAlbumSongs struct {
+	subsonicAlbum
+	Song []subsonicChild `xml:"song" json:"song,omitempty"`
+}
+
+type subsonicSearchResult struct {
+	Artist []subsonicArtist `xml:"artist" json:"artist,omitempty"`
+	Album  []subsonicAlbum  `xml:"album" json:"album,omitempty"`
+	Song   []subsonicChild  `xml:"song" json:"song,omitempty"`
+}
+
+type subsonicPlaylists struct {
+	Playlist []subsonicPlaylist `xml:"playlist" json:"playlist,omitempty"`
+}
+
+type subsonicPlaylist struct {
+	ID        string `xml:"id,attr" json:"id"`
+	Name      string `xml:"name,attr" json:"name"`
+	Comment   string `xml:"comment,attr,omitempty" json:"comment,omitempty"`
+	Owner     string `xml:"owner,attr" json:"owner"`
+	Public    bool   `xml:"public,attr" json:"public"`
+	SongCount int    `xml:"songCount,attr" json:"songCount"`
+	Duration  int    `xml:"duration,attr" json:"duration"`
+	Created   string `xml:"created,attr" json:"created"`
+	Changed   string `xml:"changed,attr" json:"changed"`
+}
+
+type subsonicPlaylistEntries struct {
+	subsonicPlaylist
+	Entry []subsonicChild `xml:"entry" json:"entry,omitempty"`
+}
+
+// subsonicOK returns an empty successful response.
+func subsonicOK() *subsonicResponse {
+	return &subsonicResponse{Status: "ok"}
+}
+
+// subsonicFailure returns a failed response. Subsonic reports errors with a
+// 200 status.
+func subsonicFailure(code int, message string) *subsonicResponse {
+	return &subsonicResponse{Status: "failed", Error: &subsonicError{Code: code, Message: message}}
+}
+
+// subsonicID is the ID of an artist ("ar"), album ("al"), song ("tr"), folder
+// ("fo") or playlist ("pl") in Subsonic responses.
+func subsonicID(prefix string, id int64) string {
+	return prefix + "-" + strconv.FormatInt(id, 10)
+}
+
+// parseSubsonicID parses an ID made by subsonicID with the given prefix.
+func parseSubsonicID(v, prefix string) (int64, bool) {
+	num, ok := strings.CutPrefix(v, prefix+"-")
+	if !ok {
+		return 0, false
+	}
+	id, err := strconv.ParseInt(num, 10, 64)
+	return id, err == nil && id > 0
+}
+
+// subsonicTime formats a time the way Subsonic clients parse it.
+func subsonicTime(t time.Time) string {
+	return t.UTC().Format("2006-01-02T15:04:05.000Z")
+}
+
+// subsonicRequest is an authenticated call to a Subsonic method. Parameters
+// come from the query string or a form body.
+type subsonicRequest struct {
+	c        *gin.Context
+	form     url.Values
+	ownerID  string
+	username string
+}
+
+// param returns the first value of a parameter.
+func (r *subsonicRequest) param(name string) string {
+	return r.form.Get(name)
+}
+
+// id parses the required ID parameter with the given prefix.
+func (r *subsonicRequest) id(name, prefix string) (int64, *subsonicResponse) {
+	v := r.param(name)
+	if v == "" {
+		return 0, subsonicFailure(subsonicErrMissingParameter, "Required parameter is missing: "+name)
+	}
+	id, ok := parseSubsonicID(v, prefix)
+	if !ok {
+		return 0, subsonicFailure(subsonicErrNotFound, "Not found: "+v)
+	}
+	return id, nil
+}
+
+// intParam parses an optional non-negative integer parameter, capped at max.
+func (r *subsonicRequest) intParam(name string, def, max int) (int, *subsonicResponse) {
+	v := r.param(name)
+	if v == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		return 0, subsonicFailure(subsonicErrGeneric, "Invalid "+name)
+	}
+	return min(n, max), nil
+}
+
+// write sends a response in the format the client asked for.
+func (r *subsonicRequest) write(resp *subsonicResponse) {
+	resp.Xmlns = "http://subsonic.org/restapi"
+	resp.Version = subsonicAPIVersion
+	resp.Type = "media-server"
+	resp.OpenSubsonic = true
+	switch r.param("f") {
+	case "json":
+		r.c.JSON(http.StatusOK, gin.H{"subsonic-response": resp})
+	case "jsonp":
+		r.c.JSONP(http.StatusOK, gin.H{"subsonic-response": resp})
+	default:
+		r.c.XML(http.StatusOK, resp)
+	}
+}
+
+// authenticate identifies the user by an API token, sent as apiKey, as the
+// password (p, plain or "enc:"-hex-encoded) or, with token authentication,
+// as t = md5(token + s).
+func (r *subsonicRequest) authenticate() *subsonicResponse {
+	ctx := r.c.Request.Context()
+
+	var tokenID int64
+	if apiKey := r.param("apiKey"); apiKey != "" {
+		err := db.QueryRowContext(ctx, `
+			SELECT t.id, t.owner_id, u.username
+			FROM api_tokens_table t
+			JOIN subsonic_users_table u ON u.owner_id = t.owner_id
+			WHERE t.token = $1
+		`, apiKey).Scan(&tokenID, &r.ownerID, &r.username)
+		if err == sql.ErrNoRows {
+			return subsonicFailure(subsonicErrInvalidAPIKey, "Invalid API key")
+		}
+		if err != nil {
+			log.Printf("Error looking up API key: %v", err)
+			return subsonicFailure(subsonicErrGeneric, "Failed to check credentials")
+		}
+	} else {
+		username, password, token, salt := r.param("u"), r.param("p"), r.param("t"), r.param("s")
+		if username == "" || (password == "" && (token == "" || salt == "")) {
+			return subsonicFailure(subsonicErrMissingParameter, "Required parameter is missing: u and either p or t and s")
+		}
+		if encoded, ok := strings.CutPrefix(password, "enc:"); ok {
+			decoded, err := hex.DecodeString(encoded)
+			if err != nil {
+				return subsonicFailure(subsonicErrWrongCredentials, "Wrong username or password")
+			}
+			password = string(decoded)
+		}
+
+		rows, err := db.QueryContext(ctx, `
+			SELECT t.id, t.owner_id, t.token
+			FROM api_tokens_table t
+			JOIN subsonic_users_table u ON u.owner_id = t.owner_id
+			WHERE u.username = $1
+		`, username)
+		if err != nil {
+			log.Printf("Error looking up tokens of %s: %v", username, err)
+			return subsonicFailure(subsonicErrGeneric, "Failed to check credentials")
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var id int64
+			var ownerID, secret string
+			if err := rows.Scan(&id, &ownerID, &secret); err != nil {
+				log.Printf("Error scanning token: %v", err)
+				continue
+			}
+			if subsonicCredentialsMatch(secret, password, token, salt) {
+				tokenID, r.ownerID, r.username = id, ownerID, username
+				break
+			}
+		}
+		if err := rows.Err(); err != nil {
+			log.Printf("Error reading tokens of %s: %v", username, err)
+			return subsonicFailure(subsonicErrGeneric, "Failed to check credentials")
+		}
+		if tokenID == 0 {
+			return subsonicFailure(subsonicErrWrongCredentials, "Wrong username or password")
+		}
+	}
+
+	// Clients call on every track; once a minute is precise enough.
+	_, err := db.ExecContext(ctx, `
+		UPDATE api_tokens_table SET last_used_at = $1
+		WHERE id = $2 AND (last_used_at IS NULL OR last_used_at < $3)
+	`, time.Now(), tokenID, time.Now().Add(-time.Minute))
+	if err != nil {
+		log.Printf("Failed to record use of token %d: %v", tokenID, err)
+	}
+	return nil
+}
+
+// subsonicCredentialsMatch reports whether the password, or without one the
+// token t and salt s, prove knowledge of an API token's secret.
+func subsonicCredentialsMatch(secret, password, token, salt string) bool {
+	expected := secret
+	given := password
+	if password == "" {
+		sum := md5.Sum([]byte(secret + salt))
+		expected, given = hex.EncodeToString(sum[:]), strings.ToLower(token)
+	}
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(given)) == 1
+}
+
+// subsonicHandler implements a Subsonic method. It returns nil when it wrote
+// the response itself, e.g. a media stream.
+type subsonicHandler func(r *subsonicRequest) *subsonicResponse
+
+// subsonicMethods are the Subsonic methods served under /rest.
+var subsonicMethods = map[string]subsonicHandler{
+	"ping":              subsonicPing,
+	"getLicense":        subsonicGetLicense,
+	"getMusicFolders":   subsonicGetMusicFolders,
+	"getIndexes":        subsonicGetIndexes,
+	"getMusicDirectory": subsonicGetMusicDirectory,
+	"getArtists":        subsonicGetArtists,
+	"getArtist":         subsonicGetArtist,
+	"getAlbum":          subsonicGetAlbum,
+	"getSong":           subsonicGetSong,
+	"search3":           subsonicSearch3,
+	"stream":            subsonicStream,
+	"download":          subsonicStream,
+	"getCoverArt":       subsonicGetCoverArt,
+	"scrobble":          subsonicScrobble,
+	"getPlaylists":      subsonicGetPlaylists,
+	"getPlaylist":       subsonicGetPlaylist,
+	"createPlaylist":    subsonicCreatePlaylist,
+	"updatePlaylist":    subsonicUpdatePlaylist,
+	"deletePlaylist":    subsonicDeletePlaylist,
+}
+
+// Subsonic serves /rest/:method, with or without the .view suffix older
+// clients add, to Subsonic-compatible music apps.
+func Subsonic(c *gin.Context) {
+	r := &subsonicRequest{c: c}
+	if err := c.Request.ParseForm(); err != nil {
+		r.form = c.Request.URL.Query()
+		r.write(subsonicFailure(subsonicErrGeneric, "Invalid parameters"))
+		return
+	}
+	r.form = c.Request.Form
+
+	method := strings.TrimSuffix(c.Param("method"), ".view")
+	// Clients discover extensions before they know how to authenticate.
+	if method == "getOpenSubsonicExtensions" {
+		resp := subsonicOK()
+		resp.OpenSubsonicExtensions = []subsonicExtension{{Name: "apiKeyAuthentication", Versions: []int{1}}}
+		r.write(resp)
+		return
+	}
+	if db == nil || r2Client == nil {
+		r.write(subsonicFailure(subsonicErrGeneric, "Service not initialized"))
+		return
+	}
+	if resp := r.authenticate(); resp != nil {
+		r.write(resp)
+		return
+	}
+
+	handler, ok := subsonicMethods[method]
+	if !ok {
+		r.write(subsonicFailure(subsonicErrNotFound, "Unknown method: "+method))
+		return
+	}
+	if resp := handler(r); resp != nil {
+		r.write(resp)
+	}
+}
+
+func subsonicPing(r *subsonicRequest) *subsonicResponse {
+	return subsonicOK()
+}
+
+func subsonicGetLicense(r *subsonicRequest) *subsonicResponse {
+	resp := subsonicOK()
+	resp.License = &subsonicLicense{Valid: true}
+	return resp
+}
+
+// subsonicUsernamePattern restricts usernames to what fits in a URL unescaped.
+var subsonicUsernamePattern = regexp.MustCompile(`^[A-Za-z0-9._@-]{1,64}$`)
+
+// CreateAPITokenRequest is the body of POST /subsonic/tokens. Username is
+// only used for the first token; later ones keep it.
+type CreateAPITokenRequest struct {
+	Name     string `json:"name"`
+	Username string `json:"username"`
+}
+
+// ListAPITokens lists the Subsonic tokens of the current user.
+func ListAPITokens(c *gin.Context) {
+	if db == nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "DB not initialized"})
+		return
+	}
+	tokens, err := dbstore.ListAPITokens(c.Request.Context(), db, middleware.UserID(c))
+	if err != nil {
+		log.Printf("Error listing API tokens: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list tokens"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"tokens": tokens})
+}
+
+// CreateAPIToken creates a token the current user logs into Subsonic clients
+// with, as the password of their username. The token is only shown once.
+func CreateAPIToken(c *gin.Context) {
+	if db == nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "DB not initialized"})
+		return
+	}
+	var req CreateAPITokenRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid token request"})
+		return
+	}
+	if req.Username != "" && !subsonicUsernamePattern.MatchString(req.Username) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Usernames are 1 to 64 letters, digits or . _ @ -"})
+		return
+	}
+
+	token, err := dbstore.CreateAPIToken(c.Request.Context(), db, middleware.UserID(c), req.Username, strings.TrimSpace(req.Name))
+	if errors.Is(err, dbstore.ErrUsernameRequired) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "A username is required for the first token"})
+		return
+	}
+	if errors.Is(err, dbstore.ErrUsernameTaken) {
+		c.JSON(http.StatusConflict, gin.H{"error": "Username is taken"})
+		return
+	}
+	if err != nil {
+		log.Printf("Error creating API token: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create token"})
+		return
+	}
+	c.JSON(http.StatusCreated, token)
+}
+
+// DeleteAPIToken revokes a Subsonic token of the current user.
+func DeleteAPIToken(c *gin.Context) {
+	if db == nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "DB not initialized"})
+		return
+	}
+	id, ok := idParam(c)
+	if !ok {
+		return
+	}
+	found, err := dbstore.DeleteAPIToken(c.Request.Context(), db, middleware.UserID(c), id)
+	if err != nil {
+		log.Printf("Error deleting API token %d: %v", id, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete token"})
+		return
+	}
+	if !found {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Token not found"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": fmt.Sprintf("Token %d revoked", id)})
+}
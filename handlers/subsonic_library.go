@@ -0,0 +1,634 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"media-server/assets"
+	"media-server/config"
+	"media-server/mediatype"
+	dbstore "media-server/storage"
+	"net/http"
+	"path"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/lib/pq"
+)
+
+// subsonicSongColumns are read by scanSubsonicSong after mediaFileColumns.
+// Audio files that haven't been probed yet have no tracks_table row.
+const subsonicSongColumns = `f.parent, t.title, t.artist_id, ar.name, t.album_id, al.title,
+	t.track_number, t.disc_number, t.year, t.genre`
+
+// subsonicSongTables joins every table subsonicSongColumns and
+// mediaFileColumns read.
+const subsonicSongTables = `files_table f
+	LEFT JOIN tracks_table t ON t.file_id = f.id
+	LEFT JOIN artists_table ar ON ar.id = t.artist_id
+	LEFT JOIN albums_table al ON al.id = t.album_id`
+
+// subsonicSongOrder sorts the songs of a folder or album.
+const subsonicSongOrder = `t.disc_number NULLS LAST, t.track_number NULLS LAST, lower(COALESCE(t.title, f.name)), f.id`
+
+// subsonicFolderHasAudio holds for folders (aliased as fo) with a visible
+// audio file beneath them; $1 is the audio extensions.
+const subsonicFolderHasAudio = `EXISTS (
+	SELECT 1 FROM files_table f
+	JOIN folders_table p ON p.id = f.parent
+	WHERE NOT f.hidden AND LOWER(f.type) = ANY($1)
+		AND (p.path = fo.path OR starts_with(p.path, fo.path || '/')))`
+
+// scanSubsonicSong reads a row selected with mediaFileColumns and
+// subsonicSongColumns.
+func scanSubsonicSong(row rowScanner) (subsonicChild, error) {
+	var parent int64
+	var title, artist, album, genre sql.NullString
+	var artistID, albumID, track, disc, year sql.NullInt64
+	f, err := scanMediaFile(row, &parent, &title, &artistID, &artist, &albumID, &album, &track, &disc, &year, &genre)
+	if err != nil {
+		return subsonicChild{}, err
+	}
+
+	song := subsonicChild{
+		ID:          subsonicID("tr", f.ID),
+		Parent:      subsonicID("fo", parent),
+		Title:       title.String,
+		Album:       album.String,
+		Artist:      artist.String,
+		Track:       int(track.Int64),
+		DiscNumber:  int(disc.Int64),
+		Year:        int(year.Int64),
+		Genre:       genre.String,
+		Size:        f.Size,
+		ContentType: mediatype.ByExtension(f.Type),
+		Suffix:      strings.TrimPrefix(strings.ToLower(f.Type), "."),
+		Duration:    int(math.Round(f.Duration.Float64)),
+		Path:        strings.TrimPrefix(f.URL, config.CloudflarePublicDevURL+"/"),
+		Type:        "music",
+		Created:     subsonicTime(f.CreatedAt),
+	}
+	if !title.Valid {
+		song.Title = strings.TrimSuffix(f.Name, path.Ext(f.Name))
+	}
+	if artistID.Valid {
+		song.ArtistID = subsonicID("ar", artistID.Int64)
+	}
+	if albumID.Valid {
+		song.AlbumID = subsonicID("al", albumID.Int64)
+	}
+	if f.ThumbnailURL.Valid {
+		song.CoverArt = subsonicID("tr", f.ID)
+	}
+	return song, nil
+}
+
+// querySubsonicSongs lists the visible audio files matching a condition
+// followed by its ORDER BY. The condition's arguments start at $2.
+func querySubsonicSongs(ctx context.Context, where string, args ...any) ([]subsonicChild, error) {
+	rows, err := db.QueryContext(ctx,
+		"SELECT "+mediaFileColumns+", "+subsonicSongColumns+" FROM "+subsonicSongTables+
+			" WHERE NOT f.hidden AND LOWER(f.type) = ANY($1) AND "+where,
+		append([]any{pq.Array(dbstore.AudioExtensions)}, args...)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var songs []subsonicChild
+	for rows.Next() {
+		song, err := scanSubsonicSong(rows)
+		if err != nil {
+			log.Printf("Error scanning song: %v", err)
+			continue
+		}
+		songs = append(songs, song)
+	}
+	return songs, rows.Err()
+}
+
+// querySubsonicFolders lists, as directories, the folders matching a
+// condition that have audio beneath them. The condition's arguments start at
+// $2.
+func querySubsonicFolders(ctx context.Context, where string, args ...any) ([]subsonicChild, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT fo.id, fo.name, fo.parent, fo.created_at
+		FROM folders_table fo
+		WHERE fo.name != '' AND `+subsonicFolderHasAudio+` AND `+where+`
+		ORDER BY lower(fo.name), fo.id`,
+		append([]any{pq.Array(dbstore.AudioExtensions)}, args...)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var folders []subsonicChild
+	for rows.Next() {
+		var id int64
+		var name string
+		var parent sql.NullInt64
+		var createdAt time.Time
+		if err := rows.Scan(&id, &name, &parent, &createdAt); err != nil {
+			log.Printf("Error scanning folder: %v", err)
+			continue
+		}
+		folder := subsonicChild{ID: subsonicID("fo", id), IsDir: true, Title: name, Created: subsonicTime(createdAt)}
+		if parent.Valid {
+			folder.Parent = subsonicID("fo", parent.Int64)
+		}
+		folders = append(folders, folder)
+	}
+	return folders, rows.Err()
+}
+
+// subsonicIndexName is the index a name is listed under: its upper-cased
+// first letter, or # for names starting with anything else.
+func subsonicIndexName(name string) string {
+	for _, r := range name {
+		if unicode.IsLetter(r) {
+			return string(unicode.ToUpper(r))
+		}
+		return "#"
+	}
+	return "#"
+}
+
+// groupByIndex groups items by the index of their name, in index order,
+// keeping the order of items within an index.
+func groupByIndex[T any](items []T, name func(T) string) ([]string, map[string][]T) {
+	groups := map[string][]T{}
+	var names []string
+	for _, item := range items {
+		index := subsonicIndexName(name(item))
+		if _, ok := groups[index]; !ok {
+			names = append(names, index)
+		}
+		groups[index] = append(groups[index], item)
+	}
+	sort.Strings(names)
+	return names, groups
+}
+
+// subsonicGetMusicFolders lists the single music folder: the whole library.
+func subsonicGetMusicFolders(r *subsonicRequest) *subsonicResponse {
+	resp := subsonicOK()
+	resp.MusicFolders = &subsonicMusicFolders{MusicFolder: []subsonicMusicFolder{{ID: 1, Name: "Music"}}}
+	return resp
+}
+
+// subsonicGetIndexes lists the top-level folders with audio by their first
+// letter and the songs in the root folder. With ifModifiedSince, nothing is
+// listed unless audio was added since.
+func subsonicGetIndexes(r *subsonicRequest) *subsonicResponse {
+	ctx := r.c.Request.Context()
+
+	var rootID sql.NullInt64
+	var lastModified sql.NullTime
+	err := db.QueryRowContext(ctx, `
+		SELECT (SELECT id FROM folders_table WHERE path = '' AND name = ''),
+			(SELECT MAX(created_at) FROM files_table WHERE NOT hidden AND LOWER(type) = ANY($1))
+	`, pq.Array(dbstore.AudioExtensions)).Scan(&rootID, &lastModified)
+	if err != nil {
+		log.Printf("Error querying music root: %v", err)
+		return subsonicFailure(subsonicErrGeneric, "Failed to query folders")
+	}
+
+	indexes := &subsonicIndexes{}
+	if lastModified.Valid {
+		indexes.LastModified = lastModified.Time.UnixMilli()
+	}
+	resp := subsonicOK()
+	resp.Indexes = indexes
+	since, err := strconv.ParseInt(r.param("ifModifiedSince"), 10, 64)
+	if !rootID.Valid || (err == nil && since >= indexes.LastModified) {
+		return resp
+	}
+
+	folders, err := querySubsonicFolders(ctx, "fo.parent = $2", rootID.Int64)
+	if err != nil {
+		log.Printf("Error querying top-level folders: %v", err)
+		return subsonicFailure(subsonicErrGeneric, "Failed to query folders")
+	}
+	names, groups := groupByIndex(folders, func(f subsonicChild) string { return f.Title })
+	for _, name := range names {
+		index := subsonicIndex{Name: name}
+		for _, f := range groups[name] {
+			index.Artist = append(index.Artist, subsonicIndexFolder{ID: f.ID, Name: f.Title})
+		}
+		indexes.Index = append(indexes.Index, index)
+	}
+
+	indexes.Child, err = querySubsonicSongs(ctx, "f.parent = $2 ORDER BY "+subsonicSongOrder, rootID.Int64)
+	if err != nil {
+		log.Printf("Error querying root songs: %v", err)
+		return subsonicFailure(subsonicErrGeneric, "Failed to query songs")
+	}
+	return resp
+}
+
+// subsonicGetMusicDirectory lists the subfolders with audio and the songs of
+// a folder.
+func subsonicGetMusicDirectory(r *subsonicRequest) *subsonicResponse {
+	ctx := r.c.Request.Context()
+	id, fail := r.id("id", "fo")
+	if fail != nil {
+		return fail
+	}
+
+	var name string
+	var parent sql.NullInt64
+	err := db.QueryRowContext(ctx, "SELECT name, parent FROM folders_table WHERE id = $1", id).Scan(&name, &parent)
+	if err == sql.ErrNoRows {
+		return subsonicFailure(subsonicErrNotFound, "Directory not found")
+	}
+	if err != nil {
+		log.Printf("Error querying folder %d: %v", id, err)
+		return subsonicFailure(subsonicErrGeneric, "Failed to query directory")
+	}
+
+	dir := &subsonicDirectory{ID: subsonicID("fo", id), Name: name}
+	if parent.Valid {
+		dir.Parent = subsonicID("fo", parent.Int64)
+	} else {
+		dir.Name = "Music"
+	}
+	folders, err := querySubsonicFolders(ctx, "fo.parent = $2", id)
+	if err != nil {
+		log.Printf("Error querying subfolders of %d: %v", id, err)
+		return subsonicFailure(subsonicErrGeneric, "Failed to query directory")
+	}
+	songs, err := querySubsonicSongs(ctx, "f.parent = $2 ORDER BY "+subsonicSongOrder, id)
+	if err != nil {
+		log.Printf("Error querying songs of folder %d: %v", id, err)
+		return subsonicFailure(subsonicErrGeneric, "Failed to query directory")
+	}
+	dir.Child = append(folders, songs...)
+
+	resp := subsonicOK()
+	resp.Directory = dir
+	return resp
+}
+
+// subsonicArtistQuery selects the artists of visible tracks or albums with
+// the number of their albums that have visible tracks. %s is the WHERE
+// condition; ORDER BY and LIMIT go after it.
+const subsonicArtistQuery = `
+	SELECT a.id, a.name,
+		(SELECT COUNT(*) FROM albums_table al WHERE al.artist_id = a.id AND EXISTS (
+			SELECT 1 FROM tracks_table t JOIN files_table f ON f.id = t.file_id AND NOT f.hidden
+			WHERE t.album_id = al.id))
+	FROM artists_table a
+	WHERE (EXISTS (SELECT 1 FROM tracks_table t JOIN files_table f ON f.id = t.file_id AND NOT f.hidden WHERE t.artist_id = a.id)
+		OR EXISTS (SELECT 1 FROM albums_table al JOIN tracks_table t ON t.album_id = al.id JOIN files_table f ON f.id = t.file_id AND NOT f.hidden
+			WHERE al.artist_id = a.id))
+		AND %s`
+
+// querySubsonicArtists lists the artists selected with subsonicArtistQuery.
+func querySubsonicArtists(ctx context.Context, where string, args ...any) ([]subsonicArtist, error) {
+	rows, err := db.QueryContext(ctx, fmt.Sprintf(subsonicArtistQuery, where), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var artists []subsonicArtist
+	for rows.Next() {
+		var id int64
+		var a subsonicArtist
+		if err := rows.Scan(&id, &a.Name, &a.AlbumCount); err != nil {
+			log.Printf("Error scanning artist: %v", err)
+			continue
+		}
+		a.ID = subsonicID("ar", id)
+		artists = append(artists, a)
+	}
+	return artists, rows.Err()
+}
+
+// scanSubsonicAlbum reads a row selected with albumQuery.
+func scanSubsonicAlbum(row rowScanner) (subsonicAlbum, error) {
+	var id int64
+	var title, titleKey string
+	var artistID, year sql.NullInt64
+	var artist, thumbnail sql.NullString
+	var tracks int
+	var duration float64
+	var createdAt time.Time
+	err := row.Scan(&id, &title, &titleKey, &artistID, &artist, &year, &tracks, &duration, &createdAt, &thumbnail)
+	if err != nil {
+		return subsonicAlbum{}, err
+	}
+	album := subsonicAlbum{
+		ID:        subsonicID("al", id),
+		Name:      title,
+		Artist:    artist.String,
+		SongCount: tracks,
+		Duration:  int(math.Round(duration)),
+		Created:   subsonicTime(createdAt),
+		Year:      int(year.Int64),
+	}
+	if artistID.Valid {
+		album.ArtistID = subsonicID("ar", artistID.Int64)
+	}
+	if thumbnail.Valid {
+		album.CoverArt = album.ID
+	}
+	return album, nil
+}
+
+// querySubsonicAlbums lists the albums selected with albumQuery.
+func querySubsonicAlbums(ctx context.Context, query string, args ...any) ([]subsonicAlbum, error) {
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var albums []subsonicAlbum
+	for rows.Next() {
+		album, err := scanSubsonicAlbum(rows)
+		if err != nil {
+			log.Printf("Error scanning album: %v", err)
+			continue
+		}
+		albums = append(albums, album)
+	}
+	return albums, rows.Err()
+}
+
+// subsonicGetArtists lists the artists of tags by their first letter.
+func subsonicGetArtists(r *subsonicRequest) *subsonicResponse {
+	artists, err := querySubsonicArtists(r.c.Request.Context(), "TRUE ORDER BY a.name_key, a.id")
+	if err != nil {
+		log.Printf("Error querying artists: %v", err)
+		return subsonicFailure(subsonicErrGeneric, "Failed to query artists")
+	}
+
+	result := &subsonicArtists{}
+	names, groups := groupByIndex(artists, func(a subsonicArtist) string { return a.Name })
+	for _, name := range names {
+		result.Index = append(result.Index, subsonicArtistIndex{Name: name, Artist: groups[name]})
+	}
+	resp := subsonicOK()
+	resp.Artists = result
+	return resp
+}
+
+// subsonicGetArtist returns an artist with their albums, oldest first.
+func subsonicGetArtist(r *subsonicRequest) *subsonicResponse {
+	ctx := r.c.Request.Context()
+	id, fail := r.id("id", "ar")
+	if fail != nil {
+		return fail
+	}
+
+	artists, err := querySubsonicArtists(ctx, "a.id = $1", id)
+	if err != nil {
+		log.Printf("Error querying artist %d: %v", id, err)
+		return subsonicFailure(subsonicErrGeneric, "Failed to query artist")
+	}
+	if len(artists) == 0 {
+		return subsonicFailure(subsonicErrNotFound, "Artist not found")
+	}
+	albums, err := querySubsonicAlbums(ctx,
+		fmt.Sprintf(albumQuery, "al.artist_id = $1")+" ORDER BY al.year NULLS LAST, al.title_key, al.id", id)
+	if err != nil {
+		log.Printf("Error querying albums of artist %d: %v", id, err)
+		return subsonicFailure(subsonicErrGeneric, "Failed to query albums")
+	}
+
+	resp := subsonicOK()
+	resp.Artist = &subsonicArtistAlbums{subsonicArtist: artists[0], Album: albums}
+	return resp
+}
+
+// subsonicGetAlbum returns an album with its songs in disc and track order.
+func subsonicGetAlbum(r *subsonicRequest) *subsonicResponse {
+	ctx := r.c.Request.Context()
+	id, fail := r.id("id", "al")
+	if fail != nil {
+		return fail
+	}
+
+	album, err := scanSubsonicAlbum(db.QueryRowContext(ctx, fmt.Sprintf(albumQuery, "al.id = $1"), id))
+	if err == sql.ErrNoRows {
+		return subsonicFailure(subsonicErrNotFound, "Album not found")
+	}
+	if err != nil {
+		log.Printf("Error querying album %d: %v", id, err)
+		return subsonicFailure(subsonicErrGeneric, "Failed to query album")
+	}
+	songs, err := querySubsonicSongs(ctx, "t.album_id = $2 ORDER BY "+subsonicSongOrder, id)
+	if err != nil {
+		log.Printf("Error querying songs of album %d: %v", id, err)
+		return subsonicFailure(subsonicErrGeneric, "Failed to query songs")
+	}
+
+	resp := subsonicOK()
+	resp.Album = &subsonicAlbumSongs{subsonicAlbum: album, Song: songs}
+	return resp
+}
+
+// subsonicGetSong returns a single song.
+func subsonicGetSong(r *subsonicRequest) *subsonicResponse {
+	id, fail := r.id("id", "tr")
+	if fail != nil {
+		return fail
+	}
+	songs, err := querySubsonicSongs(r.c.Request.Context(), "f.id = $2", id)
+	if err != nil {
+		log.Printf("Error querying song %d: %v", id, err)
+		return subsonicFailure(subsonicErrGeneric, "Failed to query song")
+	}
+	if len(songs) == 0 {
+		return subsonicFailure(subsonicErrNotFound, "Song not found")
+	}
+	resp := subsonicOK()
+	resp.Song = &songs[0]
+	return resp
+}
+
+// maxSubsonicSearchCount bounds each kind of search3 result.
+const maxSubsonicSearchCount = 500
+
+// subsonicSearch3 finds artists, albums and songs whose name contains the
+// query. Clients sync the whole library by searching for "" page by page.
+func subsonicSearch3(r *subsonicRequest) *subsonicResponse {
+	ctx := r.c.Request.Context()
+	query := strings.Trim(strings.TrimSpace(r.param("query")), `"`)
+
+	var counts [3]struct{ count, offset int }
+	for i, kind := range []string{"artist", "album", "song"} {
+		var fail *subsonicResponse
+		if counts[i].count, fail = r.intParam(kind+"Count", 20, maxSubsonicSearchCount); fail != nil {
+			return fail
+		}
+		if counts[i].offset, fail = r.intParam(kind+"Offset", 0, math.MaxInt32); fail != nil {
+			return fail
+		}
+	}
+
+	result := &subsonicSearchResult{}
+	var err error
+	if counts[0].count > 0 {
+		result.Artist, err = querySubsonicArtists(ctx,
+			"strpos(a.name_key, lower($1)) > 0 ORDER BY a.name_key, a.id LIMIT $2 OFFSET $3",
+			query, counts[0].count, counts[0].offset)
+		if err != nil {
+			log.Printf("Error searching artists: %v", err)
+			return subsonicFailure(subsonicErrGeneric, "Failed to search artists")
+		}
+	}
+	if counts[1].count > 0 {
+		result.Album, err = querySubsonicAlbums(ctx,
+			fmt.Sprintf(albumQuery, "strpos(al.title_key, lower($1)) > 0")+" ORDER BY al.title_key, al.id LIMIT $2 OFFSET $3",
+			query, counts[1].count, counts[1].offset)
+		if err != nil {
+			log.Printf("Error searching albums: %v", err)
+			return subsonicFailure(subsonicErrGeneric, "Failed to search albums")
+		}
+	}
+	if counts[2].count > 0 {
+		result.Song, err = querySubsonicSongs(ctx, `(strpos(lower(COALESCE(t.title, f.name)), lower($2)) > 0
+			OR strpos(lower(COALESCE(ar.name, '')), lower($2)) > 0
+			OR strpos(lower(COALESCE(al.title, '')), lower($2)) > 0)
+			ORDER BY lower(COALESCE(t.title, f.name)), f.id LIMIT $3 OFFSET $4`,
+			query, counts[2].count, counts[2].offset)
+		if err != nil {
+			log.Printf("Error searching songs: %v", err)
+			return subsonicFailure(subsonicErrGeneric, "Failed to search songs")
+		}
+	}
+
+	resp := subsonicOK()
+	resp.SearchResult3 = result
+	return resp
+}
+
+// subsonicStream proxies a song from R2, passing the Range header through so
+// clients can seek. Songs are sent as stored; maxBitRate and format are
+// ignored.
+func subsonicStream(r *subsonicRequest) *subsonicResponse {
+	ctx := r.c.Request.Context()
+	id, fail := r.id("id", "tr")
+	if fail != nil {
+		return fail
+	}
+
+	var url, fileType string
+	err := db.QueryRowContext(ctx, "SELECT url, type FROM files_table WHERE id = $1 AND NOT hidden", id).Scan(&url, &fileType)
+	if err == sql.ErrNoRows {
+		return subsonicFailure(subsonicErrNotFound, "Song not found")
+	}
+	if err != nil {
+		log.Printf("Error querying file %d: %v", id, err)
+		return subsonicFailure(subsonicErrGeneric, "Failed to query song")
+	}
+
+	key := strings.TrimPrefix(url, config.CloudflarePublicDevURL+"/")
+	if err := streamObject(r.c, key, fileType); err != nil {
+		log.Printf("Failed to fetch file %d from R2: %v", id, err)
+		return subsonicFailure(subsonicErrNotFound, "Song not found in storage")
+	}
+	return nil
+}
+
+// subsonicGetCoverArt proxies the thumbnail of a song or album. size picks
+// the smallest JPEG variant at least that wide; without it, the largest is
+// sent.
+func subsonicGetCoverArt(r *subsonicRequest) *subsonicResponse {
+	ctx := r.c.Request.Context()
+	v := r.param("id")
+	if v == "" {
+		return subsonicFailure(subsonicErrMissingParameter, "Required parameter is missing: id")
+	}
+	size, fail := r.intParam("size", 0, math.MaxInt32)
+	if fail != nil {
+		return fail
+	}
+
+	var fileID int64
+	var url string
+	var err error
+	if id, ok := parseSubsonicID(v, "al"); ok {
+		err = db.QueryRowContext(ctx, `
+			SELECT f.id, f.url FROM tracks_table t
+			JOIN files_table f ON f.id = t.file_id AND NOT f.hidden
+			WHERE t.album_id = $1 AND f.thumbnail_url IS NOT NULL
+			ORDER BY `+trackOrder+` LIMIT 1`, id).Scan(&fileID, &url)
+	} else if id, ok := parseSubsonicID(v, "tr"); ok {
+		err = db.QueryRowContext(ctx, "SELECT id, url FROM files_table WHERE id = $1 AND thumbnail_url IS NOT NULL", id).Scan(&fileID, &url)
+	} else {
+		err = sql.ErrNoRows
+	}
+	if err == sql.ErrNoRows {
+		return subsonicFailure(subsonicErrNotFound, "Cover art not found")
+	}
+	if err != nil {
+		log.Printf("Error querying cover art %s: %v", v, err)
+		return subsonicFailure(subsonicErrGeneric, "Failed to query cover art")
+	}
+
+	rows, err := db.QueryContext(ctx, "SELECT object_key FROM derived_assets_table WHERE file_id = $1 AND kind = $2",
+		fileID, dbstore.AssetKindThumbnail)
+	if err != nil {
+		log.Printf("Error listing thumbnails of file %d: %v", fileID, err)
+		return subsonicFailure(subsonicErrGeneric, "Failed to query cover art")
+	}
+	var stored []string
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err == nil {
+			stored = append(stored, key)
+		}
+	}
+	rows.Close()
+
+	objectKey := strings.TrimPrefix(url, config.CloudflarePublicDevURL+"/")
+	profile := assets.DefaultThumbnailProfile()
+	type candidate struct {
+		width int
+		key   string
+	}
+	var candidates []candidate
+	for _, variant := range profile.Variants() {
+		if key := profile.Key(objectKey, variant); variant.Format == "jpeg" && slices.Contains(stored, key) {
+			candidates = append(candidates, candidate{variant.Width, key})
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].width < candidates[j].width })
+	key := assets.ThumbnailKey(objectKey)
+	if len(candidates) > 0 {
+		key = candidates[len(candidates)-1].key
+		for _, c := range candidates {
+			if size > 0 && c.width >= size {
+				key = c.key
+				break
+			}
+		}
+	}
+
+	obj, err := r2Client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(config.CloudflareR2BucketName),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		log.Printf("Failed to fetch cover art %s from R2: %v", key, err)
+		return subsonicFailure(subsonicErrNotFound, "Cover art not found in storage")
+	}
+	defer obj.Body.Close()
+
+	r.c.Header("Content-Type", assets.ThumbnailContentType(path.Ext(key)))
+	r.c.Status(http.StatusOK)
+	io.Copy(r.c.Writer, obj.Body)
+	return nil
+}
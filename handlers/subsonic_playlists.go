@@ -0,0 +1,351 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"math"
+	dbstore "media-server/storage"
+	"strconv"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// playlistQuery selects playlists with their owner's username and the number
+// and total duration of their visible files. %s is the WHERE condition;
+// ORDER BY goes after it.
+const playlistQuery = `
+	SELECT p.id, p.name, p.comment, p.public, p.owner_id, COALESCE(u.username, p.owner_id),
+		p.created_at, p.changed_at, COUNT(f.id), COALESCE(SUM(f.duration), 0)
+	FROM playlists_table p
+	LEFT JOIN subsonic_users_table u ON u.owner_id = p.owner_id
+	LEFT JOIN playlist_entries_table e ON e.playlist_id = p.id
+	LEFT JOIN files_table f ON f.id = e.file_id AND NOT f.hidden
+	WHERE %s
+	GROUP BY p.id, u.username`
+
+// scanSubsonicPlaylist reads a row selected with playlistQuery and returns
+// the owner's ID.
+func scanSubsonicPlaylist(row rowScanner) (subsonicPlaylist, string, error) {
+	var id int64
+	var p subsonicPlaylist
+	var ownerID string
+	var createdAt, changedAt time.Time
+	var duration float64
+	err := row.Scan(&id, &p.Name, &p.Comment, &p.Public, &ownerID, &p.Owner, &createdAt, &changedAt, &p.SongCount, &duration)
+	if err != nil {
+		return subsonicPlaylist{}, "", err
+	}
+	p.ID = subsonicID("pl", id)
+	p.Created, p.Changed = subsonicTime(createdAt), subsonicTime(changedAt)
+	p.Duration = int(math.Round(duration))
+	return p, ownerID, nil
+}
+
+// queryer is satisfied by *sql.DB and *sql.Tx.
+type queryer interface {
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+}
+
+// playlistFileIDs returns the visible audio files of a playlist in order.
+// Indexes sent by clients count these.
+func playlistFileIDs(ctx context.Context, q queryer, playlistID int64) ([]int64, error) {
+	rows, err := q.QueryContext(ctx, `
+		SELECT e.file_id FROM playlist_entries_table e
+		JOIN files_table f ON f.id = e.file_id AND NOT f.hidden
+		WHERE e.playlist_id = $1 AND LOWER(f.type) = ANY($2)
+		ORDER BY e.position
+	`, playlistID, pq.Array(dbstore.AudioExtensions))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// songIDs parses every value of a parameter listing songs.
+func (r *subsonicRequest) songIDs(name string) ([]int64, *subsonicResponse) {
+	var ids []int64
+	for _, v := range r.form[name] {
+		id, ok := parseSubsonicID(v, "tr")
+		if !ok {
+			return nil, subsonicFailure(subsonicErrNotFound, "Song not found: "+v)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// ownPlaylist checks that a playlist exists and belongs to the user.
+func (r *subsonicRequest) ownPlaylist(id int64) *subsonicResponse {
+	var ownerID string
+	err := db.QueryRowContext(r.c.Request.Context(), "SELECT owner_id FROM playlists_table WHERE id = $1", id).Scan(&ownerID)
+	if err == sql.ErrNoRows {
+		return subsonicFailure(subsonicErrNotFound, "Playlist not found")
+	}
+	if err != nil {
+		log.Printf("Error querying playlist %d: %v", id, err)
+		return subsonicFailure(subsonicErrGeneric, "Failed to query playlist")
+	}
+	if ownerID != r.ownerID {
+		return subsonicFailure(subsonicErrNotAuthorized, "Only the owner can change a playlist")
+	}
+	return nil
+}
+
+// subsonicGetPlaylists lists the user's playlists and everyone's public ones.
+func subsonicGetPlaylists(r *subsonicRequest) *subsonicResponse {
+	rows, err := db.QueryContext(r.c.Request.Context(),
+		fmt.Sprintf(playlistQuery, "p.owner_id = $1 OR p.public")+" ORDER BY lower(p.name), p.id", r.ownerID)
+	if err != nil {
+		log.Printf("Error querying playlists: %v", err)
+		return subsonicFailure(subsonicErrGeneric, "Failed to query playlists")
+	}
+	defer rows.Close()
+
+	playlists := &subsonicPlaylists{}
+	for rows.Next() {
+		p, _, err := scanSubsonicPlaylist(rows)
+		if err != nil {
+			log.Printf("Error scanning playlist: %v", err)
+			continue
+		}
+		playlists.Playlist = append(playlists.Playlist, p)
+	}
+	if err := rows.Err(); err != nil {
+		log.Printf("Error reading playlists: %v", err)
+		return subsonicFailure(subsonicErrGeneric, "Failed to query playlists")
+	}
+
+	resp := subsonicOK()
+	resp.Playlists = playlists
+	return resp
+}
+
+// playlistResponse returns a playlist with its songs, if the user may see it.
+func (r *subsonicRequest) playlistResponse(id int64) *subsonicResponse {
+	ctx := r.c.Request.Context()
+	p, ownerID, err := scanSubsonicPlaylist(db.QueryRowContext(ctx, fmt.Sprintf(playlistQuery, "p.id = $1"), id))
+	if err == sql.ErrNoRows || (err == nil && ownerID != r.ownerID && !p.Public) {
+		return subsonicFailure(subsonicErrNotFound, "Playlist not found")
+	}
+	if err != nil {
+		log.Printf("Error querying playlist %d: %v", id, err)
+		return subsonicFailure(subsonicErrGeneric, "Failed to query playlist")
+	}
+
+	ids, err := playlistFileIDs(ctx, db, id)
+	if err != nil {
+		log.Printf("Error querying entries of playlist %d: %v", id, err)
+		return subsonicFailure(subsonicErrGeneric, "Failed to query playlist")
+	}
+	songs, err := querySubsonicSongs(ctx, "f.id = ANY($2)", pq.Array(ids))
+	if err != nil {
+		log.Printf("Error querying songs of playlist %d: %v", id, err)
+		return subsonicFailure(subsonicErrGeneric, "Failed to query playlist")
+	}
+	byID := map[string]subsonicChild{}
+	for _, song := range songs {
+		byID[song.ID] = song
+	}
+
+	playlist := &subsonicPlaylistEntries{subsonicPlaylist: p}
+	for _, fileID := range ids {
+		if song, ok := byID[subsonicID("tr", fileID)]; ok {
+			playlist.Entry = append(playlist.Entry, song)
+		}
+	}
+	resp := subsonicOK()
+	resp.Playlist = playlist
+	return resp
+}
+
+// subsonicGetPlaylist returns a playlist with its songs.
+func subsonicGetPlaylist(r *subsonicRequest) *subsonicResponse {
+	id, fail := r.id("id", "pl")
+	if fail != nil {
+		return fail
+	}
+	return r.playlistResponse(id)
+}
+
+// subsonicCreatePlaylist creates a playlist of songId songs, or replaces the
+// songs of the playlist given as playlistId.
+func subsonicCreatePlaylist(r *subsonicRequest) *subsonicResponse {
+	ctx := r.c.Request.Context()
+	songs, fail := r.songIDs("songId")
+	if fail != nil {
+		return fail
+	}
+	name := r.param("name")
+
+	var id int64
+	if r.param("playlistId") != "" {
+		if id, fail = r.id("playlistId", "pl"); fail != nil {
+			return fail
+		}
+		if fail = r.ownPlaylist(id); fail != nil {
+			return fail
+		}
+	} else if name == "" {
+		return subsonicFailure(subsonicErrMissingParameter, "Required parameter is missing: name")
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		log.Printf("Error starting playlist transaction: %v", err)
+		return subsonicFailure(subsonicErrGeneric, "Failed to save playlist")
+	}
+	defer tx.Rollback()
+
+	if id == 0 {
+		err = tx.QueryRowContext(ctx, "INSERT INTO playlists_table (owner_id, name) VALUES ($1, $2) RETURNING id",
+			r.ownerID, name).Scan(&id)
+	} else if name != "" {
+		_, err = tx.ExecContext(ctx, "UPDATE playlists_table SET name = $1 WHERE id = $2", name, id)
+	}
+	if err == nil {
+		err = dbstore.SetPlaylistEntries(ctx, tx, id, songs)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Printf("Error saving playlist: %v", err)
+		return subsonicFailure(subsonicErrGeneric, "Failed to save playlist")
+	}
+	return r.playlistResponse(id)
+}
+
+// subsonicUpdatePlaylist renames a playlist, changes its comment or
+// visibility, removes the songs at songIndexToRemove and appends the
+// songIdToAdd songs.
+func subsonicUpdatePlaylist(r *subsonicRequest) *subsonicResponse {
+	ctx := r.c.Request.Context()
+	id, fail := r.id("playlistId", "pl")
+	if fail != nil {
+		return fail
+	}
+	if fail = r.ownPlaylist(id); fail != nil {
+		return fail
+	}
+	added, fail := r.songIDs("songIdToAdd")
+	if fail != nil {
+		return fail
+	}
+	removed := map[int]bool{}
+	for _, v := range r.form["songIndexToRemove"] {
+		index, err := strconv.Atoi(v)
+		if err != nil || index < 0 {
+			return subsonicFailure(subsonicErrGeneric, "Invalid songIndexToRemove: "+v)
+		}
+		removed[index] = true
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		log.Printf("Error starting playlist transaction: %v", err)
+		return subsonicFailure(subsonicErrGeneric, "Failed to save playlist")
+	}
+	defer tx.Rollback()
+
+	var name, comment *string
+	var public *bool
+	if v, ok := r.form["name"]; ok {
+		name = &v[0]
+	}
+	if v, ok := r.form["comment"]; ok {
+		comment = &v[0]
+	}
+	if v := r.param("public"); v != "" {
+		b := v == "true"
+		public = &b
+	}
+	// Locking the playlist serialises concurrent edits of its entries.
+	_, err = tx.ExecContext(ctx, `
+		UPDATE playlists_table
+		SET name = COALESCE($1, name), comment = COALESCE($2, comment), public = COALESCE($3, public), changed_at = $4
+		WHERE id = $5
+	`, name, comment, public, time.Now(), id)
+	if err == nil && (len(added) > 0 || len(removed) > 0) {
+		var current []int64
+		current, err = playlistFileIDs(ctx, tx, id)
+		var kept []int64
+		for i, fileID := range current {
+			if !removed[i] {
+				kept = append(kept, fileID)
+			}
+		}
+		if err == nil {
+			err = dbstore.SetPlaylistEntries(ctx, tx, id, append(kept, added...))
+		}
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Printf("Error updating playlist %d: %v", id, err)
+		return subsonicFailure(subsonicErrGeneric, "Failed to save playlist")
+	}
+	return subsonicOK()
+}
+
+// subsonicDeletePlaylist deletes a playlist of the user.
+func subsonicDeletePlaylist(r *subsonicRequest) *subsonicResponse {
+	id, fail := r.id("id", "pl")
+	if fail != nil {
+		return fail
+	}
+	if fail = r.ownPlaylist(id); fail != nil {
+		return fail
+	}
+	if _, err := db.ExecContext(r.c.Request.Context(), "DELETE FROM playlists_table WHERE id = $1", id); err != nil {
+		log.Printf("Error deleting playlist %d: %v", id, err)
+		return subsonicFailure(subsonicErrGeneric, "Failed to delete playlist")
+	}
+	return subsonicOK()
+}
+
+// subsonicScrobble records plays of the id songs, at the matching time in
+// milliseconds or now. Now-playing notifications (submission=false) are
+// accepted and not recorded.
+func subsonicScrobble(r *subsonicRequest) *subsonicResponse {
+	ids, fail := r.songIDs("id")
+	if fail != nil {
+		return fail
+	}
+	if len(ids) == 0 {
+		return subsonicFailure(subsonicErrMissingParameter, "Required parameter is missing: id")
+	}
+	if r.param("submission") == "false" {
+		return subsonicOK()
+	}
+
+	times := r.form["time"]
+	for i, id := range ids {
+		playedAt := time.Now()
+		if i < len(times) {
+			ms, err := strconv.ParseInt(times[i], 10, 64)
+			if err != nil {
+				return subsonicFailure(subsonicErrGeneric, "Invalid time: "+times[i])
+			}
+			playedAt = time.UnixMilli(ms)
+		}
+		if err := dbstore.RecordScrobble(r.c.Request.Context(), db, r.ownerID, id, playedAt); err != nil {
+			log.Printf("Error recording play of file %d: %v", id, err)
+			return subsonicFailure(subsonicErrGeneric, "Failed to record play")
+		}
+	}
+	return subsonicOK()
+}
@@ -0,0 +1,28 @@
+package handlers
+
+import "testing"
+
+func TestSubsonicCredentialsMatch(t *testing.T) {
+	// The example from the Subsonic API documentation.
+	const secret, salt, token = "sesame", "c19b2d", "26719a1196d2a940705a59634eb18eab"
+	tests := []struct {
+		name                  string
+		password, token, salt string
+		want                  bool
+	}{
+		{"password", "sesame", "", "", true},
+		{"wrong password", "sesam", "", "", false},
+		{"token", "", token, salt, true},
+		{"upper-case token", "", "26719A1196D2A940705A59634EB18EAB", salt, true},
+		{"other salt", "", token, "c19b2e", false},
+		{"secret as token", "", secret, salt, false},
+		{"empty token", "", "", salt, false},
+		{"password wins over token", "wrong", token, salt, false},
+	}
+	for _, tt := range tests {
+		if got := subsonicCredentialsMatch(secret, tt.password, tt.token, tt.salt); got != tt.want {
+			t.Errorf("%s: subsonicCredentialsMatch(%q, %q, %q, %q) = %v, want %v",
+				tt.name, secret, tt.password, tt.token, tt.salt, got, tt.want)
+		}
+	}
+}
@@ -1,28 +1,33 @@
 package handlers
 
 import (
-	"bytes"
 	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"media-server/config"
+	dbstore "media-server/storage"
+	"media-server/vtt"
 	"net/http"
-	"os/exec"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/gin-gonic/gin"
+	"golang.org/x/sync/singleflight"
 )
 
 // DB stores full URLs with domain in the `url` column
 // const dbHasFullURLs = true
 
+// GetSubtitles redirects to a subtitle track of the video, extracting the
+// tracks on first use. ?track=<id> or ?lang=<code> select a track; otherwise
+// the default one is served.
 func GetSubtitles(c *gin.Context) {
 	if db == nil || r2Client == nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Service not initialized"})
@@ -41,17 +46,16 @@ func GetSubtitles(c *gin.Context) {
 	videoRelPath := strings.TrimSuffix(relPath, ".vtt")
 
 	// List of supported video file extensions to try
-	extensions := []string{".mkv", ".mp4", ".avi", ".mov", ".webm"}
+	extensions := dbstore.VideoExtensions
 
 	var fileID int64
-	var subtitleGenFailed bool
 	// var videoURL string
 	found := false
 
 	for _, ext := range extensions {
 		candidatePath := videoRelPath + ext
 		candidateURL := fmt.Sprintf("%s/%s", config.CloudflarePublicDevURL, candidatePath)
-		err := db.QueryRow("SELECT id, subtitle_gen_failed FROM files_table WHERE url = $1", candidateURL).Scan(&fileID, &subtitleGenFailed)
+		err := db.QueryRow("SELECT id FROM files_table WHERE url = $1", candidateURL).Scan(&fileID)
         if err == nil {
             videoRelPath = candidatePath
             found = true
@@ -69,79 +73,304 @@ func GetSubtitles(c *gin.Context) {
 		return
 	}
 
-	if found && subtitleGenFailed {
-		log.Printf("Skipping subtitle generation for %s as it's known to fail.", videoRelPath)
-        c.JSON(http.StatusNotFound, gin.H{"error": "Subtitles are not available for this video."})
-        return
+	tracks, err := dbstore.ListSubtitleTracks(db, fileID)
+	if err != nil {
+		log.Printf("Failed to list subtitle tracks of %s: %v", videoRelPath, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "DB error"})
+		return
+	}
 
+	trackParam, langParam := c.Query("track"), c.Query("lang")
+	if len(tracks) == 0 && trackParam == "" && langParam == "" {
+		// Subtitles extracted before tracks were recorded live at the
+		// legacy single-track key.
+		subtitleKey := filepath.ToSlash(filepath.Join("subtitles", relPath))
+		_, err := r2Client.HeadObject(context.TODO(), &s3.HeadObjectInput{
+			Bucket: aws.String(config.CloudflareR2BucketName),
+			Key:    aws.String(subtitleKey),
+		})
+		if err == nil {
+			log.Printf("Subtitle already exists at R2: %s", subtitleKey)
+			c.Redirect(http.StatusFound, "/proxy_subtitle/"+relPath)
+			return
+		}
 	}
 
-	subtitleKey := filepath.ToSlash(filepath.Join("subtitles", relPath))
+	status, err := dbstore.GetAssetStatus(db, fileID, dbstore.AssetKindSubtitle)
+	if err != nil {
+		log.Printf("Failed to read subtitle status of %s: %v", videoRelPath, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "DB error"})
+		return
+	}
 
-	// Check if subtitle already exists on R2
-	_, err := r2Client.HeadObject(context.TODO(), &s3.HeadObjectInput{
-		Bucket: aws.String(config.CloudflareR2BucketName),
-		Key:    aws.String(subtitleKey),
-	})
-	if err == nil {
-		log.Printf("Subtitle already exists at R2: %s", subtitleKey)
-		c.Redirect(http.StatusFound, "/proxy_subtitle/"+relPath)
+	// Sidecar and uploaded tracks don't replace the embedded ones.
+	if status.Due() && !hasEmbeddedTracks(tracks) {
+		_, done, err := waitForAsset(c.Request.Context(), func() <-chan singleflight.Result {
+			return dbstore.StartSubtitles(db, r2Client, config.CloudflareR2BucketName, fileID, videoRelPath)
+		})
+		if !done {
+			respondAssetQueued(c, "Subtitles")
+			return
+		}
+		if err == nil {
+			tracks, err = dbstore.ListSubtitleTracks(db, fileID)
+			if err != nil {
+				log.Printf("Failed to list subtitle tracks of %s: %v", videoRelPath, err)
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list subtitles"})
+				return
+			}
+		} else if status, err = dbstore.GetAssetStatus(db, fileID, dbstore.AssetKindSubtitle); err != nil {
+			log.Printf("Failed to read subtitle status of %s: %v", videoRelPath, err)
+		}
+	}
+	if len(tracks) == 0 {
+		respondAssetUnavailable(c, status, "Subtitles")
 		return
 	}
 
-	// Generate presigned URL for the video file using the discovered videoRelPath
-	presignClient := s3.NewPresignClient(r2Client)
-	presigned, err := presignClient.PresignGetObject(context.TODO(), &s3.GetObjectInput{
-		Bucket: aws.String(config.CloudflareR2BucketName),
-		Key:    aws.String(videoRelPath),
-	}, s3.WithPresignExpires(5*time.Minute))
-	if err != nil {
-		log.Printf("Failed to generate presigned URL: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to access video file"})
-		return
-	}
-
-	var subtitleBuf bytes.Buffer
-	var stderr bytes.Buffer
-	cmd := exec.Command("ffmpeg",
-		"-i", presigned.URL,
-		"-map", "0:s:0",
-		"-f", "webvtt",
-		"pipe:1",
-	)
-	cmd.Stdout = &subtitleBuf
-	cmd.Stderr = &stderr
-
-	if err := cmd.Run(); err != nil  || subtitleBuf.Len() == 0 {
-		log.Printf("FFmpeg error: %v, stderr: %s", err, stderr.String())
-		
-		// Flag the failure in the database 
-		if found {
-			_, dbErr := db.Exec("UPDATE files_table SET subtitle_gen_failed = TRUE WHERE id = $1", fileID)
-            if dbErr != nil {
-                log.Printf("Failed to mark subtitle generation as failed for file ID %d: %v", fileID, dbErr)
-            }
+	track := selectSubtitleTrack(tracks, trackParam, langParam)
+	if track == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Subtitle track not found"})
+		return
+	}
+	c.Redirect(http.StatusFound, "/proxy_subtitle/"+strings.TrimPrefix(track.ObjectKey, "subtitles/"))
+}
+
+// ListSubtitles returns the subtitle tracks of the video at ?path=,
+// extracting them first if that hasn't happened yet.
+func ListSubtitles(c *gin.Context) {
+	if db == nil || r2Client == nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Service not initialized"})
+		return
+	}
+
+	path := c.Query("path")
+	if path == "" || strings.Contains(path, "..") {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid path"})
+		return
+	}
+
+	var fileID int64
+	var fileType string
+	err := db.QueryRow("SELECT id, type FROM files_table WHERE url = $1",
+		config.CloudflarePublicDevURL+"/"+path).Scan(&fileID, &fileType)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
+		return
+	}
+	if err != nil {
+		log.Printf("Error looking up %s: %v", path, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to query file"})
+		return
+	}
+
+	tracks, err := dbstore.ListSubtitleTracks(db, fileID)
+	if err != nil {
+		log.Printf("Failed to list subtitle tracks of %s: %v", path, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list subtitles"})
+		return
+	}
+	status, err := dbstore.GetAssetStatus(db, fileID, dbstore.AssetKindSubtitle)
+	if err != nil {
+		log.Printf("Failed to read subtitle status of %s: %v", path, err)
+	}
+	if err == nil && status.Due() && !hasEmbeddedTracks(tracks) && dbstore.IsVideoFile(fileType) {
+		// While extraction is still running the tracks found so far are
+		// listed with a pending status.
+		_, done, err := waitForAsset(c.Request.Context(), func() <-chan singleflight.Result {
+			return dbstore.StartSubtitles(db, r2Client, config.CloudflareR2BucketName, fileID, path)
+		})
+		if done {
+			if err == nil {
+				if extracted, err := dbstore.ListSubtitleTracks(db, fileID); err == nil {
+					tracks = extracted
+				}
+			}
+			if status, err = dbstore.GetAssetStatus(db, fileID, dbstore.AssetKindSubtitle); err != nil {
+				log.Printf("Failed to read subtitle status of %s: %v", path, err)
+			}
 		}
+	}
+
+	base := strings.TrimSuffix(path, filepath.Ext(path))
+	entries := []gin.H{}
+	for _, t := range tracks {
+		entries = append(entries, subtitleTrackEntry(base, t))
+	}
+	c.JSON(http.StatusOK, gin.H{"path": path, "tracks": entries, "extraction": status})
+}
+
+// maxSubtitleUploadSize bounds uploaded subtitle files.
+const maxSubtitleUploadSize = 10 * 1024 * 1024
 
-		c.JSON(http.StatusNotFound, gin.H{"error": "No subtitles found or extraction failed"})
+// UploadSubtitle converts an uploaded SRT, ASS/SSA or WebVTT file to WebVTT
+// and adds it as a track of the video at ?path=.
+//
+// Form fields: file. Query parameters: path, lang, title, forced.
+func UploadSubtitle(c *gin.Context) {
+	if db == nil || r2Client == nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Service not initialized"})
 		return
 	}
 
-	uploader := manager.NewUploader(r2Client)
-	_, err = uploader.Upload(context.TODO(), &s3.PutObjectInput{
-		Bucket:      aws.String(config.CloudflareR2BucketName),
-		Key:         aws.String(subtitleKey),
-		Body:        bytes.NewReader(subtitleBuf.Bytes()),
-		ContentType: aws.String("text/vtt"),
-	})
+	path := c.Query("path")
+	if path == "" || strings.Contains(path, "..") {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid path"})
+		return
+	}
+	forced := false
+	if v := c.Query("forced"); v != "" {
+		var err error
+		if forced, err = strconv.ParseBool(v); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid forced flag"})
+			return
+		}
+	}
+
+	var fileID int64
+	var fileType, ownerID string
+	err := db.QueryRow("SELECT id, type, ownerId FROM files_table WHERE url = $1",
+		config.CloudflarePublicDevURL+"/"+path).Scan(&fileID, &fileType, &ownerID)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
+		return
+	}
+	if err != nil {
+		log.Printf("Error looking up %s: %v", path, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to query file"})
+		return
+	}
+	if !dbstore.IsVideoFile(fileType) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Subtitles can only be added to videos"})
+		return
+	}
+
+	header, err := c.FormFile("file")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Missing subtitle file"})
+		return
+	}
+	ext := strings.ToLower(filepath.Ext(header.Filename))
+	if !vtt.Supported(ext) {
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": "Unsupported subtitle format, expected .srt, .ass, .ssa or .vtt"})
+		return
+	}
+	if header.Size > maxSubtitleUploadSize {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "Subtitle file too large"})
+		return
+	}
+	f, err := header.Open()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read subtitle file"})
+		return
+	}
+	raw, err := io.ReadAll(io.LimitReader(f, maxSubtitleUploadSize))
+	f.Close()
 	if err != nil {
-		log.Printf("Error uploading subtitle to R2: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to upload subtitle"})
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read subtitle file"})
 		return
 	}
 
-	log.Printf("Subtitle uploaded to R2: %s", subtitleKey)
-	c.Redirect(http.StatusFound, "/proxy_subtitle/"+relPath)
+	data, err := vtt.Convert(ext, raw)
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": fmt.Sprintf("Invalid subtitle file: %v", err)})
+		return
+	}
+
+	quota, err := dbstore.QuotaBytes(db, ownerID)
+	if err == nil && quota > 0 {
+		used, err := dbstore.UsedBytes(db, ownerID)
+		if err == nil && used+int64(len(data)) > quota {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": quotaExceededMessage(used, quota)})
+			return
+		}
+	}
+
+	lang := dbstore.NormalizeLanguage(c.Query("lang"))
+	base := strings.TrimSuffix(path, filepath.Ext(path))
+	track, err := dbstore.AddSubtitleTrack(c.Request.Context(), db, r2Client, config.CloudflareR2BucketName, dbstore.NewSubtitleTrack{
+		FileID:    fileID,
+		Language:  lang,
+		Title:     strings.TrimSpace(c.Query("title")),
+		Source:    dbstore.SubtitleSourceUpload,
+		ObjectKey: fmt.Sprintf("subtitles/%s.upload-%d.%s.vtt", base, time.Now().UnixNano(), lang),
+		IsForced:  forced,
+	}, data)
+	if err != nil {
+		log.Printf("Error adding subtitle to %s: %v", path, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store subtitle"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, subtitleTrackEntry(base, track))
+}
+
+// subtitleTrackEntry renders a track for the subtitle endpoints.
+func subtitleTrackEntry(base string, t dbstore.SubtitleTrack) gin.H {
+	return gin.H{
+		"id":           t.ID,
+		"stream_index": t.StreamIndex,
+		"language":     t.Language,
+		"title":        t.Title,
+		"codec":        t.Codec,
+		"source":       t.Source,
+		"default":      t.IsDefault,
+		"forced":       t.IsForced,
+		"revision":     t.Revision,
+		"url":          fmt.Sprintf("/subtitle/%s.vtt?track=%d", base, t.ID),
+	}
+}
+
+// hasEmbeddedTracks reports whether the embedded tracks were extracted already.
+func hasEmbeddedTracks(tracks []dbstore.SubtitleTrack) bool {
+	for _, t := range tracks {
+		if t.Source == dbstore.SubtitleSourceEmbedded {
+			return true
+		}
+	}
+	return false
+}
+
+// selectSubtitleTrack picks a track by ID (?track=) or language (?lang=),
+// falling back to the default track when neither is given.
+func selectSubtitleTrack(tracks []dbstore.SubtitleTrack, trackParam, langParam string) *dbstore.SubtitleTrack {
+	switch {
+	case trackParam != "":
+		id, err := strconv.ParseInt(trackParam, 10, 64)
+		if err != nil {
+			return nil
+		}
+		for i := range tracks {
+			if tracks[i].ID == id {
+				return &tracks[i]
+			}
+		}
+		return nil
+	case langParam != "":
+		// Prefer a full track over a forced one in the same language.
+		var forced *dbstore.SubtitleTrack
+		for i := range tracks {
+			if !dbstore.LanguageMatches(tracks[i].Language, langParam) {
+				continue
+			}
+			if !tracks[i].IsForced {
+				return &tracks[i]
+			}
+			if forced == nil {
+				forced = &tracks[i]
+			}
+		}
+		return forced
+	}
+	for i := range tracks {
+		if tracks[i].IsDefault {
+			return &tracks[i]
+		}
+	}
+	if len(tracks) > 0 {
+		return &tracks[0]
+	}
+	return nil
 }
 
 func ProxySubtitle(c *gin.Context) {
@@ -149,6 +378,15 @@ func ProxySubtitle(c *gin.Context) {
 	relPath = filepath.ToSlash(filepath.Clean(relPath))
 
 	key := filepath.ToSlash(filepath.Join("subtitles", relPath))
+	// Retimed tracks are served at the original track URL.
+	if db != nil {
+		current, err := dbstore.CurrentSubtitleKey(c.Request.Context(), db, key)
+		if err != nil {
+			log.Printf("Failed to resolve subtitle revision of %s: %v", key, err)
+		} else {
+			key = current
+		}
+	}
 	log.Printf("Proxying subtitle from R2: %s", key)
 
 	resp, err := r2Client.GetObject(context.TODO(), &s3.GetObjectInput{
@@ -163,7 +401,151 @@ func ProxySubtitle(c *gin.Context) {
 	defer resp.Body.Close()
 
 	c.Header("Content-Type", "text/vtt")
+	c.Header("Cache-Control", "no-cache")
 	c.Header("Access-Control-Allow-Origin", "*")
 	c.Status(http.StatusOK)
 	io.Copy(c.Writer, resp.Body)
 }
+
+// RetimeRequest is the body of POST /media/subtitles/:id/timing. Every cue
+// time t becomes t*scale + offset. The scale is given directly or as the
+// frame rate the subtitle was made for (source_fps) and the video's frame
+// rate (target_fps).
+type RetimeRequest struct {
+	OffsetMS     int64    `json:"offset_ms"`
+	Scale        *float64 `json:"scale"`
+	SourceFPS    float64  `json:"source_fps"`
+	TargetFPS    float64  `json:"target_fps"`
+	FromOriginal bool     `json:"from_original"`
+}
+
+// scale validates the request and returns the factor cue times are
+// multiplied by.
+func (r RetimeRequest) scale() (float64, error) {
+	scale := 1.0
+	switch {
+	case r.Scale != nil && (r.SourceFPS != 0 || r.TargetFPS != 0):
+		return 0, errors.New("Give either scale or source_fps/target_fps, not both")
+	case r.Scale != nil:
+		scale = *r.Scale
+	case r.SourceFPS != 0 || r.TargetFPS != 0:
+		if r.SourceFPS <= 0 || r.TargetFPS <= 0 {
+			return 0, errors.New("source_fps and target_fps must both be positive")
+		}
+		// A cue at frame n is at n/source_fps in the subtitle and at
+		// n/target_fps in the video.
+		scale = r.SourceFPS / r.TargetFPS
+	}
+	if scale <= 0 {
+		return 0, errors.New("Scale must be positive")
+	}
+	if scale == 1 && r.OffsetMS == 0 {
+		return 0, errors.New("Nothing to change, give an offset or a scale")
+	}
+	return scale, nil
+}
+
+// RetimeSubtitle shifts and/or stretches a subtitle track, saving the result
+// as a new revision that is served from then on. The original is kept.
+func RetimeSubtitle(c *gin.Context) {
+	track, ok := loadSubtitleTrack(c)
+	if !ok {
+		return
+	}
+
+	var req RetimeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid retime request"})
+		return
+	}
+	scale, err := req.scale()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	rev, err := dbstore.RetimeSubtitleTrack(c.Request.Context(), db, r2Client, config.CloudflareR2BucketName,
+		track, scale, time.Duration(req.OffsetMS)*time.Millisecond, req.FromOriginal)
+	if err != nil {
+		if rev.Revision == 0 {
+			log.Printf("Error retiming subtitle track %d: %v", track.ID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retime subtitle"})
+			return
+		}
+		// The revision is stored and served; only bookkeeping failed.
+		log.Printf("Retimed subtitle track %d with errors: %v", track.ID, err)
+	}
+
+	c.JSON(http.StatusCreated, rev)
+}
+
+// ListSubtitleRevisions returns every revision of a subtitle track.
+func ListSubtitleRevisions(c *gin.Context) {
+	track, ok := loadSubtitleTrack(c)
+	if !ok {
+		return
+	}
+	revisions, err := dbstore.ListSubtitleRevisions(db, track)
+	if err != nil {
+		log.Printf("Error listing revisions of subtitle track %d: %v", track.ID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list revisions"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"track_id": track.ID, "revisions": revisions})
+}
+
+// RevisionRequest is the body of PUT /media/subtitles/:id/revision.
+type RevisionRequest struct {
+	Revision *int `json:"revision"`
+}
+
+// SelectSubtitleRevision chooses which revision of a track is served; 0
+// restores the original.
+func SelectSubtitleRevision(c *gin.Context) {
+	track, ok := loadSubtitleTrack(c)
+	if !ok {
+		return
+	}
+	var req RevisionRequest
+	if err := c.ShouldBindJSON(&req); err != nil || req.Revision == nil || *req.Revision < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid revision"})
+		return
+	}
+
+	err := dbstore.SetSubtitleRevision(c.Request.Context(), db, r2Client, config.CloudflareR2BucketName, track, *req.Revision)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Revision not found"})
+		return
+	}
+	if err != nil {
+		log.Printf("Error selecting revision %d of subtitle track %d: %v", *req.Revision, track.ID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to select revision"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"track_id": track.ID, "revision": *req.Revision})
+}
+
+// loadSubtitleTrack reads the track named by the :id parameter, writing an
+// error response if there is none.
+func loadSubtitleTrack(c *gin.Context) (dbstore.SubtitleTrack, bool) {
+	if db == nil || r2Client == nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Service not initialized"})
+		return dbstore.SubtitleTrack{}, false
+	}
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid track ID"})
+		return dbstore.SubtitleTrack{}, false
+	}
+	track, err := dbstore.GetSubtitleTrack(db, id)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Subtitle track not found"})
+		return dbstore.SubtitleTrack{}, false
+	}
+	if err != nil {
+		log.Printf("Error loading subtitle track %d: %v", id, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load subtitle track"})
+		return dbstore.SubtitleTrack{}, false
+	}
+	return track, true
+}
@@ -0,0 +1,37 @@
+package handlers
+
+import "testing"
+
+func TestRetimeRequestScale(t *testing.T) {
+	f := func(v float64) *float64 { return &v }
+	tests := []struct {
+		name    string
+		req     RetimeRequest
+		want    float64
+		wantErr bool
+	}{
+		{"offset only", RetimeRequest{OffsetMS: -1500}, 1, false},
+		{"scale", RetimeRequest{Scale: f(1.001)}, 1.001, false},
+		{"scale and offset", RetimeRequest{Scale: f(0.5), OffsetMS: 200}, 0.5, false},
+		{"frame rates", RetimeRequest{SourceFPS: 24, TargetFPS: 25}, 0.96, false},
+		{"nothing to change", RetimeRequest{}, 0, true},
+		{"scale of one", RetimeRequest{Scale: f(1)}, 0, true},
+		{"same frame rates", RetimeRequest{SourceFPS: 25, TargetFPS: 25}, 0, true},
+		{"zero scale", RetimeRequest{Scale: f(0), OffsetMS: 100}, 0, true},
+		{"negative scale", RetimeRequest{Scale: f(-1)}, 0, true},
+		{"scale and frame rates", RetimeRequest{Scale: f(2), SourceFPS: 25, TargetFPS: 24}, 0, true},
+		{"source frame rate only", RetimeRequest{SourceFPS: 25}, 0, true},
+		{"negative frame rate", RetimeRequest{SourceFPS: -25, TargetFPS: 24}, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.req.scale()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("scale() error = %v, want error %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("scale() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -1,23 +1,28 @@
 package handlers
 
 import (
-	"bytes"
 	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"media-server/assets"
 	"media-server/config"
+	dbstore "media-server/storage"
 	"net/http"
-	"os/exec"
+	"path"
 	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+	"golang.org/x/sync/singleflight"
 )
 
 func GetThumbnail(c *gin.Context) {
@@ -35,29 +40,32 @@ func GetThumbnail(c *gin.Context) {
 
 	log.Printf("Requested thumbnail for: %s", relPath)
 
-	thumbnailName := strings.TrimSuffix(filepath.Base(relPath), filepath.Ext(relPath)) + ".jpg"
-	thumbnailKey := filepath.ToSlash(filepath.Join("thumbnails", filepath.Dir(relPath), thumbnailName))
+	profile := assets.DefaultThumbnailProfile()
+	variant, ok := profile.Variant(c.Query("size"), thumbnailFormat(c, profile))
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unsupported thumbnail size or format"})
+		return
+	}
+	c.Header("Vary", "Accept")
 
-	// Check if thumbnail exists
-	_, err := r2Client.HeadObject(context.TODO(), &s3.HeadObjectInput{
-		Bucket: aws.String(config.CloudflareR2BucketName),
-		Key:    aws.String(thumbnailKey),
-	})
-	if err == nil {
-		c.Redirect(http.StatusFound, "/proxy_thumbnail/"+relPath)
+	// Keys are derived from the video path, whose extension doesn't matter here.
+	thumbnailKey := profile.Key(relPath, variant)
+	if thumbnailExists(c.Request.Context(), thumbnailKey) {
+		c.Redirect(http.StatusFound, "/proxy_thumbnail/"+strings.TrimPrefix(thumbnailKey, "thumbnails/"))
 		return
 	}
 
-	// Try finding matching video with known extensions
-	base := strings.TrimSuffix(relPath, ".jpg")
-	extensions := []string{".mp4", ".mkv", ".avi", ".mov", ".webm"}
+	// Try finding matching video, photo or audio file with known extensions
+	base := strings.TrimSuffix(relPath, filepath.Ext(relPath))
+	extensions := append(slices.Clone(dbstore.VideoExtensions), dbstore.ImageExtensions...)
+	extensions = append(extensions, dbstore.AudioExtensions...)
 	var videoRelPath string
+	var fileID int64
 	var found bool
 
 	for _, ext := range extensions {
 		candidate := base + ext
 		candidateURL := fmt.Sprintf("%s/%s", config.CloudflarePublicDevURL, candidate)
-		var fileID int64
 		err := db.QueryRowContext(context.TODO(), "SELECT id FROM files_table WHERE url = $1", candidateURL).Scan(&fileID)
 		if err == nil {
 			videoRelPath = candidate
@@ -71,58 +79,187 @@ func GetThumbnail(c *gin.Context) {
 	}
 
 	if !found {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Video not found"})
+		c.JSON(http.StatusNotFound, gin.H{"error": "Media not found"})
 		return
 	}
 
-	// Presign download URL for video
-	presignClient := s3.NewPresignClient(r2Client)
-	presigned, err := presignClient.PresignGetObject(context.TODO(), &s3.GetObjectInput{
-		Bucket: aws.String(config.CloudflareR2BucketName),
-		Key:    aws.String(videoRelPath),
-	}, s3.WithPresignExpires(5*time.Minute))
+	// A variant missing next to other variants has no encoder in this ffmpeg
+	// build, so the default is served. Thumbnails made before variants
+	// existed are only the default and get regenerated.
+	defaultKey := assets.ThumbnailKey(relPath)
+	if thumbnailKey != defaultKey && thumbnailExists(c.Request.Context(), defaultKey) {
+		var variants int
+		err := db.QueryRowContext(c.Request.Context(), "SELECT COUNT(*) FROM derived_assets_table WHERE file_id = $1 AND kind = $2",
+			fileID, dbstore.AssetKindThumbnail).Scan(&variants)
+		if err == nil && variants > 1 {
+			c.Redirect(http.StatusFound, "/proxy_thumbnail/"+strings.TrimPrefix(defaultKey, "thumbnails/"))
+			return
+		}
+	}
+
+	// An ok status with no object means the thumbnail was deleted or a size
+	// was added; render it again, from the custom source if there is one.
+	status, err := dbstore.GetAssetStatus(db, fileID, dbstore.AssetKindThumbnail)
 	if err != nil {
-		log.Printf("Presign error: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Presign failed"})
+		log.Printf("Failed to read thumbnail status of %s: %v", videoRelPath, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "DB error"})
+		return
+	}
+	if !status.Due() && status.Status != dbstore.AssetStatusOK {
+		respondAssetUnavailable(c, status, "Thumbnails")
 		return
 	}
 
-	var thumbnailBuf bytes.Buffer
-	var stderr bytes.Buffer
+	_, done, err := waitForAsset(c.Request.Context(), func() <-chan singleflight.Result {
+		return dbstore.StartThumbnailVariants(db, r2Client, config.CloudflareR2BucketName, fileID, videoRelPath)
+	})
+	if !done {
+		respondAssetQueued(c, "Thumbnails")
+		return
+	}
+	if errors.Is(err, dbstore.ErrNoStream) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Thumbnails are not available for this file."})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Thumbnail generation failed"})
+		return
+	}
 
-	// -ss after -i allows accurate seeking with streaming URLs
-	cmd := exec.Command("ffmpeg",
-		"-i", presigned.URL,
-		"-ss", "5",
-		"-vframes", "1",
-		"-vf", "scale=320:-1",
-		"-f", "image2pipe",
-		"pipe:1",
-	)
-	cmd.Stdout = &thumbnailBuf
-	cmd.Stderr = &stderr
+	// Variants whose encoder is unavailable fall back to the default.
+	if !thumbnailExists(c.Request.Context(), thumbnailKey) {
+		thumbnailKey = defaultKey
+	}
+	c.Redirect(http.StatusTemporaryRedirect, "/proxy_thumbnail/"+strings.TrimPrefix(thumbnailKey, "thumbnails/"))
+}
 
-	if err := cmd.Run(); err != nil {
-		log.Printf("FFmpeg error: %v, stderr: %s", err, stderr.String())
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Thumbnail generation failed"})
+// thumbnailFormat returns the ?format= parameter or, without one, the best
+// format the client accepts.
+func thumbnailFormat(c *gin.Context, profile assets.ThumbnailProfile) string {
+	if format := c.Query("format"); format != "" {
+		return format
+	}
+	accept := c.GetHeader("Accept")
+	best, bestQ := "jpeg", acceptQuality(accept, "image/jpeg", true)
+	// Ties go to the smaller format; wildcards don't count for these, as
+	// clients that don't name them may not decode them.
+	for _, format := range []string{"webp", "avif"} {
+		if q := acceptQuality(accept, "image/"+format, false); slices.Contains(profile.Formats, format) && q > 0 && q >= bestQ {
+			best, bestQ = format, q
+		}
+	}
+	return best
+}
+
+// acceptQuality returns the q-value an Accept header gives mediaType, taken
+// from its most specific matching media range. With wildcards unset, only an
+// exact match counts; otherwise an empty header accepts everything.
+func acceptQuality(accept, mediaType string, wildcards bool) float64 {
+	if wildcards && strings.TrimSpace(accept) == "" {
+		return 1
+	}
+	mainType, _, _ := strings.Cut(mediaType, "/")
+	q, specificity := 0.0, -1
+	for _, mediaRange := range strings.Split(accept, ",") {
+		params := strings.Split(mediaRange, ";")
+		name := strings.ToLower(strings.TrimSpace(params[0]))
+		s := -1
+		switch {
+		case name == mediaType:
+			s = 2
+		case wildcards && name == mainType+"/*":
+			s = 1
+		case wildcards && name == "*/*":
+			s = 0
+		}
+		if s <= specificity {
+			continue
+		}
+		rangeQ := 1.0
+		for _, param := range params[1:] {
+			key, value, _ := strings.Cut(param, "=")
+			if strings.EqualFold(strings.TrimSpace(key), "q") {
+				if v, err := strconv.ParseFloat(strings.TrimSpace(value), 64); err == nil {
+					rangeQ = v
+				}
+			}
+		}
+		q, specificity = rangeQ, s
+	}
+	return q
+}
+
+// addThumbnailSources adds "thumbnails" to listing entries that have
+// thumbnail variants: one srcset per image format, preferred formats first,
+// ready to use as <picture> sources.
+func addThumbnailSources(ctx context.Context, entries []gin.H) {
+	var ids []int64
+	for _, e := range entries {
+		ids = append(ids, e["id"].(int64))
+	}
+	if len(ids) == 0 {
 		return
 	}
 
-	// Upload thumbnail to R2
-	uploader := manager.NewUploader(r2Client)
-	_, err = uploader.Upload(context.TODO(), &s3.PutObjectInput{
-		Bucket:      aws.String(config.CloudflareR2BucketName),
-		Key:         aws.String(thumbnailKey),
-		Body:        bytes.NewReader(thumbnailBuf.Bytes()),
-		ContentType: aws.String("image/jpeg"),
-	})
+	rows, err := db.QueryContext(ctx, `
+		SELECT file_id, object_key, created_at FROM derived_assets_table
+		WHERE kind = $1 AND file_id = ANY($2)
+	`, dbstore.AssetKindThumbnail, pq.Array(ids))
 	if err != nil {
-		log.Printf("Upload error: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Upload failed"})
+		log.Printf("Failed to list thumbnail variants: %v", err)
 		return
 	}
+	defer rows.Close()
+	// Replaced thumbnails keep their keys; the version gets past caches.
+	stored := map[int64]map[string]int64{}
+	for rows.Next() {
+		var id int64
+		var key string
+		var createdAt time.Time
+		if err := rows.Scan(&id, &key, &createdAt); err != nil {
+			log.Printf("Failed to read thumbnail variant: %v", err)
+			return
+		}
+		if stored[id] == nil {
+			stored[id] = map[string]int64{}
+		}
+		stored[id][key] = createdAt.Unix()
+	}
 
-	c.Redirect(http.StatusTemporaryRedirect, fmt.Sprintf("%s/%s", config.CloudflarePublicDevURL, thumbnailKey))
+	profile := assets.DefaultThumbnailProfile()
+	for _, e := range entries {
+		keys := stored[e["id"].(int64)]
+		if len(keys) == 0 {
+			continue
+		}
+		objectKey := e["path"].(string)
+		sources := []gin.H{}
+		for _, format := range []string{"avif", "webp", "jpeg"} {
+			var srcset []string
+			var contentType string
+			for _, v := range profile.Variants() {
+				key := profile.Key(objectKey, v)
+				version, ok := keys[key]
+				if v.Format != format || !ok {
+					continue
+				}
+				srcset = append(srcset, fmt.Sprintf("%s/%s?v=%d %dw", config.CloudflarePublicDevURL, key, version, v.Width))
+				contentType = v.ContentType()
+			}
+			if len(srcset) > 0 {
+				sources = append(sources, gin.H{"type": contentType, "srcset": strings.Join(srcset, ", ")})
+			}
+		}
+		e["thumbnails"] = sources
+	}
+}
+
+func thumbnailExists(ctx context.Context, key string) bool {
+	_, err := r2Client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(config.CloudflareR2BucketName),
+		Key:    aws.String(key),
+	})
+	return err == nil
 }
 
 func ProxyThumbnail(c *gin.Context) {
@@ -143,8 +280,150 @@ func ProxyThumbnail(c *gin.Context) {
 	}
 	defer resp.Body.Close()
 
-	c.Header("Content-Type", "image/jpeg")
+	c.Header("Content-Type", assets.ThumbnailContentType(path.Ext(key)))
 	c.Header("Access-Control-Allow-Origin", "*")
 	c.Status(http.StatusOK)
 	io.Copy(c.Writer, resp.Body)
-}
\ No newline at end of file
+}
+
+// maxThumbnailUploadSize bounds uploaded poster images.
+const maxThumbnailUploadSize = 20 * 1024 * 1024
+
+// lookupVideo finds the video at ?path= and writes an error response when
+// there is none.
+func lookupVideo(c *gin.Context) (fileID int64, path string, ok bool) {
+	path = c.Query("path")
+	if path == "" || strings.Contains(path, "..") {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid path"})
+		return 0, "", false
+	}
+
+	var fileType string
+	err := db.QueryRow("SELECT id, type FROM files_table WHERE url = $1",
+		config.CloudflarePublicDevURL+"/"+path).Scan(&fileID, &fileType)
+	if err == sql.ErrNoRows || (err == nil && !dbstore.IsVideoFile(fileType)) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Video not found"})
+		return 0, "", false
+	}
+	if err != nil {
+		log.Printf("Error looking up %s: %v", path, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to query file"})
+		return 0, "", false
+	}
+	return fileID, path, true
+}
+
+// UploadThumbnail replaces the thumbnail of the video at ?path= with an
+// uploaded JPEG, PNG, WebP or GIF image, rendered into every thumbnail size
+// and format.
+//
+// Form fields: file.
+func UploadThumbnail(c *gin.Context) {
+	if db == nil || r2Client == nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Service not initialized"})
+		return
+	}
+	fileID, path, ok := lookupVideo(c)
+	if !ok {
+		return
+	}
+
+	header, err := c.FormFile("file")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Missing image file"})
+		return
+	}
+	if header.Size > maxThumbnailUploadSize {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "Image file too large"})
+		return
+	}
+	f, err := header.Open()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read image file"})
+		return
+	}
+	image, err := io.ReadAll(io.LimitReader(f, maxThumbnailUploadSize))
+	f.Close()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read image file"})
+		return
+	}
+	switch http.DetectContentType(image) {
+	case "image/jpeg", "image/png", "image/webp", "image/gif":
+	default:
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": "Unsupported image format, expected JPEG, PNG, WebP or GIF"})
+		return
+	}
+
+	url, err := dbstore.SetUploadedThumbnail(c.Request.Context(), db, r2Client, config.CloudflareR2BucketName, fileID, path, image)
+	if err != nil {
+		log.Printf("Error setting uploaded thumbnail of %s: %v", path, err)
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "Failed to process image"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"thumbnail_url": url, "thumbnail_source": dbstore.ThumbnailSourceUpload})
+}
+
+// ThumbnailFrameRequest is the body of POST /media/thumbnail/frame.
+type ThumbnailFrameRequest struct {
+	TimeMS *int64 `json:"time_ms"`
+}
+
+// SelectThumbnailFrame replaces the thumbnail of the video at ?path= with
+// its frame at time_ms.
+func SelectThumbnailFrame(c *gin.Context) {
+	if db == nil || r2Client == nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Service not initialized"})
+		return
+	}
+	fileID, path, ok := lookupVideo(c)
+	if !ok {
+		return
+	}
+
+	var req ThumbnailFrameRequest
+	if err := c.ShouldBindJSON(&req); err != nil || req.TimeMS == nil || *req.TimeMS < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "time_ms must be a non-negative number of milliseconds"})
+		return
+	}
+
+	at := time.Duration(*req.TimeMS) * time.Millisecond
+	url, err := dbstore.SetThumbnailFrame(c.Request.Context(), db, r2Client, config.CloudflareR2BucketName, fileID, path, at)
+	if errors.Is(err, dbstore.ErrNoStream) {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "The video has no frame at " + strconv.FormatInt(*req.TimeMS, 10) + "ms"})
+		return
+	}
+	if err != nil {
+		log.Printf("Error setting thumbnail frame of %s: %v", path, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Thumbnail generation failed"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"thumbnail_url": url, "thumbnail_source": dbstore.ThumbnailSourceFrame})
+}
+
+// RevertThumbnail replaces a custom thumbnail of the video at ?path= with an
+// automatically picked one.
+func RevertThumbnail(c *gin.Context) {
+	if db == nil || r2Client == nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Service not initialized"})
+		return
+	}
+	fileID, path, ok := lookupVideo(c)
+	if !ok {
+		return
+	}
+
+	url, done, err := waitForAsset(c.Request.Context(), func() <-chan singleflight.Result {
+		return dbstore.StartThumbnail(db, r2Client, config.CloudflareR2BucketName, fileID, path)
+	})
+	if !done {
+		respondAssetQueued(c, "Thumbnails")
+		return
+	}
+	if err != nil {
+		log.Printf("Error reverting thumbnail of %s: %v", path, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Thumbnail generation failed"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"thumbnail_url": *url, "thumbnail_source": dbstore.ThumbnailSourceAuto})
+}
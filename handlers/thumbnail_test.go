@@ -0,0 +1,41 @@
+package handlers
+
+import (
+	"media-server/assets"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestThumbnailFormat(t *testing.T) {
+	profile := assets.ThumbnailProfile{Formats: []string{"jpeg", "webp", "avif"}}
+	tests := []struct {
+		accept string
+		want   string
+	}{
+		{"", "jpeg"},
+		{"*/*", "jpeg"},
+		{"image/avif,image/webp,image/apng,image/*,*/*;q=0.8", "avif"},
+		{"image/webp,*/*", "webp"},
+		{"image/avif;q=0,image/webp", "webp"},
+		{"image/avif;q=0.5,image/webp;q=0.9", "webp"},
+		{"image/jpeg,image/webp;q=0.5", "jpeg"},
+		{"image/webp;q=0.5,image/*;q=0.1", "webp"},
+		{"text/html,image/webpx", "jpeg"},
+	}
+	for _, tt := range tests {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request = httptest.NewRequest("GET", "/thumbnail/1", nil)
+		c.Request.Header.Set("Accept", tt.accept)
+		if got := thumbnailFormat(c, profile); got != tt.want {
+			t.Errorf("thumbnailFormat(Accept: %q) = %q, want %q", tt.accept, got, tt.want)
+		}
+	}
+
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest("GET", "/thumbnail/1?format=webp", nil)
+	if got := thumbnailFormat(c, assets.ThumbnailProfile{}); got != "webp" {
+		t.Errorf("thumbnailFormat(?format=webp) = %q, want %q", got, "webp")
+	}
+}
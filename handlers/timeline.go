@@ -0,0 +1,463 @@
+package handlers
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	dbstore "media-server/storage"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+)
+
+// capturedAtSQL is when a file (aliased as f, with its exif_table row as e)
+// was captured: the camera's date, or the upload date for files without one.
+const capturedAtSQL = "COALESCE(e.taken_at, f.created_at)"
+
+// timelineGroups maps the `group` parameter of /timeline to the date_trunc
+// field and the layout of its period keys.
+var timelineGroups = map[string]struct {
+	field  string
+	layout string
+}{
+	"year":  {"year", "2006"},
+	"month": {"month", "2006-01"},
+	"day":   {"day", "2006-01-02"},
+}
+
+// timelineFilter returns the conditions shared by the timeline and map
+// endpoints: visible photos and videos of the types in ?type=.
+func timelineFilter(c *gin.Context, arg func(any) string) (string, bool) {
+	exts := append(slices.Clone(dbstore.ImageExtensions), dbstore.VideoExtensions...)
+	if types := c.Query("type"); types != "" {
+		exts = nil
+		for _, t := range strings.Split(types, ",") {
+			t = strings.TrimSpace(t)
+			if t != "image" && t != "video" {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid type, expected image or video"})
+				return "", false
+			}
+			exts = append(exts, mediaTypeExtensions[t]...)
+		}
+	}
+	return "NOT f.hidden AND LOWER(f.type) = ANY(" + arg(pq.Array(exts)) + ")", true
+}
+
+// GetTimeline counts photos and videos per year, month or day they were
+// captured, most recent first, one page of periods at a time. Files without
+// a capture date count on their upload date.
+//
+// Query parameters: group (year|month|day), order (asc|desc), limit, cursor,
+// type (image,video).
+func GetTimeline(c *gin.Context) {
+	if db == nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "DB not initialized"})
+		return
+	}
+
+	group := c.DefaultQuery("group", "day")
+	grouping, ok := timelineGroups[group]
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid group, expected year, month or day"})
+		return
+	}
+	order := strings.ToLower(c.DefaultQuery("order", "desc"))
+	if order != "asc" && order != "desc" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid order, expected asc or desc"})
+		return
+	}
+	limit, err := parseLimit(c.Query("limit"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid limit"})
+		return
+	}
+
+	var args []any
+	arg := func(v any) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+	filter, ok := timelineFilter(c, arg)
+	if !ok {
+		return
+	}
+	period := fmt.Sprintf("date_trunc('%s', %s)", grouping.field, capturedAtSQL)
+	where := []string{filter}
+	if raw := c.Query("cursor"); raw != "" {
+		p, err := decodeCursor(raw)
+		after, timeErr := time.Parse(time.RFC3339, p.Value)
+		if err != nil || timeErr != nil || p.Sort != group || p.Order != order {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid cursor for this grouping"})
+			return
+		}
+		cmp := ">"
+		if order == "desc" {
+			cmp = "<"
+		}
+		where = append(where, fmt.Sprintf("%s %s %s", period, cmp, arg(after)))
+	}
+
+	query := fmt.Sprintf(`
+		SELECT %[1]s AS period, COUNT(*),
+			(array_agg(f.thumbnail_url ORDER BY %[2]s DESC, f.id DESC) FILTER (WHERE f.thumbnail_url IS NOT NULL))[1]
+		FROM files_table f
+		LEFT JOIN exif_table e ON e.file_id = f.id
+		WHERE %[3]s
+		GROUP BY period
+		ORDER BY period %[4]s
+		LIMIT %[5]s`,
+		period, capturedAtSQL, strings.Join(where, " AND "), order, arg(limit+1))
+
+	rows, err := db.QueryContext(c.Request.Context(), query, args...)
+	if err != nil {
+		log.Printf("Error querying timeline: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to query timeline"})
+		return
+	}
+	defer rows.Close()
+
+	periods := []gin.H{}
+	var last time.Time
+	var next *string
+	for rows.Next() {
+		if len(periods) == limit {
+			cursor := pageCursor{Sort: group, Order: order, Value: last.Format(time.RFC3339)}.encode()
+			next = &cursor
+			break
+		}
+		var start time.Time
+		var count int64
+		var cover *string
+		if err := rows.Scan(&start, &count, &cover); err != nil {
+			log.Printf("Error scanning timeline period: %v", err)
+			continue
+		}
+		entry := gin.H{
+			"period":        start.Format(grouping.layout),
+			"year":          start.Year(),
+			"count":         count,
+			"thumbnail_url": "",
+		}
+		if group != "year" {
+			entry["month"] = int(start.Month())
+		}
+		if group == "day" {
+			entry["day"] = start.Day()
+		}
+		if cover != nil {
+			entry["thumbnail_url"] = *cover
+		}
+		periods = append(periods, entry)
+		last = start
+	}
+	if err := rows.Err(); err != nil {
+		log.Printf("Error reading timeline: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to query timeline"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"group":       group,
+		"periods":     periods,
+		"next_cursor": next,
+	})
+}
+
+// parsePeriod parses a timeline period key (YYYY, YYYY-MM or YYYY-MM-DD) into
+// the range of times it covers.
+func parsePeriod(v string) (start, end time.Time, err error) {
+	for _, g := range []struct {
+		layout string
+		years  int
+		months int
+		days   int
+	}{
+		{"2006", 1, 0, 0},
+		{"2006-01", 0, 1, 0},
+		{"2006-01-02", 0, 0, 1},
+	} {
+		if len(v) != len(g.layout) {
+			continue
+		}
+		if start, err = time.Parse(g.layout, v); err != nil {
+			return
+		}
+		return start, start.AddDate(g.years, g.months, g.days), nil
+	}
+	return start, end, fmt.Errorf("invalid period %q", v)
+}
+
+// GetTimelineItems lists the photos and videos captured in one timeline
+// period, one page at a time, in capture order.
+//
+// Query parameters: period (YYYY, YYYY-MM or YYYY-MM-DD), order (asc|desc),
+// limit, cursor, type (image,video).
+func GetTimelineItems(c *gin.Context) {
+	if db == nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "DB not initialized"})
+		return
+	}
+
+	period := c.Query("period")
+	start, end, err := parsePeriod(period)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid period, expected YYYY, YYYY-MM or YYYY-MM-DD"})
+		return
+	}
+	order := strings.ToLower(c.DefaultQuery("order", "desc"))
+	if order != "asc" && order != "desc" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid order, expected asc or desc"})
+		return
+	}
+	limit, err := parseLimit(c.Query("limit"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid limit"})
+		return
+	}
+
+	var args []any
+	arg := func(v any) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+	filter, ok := timelineFilter(c, arg)
+	if !ok {
+		return
+	}
+	where := []string{filter, capturedAtSQL + " >= " + arg(start), capturedAtSQL + " < " + arg(end)}
+	if raw := c.Query("cursor"); raw != "" {
+		p, err := decodeCursor(raw)
+		after, timeErr := time.Parse(time.RFC3339Nano, p.Value)
+		if err != nil || timeErr != nil || p.Sort != "captured_at" || p.Order != order {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid cursor for this sort order"})
+			return
+		}
+		cmp := ">"
+		if order == "desc" {
+			cmp = "<"
+		}
+		where = append(where, fmt.Sprintf("(%s, f.id) %s (CAST(%s AS timestamp), %s)", capturedAtSQL, cmp, arg(after), arg(p.ID)))
+	}
+
+	query := fmt.Sprintf(`
+		SELECT %[1]s, %[2]s
+		FROM files_table f
+		LEFT JOIN exif_table e ON e.file_id = f.id
+		WHERE %[3]s
+		ORDER BY %[2]s %[4]s, f.id %[4]s
+		LIMIT %[5]s`,
+		mediaFileColumns, capturedAtSQL, strings.Join(where, " AND "), order, arg(limit+1))
+
+	rows, err := db.QueryContext(c.Request.Context(), query, args...)
+	if err != nil {
+		log.Printf("Error querying timeline period %s: %v", period, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to query files"})
+		return
+	}
+	defer rows.Close()
+
+	files := []gin.H{}
+	var next *string
+	var last *mediaFile
+	var lastCaptured time.Time
+	for rows.Next() {
+		if len(files) == limit {
+			cursor := pageCursor{Sort: "captured_at", Order: order, Value: lastCaptured.Format(time.RFC3339Nano), ID: last.ID}.encode()
+			next = &cursor
+			break
+		}
+		var captured time.Time
+		f, err := scanMediaFile(rows, &captured)
+		if err != nil {
+			log.Printf("Error scanning timeline file: %v", err)
+			continue
+		}
+		entry := f.entry()
+		entry["captured_at"] = captured.Format("2006-01-02T15:04:05")
+		files = append(files, entry)
+		last, lastCaptured = f, captured
+	}
+	if err := rows.Err(); err != nil {
+		log.Printf("Error reading timeline period %s: %v", period, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to query files"})
+		return
+	}
+	addThumbnailSources(c.Request.Context(), files)
+	addExif(c.Request.Context(), files)
+
+	c.JSON(http.StatusOK, gin.H{
+		"period":      period,
+		"files":       files,
+		"next_cursor": next,
+	})
+}
+
+// Grid sizes of /places clusters, in cells per side of the bounding box.
+const (
+	defaultPlacesGrid = 8
+	maxPlacesGrid     = 32
+)
+
+// parseBBox parses west,south,east,north in degrees. west may exceed east
+// for boxes crossing the antimeridian.
+func parseBBox(v string) (west, south, east, north float64, err error) {
+	if v == "" {
+		return -180, -90, 180, 90, nil
+	}
+	parts := strings.Split(v, ",")
+	if len(parts) != 4 {
+		return 0, 0, 0, 0, fmt.Errorf("invalid bbox %q", v)
+	}
+	var coords [4]float64
+	for i, p := range parts {
+		if coords[i], err = strconv.ParseFloat(strings.TrimSpace(p), 64); err != nil || math.IsNaN(coords[i]) {
+			return 0, 0, 0, 0, fmt.Errorf("invalid bbox %q", v)
+		}
+	}
+	west, south, east, north = coords[0], coords[1], coords[2], coords[3]
+	if west < -180 || west > 180 || east < -180 || east > 180 || south < -90 || north > 90 || south >= north || west == east {
+		return 0, 0, 0, 0, fmt.Errorf("invalid bbox %q", v)
+	}
+	return west, south, east, north, nil
+}
+
+// GetPlaces clusters the geotagged photos and videos inside a bounding box
+// on a grid for a map view. Each cluster has its centre, bounds, size and
+// its most recently captured file; a cluster of one is that file.
+//
+// Query parameters: bbox (west,south,east,north; the whole world by
+// default), grid (cells per side), type (image,video).
+func GetPlaces(c *gin.Context) {
+	if db == nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "DB not initialized"})
+		return
+	}
+
+	west, south, east, north, err := parseBBox(c.Query("bbox"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid bbox, expected west,south,east,north in degrees"})
+		return
+	}
+	grid, err := boundedIntParam(c.Query("grid"), defaultPlacesGrid, maxPlacesGrid)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid grid"})
+		return
+	}
+	width := east - west
+	if width < 0 {
+		width += 360
+	}
+
+	var args []any
+	arg := func(v any) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+	filter, ok := timelineFilter(c, arg)
+	if !ok {
+		return
+	}
+
+	// x is the longitude east of west, in [0, 360), so boxes crossing the
+	// antimeridian need no special case.
+	westArg, southArg, gridArg := arg(west), arg(south), arg(grid)
+	query := fmt.Sprintf(`
+		WITH geo AS (
+			SELECT f.id, e.latitude AS lat,
+				(e.longitude - %[1]s + 360) - 360 * floor((e.longitude - %[1]s + 360) / 360) AS x,
+				%[2]s AS captured_at
+			FROM files_table f
+			JOIN exif_table e ON e.file_id = f.id
+			WHERE %[3]s AND e.latitude IS NOT NULL AND e.longitude IS NOT NULL
+		)
+		SELECT COUNT(*), AVG(lat), AVG(x), MIN(lat), MAX(lat), MIN(x), MAX(x),
+			(array_agg(id ORDER BY captured_at DESC, id DESC))[1]
+		FROM geo
+		WHERE lat BETWEEN %[4]s AND %[5]s AND x <= %[6]s
+		GROUP BY LEAST(floor(x / %[6]s * %[7]s), %[7]s - 1), LEAST(floor((lat - %[4]s) / (%[5]s - %[4]s) * %[7]s), %[7]s - 1)
+		ORDER BY COUNT(*) DESC`,
+		westArg, capturedAtSQL, filter, southArg, arg(north), arg(width), gridArg)
+
+	rows, err := db.QueryContext(c.Request.Context(), query, args...)
+	if err != nil {
+		log.Printf("Error querying places: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to query places"})
+		return
+	}
+	defer rows.Close()
+
+	// longitude turns an offset east of west back into degrees.
+	longitude := func(x float64) float64 {
+		lon := west + x
+		if lon >= 180 {
+			lon -= 360
+		}
+		return lon
+	}
+	clusters := []gin.H{}
+	var coverIDs []int64
+	for rows.Next() {
+		var count, coverID int64
+		var lat, x, minLat, maxLat, minX, maxX float64
+		if err := rows.Scan(&count, &lat, &x, &minLat, &maxLat, &minX, &maxX, &coverID); err != nil {
+			log.Printf("Error scanning place cluster: %v", err)
+			continue
+		}
+		clusters = append(clusters, gin.H{
+			"latitude":  lat,
+			"longitude": longitude(x),
+			"count":     count,
+			"bounds": gin.H{
+				"west":  longitude(minX),
+				"south": minLat,
+				"east":  longitude(maxX),
+				"north": maxLat,
+			},
+		})
+		coverIDs = append(coverIDs, coverID)
+	}
+	if err := rows.Err(); err != nil {
+		log.Printf("Error reading places: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to query places"})
+		return
+	}
+
+	if len(coverIDs) > 0 {
+		covers, err := db.QueryContext(c.Request.Context(),
+			"SELECT "+mediaFileColumns+" FROM files_table f WHERE f.id = ANY($1)", pq.Array(coverIDs))
+		if err != nil {
+			log.Printf("Error querying place covers: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to query places"})
+			return
+		}
+		defer covers.Close()
+		entries := map[int64]gin.H{}
+		var files []gin.H
+		for covers.Next() {
+			f, err := scanMediaFile(covers)
+			if err != nil {
+				log.Printf("Error scanning place cover: %v", err)
+				continue
+			}
+			entries[f.ID] = f.entry()
+			files = append(files, entries[f.ID])
+		}
+		addExif(c.Request.Context(), files)
+		for i, id := range coverIDs {
+			if entry, ok := entries[id]; ok {
+				clusters[i]["file"] = entry
+			}
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"bbox":     gin.H{"west": west, "south": south, "east": east, "north": north},
+		"clusters": clusters,
+	})
+}
@@ -0,0 +1,105 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"io"
+	"log"
+	"media-server/assets"
+	"media-server/config"
+	dbstore "media-server/storage"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/gin-gonic/gin"
+	"golang.org/x/sync/singleflight"
+)
+
+// GetTrickplay serves the WebVTT index of a video's seek-preview sprite
+// sheets. Each cue maps a time range to a tile, as <sheet url>#xywh=x,y,w,h.
+// The sheets are rendered on first use if the background job hasn't yet.
+func GetTrickplay(c *gin.Context) {
+	if db == nil || r2Client == nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Service not initialized"})
+		return
+	}
+	if config.TrickplayInterval <= 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Seek previews are disabled"})
+		return
+	}
+
+	relPath := strings.TrimPrefix(c.Param("filepath"), "/")
+	relPath = filepath.ToSlash(filepath.Clean(relPath))
+	if strings.Contains(relPath, "..") {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid path"})
+		return
+	}
+
+	var fileID int64
+	var fileType string
+	err := db.QueryRow("SELECT id, type FROM files_table WHERE url = $1",
+		config.CloudflarePublicDevURL+"/"+relPath).Scan(&fileID, &fileType)
+	if err == sql.ErrNoRows || (err == nil && !dbstore.IsVideoFile(fileType)) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Video not found"})
+		return
+	}
+	if err != nil {
+		log.Printf("Error looking up %s: %v", relPath, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "DB error"})
+		return
+	}
+
+	indexKey := assets.TrickplayIndexKey(relPath)
+	if serveTrickplayIndex(c, indexKey) {
+		return
+	}
+
+	// An ok status with no index means the sheets were deleted; make them again.
+	status, err := dbstore.GetAssetStatus(db, fileID, dbstore.AssetKindTrickplay)
+	if err != nil {
+		log.Printf("Failed to read trickplay status of %s: %v", relPath, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "DB error"})
+		return
+	}
+	if !status.Due() && status.Status != dbstore.AssetStatusOK {
+		respondAssetUnavailable(c, status, "Seek previews")
+		return
+	}
+
+	_, done, err := waitForAsset(c.Request.Context(), func() <-chan singleflight.Result {
+		return dbstore.StartTrickplay(db, r2Client, config.CloudflareR2BucketName, fileID, relPath)
+	})
+	if !done {
+		respondAssetQueued(c, "Seek previews")
+		return
+	}
+	if errors.Is(err, dbstore.ErrNoStream) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Seek previews are not available for this file."})
+		return
+	}
+	if err != nil || !serveTrickplayIndex(c, indexKey) {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Seek preview generation failed"})
+	}
+}
+
+// serveTrickplayIndex copies the index object to the response, reporting
+// whether it exists.
+func serveTrickplayIndex(c *gin.Context, key string) bool {
+	resp, err := r2Client.GetObject(c.Request.Context(), &s3.GetObjectInput{
+		Bucket: aws.String(config.CloudflareR2BucketName),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return false
+	}
+	defer resp.Body.Close()
+
+	c.Header("Content-Type", "text/vtt")
+	c.Header("Access-Control-Allow-Origin", "*")
+	c.Status(http.StatusOK)
+	io.Copy(c.Writer, resp.Body)
+	return true
+}
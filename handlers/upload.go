@@ -1,24 +1,136 @@
 package handlers
 
 import (
+	"bufio"
+	"context"
+	"database/sql"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"media-server/config"
+	"media-server/mediatype"
+	"media-server/middleware"
 	dbstore "media-server/storage"
+	"mime/multipart"
 	"net/http"
+	"path"
 	"path/filepath"
 	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
 	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 	"github.com/gin-gonic/gin"
 )
 
 const multipartChunkSize = 5 * 1024 * 1024 // 5 MB chunks
 
+// maxRenameAttempts bounds the search for a free "name (n).ext" key.
+const maxRenameAttempts = 1000
+
+// Conflict policies accepted by the `conflict` query parameter of /upload.
+const (
+	conflictOverwrite = "overwrite"
+	conflictRename    = "rename"
+	conflictSkip      = "skip"
+	conflictFail      = "fail"
+)
+
+// Per-file upload outcomes reported in the `results` array.
+const (
+	uploadStatusUploaded    = "uploaded"
+	uploadStatusOverwritten = "overwritten"
+	uploadStatusRenamed     = "renamed"
+	uploadStatusSkipped     = "skipped"
+	uploadStatusConflict    = "conflict"
+	uploadStatusRejected    = "rejected"
+	uploadStatusQuota       = "quota_exceeded"
+	uploadStatusFailed      = "failed"
+)
+
+// UploadResult describes what happened to one file part of an upload request.
+type UploadResult struct {
+	Name        string `json:"name"`
+	StoredName  string `json:"storedName,omitempty"`
+	Path        string `json:"path,omitempty"`
+	URL         string `json:"url,omitempty"`
+	Size        int64  `json:"size,omitempty"`
+	ContentType string `json:"contentType,omitempty"`
+	Status      string `json:"status"`
+	Error       string `json:"error,omitempty"`
+	Warning     string `json:"warning,omitempty"`
+}
+
+func (r UploadResult) succeeded() bool {
+	switch r.Status {
+	case uploadStatusUploaded, uploadStatusOverwritten, uploadStatusRenamed:
+		return true
+	}
+	return false
+}
+
+// uploadSession holds the state shared by all parts of one upload request.
+type uploadSession struct {
+	uploader   *manager.Uploader
+	ownerID    string
+	uploadPath string
+	parentID   int64
+	policy     string
+
+	// claimed holds keys written earlier in this request; they count as
+	// taken even before the DB sees them, so two parts with the same name
+	// don't collide.
+	claimed map[string]bool
+
+	// quotaBytes is the owner's quota (0 = unlimited) and remainingQuota
+	// the number of bytes they may still store, or -1 when no quota applies.
+	quotaBytes     int64
+	remainingQuota int64
+}
+
+// uploadLimit returns how many bytes a part may have, or -1 for no limit, and
+// whether the owner's quota rather than maxUploadSize (0 = none) sets it.
+// remainingQuota is -1 without a quota, and replacedSize the size of the
+// owner's file the part overwrites, which is freed again.
+func uploadLimit(remainingQuota, replacedSize, maxUploadSize int64) (int64, bool) {
+	if remainingQuota >= 0 {
+		available := remainingQuota + replacedSize
+		if maxUploadSize == 0 || available < maxUploadSize {
+			return available, true
+		}
+	}
+	if maxUploadSize > 0 {
+		return maxUploadSize, false
+	}
+	return -1, false
+}
+
+// errUploadTooLarge is returned by limitReader once the limit is exceeded.
+var errUploadTooLarge = errors.New("upload exceeds size limit")
+
+// limitReader fails the stream as soon as more than limit bytes were read, so
+// oversized uploads are aborted instead of being stored.
+type limitReader struct {
+	r        io.Reader
+	limit    int64
+	read     int64
+	exceeded bool
+}
+
+func (l *limitReader) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	l.read += int64(n)
+	if l.read > l.limit {
+		l.exceeded = true
+		return n, errUploadTooLarge
+	}
+	return n, err
+}
+
 func UploadFiles(c *gin.Context) {
 	log.Println("UploadFiles handler hit")
 	if db == nil || r2Client == nil {
@@ -26,13 +138,19 @@ func UploadFiles(c *gin.Context) {
 		return
 	}
 
-	uploadPath := filepath.ToSlash(filepath.Clean(c.Query("path")))
-	if strings.Contains(uploadPath, "..") {
+	// 1. Validate the destination folder and the conflict policy
+	uploadPath, err := sanitizeFolderPath(c.Query("path"))
+	if err != nil || dbstore.ShouldSkip(uploadPath) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid path"})
 		return
 	}
-	if uploadPath == "." || uploadPath == "/" {
-		uploadPath = ""
+
+	policy := c.DefaultQuery("conflict", conflictRename)
+	switch policy {
+	case conflictOverwrite, conflictRename, conflictSkip, conflictFail:
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid conflict policy, expected overwrite, rename, skip or fail"})
+		return
 	}
 
 	// 2. Instantiate the S3 Uploader
@@ -43,8 +161,7 @@ func UploadFiles(c *gin.Context) {
 	})
 
 	ctx := c.Request.Context()
-	var uploadedFiles []gin.H
-	
+
 	// 3. Get a streaming multipart reader from the request
 	mpReader, err := c.Request.MultipartReader()
 	if err != nil {
@@ -65,7 +182,39 @@ func UploadFiles(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create destination folder in DB"})
 		return
 	}
-	
+
+	session := &uploadSession{
+		uploader:       uploader,
+		ownerID:        middleware.UserID(c),
+		uploadPath:     uploadPath,
+		parentID:       parentID,
+		policy:         policy,
+		claimed:        make(map[string]bool),
+		remainingQuota: -1,
+	}
+	session.quotaBytes, err = dbstore.QuotaBytes(db, session.ownerID)
+	if err != nil {
+		log.Printf("Error reading quota for %s: %v", session.ownerID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read storage quota"})
+		return
+	}
+	if session.quotaBytes > 0 {
+		used, err := dbstore.UsedBytes(db, session.ownerID)
+		if err != nil {
+			log.Printf("Error reading usage for %s: %v", session.ownerID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read storage usage"})
+			return
+		}
+		session.remainingQuota = max(session.quotaBytes-used, 0)
+		// A full quota still leaves room for files that replace others.
+		if session.remainingQuota == 0 && policy != conflictOverwrite {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": quotaExceededMessage(used, session.quotaBytes)})
+			return
+		}
+	}
+
+	results := []UploadResult{}
+
 	// 5. Process each part of the stream
 	for {
 		part, err := mpReader.NextPart()
@@ -74,7 +223,7 @@ func UploadFiles(c *gin.Context) {
 		}
 		if err != nil {
 			log.Printf("Error reading multipart part: %v", err)
-			continue
+			break
 		}
 
 		// Skip parts that are not files
@@ -83,68 +232,415 @@ func UploadFiles(c *gin.Context) {
 			continue
 		}
 
-		fileName := part.FileName()
-		key := filepath.ToSlash(filepath.Join(uploadPath, fileName))
-		publicURL := fmt.Sprintf("%s/%s", config.CloudflarePublicDevURL, key)
+		result := session.uploadPart(ctx, part)
+		// Must close the part after processing; this drains skipped parts.
+		part.Close()
+		results = append(results, result)
+	}
 
-		// The part object is an io.Reader, which we can pass directly to the uploader.
-		// The manager will read from this stream.
-		result, err := uploader.Upload(ctx, &s3.PutObjectInput{
-			Bucket: aws.String(config.CloudflareR2BucketName),
-			Key:    aws.String(key),
-			Body:   part, // Stream the part directly
+	uploaded := []UploadResult{}
+	conflicts := 0
+	skipped := 0
+	overQuota := 0
+	for _, r := range results {
+		switch {
+		case r.succeeded():
+			uploaded = append(uploaded, r)
+		case r.Status == uploadStatusConflict:
+			conflicts++
+		case r.Status == uploadStatusSkipped:
+			skipped++
+		case r.Status == uploadStatusQuota:
+			overQuota++
+		}
+	}
+
+	if len(uploaded) == 0 && skipped == 0 {
+		status := http.StatusBadRequest
+		message := "No files were successfully uploaded"
+		if overQuota > 0 {
+			status = http.StatusRequestEntityTooLarge
+			message = fmt.Sprintf("Storage quota of %s exceeded, no files were uploaded", formatBytes(session.quotaBytes))
+		} else if conflicts > 0 {
+			status = http.StatusConflict
+		}
+		c.JSON(status, gin.H{
+			"error":   message,
+			"results": results,
 		})
+		return
+	}
 
-		// Must close the part after processing
-		part.Close()
+	c.JSON(http.StatusOK, gin.H{
+		"message":  fmt.Sprintf("%d of %d files uploaded", len(uploaded), len(results)),
+		"uploaded": uploaded,
+		"results":  results,
+	})
+}
 
-		if err != nil {
-			log.Printf("Failed to upload file %s: %v", fileName, err)
-			// Decide if you want to stop or continue with other files
-			continue
+// uploadPart validates a single multipart file, streams it to R2 under the
+// session's folder applying the conflict policy, and records it in
+// files_table.
+func (s *uploadSession) uploadPart(ctx context.Context, part *multipart.Part) UploadResult {
+	result := UploadResult{Name: part.FileName()}
+
+	fileName := sanitizeFileName(part.FileName())
+	if fileName == "" {
+		result.Status = uploadStatusRejected
+		result.Error = "File name is empty after sanitization"
+		return result
+	}
+
+	key := path.Join(s.uploadPath, fileName)
+	if dbstore.ShouldSkip(key) {
+		result.Status = uploadStatusRejected
+		result.Error = "File name is reserved"
+		return result
+	}
+
+	// Sniff the real content type from the first bytes; the buffered reader
+	// keeps them for the upload itself.
+	body := bufio.NewReaderSize(part, mediatype.SniffLen)
+	prefix, err := body.Peek(mediatype.SniffLen)
+	if err != nil && err != io.EOF {
+		log.Printf("Failed to read %s: %v", fileName, err)
+		result.Status = uploadStatusFailed
+		result.Error = "Failed to read file"
+		return result
+	}
+
+	fileExt := filepath.Ext(fileName)
+	declared := mediatype.ByExtension(fileExt)
+	sniffed := mediatype.Detect(prefix)
+	contentType := sniffed
+	if mediatype.IsGeneric(sniffed) && declared != "" {
+		contentType = declared
+	}
+	result.ContentType = contentType
+
+	mismatch := !mediatype.Matches(declared, sniffed)
+	if mismatch {
+		if config.RejectTypeMismatch {
+			result.Status = uploadStatusRejected
+			result.Error = fmt.Sprintf("File content (%s) does not match its extension (%s)", sniffed, declared)
+			return result
 		}
+		result.Warning = fmt.Sprintf("File content (%s) does not match its extension (%s)", sniffed, declared)
+	}
+	if !mediatype.Allowed(contentType, config.UploadAllowedTypes, config.UploadDeniedTypes) {
+		result.Status = uploadStatusRejected
+		result.Error = fmt.Sprintf("File type %s is not allowed", contentType)
+		return result
+	}
 
-		log.Printf("Successfully uploaded %s to %s", fileName, result.Location)
+	// Resolve naming conflicts before any bytes are written
+	exists, err := objectTaken(ctx, key, s.claimed)
+	if err != nil {
+		log.Printf("Conflict check failed for %s: %v", key, err)
+		result.Status = uploadStatusFailed
+		result.Error = "Conflict check failed"
+		return result
+	}
 
-		// To get the file size, we need to query R2 after the upload,
-		// as we can't know the size from a stream beforehand.
-		head, err := r2Client.HeadObject(ctx, &s3.HeadObjectInput{
-			Bucket: aws.String(config.CloudflareR2BucketName),
-			Key:    aws.String(key),
-		})
-		if err != nil {
-			log.Printf("Failed to get metadata for %s after upload: %v", key, err)
-			continue
+	status := uploadStatusUploaded
+	if exists {
+		switch s.policy {
+		case conflictSkip:
+			result.Status = uploadStatusSkipped
+			result.Path = key
+			return result
+		case conflictFail:
+			result.Status = uploadStatusConflict
+			result.Path = key
+			result.Error = "A file with that name already exists"
+			return result
+		case conflictOverwrite:
+			status = uploadStatusOverwritten
+		case conflictRename:
+			key, fileName, err = nextFreeKey(ctx, s.uploadPath, fileName, s.claimed)
+			if err != nil {
+				log.Printf("Could not find a free name for %s: %v", part.FileName(), err)
+				result.Status = uploadStatusFailed
+				result.Error = "Could not find a free file name"
+				return result
+			}
+			status = uploadStatusRenamed
 		}
-		fileSize := head.ContentLength
+	}
+	s.claimed[key] = true
+	publicURL := fmt.Sprintf("%s/%s", config.CloudflarePublicDevURL, key)
 
-		// 6. Insert file metadata into the database
-		fileExt := filepath.Ext(fileName)
-		_, err = db.Exec(
-			`INSERT INTO files_table (ownerId, name, size, url, type, parent, created_at)
-			 VALUES ($1, $2, $3, $4, $5, $6, $7)`,
-			"default_user", fileName, fileSize, publicURL, fileExt, parentID, time.Now(),
-		)
-		if err != nil {
-			log.Printf("DB insert failed for %s: %v", fileName, err)
-			// You might want to delete the uploaded R2 object here for consistency
-			continue
+	// Only the owner may overwrite a file, which frees its size again.
+	var replacedSize int64
+	if status == uploadStatusOverwritten {
+		var ownerID string
+		err := db.QueryRowContext(ctx, "SELECT ownerId, size FROM files_table WHERE url = $1",
+			publicURL).Scan(&ownerID, &replacedSize)
+		if err != nil && err != sql.ErrNoRows {
+			log.Printf("Failed to read owner of %s before overwriting it: %v", key, err)
+			result.Status = uploadStatusFailed
+			result.Error = "Conflict check failed"
+			return result
 		}
+		if err == nil && ownerID != s.ownerID {
+			result.Status = uploadStatusConflict
+			result.Path = key
+			result.Error = "A file with that name belongs to another user"
+			return result
+		}
+	}
 
-		uploadedFiles = append(uploadedFiles, gin.H{
-			"name": fileName,
-			"size": fileSize,
-			"url":  publicURL,
-		})
+	// Enforce the per-file limit and the owner's remaining quota while
+	// streaming, since the size isn't known up front.
+	var limited *limitReader
+	limit, quotaBound := uploadLimit(s.remainingQuota, replacedSize, config.MaxUploadSize)
+	var reader io.Reader = body
+	if limit >= 0 {
+		limited = &limitReader{r: body, limit: limit}
+		reader = limited
 	}
 
-	if len(uploadedFiles) == 0 {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "No files were successfully uploaded"})
-		return
+	// The reader wraps the part, which we can pass directly to the uploader.
+	// The manager will read from this stream.
+	uploadOut, err := s.uploader.Upload(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(config.CloudflareR2BucketName),
+		Key:         aws.String(key),
+		Body:        reader, // Stream the part directly
+		ContentType: aws.String(contentType),
+	})
+	if err != nil {
+		result.Status = uploadStatusFailed
+		result.Error = "Upload to storage failed"
+		if limited != nil && limited.exceeded {
+			if quotaBound {
+				result.Status = uploadStatusQuota
+				result.Error = fmt.Sprintf("Storage quota of %s exceeded", formatBytes(s.quotaBytes))
+			} else {
+				result.Status = uploadStatusRejected
+				result.Error = fmt.Sprintf("File exceeds the maximum upload size of %s", formatBytes(config.MaxUploadSize))
+			}
+		}
+		log.Printf("Failed to upload file %s: %v", fileName, err)
+		return result
 	}
+	log.Printf("Successfully uploaded %s to %s", fileName, uploadOut.Location)
 
-	c.JSON(http.StatusOK, gin.H{
-		"message":  "Files uploaded successfully",
-		"uploaded": uploadedFiles,
+	// To get the file size, we need to query R2 after the upload,
+	// as we can't know the size from a stream beforehand.
+	head, err := r2Client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(config.CloudflareR2BucketName),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		log.Printf("Failed to get metadata for %s after upload: %v", key, err)
+		result.Status = uploadStatusFailed
+		result.Error = "Failed to read uploaded file metadata"
+		return result
+	}
+	fileSize := aws.ToInt64(head.ContentLength)
+
+	// 6. Insert (or, when overwriting, refresh) the file row. Derived assets
+	// are reset so they get regenerated for the new content.
+	var fileID int64
+	err = db.QueryRowContext(ctx,
+		`INSERT INTO files_table (ownerId, name, size, url, type, parent, created_at, content_type, type_mismatch)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		 ON CONFLICT (url) DO UPDATE SET
+			size = EXCLUDED.size,
+			created_at = EXCLUDED.created_at,
+			content_type = EXCLUDED.content_type,
+			type_mismatch = EXCLUDED.type_mismatch,
+			thumbnail_url = NULL,
+			thumbnail_source = 'auto',
+			thumbnail_source_key = NULL,
+			thumbnail_frame_ms = NULL,
+			subtitle_url = NULL,
+			preview_url = NULL,
+			display_url = NULL,
+			probed_at = NULL,
+			cues_indexed_at = NULL
+		 RETURNING id`,
+		s.ownerID, fileName, fileSize, publicURL, fileExt, s.parentID, time.Now(), contentType, mismatch,
+	).Scan(&fileID)
+	if err != nil {
+		log.Printf("DB insert failed for %s: %v", fileName, err)
+		if status != uploadStatusOverwritten {
+			// Don't leave an orphaned object behind that sync would re-import.
+			deleteObject(ctx, key)
+		}
+		result.Status = uploadStatusFailed
+		result.Error = "Failed to record file in database"
+		return result
+	}
+
+	if status == uploadStatusOverwritten {
+		deleteDerivedAssets(ctx, key)
+		if err := dbstore.ClearAssetStatus(ctx, db, fileID); err != nil {
+			log.Printf("Failed to reset asset status of %s: %v", key, err)
+		}
+	}
+	if err := dbstore.RefreshSearchDocument(db, fileID); err != nil {
+		log.Printf("Search index update failed for %s: %v", key, err)
+	}
+	if err := dbstore.RecognizeMedia(ctx, db, fileID, key); err != nil {
+		log.Printf("Failed to recognize %s: %v", key, err)
+	}
+	if s.remainingQuota >= 0 {
+		s.remainingQuota = max(s.remainingQuota+replacedSize-fileSize, 0)
+	}
+	if dbstore.IsVideoFile(fileExt) || dbstore.IsAudioFile(fileExt) {
+		dbstore.StartProbe(db, r2Client, config.CloudflareR2BucketName, fileID, key)
+	}
+	if dbstore.IsImageFile(fileExt) || dbstore.IsAudioFile(fileExt) {
+		// Photos aren't probed; their metadata is read along with the
+		// thumbnail. Audio files get their cover art. Both run in the
+		// background.
+		dbstore.StartThumbnail(db, r2Client, config.CloudflareR2BucketName, fileID, key)
+	}
+	if dbstore.IsSubtitleFile(fileExt) {
+		go dbstore.AttachSidecarSubtitles(db, r2Client, config.CloudflareR2BucketName, []string{key})
+	}
+	if dbstore.IsMetadataSidecar(key) {
+		go dbstore.AttachSidecarMetadata(db, r2Client, config.CloudflareR2BucketName, []string{key})
+	} else if dbstore.IsVideoFile(fileExt) {
+		// Artwork and NFO files uploaded before the video can now be matched.
+		go dbstore.AttachFolderSidecars(db, r2Client, config.CloudflareR2BucketName, s.parentID)
+	}
+
+	result.Status = status
+	result.StoredName = fileName
+	result.Path = key
+	result.URL = publicURL
+	result.Size = fileSize
+	return result
+}
+
+// objectTaken reports whether key is already used by this request, by a row
+// in files_table or by an object in the bucket.
+func objectTaken(ctx context.Context, key string, claimed map[string]bool) (bool, error) {
+	if claimed[key] {
+		return true, nil
+	}
+
+	var id int64
+	url := fmt.Sprintf("%s/%s", config.CloudflarePublicDevURL, key)
+	err := db.QueryRowContext(ctx, "SELECT id FROM files_table WHERE url = $1", url).Scan(&id)
+	if err == nil {
+		return true, nil
+	}
+	if err != sql.ErrNoRows {
+		return false, err
+	}
+
+	// An object that is in R2 but not in the DB would be clobbered too.
+	_, err = r2Client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(config.CloudflareR2BucketName),
+		Key:    aws.String(key),
 	})
+	if isNotFound(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// isNotFound reports whether an R2 request failed because the object doesn't
+// exist, as opposed to a network or permission error.
+func isNotFound(err error) bool {
+	var notFound *types.NotFound
+	var noSuchKey *types.NoSuchKey
+	var respErr *awshttp.ResponseError
+	return errors.As(err, &notFound) || errors.As(err, &noSuchKey) ||
+		(errors.As(err, &respErr) && respErr.HTTPStatusCode() == http.StatusNotFound)
+}
+
+// nextFreeKey finds the first "name (n).ext" in dir that is not taken.
+func nextFreeKey(ctx context.Context, dir, fileName string, claimed map[string]bool) (string, string, error) {
+	for n := 1; n <= maxRenameAttempts; n++ {
+		candidate := numberedFileName(fileName, n)
+		key := path.Join(dir, candidate)
+		taken, err := objectTaken(ctx, key, claimed)
+		if err != nil {
+			return "", "", err
+		}
+		if !taken {
+			return key, candidate, nil
+		}
+	}
+	return "", "", fmt.Errorf("no free name after %d attempts", maxRenameAttempts)
+}
+
+// deleteObject removes an object from the bucket, logging failures.
+func deleteObject(ctx context.Context, key string) {
+	_, err := r2Client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(config.CloudflareR2BucketName),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		log.Printf("Failed to delete object %s: %v", key, err)
+	}
+}
+
+// deleteDerivedAssets removes every asset generated for key so stale assets
+// aren't served after the source was replaced.
+func deleteDerivedAssets(ctx context.Context, key string) {
+	url := fmt.Sprintf("%s/%s", config.CloudflarePublicDevURL, key)
+	rows, err := db.QueryContext(ctx, `
+		DELETE FROM derived_assets_table
+		WHERE file_id = (SELECT id FROM files_table WHERE url = $1)
+		RETURNING object_key
+	`, url)
+	if err != nil {
+		log.Printf("Failed to clear derived assets of %s: %v", key, err)
+	} else {
+		defer rows.Close()
+		for rows.Next() {
+			var objectKey string
+			if err := rows.Scan(&objectKey); err == nil {
+				deleteObject(ctx, objectKey)
+			}
+		}
+	}
+
+	_, err = db.ExecContext(ctx, `
+		DELETE FROM subtitle_cues_table
+		WHERE file_id = (SELECT id FROM files_table WHERE url = $1)
+	`, url)
+	if err != nil {
+		log.Printf("Failed to clear subtitle cues of %s: %v", key, err)
+	}
+	_, err = db.ExecContext(ctx, `
+		DELETE FROM subtitle_tracks_table
+		WHERE file_id = (SELECT id FROM files_table WHERE url = $1)
+	`, url)
+	if err != nil {
+		log.Printf("Failed to clear subtitle tracks of %s: %v", key, err)
+	}
+
+	// An overwritten sidecar invalidates the track converted from it.
+	rows, err = db.QueryContext(ctx, `
+		WITH tracks AS (
+			DELETE FROM subtitle_tracks_table
+			WHERE sidecar_file_id = (SELECT id FROM files_table WHERE url = $1)
+			RETURNING object_key
+		)
+		DELETE FROM derived_assets_table
+		WHERE object_key IN (SELECT object_key FROM tracks)
+		RETURNING object_key
+	`, url)
+	if err != nil {
+		log.Printf("Failed to clear sidecar tracks of %s: %v", key, err)
+	} else {
+		defer rows.Close()
+		for rows.Next() {
+			var objectKey string
+			if err := rows.Scan(&objectKey); err == nil {
+				deleteObject(ctx, objectKey)
+			}
+		}
+	}
+
+	// Assets generated before accounting existed aren't in the table.
+	base := strings.TrimSuffix(key, filepath.Ext(key))
+	deleteObject(ctx, "thumbnails/"+base+".jpg")
+	deleteObject(ctx, "subtitles/"+base+".vtt")
 }
@@ -0,0 +1,59 @@
+package handlers
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestUploadLimit(t *testing.T) {
+	tests := []struct {
+		name           string
+		remainingQuota int64
+		replacedSize   int64
+		maxUploadSize  int64
+		wantLimit      int64
+		wantQuota      bool
+	}{
+		{"no limits", -1, 0, 0, -1, false},
+		{"max upload size only", -1, 500, 100, 100, false},
+		{"quota below max size", 50, 0, 100, 50, true},
+		{"quota above max size", 500, 0, 100, 100, false},
+		{"quota without max size", 500, 0, 0, 500, true},
+		{"full quota", 0, 0, 0, 0, true},
+		{"overwrite credits the replaced file", 0, 70, 0, 70, true},
+		{"credit capped by max size", 40, 70, 100, 100, false},
+		{"credit below max size", 10, 70, 100, 80, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			limit, quota := uploadLimit(tt.remainingQuota, tt.replacedSize, tt.maxUploadSize)
+			if limit != tt.wantLimit || quota != tt.wantQuota {
+				t.Errorf("uploadLimit(%d, %d, %d) = %d, %v, want %d, %v",
+					tt.remainingQuota, tt.replacedSize, tt.maxUploadSize, limit, quota, tt.wantLimit, tt.wantQuota)
+			}
+		})
+	}
+}
+
+func TestLimitReader(t *testing.T) {
+	tests := []struct {
+		size     int
+		limit    int64
+		exceeded bool
+	}{
+		{0, 0, false},
+		{10, 10, false},
+		{11, 10, true},
+		{10, 0, true},
+	}
+	for _, tt := range tests {
+		l := &limitReader{r: strings.NewReader(strings.Repeat("x", tt.size)), limit: tt.limit}
+		_, err := io.ReadAll(l)
+		if l.exceeded != tt.exceeded || errors.Is(err, errUploadTooLarge) != tt.exceeded {
+			t.Errorf("%d bytes with limit %d: exceeded = %v, err = %v, want exceeded %v",
+				tt.size, tt.limit, l.exceeded, err, tt.exceeded)
+		}
+	}
+}
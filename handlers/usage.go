@@ -0,0 +1,48 @@
+package handlers
+
+import (
+	"fmt"
+	"log"
+	"media-server/middleware"
+	dbstore "media-server/storage"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// GetUsage reports the storage consumed by the current user, including
+// derived assets, with a per-folder breakdown.
+func GetUsage(c *gin.Context) {
+	if db == nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "DB not initialized"})
+		return
+	}
+
+	usage, err := dbstore.GetUsage(db, middleware.UserID(c))
+	if err != nil {
+		log.Printf("Error computing usage: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to compute usage"})
+		return
+	}
+
+	c.JSON(http.StatusOK, usage)
+}
+
+// quotaExceededMessage is the error returned when an owner has no space left.
+func quotaExceededMessage(used, quota int64) string {
+	return fmt.Sprintf("Storage quota exceeded: %s of %s used", formatBytes(used), formatBytes(quota))
+}
+
+// formatBytes renders a byte count with a binary unit, e.g. "1.50 GB".
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.2f %cB", float64(n)/float64(div), "KMGTPE"[exp])
+}
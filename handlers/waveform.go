@@ -0,0 +1,180 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"io"
+	"log"
+	"media-server/assets"
+	"media-server/config"
+	dbstore "media-server/storage"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/gin-gonic/gin"
+	"golang.org/x/sync/singleflight"
+)
+
+// maxWaveformWidth bounds the number of peaks a client can ask for.
+const maxWaveformWidth = 100000
+
+// GetWaveform serves the waveform peaks of an audio or video file, as
+// audiowaveform JSON or, with format=dat, its binary data format. The peaks
+// are computed on first use if the background job hasn't yet.
+//
+// Query parameters: width (number of peaks to fit the whole file in) or
+// pixels_per_second, bits (8 or 16, default 16), format (json or dat).
+// Without width or pixels_per_second the stored resolution is served.
+func GetWaveform(c *gin.Context) {
+	if db == nil || r2Client == nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Service not initialized"})
+		return
+	}
+	if config.WaveformResolution <= 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Waveforms are disabled"})
+		return
+	}
+
+	relPath := strings.TrimPrefix(c.Param("filepath"), "/")
+	relPath = filepath.ToSlash(filepath.Clean(relPath))
+	if strings.Contains(relPath, "..") {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid path"})
+		return
+	}
+
+	width, err := boundedIntParam(c.Query("width"), 0, maxWaveformWidth)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid width"})
+		return
+	}
+	pixelsPerSecond, err := boundedIntParam(c.Query("pixels_per_second"), 0, config.WaveformResolution)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid pixels_per_second"})
+		return
+	}
+	if width > 0 && pixelsPerSecond > 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Use either width or pixels_per_second"})
+		return
+	}
+	bits := c.DefaultQuery("bits", "16")
+	format := c.DefaultQuery("format", "json")
+	if (bits != "8" && bits != "16") || (format != "json" && format != "dat") {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unsupported bits or format"})
+		return
+	}
+
+	var fileID int64
+	var fileType string
+	err = db.QueryRow("SELECT id, type FROM files_table WHERE url = $1",
+		config.CloudflarePublicDevURL+"/"+relPath).Scan(&fileID, &fileType)
+	if err == sql.ErrNoRows || (err == nil && !dbstore.IsVideoFile(fileType) && !dbstore.IsAudioFile(fileType)) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Media not found"})
+		return
+	}
+	if err != nil {
+		log.Printf("Error looking up %s: %v", relPath, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "DB error"})
+		return
+	}
+
+	key := assets.WaveformKey(relPath)
+	waveform, err := readWaveform(c.Request.Context(), key)
+	if err != nil && !isNotFound(err) {
+		// Only missing peaks are computed again; that decodes the whole file.
+		log.Printf("Failed to read waveform of %s: %v", relPath, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read waveform"})
+		return
+	}
+	if err != nil {
+		// An ok status with no peaks means they were deleted; compute them again.
+		status, err := dbstore.GetAssetStatus(db, fileID, dbstore.AssetKindWaveform)
+		if err != nil {
+			log.Printf("Failed to read waveform status of %s: %v", relPath, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "DB error"})
+			return
+		}
+		if !status.Due() && status.Status != dbstore.AssetStatusOK {
+			respondAssetUnavailable(c, status, "Waveforms")
+			return
+		}
+
+		_, done, err := waitForAsset(c.Request.Context(), func() <-chan singleflight.Result {
+			return dbstore.StartWaveform(db, r2Client, config.CloudflareR2BucketName, fileID, relPath)
+		})
+		if !done {
+			respondAssetQueued(c, "Waveforms")
+			return
+		}
+		if errors.Is(err, dbstore.ErrNoStream) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "This file has no audio."})
+			return
+		}
+		if err == nil {
+			waveform, err = readWaveform(c.Request.Context(), key)
+		}
+		if err != nil {
+			log.Printf("Failed to read waveform of %s: %v", relPath, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Waveform generation failed"})
+			return
+		}
+	}
+
+	// Buckets can only be merged, so the stored resolution is the finest.
+	factor := 1
+	if width > 0 {
+		factor = (waveform.Length() + width - 1) / width
+	} else if pixelsPerSecond > 0 {
+		factor = waveform.SampleRate / waveform.SamplesPerPixel / pixelsPerSecond
+	}
+	waveform = waveform.Resample(factor)
+
+	if format == "dat" {
+		if bits == "8" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "The dat format is only served with 16 bits"})
+			return
+		}
+		data, _ := waveform.MarshalBinary()
+		c.Data(http.StatusOK, "application/octet-stream", data)
+		return
+	}
+
+	peaks := make([]int, len(waveform.Data))
+	for i, v := range waveform.Data {
+		peaks[i] = int(v)
+		if bits == "8" {
+			peaks[i] >>= 8
+		}
+	}
+	n, _ := strconv.Atoi(bits)
+	c.JSON(http.StatusOK, gin.H{
+		"version":           2,
+		"channels":          1,
+		"sample_rate":       waveform.SampleRate,
+		"samples_per_pixel": waveform.SamplesPerPixel,
+		"bits":              n,
+		"length":            waveform.Length(),
+		"data":              peaks,
+	})
+}
+
+// readWaveform downloads and decodes stored waveform peaks.
+func readWaveform(ctx context.Context, key string) (*assets.Waveform, error) {
+	resp, err := r2Client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(config.CloudflareR2BucketName),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	return assets.ParseWaveform(data)
+}
@@ -1,12 +1,15 @@
 package main
 
 import (
+	"database/sql"
 	"fmt"
 	"log"
 	"media-server/config"
 	"media-server/handlers"
 	"media-server/r2"
 	"media-server/storage"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
 )
 
 func main() {
@@ -31,19 +34,48 @@ func main() {
 	handlers.SetDB(db)
 	handlers.SetR2Client(r2Client)
 
+	// Step 1: Bring the library up to date in the background, so a large
+	// backlog doesn't keep the server down after a deploy
+	go backfill(db, r2Client)
+
+	// Step 2: Start the HTTP server
+	r := setupRouter()
+	r.Run(fmt.Sprintf(":%v", config.AppPort))
+}
+
+// backfill syncs new R2 objects into the DB, fills in data that older
+// versions didn't record and generates missing assets. Errors are logged and
+// the remaining steps still run.
+func backfill(db *sql.DB, r2Client *s3.Client) {
+	bucket := config.CloudflareR2BucketName
+
 	// Step 1: Sync files from R2 to DB (inserts any new files)
-	err = storage.SyncFilesWithR2(db, r2Client, config.CloudflareR2BucketName)
-	if err != nil {
-		log.Fatalf("Error Syncing Files from R2: %v", err)
+	if err := storage.SyncFilesWithR2(db, r2Client, bucket); err != nil {
+		log.Printf("Error Syncing Files from R2: %v", err)
 	}
 
-	// Step 2: For already-synced files, generate missing thumbnails/subtitles
-	err = storage.GenerateMissingAssetsForExistingFiles(db, r2Client, config.CloudflareR2BucketName)
-	if err != nil {
-		log.Fatalf("Error Generating Thumbnails/Subtitles: %v", err)
+	// Step 2: Probe duration/dimensions of files that haven't been probed yet
+	if err := storage.ProbeMissingMetadata(db, r2Client, bucket); err != nil {
+		log.Printf("Error Probing Media Metadata: %v", err)
 	}
 
-	// Step 3: Start the HTTP server
-	r := setupRouter()
-	r.Run(fmt.Sprintf(":%v", config.AppPort))
+	// Step 3: Bring the search index up to date with names, folders and probe data
+	if err := storage.RefreshSearchDocuments(db); err != nil {
+		log.Printf("Error Refreshing Search Index: %v", err)
+	}
+
+	// Step 4: Recognize movies and episodes synced before recognition existed
+	if err := storage.RecognizeMissingMedia(db); err != nil {
+		log.Printf("Error Recognizing Movies and Episodes: %v", err)
+	}
+
+	// Step 5: Index the cues of subtitles extracted before dialogue search existed
+	if err := storage.IndexMissingSubtitleCues(db, r2Client, bucket); err != nil {
+		log.Printf("Error Indexing Subtitle Cues: %v", err)
+	}
+
+	// Step 6: Generate missing thumbnails/subtitles and other assets, then
+	// keep retrying the ones that failed transiently. Every job holds its
+	// weight of the shared ffmpeg budget while it runs.
+	storage.RunAssetRetries(db, r2Client, bucket, config.AssetRetryInterval)
 }
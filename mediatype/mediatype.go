@@ -0,0 +1,188 @@
+package mediatype
+
+import (
+	"bytes"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// SniffLen is the number of leading bytes Detect looks at.
+const SniffLen = 512
+
+// Generic is returned when the content type can't be determined.
+const Generic = "application/octet-stream"
+
+// extraTypes covers media extensions that the system MIME tables often lack.
+var extraTypes = map[string]string{
+	".mkv":  "video/x-matroska",
+	".mka":  "audio/x-matroska",
+	".webm": "video/webm",
+	".mp4":  "video/mp4",
+	".m4v":  "video/mp4",
+	".mov":  "video/quicktime",
+	".avi":  "video/x-msvideo",
+	".ts":   "video/mp2t",
+	".mp3":  "audio/mpeg",
+	".m4a":  "audio/mp4",
+	".m4b":  "audio/mp4",
+	".aac":  "audio/aac",
+	".flac": "audio/flac",
+	".ogg":  "audio/ogg",
+	".opus": "audio/ogg",
+	".wav":  "audio/wav",
+	".jpg":  "image/jpeg",
+	".jpeg": "image/jpeg",
+	".png":  "image/png",
+	".gif":  "image/gif",
+	".webp": "image/webp",
+	".heic": "image/heic",
+	".heif": "image/heif",
+	".avif": "image/avif",
+	".vtt":  "text/vtt",
+	".srt":  "application/x-subrip",
+	".ass":  "text/x-ssa",
+	".ssa":  "text/x-ssa",
+	".nfo":  "text/xml",
+}
+
+// ByExtension returns the MIME type conventionally used for ext (including the
+// leading dot), or "" if it is unknown.
+func ByExtension(ext string) string {
+	ext = strings.ToLower(ext)
+	if t, ok := extraTypes[ext]; ok {
+		return t
+	}
+	if t := mime.TypeByExtension(ext); t != "" {
+		return stripParams(t)
+	}
+	return ""
+}
+
+// Detect returns the MIME type implied by the leading bytes of a file. It
+// knows the common audio/video containers and falls back to
+// http.DetectContentType for everything else.
+func Detect(head []byte) string {
+	switch {
+	case bytes.HasPrefix(head, []byte{0x1A, 0x45, 0xDF, 0xA3}):
+		// EBML header; the DocType tells WebM from Matroska.
+		if bytes.Contains(head[:min(len(head), 64)], []byte("webm")) {
+			return "video/webm"
+		}
+		return "video/x-matroska"
+	case len(head) >= 12 && string(head[4:8]) == "ftyp":
+		return detectISOBMFF(string(head[8:12]))
+	case len(head) >= 12 && string(head[0:4]) == "RIFF":
+		switch string(head[8:12]) {
+		case "AVI ":
+			return "video/x-msvideo"
+		case "WAVE":
+			return "audio/wav"
+		case "WEBP":
+			return "image/webp"
+		}
+	case bytes.HasPrefix(head, []byte("fLaC")):
+		return "audio/flac"
+	case bytes.HasPrefix(head, []byte("OggS")):
+		return "audio/ogg"
+	case bytes.HasPrefix(head, []byte("ID3")):
+		return "audio/mpeg"
+	case len(head) >= 2 && head[0] == 0xFF && head[1]&0xF6 == 0xF0:
+		return "audio/aac"
+	case len(head) >= 2 && head[0] == 0xFF && head[1]&0xE0 == 0xE0:
+		return "audio/mpeg"
+	case len(head) >= 189 && head[0] == 0x47 && head[188] == 0x47:
+		return "video/mp2t"
+	case bytes.HasPrefix(head, []byte("WEBVTT")):
+		return "text/vtt"
+	}
+	return stripParams(http.DetectContentType(head))
+}
+
+// detectISOBMFF maps an ISO base media file "ftyp" major brand to a MIME type.
+func detectISOBMFF(brand string) string {
+	switch brand {
+	case "qt  ":
+		return "video/quicktime"
+	case "M4A ", "M4B ", "M4P ":
+		return "audio/mp4"
+	case "heic", "heix", "heim", "heis", "hevc", "hevx":
+		return "image/heic"
+	case "mif1", "msf1":
+		return "image/heif"
+	case "avif", "avis":
+		return "image/avif"
+	case "3gp4", "3gp5", "3gp6", "3g2a":
+		return "video/3gpp"
+	}
+	return "video/mp4"
+}
+
+// IsGeneric reports whether t carries no real information about the content,
+// e.g. plain text or unknown binary.
+func IsGeneric(t string) bool {
+	return t == "" || t == Generic || t == "text/plain"
+}
+
+// Matches reports whether the sniffed type is consistent with the type implied
+// by the file extension. Audio and video containers are interchangeable (an
+// .mp4 may hold only audio), and generic results are never a mismatch.
+func Matches(declared, sniffed string) bool {
+	if IsGeneric(declared) || IsGeneric(sniffed) {
+		return true
+	}
+	if declared == sniffed {
+		return true
+	}
+	df, sf := family(declared), family(sniffed)
+	if df == sf {
+		return true
+	}
+	return isAV(df) && isAV(sf)
+}
+
+// Allowed reports whether t matches at least one allow pattern and no deny
+// pattern. Patterns are full types ("video/mp4") or wildcards ("video/*"). An
+// empty allow list allows everything.
+func Allowed(t string, allow, deny []string) bool {
+	for _, p := range deny {
+		if matchPattern(p, t) {
+			return false
+		}
+	}
+	if len(allow) == 0 {
+		return true
+	}
+	for _, p := range allow {
+		if matchPattern(p, t) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchPattern(pattern, t string) bool {
+	pattern = strings.ToLower(strings.TrimSpace(pattern))
+	t = strings.ToLower(t)
+	if pattern == "*" || pattern == "*/*" {
+		return true
+	}
+	if prefix, ok := strings.CutSuffix(pattern, "/*"); ok {
+		return family(t) == prefix
+	}
+	return pattern == t
+}
+
+func family(t string) string {
+	f, _, _ := strings.Cut(t, "/")
+	return f
+}
+
+func isAV(f string) bool {
+	return f == "audio" || f == "video"
+}
+
+func stripParams(t string) string {
+	t, _, _ = strings.Cut(t, ";")
+	return strings.TrimSpace(t)
+}
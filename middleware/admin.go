@@ -0,0 +1,21 @@
+package middleware
+
+import (
+	"media-server/config"
+	"net/http"
+	"slices"
+
+	"github.com/gin-gonic/gin"
+)
+
+// RequireAdmin only lets through users listed in ADMIN_USER_IDS. It must run
+// after JWTAuthMiddleware.
+func RequireAdmin() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !slices.Contains(config.AdminUserIDs, UserID(c)) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Admin access required"})
+			return
+		}
+		c.Next()
+	}
+}
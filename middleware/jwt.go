@@ -61,3 +61,24 @@ func JWTAuthMiddleware() gin.HandlerFunc {
 		c.Next()
 	}
 }
+
+// DefaultUserID owns files that were synced from the bucket rather than
+// uploaded by a signed-in user.
+const DefaultUserID = "default_user"
+
+// UserID returns the subject of the authenticated token, or DefaultUserID when
+// the request carries no user claims.
+func UserID(c *gin.Context) string {
+	claims, ok := c.Get("userClaims")
+	if !ok {
+		return DefaultUserID
+	}
+	mapClaims, ok := claims.(jwt.MapClaims)
+	if !ok {
+		return DefaultUserID
+	}
+	if sub, ok := mapClaims["sub"].(string); ok && sub != "" {
+		return sub
+	}
+	return DefaultUserID
+}
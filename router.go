@@ -27,22 +27,66 @@ func setupRouter() *gin.Engine {
 	r.GET("/health", handlers.Health)
 	r.GET("/proxy_subtitle/*filepath", handlers.ProxySubtitle)
 
+	// Subsonic API for music apps; authenticated by API tokens
+	r.Any("/rest/:method", handlers.Subsonic)
+
+	// Podcast feeds of folders; authenticated by the token in the URL
+	r.GET("/feeds/:token/rss", handlers.GetFeed)
+	r.GET("/feeds/:token/media/:id/*name", handlers.GetFeedMedia)
+	r.HEAD("/feeds/:token/media/:id/*name", handlers.GetFeedMedia)
+
 
 	// Protected routes
 	authorized := r.Group("/")
 	authorized.Use(middleware.JWTAuthMiddleware())
 	{
 		authorized.GET("/media", handlers.ListMedia)
+		authorized.PUT("/media/tags", handlers.SetTags)
+		authorized.PUT("/media/thumbnail", handlers.UploadThumbnail)
+		authorized.POST("/media/thumbnail/frame", handlers.SelectThumbnailFrame)
+		authorized.DELETE("/media/thumbnail", handlers.RevertThumbnail)
+		authorized.GET("/media/subtitles", handlers.ListSubtitles)
+		authorized.POST("/media/subtitles", handlers.UploadSubtitle)
+		authorized.POST("/media/subtitles/:id/timing", handlers.RetimeSubtitle)
+		authorized.GET("/media/subtitles/:id/revisions", handlers.ListSubtitleRevisions)
+		authorized.PUT("/media/subtitles/:id/revision", handlers.SelectSubtitleRevision)
+		authorized.GET("/search", handlers.Search)
+		authorized.GET("/search/dialogue", handlers.SearchDialogue)
+		authorized.GET("/timeline", handlers.GetTimeline)
+		authorized.GET("/timeline/items", handlers.GetTimelineItems)
+		authorized.GET("/places", handlers.GetPlaces)
+		authorized.GET("/music/artists", handlers.ListArtists)
+		authorized.GET("/music/artists/:id", handlers.GetArtist)
+		authorized.GET("/music/albums", handlers.ListAlbums)
+		authorized.GET("/music/albums/:id", handlers.GetAlbum)
+		authorized.GET("/music/tracks", handlers.ListTracks)
+		authorized.GET("/shows", handlers.ListShows)
+		authorized.GET("/shows/:id/seasons", handlers.GetShowSeasons)
+		authorized.GET("/movies", handlers.ListMovies)
+		authorized.GET("/subsonic/tokens", handlers.ListAPITokens)
+		authorized.POST("/subsonic/tokens", handlers.CreateAPIToken)
+		authorized.DELETE("/subsonic/tokens/:id", handlers.DeleteAPIToken)
+		authorized.GET("/feeds", handlers.ListFeeds)
+		authorized.POST("/feeds", handlers.CreateFeed)
+		authorized.DELETE("/feeds/:id", handlers.DeleteFeed)
 		authorized.GET("/media_stream", handlers.ServeMedia) // This will now be a redirect handler
 		authorized.GET("/thumbnail/*filepath", handlers.GetThumbnail)
 		authorized.GET("/proxy_thumbnail/*filepath", handlers.ProxyThumbnail)
 
 		authorized.GET("/subtitle/*filepath", handlers.GetSubtitles)
+		authorized.GET("/trickplay/*filepath", handlers.GetTrickplay)
+		authorized.GET("/waveform/*filepath", handlers.GetWaveform)
 		// authorized.
 		
 		
 		authorized.GET("/user/:name", handlers.GetUser)
 
+		authorized.GET("/usage", handlers.GetUsage)
+
+		admin := authorized.Group("/admin", middleware.RequireAdmin())
+		admin.GET("/assets", handlers.ListAssetStatuses)
+		admin.POST("/assets/requeue", handlers.RequeueAssets)
+
 		authorized.POST("/upload", handlers.UploadFiles)
 		authorized.PUT("/rename", handlers.RenameFile)
 	}
@@ -0,0 +1,288 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"media-server/assets"
+	"media-server/config"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/lib/pq"
+)
+
+// Generation states of a derived asset.
+const (
+	AssetStatusPending  = "pending"   // Not attempted yet, or requeued
+	AssetStatusOK       = "ok"        // Generated
+	AssetStatusNoStream = "no_stream" // The file has nothing to generate it from
+	AssetStatusError    = "error"     // Generation failed; retried with backoff
+)
+
+// ErrNoStream is returned by asset generators when the source has no stream
+// to generate the asset from, e.g. a video without subtitles. It is final and
+// never retried automatically.
+var ErrNoStream = assets.ErrNoStream
+
+// Retry backoff after failed attempts: assetRetryBase, doubling per attempt,
+// capped at assetRetryMax.
+const (
+	assetRetryBase = 5 * time.Minute
+	assetRetryMax  = 6 * time.Hour
+)
+
+// CreateAssetStatusTableSQL records the outcome of generating each derived
+// asset of a file. Files without a row haven't been attempted yet.
+const CreateAssetStatusTableSQL = `
+CREATE TABLE IF NOT EXISTS asset_status_table (
+    file_id INTEGER NOT NULL,
+    kind TEXT NOT NULL,
+    status TEXT NOT NULL DEFAULT 'pending',
+    message TEXT,
+    attempts INTEGER NOT NULL DEFAULT 0,
+    last_attempt_at TIMESTAMP,
+    next_attempt_at TIMESTAMP,
+    PRIMARY KEY (file_id, kind),
+    CONSTRAINT fk_status_file
+        FOREIGN KEY (file_id)
+        REFERENCES files_table(id)
+        ON DELETE CASCADE
+);
+`
+
+// AssetStatusMigrations carry subtitle_gen_failed over into the status table.
+// The old flag didn't tell missing streams from crashes, so those files are
+// retried once.
+var AssetStatusMigrations = []string{
+	`CREATE INDEX IF NOT EXISTS asset_status_status_index ON asset_status_table (status, next_attempt_at);`,
+	`INSERT INTO asset_status_table (file_id, kind, status, message, attempts, last_attempt_at, next_attempt_at)
+		SELECT id, 'subtitle', 'error', 'failed before generation status was tracked', 1, NOW(), NOW()
+		FROM files_table WHERE subtitle_gen_failed
+		ON CONFLICT (file_id, kind) DO NOTHING;`,
+	`UPDATE files_table SET subtitle_gen_failed = FALSE WHERE subtitle_gen_failed;`,
+}
+
+// assetDueSQL is true for a status row s whose asset should be generated now.
+const assetDueSQL = `(s.status = 'pending' OR (s.status = 'error' AND s.attempts < $%d AND (s.next_attempt_at IS NULL OR s.next_attempt_at <= NOW())))`
+
+// AssetStatus is a row of asset_status_table.
+type AssetStatus struct {
+	FileID        int64      `json:"file_id"`
+	Kind          string     `json:"kind"`
+	Status        string     `json:"status"`
+	Message       string     `json:"message,omitempty"`
+	Attempts      int        `json:"attempts"`
+	LastAttemptAt *time.Time `json:"last_attempt_at"`
+	NextAttemptAt *time.Time `json:"next_attempt_at"`
+}
+
+// Due reports whether the asset should be generated now.
+func (s AssetStatus) Due() bool {
+	switch s.Status {
+	case AssetStatusPending:
+		return true
+	case AssetStatusError:
+		return s.Attempts < config.AssetMaxAttempts && (s.NextAttemptAt == nil || !s.NextAttemptAt.After(time.Now()))
+	}
+	return false
+}
+
+// Exhausted reports whether a failed asset has used up its automatic retries.
+func (s AssetStatus) Exhausted() bool {
+	return s.Status == AssetStatusError && s.Attempts >= config.AssetMaxAttempts
+}
+
+// InitAssetStatus creates the status table and migrates the old failure flag.
+func InitAssetStatus(db *sql.DB) error {
+	if _, err := db.Exec(CreateAssetStatusTableSQL); err != nil {
+		return fmt.Errorf("failed to create asset_status_table: %w", err)
+	}
+	for _, migration := range AssetStatusMigrations {
+		if _, err := db.Exec(migration); err != nil {
+			return fmt.Errorf("failed to migrate asset_status_table: %w", err)
+		}
+	}
+	log.Println("Created/Verified Table: asset_status_table")
+	return nil
+}
+
+// GetAssetStatus returns the status of an asset; assets never attempted are
+// pending.
+func GetAssetStatus(db *sql.DB, fileID int64, kind string) (AssetStatus, error) {
+	s := AssetStatus{FileID: fileID, Kind: kind, Status: AssetStatusPending}
+	var message sql.NullString
+	err := db.QueryRow(`
+		SELECT status, message, attempts, last_attempt_at, next_attempt_at
+		FROM asset_status_table WHERE file_id = $1 AND kind = $2
+	`, fileID, kind).Scan(&s.Status, &message, &s.Attempts, &s.LastAttemptAt, &s.NextAttemptAt)
+	if err == sql.ErrNoRows {
+		return s, nil
+	}
+	s.Message = message.String
+	return s, err
+}
+
+// RecordAssetResult stores the outcome of a generation attempt: ok when err
+// is nil, no_stream for ErrNoStream, and error with the next retry scheduled
+// otherwise. Attempts abandoned because their caller went away aren't
+// counted.
+func RecordAssetResult(db *sql.DB, fileID int64, kind string, genErr error) {
+	if errors.Is(genErr, context.Canceled) {
+		return
+	}
+	status, message := AssetStatusOK, ""
+	switch {
+	case errors.Is(genErr, ErrNoStream):
+		status, message = AssetStatusNoStream, genErr.Error()
+	case genErr != nil:
+		status, message = AssetStatusError, genErr.Error()
+	}
+
+	// The backoff doubles with every failed attempt:
+	// base * 2^(attempts-1), capped.
+	_, err := db.Exec(`
+		INSERT INTO asset_status_table (file_id, kind, status, message, attempts, last_attempt_at, next_attempt_at)
+		VALUES ($1, $2, $3, NULLIF($4, ''), 1, NOW(),
+			CASE WHEN $3 = 'error' THEN NOW() + make_interval(secs => $5) END)
+		ON CONFLICT (file_id, kind) DO UPDATE SET
+			status = EXCLUDED.status,
+			message = EXCLUDED.message,
+			attempts = asset_status_table.attempts + 1,
+			last_attempt_at = EXCLUDED.last_attempt_at,
+			next_attempt_at = CASE WHEN EXCLUDED.status = 'error'
+				THEN NOW() + make_interval(secs => LEAST($5 * power(2, asset_status_table.attempts), $6))
+			END
+	`, fileID, kind, status, message, assetRetryBase.Seconds(), assetRetryMax.Seconds())
+	if err != nil {
+		log.Printf("Failed to record %s status of file %d: %v", kind, fileID, err)
+	}
+}
+
+// ClearAssetStatus forgets every generation attempt for a file, e.g. after
+// its content was replaced.
+func ClearAssetStatus(ctx context.Context, db *sql.DB, fileID int64) error {
+	_, err := db.ExecContext(ctx, "DELETE FROM asset_status_table WHERE file_id = $1", fileID)
+	return err
+}
+
+// AssetStatusFilter selects status rows to list or requeue. Empty fields
+// match everything.
+type AssetStatusFilter struct {
+	FileIDs []int64
+	Path    string // Folder or file path prefix
+	Kind    string
+	Status  string
+}
+
+func (f AssetStatusFilter) where(args *[]any) string {
+	arg := func(v any) string {
+		*args = append(*args, v)
+		return fmt.Sprintf("$%d", len(*args))
+	}
+	conds := []string{"TRUE"}
+	if len(f.FileIDs) > 0 {
+		conds = append(conds, "s.file_id = ANY("+arg(pq.Array(f.FileIDs))+")")
+	}
+	if f.Path != "" {
+		conds = append(conds, "starts_with(f.url, "+arg(config.CloudflarePublicDevURL+"/"+f.Path)+")")
+	}
+	if f.Kind != "" {
+		conds = append(conds, "s.kind = "+arg(f.Kind))
+	}
+	if f.Status != "" {
+		conds = append(conds, "s.status = "+arg(f.Status))
+	}
+	return strings.Join(conds, " AND ")
+}
+
+// ListAssetStatuses returns matching status rows, most recent attempt first.
+func ListAssetStatuses(db *sql.DB, filter AssetStatusFilter, limit int) ([]AssetStatus, error) {
+	var args []any
+	where := filter.where(&args)
+	args = append(args, limit)
+	rows, err := db.Query(fmt.Sprintf(`
+		SELECT s.file_id, s.kind, s.status, COALESCE(s.message, ''), s.attempts, s.last_attempt_at, s.next_attempt_at
+		FROM asset_status_table s
+		JOIN files_table f ON f.id = s.file_id
+		WHERE %s
+		ORDER BY s.last_attempt_at DESC NULLS LAST, s.file_id, s.kind
+		LIMIT $%d
+	`, where, len(args)), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	statuses := []AssetStatus{}
+	for rows.Next() {
+		var s AssetStatus
+		if err := rows.Scan(&s.FileID, &s.Kind, &s.Status, &s.Message, &s.Attempts, &s.LastAttemptAt, &s.NextAttemptAt); err != nil {
+			return nil, err
+		}
+		statuses = append(statuses, s)
+	}
+	return statuses, rows.Err()
+}
+
+// RequeueAssets resets matching assets that weren't generated to pending with
+// a fresh retry budget and returns how many were requeued.
+func RequeueAssets(db *sql.DB, filter AssetStatusFilter) (int64, error) {
+	var args []any
+	where := filter.where(&args) + " AND s.status != 'ok'"
+	res, err := db.Exec(fmt.Sprintf(`
+		UPDATE asset_status_table s
+		SET status = 'pending', message = NULL, attempts = 0, next_attempt_at = NULL
+		FROM files_table f
+		WHERE f.id = s.file_id AND %s
+	`, where), args...)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// assetPassMu keeps the periodic retry pass and requeue-triggered passes
+// from generating the same assets twice. assetPassQueued asks the running
+// pass for another one.
+var (
+	assetPassMu     sync.Mutex
+	assetPassQueued atomic.Bool
+)
+
+// RetryDueAssets generates every asset that is pending or due for a retry.
+// If a pass is already running, it returns immediately and that pass runs
+// once more when it is done, so assets requeued meanwhile aren't missed.
+func RetryDueAssets(db *sql.DB, r2Client *s3.Client, bucket string) {
+	assetPassQueued.Store(true)
+	for assetPassQueued.Load() {
+		if !assetPassMu.TryLock() {
+			return
+		}
+		for assetPassQueued.Swap(false) {
+			if err := GenerateMissingAssetsForExistingFiles(db, r2Client, bucket); err != nil {
+				log.Printf("Asset retry pass failed: %v", err)
+			}
+		}
+		assetPassMu.Unlock()
+	}
+}
+
+// RunAssetRetries runs RetryDueAssets right away and then every interval,
+// forever. With a zero interval only the first pass runs.
+func RunAssetRetries(db *sql.DB, r2Client *s3.Client, bucket string, interval time.Duration) {
+	RetryDueAssets(db, r2Client, bucket)
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		RetryDueAssets(db, r2Client, bucket)
+	}
+}
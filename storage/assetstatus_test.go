@@ -0,0 +1,39 @@
+package storage
+
+import (
+	"media-server/config"
+	"testing"
+	"time"
+)
+
+func TestAssetStatusDue(t *testing.T) {
+	defer func(n int) { config.AssetMaxAttempts = n }(config.AssetMaxAttempts)
+	config.AssetMaxAttempts = 3
+
+	past := time.Now().Add(-time.Minute)
+	future := time.Now().Add(time.Hour)
+	tests := []struct {
+		name      string
+		status    AssetStatus
+		due       bool
+		exhausted bool
+	}{
+		{"pending", AssetStatus{Status: AssetStatusPending}, true, false},
+		{"requeued after exhausting", AssetStatus{Status: AssetStatusPending, Attempts: 5}, true, false},
+		{"ok", AssetStatus{Status: AssetStatusOK, Attempts: 1}, false, false},
+		{"no stream", AssetStatus{Status: AssetStatusNoStream, Attempts: 1}, false, false},
+		{"error, retry due", AssetStatus{Status: AssetStatusError, Attempts: 1, NextAttemptAt: &past}, true, false},
+		{"error, retry unscheduled", AssetStatus{Status: AssetStatusError, Attempts: 2}, true, false},
+		{"error, backing off", AssetStatus{Status: AssetStatusError, Attempts: 2, NextAttemptAt: &future}, false, false},
+		{"error, out of attempts", AssetStatus{Status: AssetStatusError, Attempts: 3, NextAttemptAt: &past}, false, true},
+		{"error, past the limit", AssetStatus{Status: AssetStatusError, Attempts: 4}, false, true},
+	}
+	for _, tt := range tests {
+		if got := tt.status.Due(); got != tt.due {
+			t.Errorf("%s: Due() = %v, want %v", tt.name, got, tt.due)
+		}
+		if got := tt.status.Exhausted(); got != tt.exhausted {
+			t.Errorf("%s: Exhausted() = %v, want %v", tt.name, got, tt.exhausted)
+		}
+	}
+}
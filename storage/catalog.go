@@ -0,0 +1,419 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"media-server/config"
+	"path"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// CreateShowsTableSQL holds the TV series recognized from file paths, keyed
+// by their lower-cased title and year. year is 0 when unknown so it can be
+// part of the key. folder_id is the folder named after the series, where its
+// tvshow.nfo and artwork live.
+const CreateShowsTableSQL = `
+CREATE TABLE IF NOT EXISTS shows_table (
+    id SERIAL PRIMARY KEY,
+    title TEXT NOT NULL,
+    title_key TEXT NOT NULL,
+    year INTEGER NOT NULL DEFAULT 0,
+    folder_id INTEGER,
+    UNIQUE (title_key, year),
+    CONSTRAINT fk_show_folder
+        FOREIGN KEY (folder_id)
+        REFERENCES folders_table(id)
+        ON DELETE SET NULL
+);
+`
+
+// CreateEpisodesTableSQL holds the video files recognized as episodes.
+// episode_end is the last episode of a file holding several.
+const CreateEpisodesTableSQL = `
+CREATE TABLE IF NOT EXISTS episodes_table (
+    file_id INTEGER PRIMARY KEY,
+    show_id INTEGER NOT NULL,
+    season INTEGER NOT NULL,
+    episode INTEGER NOT NULL,
+    episode_end INTEGER,
+    title TEXT NOT NULL DEFAULT '',
+    CONSTRAINT fk_episode_file
+        FOREIGN KEY (file_id)
+        REFERENCES files_table(id)
+        ON DELETE CASCADE,
+    CONSTRAINT fk_episode_show
+        FOREIGN KEY (show_id)
+        REFERENCES shows_table(id)
+        ON DELETE CASCADE
+);
+`
+
+// CreateMoviesTableSQL holds the video files recognized as movies.
+const CreateMoviesTableSQL = `
+CREATE TABLE IF NOT EXISTS movies_table (
+    file_id INTEGER PRIMARY KEY,
+    title TEXT NOT NULL,
+    title_key TEXT NOT NULL,
+    year INTEGER,
+    CONSTRAINT fk_movie_file
+        FOREIGN KEY (file_id)
+        REFERENCES files_table(id)
+        ON DELETE CASCADE
+);
+`
+
+// CatalogMigrations add columns introduced after the catalog tables and
+// index the columns shows and movies are browsed by.
+var CatalogMigrations = []string{
+	`ALTER TABLE shows_table ADD COLUMN IF NOT EXISTS folder_id INTEGER REFERENCES folders_table(id) ON DELETE SET NULL;`,
+	`CREATE INDEX IF NOT EXISTS episodes_show_index ON episodes_table (show_id, season, episode);`,
+	`CREATE INDEX IF NOT EXISTS movies_title_index ON movies_table (title_key, file_id);`,
+}
+
+// InitCatalog creates the show, episode and movie tables.
+func InitCatalog(db *sql.DB) error {
+	for _, create := range []struct{ table, sql string }{
+		{"shows_table", CreateShowsTableSQL},
+		{"episodes_table", CreateEpisodesTableSQL},
+		{"movies_table", CreateMoviesTableSQL},
+	} {
+		if _, err := db.Exec(create.sql); err != nil {
+			return fmt.Errorf("failed to create %s: %w", create.table, err)
+		}
+		log.Println("Created/Verified Table: " + create.table)
+	}
+	for _, migration := range CatalogMigrations {
+		if _, err := db.Exec(migration); err != nil {
+			return fmt.Errorf("failed to migrate catalog tables: %w", err)
+		}
+	}
+	return nil
+}
+
+// MediaKind is what a video file is in the library.
+type MediaKind string
+
+const (
+	MediaKindMovie   MediaKind = "movie"
+	MediaKindEpisode MediaKind = "episode"
+	MediaKindOther   MediaKind = "other"
+)
+
+// MediaInfo is what the path of a video file says about it. Missing values
+// are zero.
+type MediaInfo struct {
+	Kind       MediaKind
+	Series     string
+	SeriesYear int
+	SeriesPath string // Folder of the series, "" when only the file names it
+	Season     int    // 0 for specials
+	Episode    int
+	EpisodeEnd int    // Last episode of a file holding several
+	Title      string // Episode or movie title
+	Year       int    // Release year of a movie
+}
+
+var (
+	// S01E02, s1e2, S01E01E02 and S01E01-E02
+	episodePattern = regexp.MustCompile(`(?i)(?:^|[\s._\-\[(])s(\d{1,2})[\s._]?e(\d{1,3})(?:-?e(\d{1,3}))?`)
+	// 1x02
+	crossPattern = regexp.MustCompile(`(?i)(?:^|[\s._\-\[(])(\d{1,2})x(\d{2,3})(?:[\s._\-\])]|$)`)
+	// E02, Ep 2, Episode 2, a leading 02 or " - 02 - ", for files in a season
+	// folder
+	episodeNumberPattern = regexp.MustCompile(`(?i)(?:^|[\s._\-])(?:e|ep|episode)[\s._]?(\d{1,3})(?:[\s._\-]|$)|^(\d{1,3})(?:[\s._\-]|$)|\s-\s(\d{1,3})(?:\s|$)`)
+	// Season 01, Series 1, S01
+	seasonDirPattern = regexp.MustCompile(`(?i)^(?:(?:season|series|staffel|saison)[\s._-]*|s)(\d{1,3})$`)
+	// A year after the title: Title (2019), Title.2019.1080p. splitYear checks
+	// what follows it, so adjacent years both match.
+	yearPattern = regexp.MustCompile(`[\s._\-\[(]((?:19|20)\d{2})`)
+	// Release tags that end the title of scene-named files
+	releaseTagPattern = regexp.MustCompile(`(?i)[\s._\-\[(](?:2160p|1080p|720p|576p|480p|4k|uhd|hdr|bluray|blu-ray|bdrip|brrip|web-?dl|webrip|web|hdtv|dvdrip|x26[45]|h\.?26[45]|hevc|xvid|remux|proper|repack|extended|unrated)(?:[\s._\-\])]|$)`)
+)
+
+// Folders that hold a kind of video, and folders of bonus material that is
+// neither.
+var (
+	showRootDirs  = []string{"shows", "tv", "tv shows", "series", "television"}
+	movieRootDirs = []string{"movies", "films", "movie"}
+	extrasDirs    = []string{"extras", "featurettes", "behind the scenes", "deleted scenes", "trailers", "samples", "sample", "bonus"}
+)
+
+// cleanName turns a scene-style name into words and trims separators.
+func cleanName(s string) string {
+	if !strings.Contains(s, " ") {
+		s = strings.ReplaceAll(s, ".", " ")
+	}
+	s = strings.ReplaceAll(s, "_", " ")
+	s = strings.Join(strings.Fields(s), " ")
+	return strings.Trim(s, " -.[(")
+}
+
+// cutReleaseTags drops everything from the first release tag on.
+func cutReleaseTags(s string) string {
+	if loc := releaseTagPattern.FindStringIndex(s); loc != nil {
+		return s[:loc[0]]
+	}
+	return s
+}
+
+// splitYear splits "Title (2019) ..." into its title and year. Only the last
+// year counts, so titles that start with or contain one keep it.
+func splitYear(s string) (string, int) {
+	matches := yearPattern.FindAllStringSubmatchIndex(s, -1)
+	for i := len(matches) - 1; i >= 0; i-- {
+		end := matches[i][1]
+		if end < len(s) && !strings.ContainsRune(" ._-])", rune(s[end])) {
+			continue
+		}
+		title := cleanName(s[:matches[i][0]])
+		if title == "" {
+			continue
+		}
+		year, _ := strconv.Atoi(s[matches[i][2]:matches[i][3]])
+		return title, year
+	}
+	return cleanName(cutReleaseTags(s)), 0
+}
+
+// seasonOfDir returns the season a folder is named after.
+func seasonOfDir(name string) (int, bool) {
+	if strings.EqualFold(name, "specials") {
+		return 0, true
+	}
+	m := seasonDirPattern.FindStringSubmatch(name)
+	if m == nil {
+		return 0, false
+	}
+	n, _ := strconv.Atoi(m[1])
+	return n, true
+}
+
+func isDirIn(dir string, names []string) bool {
+	return slices.Contains(names, strings.ToLower(cleanName(dir)))
+}
+
+// ParseMediaPath classifies a video file from its object key, like
+// Shows/Name/Season 01/Name S01E02.mkv or Movies/Title (2019)/Title.mkv.
+// Episodes are recognized by an SxxEyy or 1x02 marker, or an episode number
+// in a season folder; movies by a year in their name or folder, or by being
+// under a Movies folder.
+func ParseMediaPath(objectKey string) MediaInfo {
+	dirs := strings.Split(path.Dir(objectKey), "/")
+	if dirs[0] == "." {
+		dirs = nil
+	}
+	name := path.Base(objectKey)
+	stem := strings.TrimSuffix(name, path.Ext(name))
+	lower := strings.ToLower(stem)
+	for _, dir := range dirs {
+		if isDirIn(dir, extrasDirs) {
+			return MediaInfo{Kind: MediaKindOther}
+		}
+	}
+	if strings.HasSuffix(lower, "-trailer") || strings.HasSuffix(lower, "-sample") || lower == "sample" {
+		return MediaInfo{Kind: MediaKindOther}
+	}
+
+	// Episodes
+	info := MediaInfo{Kind: MediaKindEpisode}
+	seasonDir := -1
+	seriesDir, seriesPath := "", ""
+	if len(dirs) > 0 {
+		if season, ok := seasonOfDir(dirs[len(dirs)-1]); ok {
+			seasonDir = season
+			if len(dirs) > 1 {
+				seriesDir, seriesPath = dirs[len(dirs)-2], strings.Join(dirs[:len(dirs)-1], "/")
+			}
+		} else if !isDirIn(dirs[len(dirs)-1], showRootDirs) && !isDirIn(dirs[len(dirs)-1], movieRootDirs) {
+			seriesDir, seriesPath = dirs[len(dirs)-1], strings.Join(dirs, "/")
+		}
+	}
+	prefix, rest := "", ""
+	if m := episodePattern.FindStringSubmatchIndex(stem); m != nil {
+		info.Season, _ = strconv.Atoi(stem[m[2]:m[3]])
+		info.Episode, _ = strconv.Atoi(stem[m[4]:m[5]])
+		if m[6] >= 0 {
+			info.EpisodeEnd, _ = strconv.Atoi(stem[m[6]:m[7]])
+		}
+		prefix, rest = stem[:m[0]], stem[m[1]:]
+	} else if m := crossPattern.FindStringSubmatchIndex(stem); m != nil {
+		info.Season, _ = strconv.Atoi(stem[m[2]:m[3]])
+		info.Episode, _ = strconv.Atoi(stem[m[4]:m[5]])
+		prefix, rest = stem[:m[0]], stem[m[1]:]
+	} else if m := episodeNumberPattern.FindStringSubmatchIndex(stem); m != nil && seasonDir >= 0 {
+		group := 2
+		for m[group] < 0 {
+			group += 2
+		}
+		info.Season = seasonDir
+		info.Episode, _ = strconv.Atoi(stem[m[group]:m[group+1]])
+		prefix, rest = stem[:m[0]], stem[m[1]:]
+	} else {
+		info.Kind = MediaKindOther
+	}
+	if info.Kind == MediaKindEpisode {
+		// The show's folder names it best; scene names only carry it before
+		// the marker.
+		series := seriesDir
+		if seasonDir < 0 && cleanName(prefix) != "" {
+			series = prefix
+		}
+		if series == "" {
+			series = prefix
+		}
+		info.Series, info.SeriesYear = splitYear(series)
+		if info.Series == "" {
+			return MediaInfo{Kind: MediaKindOther}
+		}
+		if dirTitle, _ := splitYear(seriesDir); strings.EqualFold(dirTitle, info.Series) {
+			info.SeriesPath = seriesPath
+		}
+		if info.EpisodeEnd <= info.Episode {
+			info.EpisodeEnd = 0
+		}
+		info.Title = cleanName(cutReleaseTags(rest))
+		return info
+	}
+
+	// Movies
+	for _, dir := range dirs {
+		if isDirIn(dir, showRootDirs) {
+			return MediaInfo{Kind: MediaKindOther}
+		}
+	}
+	if title, year := splitYear(stem); year > 0 {
+		return MediaInfo{Kind: MediaKindMovie, Title: title, Year: year}
+	}
+	if len(dirs) > 0 {
+		if title, year := splitYear(dirs[len(dirs)-1]); year > 0 {
+			return MediaInfo{Kind: MediaKindMovie, Title: title, Year: year}
+		}
+	}
+	for _, dir := range dirs {
+		if isDirIn(dir, movieRootDirs) {
+			if title := cleanName(cutReleaseTags(stem)); title != "" {
+				return MediaInfo{Kind: MediaKindMovie, Title: title}
+			}
+		}
+	}
+	return MediaInfo{Kind: MediaKindOther}
+}
+
+// StoreMediaInfo records a file as a movie or an episode, creating its show,
+// or as neither, and drops shows left without episodes.
+func StoreMediaInfo(ctx context.Context, db *sql.DB, fileID int64, info MediaInfo) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM movies_table WHERE file_id = $1", fileID); err != nil {
+		return err
+	}
+	res, err := tx.ExecContext(ctx, "DELETE FROM episodes_table WHERE file_id = $1", fileID)
+	if err != nil {
+		return err
+	}
+	wasEpisode, _ := res.RowsAffected()
+
+	switch info.Kind {
+	case MediaKindEpisode:
+		var showID int64
+		err := tx.QueryRowContext(ctx, `
+			INSERT INTO shows_table (title, title_key, year, folder_id)
+			VALUES ($1, lower($1), $2, (SELECT id FROM folders_table WHERE path = NULLIF($3, '')))
+			ON CONFLICT (title_key, year) DO UPDATE SET folder_id = COALESCE(shows_table.folder_id, EXCLUDED.folder_id)
+			RETURNING id
+		`, info.Series, info.SeriesYear, info.SeriesPath).Scan(&showID)
+		if err != nil {
+			return fmt.Errorf("failed to store show %q: %w", info.Series, err)
+		}
+		_, err = tx.ExecContext(ctx, `
+			INSERT INTO episodes_table (file_id, show_id, season, episode, episode_end, title)
+			VALUES ($1, $2, $3, $4, $5, $6)
+		`, fileID, showID, info.Season, info.Episode, nullIfZero(info.EpisodeEnd), info.Title)
+		if err != nil {
+			return fmt.Errorf("failed to store episode of file %d: %w", fileID, err)
+		}
+	case MediaKindMovie:
+		_, err := tx.ExecContext(ctx, `
+			INSERT INTO movies_table (file_id, title, title_key, year) VALUES ($1, $2, lower($2), $3)
+		`, fileID, info.Title, nullIfZero(info.Year))
+		if err != nil {
+			return fmt.Errorf("failed to store movie of file %d: %w", fileID, err)
+		}
+	}
+
+	if wasEpisode > 0 {
+		_, err := tx.ExecContext(ctx, `
+			DELETE FROM shows_table s
+			WHERE NOT EXISTS (SELECT 1 FROM episodes_table e WHERE e.show_id = s.id)
+		`)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// RecognizeMedia classifies a file from its object key, after it was added
+// or renamed. Only video files are movies or episodes; others are left alone.
+func RecognizeMedia(ctx context.Context, db *sql.DB, fileID int64, objectKey string) error {
+	if !IsVideoFile(path.Ext(objectKey)) {
+		return nil
+	}
+	return StoreMediaInfo(ctx, db, fileID, ParseMediaPath(objectKey))
+}
+
+// RecognizeMissingMedia classifies every video file that is neither a movie
+// nor an episode yet, such as files synced before recognition existed.
+func RecognizeMissingMedia(db *sql.DB) error {
+	rows, err := db.Query(`
+		SELECT f.id, f.url FROM files_table f
+		WHERE LOWER(f.type) = ANY($1) AND NOT f.hidden
+			AND NOT EXISTS (SELECT 1 FROM episodes_table e WHERE e.file_id = f.id)
+			AND NOT EXISTS (SELECT 1 FROM movies_table m WHERE m.file_id = f.id)
+	`, pq.Array(VideoExtensions))
+	if err != nil {
+		return fmt.Errorf("failed to query unrecognized files: %w", err)
+	}
+	type pending struct {
+		id   int64
+		info MediaInfo
+	}
+	var found []pending
+	for rows.Next() {
+		var id int64
+		var url string
+		if err := rows.Scan(&id, &url); err != nil {
+			rows.Close()
+			return err
+		}
+		key := strings.TrimPrefix(url, config.CloudflarePublicDevURL+"/")
+		if info := ParseMediaPath(key); info.Kind != MediaKindOther {
+			found = append(found, pending{id, info})
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, p := range found {
+		if err := StoreMediaInfo(context.Background(), db, p.id, p.info); err != nil {
+			log.Printf("Failed to store what file %d is: %v", p.id, err)
+		}
+	}
+	if len(found) > 0 {
+		log.Printf("Recognized %d movies and episodes", len(found))
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+package storage
+
+import "testing"
+
+func TestParseMediaPath(t *testing.T) {
+	tests := []struct {
+		key  string
+		want MediaInfo
+	}{
+		{
+			"Shows/The Office (2005)/Season 02/The Office S02E03 The Fire.mkv",
+			MediaInfo{Kind: MediaKindEpisode, Series: "The Office", SeriesYear: 2005, SeriesPath: "Shows/The Office (2005)", Season: 2, Episode: 3, Title: "The Fire"},
+		},
+		{
+			"TV/Lost/Season 1/Lost.S01E01E02.Pilot.720p.HDTV.x264.mkv",
+			MediaInfo{Kind: MediaKindEpisode, Series: "Lost", SeriesPath: "TV/Lost", Season: 1, Episode: 1, EpisodeEnd: 2, Title: "Pilot"},
+		},
+		{
+			"Downloads/Fargo.2x04.mkv",
+			MediaInfo{Kind: MediaKindEpisode, Series: "Fargo", Season: 2, Episode: 4},
+		},
+		{
+			"Shows/Planet Earth/Season 01/03 - Fresh Water.mp4",
+			MediaInfo{Kind: MediaKindEpisode, Series: "Planet Earth", SeriesPath: "Shows/Planet Earth", Season: 1, Episode: 3, Title: "Fresh Water"},
+		},
+		{
+			"Shows/Doctor Who/Specials/Doctor Who - 01.mkv",
+			MediaInfo{Kind: MediaKindEpisode, Series: "Doctor Who", SeriesPath: "Shows/Doctor Who", Episode: 1},
+		},
+		{
+			"Movies/Heat (1995)/Heat (1995).mkv",
+			MediaInfo{Kind: MediaKindMovie, Title: "Heat", Year: 1995},
+		},
+		{
+			"Blade.Runner.2049.2017.2160p.UHD.BluRay.mkv",
+			MediaInfo{Kind: MediaKindMovie, Title: "Blade Runner 2049", Year: 2017},
+		},
+		{
+			"Movies/Alien (1979)/alien.mkv",
+			MediaInfo{Kind: MediaKindMovie, Title: "Alien", Year: 1979},
+		},
+		{
+			"Movies/Inception.1080p.mkv",
+			MediaInfo{Kind: MediaKindMovie, Title: "Inception"},
+		},
+		{"Movies/Heat (1995)/Extras/Making of.mkv", MediaInfo{Kind: MediaKindOther}},
+		{"Movies/Heat (1995)/Heat-trailer.mkv", MediaInfo{Kind: MediaKindOther}},
+		{"Shows/Random clip.mkv", MediaInfo{Kind: MediaKindOther}},
+		{"Videos/birthday.mp4", MediaInfo{Kind: MediaKindOther}},
+	}
+	for _, tt := range tests {
+		if got := ParseMediaPath(tt.key); got != tt.want {
+			t.Errorf("ParseMediaPath(%q) = %+v, want %+v", tt.key, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"log"
+	"media-server/config"
+	"media-server/vtt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/lib/pq"
+)
+
+// CreateSubtitleCuesTableSQL holds the parsed cues of every extracted
+// subtitle, full-text indexed for dialogue search.
+const CreateSubtitleCuesTableSQL = `
+CREATE TABLE IF NOT EXISTS subtitle_cues_table (
+    id SERIAL PRIMARY KEY,
+    file_id INTEGER NOT NULL,
+    start_ms INTEGER NOT NULL,
+    end_ms INTEGER NOT NULL,
+    text TEXT NOT NULL,
+    text_vector tsvector GENERATED ALWAYS AS (to_tsvector('simple', text)) STORED,
+    CONSTRAINT fk_cue_file
+        FOREIGN KEY (file_id)
+        REFERENCES files_table(id)
+        ON DELETE CASCADE
+);
+`
+
+// SubtitleCuesMigrations index the cue table and track which files were indexed.
+var SubtitleCuesMigrations = []string{
+	`CREATE INDEX IF NOT EXISTS subtitle_cues_file_index ON subtitle_cues_table (file_id, start_ms);`,
+	`CREATE INDEX IF NOT EXISTS subtitle_cues_text_index ON subtitle_cues_table USING GIN (text_vector);`,
+	`ALTER TABLE files_table ADD COLUMN IF NOT EXISTS cues_indexed_at TIMESTAMP;`,
+}
+
+// InitSubtitleCues creates the cue table and its indexes.
+func InitSubtitleCues(db *sql.DB) error {
+	if _, err := db.Exec(CreateSubtitleCuesTableSQL); err != nil {
+		return fmt.Errorf("failed to create subtitle_cues_table: %w", err)
+	}
+	for _, migration := range SubtitleCuesMigrations {
+		if _, err := db.Exec(migration); err != nil {
+			return fmt.Errorf("failed to migrate subtitle_cues_table: %w", err)
+		}
+	}
+	log.Println("Created/Verified Table: subtitle_cues_table")
+	return nil
+}
+
+// IndexSubtitleCues parses a WebVTT document and replaces the indexed cues of
+// a subtitle track with its contents. A trackID of 0 stands for the legacy
+// single subtitle of the file.
+func IndexSubtitleCues(db *sql.DB, fileID, trackID int64, data []byte) error {
+	cues, err := vtt.Parse(bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("failed to parse subtitles of file %d: %w", fileID, err)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var track *int64
+	clear := "DELETE FROM subtitle_cues_table WHERE file_id = $1 AND track_id IS NULL"
+	args := []any{fileID}
+	if trackID != 0 {
+		track = &trackID
+		clear = "DELETE FROM subtitle_cues_table WHERE track_id = $1"
+		args = []any{trackID}
+	}
+	if _, err := tx.Exec(clear, args...); err != nil {
+		return fmt.Errorf("failed to clear cues of file %d: %w", fileID, err)
+	}
+
+	stmt, err := tx.Prepare(pq.CopyIn("subtitle_cues_table", "file_id", "track_id", "start_ms", "end_ms", "text"))
+	if err != nil {
+		return fmt.Errorf("failed to prepare cue copy: %w", err)
+	}
+	for _, cue := range cues {
+		text := vtt.PlainText(cue.Text)
+		if text == "" {
+			continue
+		}
+		if _, err := stmt.Exec(fileID, track, cue.Start.Milliseconds(), cue.End.Milliseconds(), text); err != nil {
+			stmt.Close()
+			return fmt.Errorf("failed to copy cue: %w", err)
+		}
+	}
+	if _, err := stmt.Exec(); err != nil {
+		stmt.Close()
+		return fmt.Errorf("failed to flush cues: %w", err)
+	}
+	if err := stmt.Close(); err != nil {
+		return err
+	}
+
+	mark := "UPDATE files_table SET cues_indexed_at = $1 WHERE id = $2"
+	if track != nil {
+		mark = "UPDATE subtitle_tracks_table SET cues_indexed_at = $1 WHERE id = $2"
+		args = []any{trackID}
+	}
+	if _, err := tx.Exec(mark, time.Now(), args[0]); err != nil {
+		return fmt.Errorf("failed to mark cues of file %d as indexed: %w", fileID, err)
+	}
+	return tx.Commit()
+}
+
+// IndexMissingSubtitleCues downloads and indexes every subtitle track, and
+// every legacy single-track subtitle, whose cues haven't been indexed yet.
+func IndexMissingSubtitleCues(db *sql.DB, r2Client *s3.Client, bucket string) error {
+	rows, err := db.Query(`
+		SELECT t.file_id, t.id, t.object_key
+		FROM subtitle_tracks_table t
+		WHERE t.cues_indexed_at IS NULL
+		UNION ALL
+		SELECT f.id, 0, f.subtitle_url
+		FROM files_table f
+		WHERE f.subtitle_url IS NOT NULL AND f.cues_indexed_at IS NULL
+			AND NOT EXISTS (SELECT 1 FROM subtitle_tracks_table t WHERE t.file_id = f.id)
+	`)
+	if err != nil {
+		return err
+	}
+
+	type pending struct {
+		fileID, trackID int64
+		key             string
+	}
+	var subtitles []pending
+	for rows.Next() {
+		var p pending
+		if err := rows.Scan(&p.fileID, &p.trackID, &p.key); err != nil {
+			log.Printf("Scan failed: %v", err)
+			continue
+		}
+		p.key = strings.TrimPrefix(p.key, config.CloudflarePublicDevURL+"/")
+		subtitles = append(subtitles, p)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, p := range subtitles {
+		data, err := downloadObject(context.Background(), r2Client, bucket, p.key)
+		if err != nil {
+			log.Printf("Failed to download subtitle %s: %v", p.key, err)
+			continue
+		}
+		if err := IndexSubtitleCues(db, p.fileID, p.trackID, data); err != nil {
+			log.Printf("Failed to index subtitle %s: %v", p.key, err)
+			continue
+		}
+		log.Printf("Indexed subtitle cues: %s", p.key)
+	}
+	return nil
+}
+
+// downloadObject reads a whole object into memory.
+func downloadObject(ctx context.Context, r2Client *s3.Client, bucket, key string) ([]byte, error) {
+	resp, err := r2Client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return io.ReadAll(resp.Body)
+}
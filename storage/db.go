@@ -1,22 +1,24 @@
 package storage
 
 import (
-	"bytes"
 	"context"
 	"database/sql"
 	"fmt"
 	"log"
+	"media-server/assets"
 	"media-server/config"
-	"os/exec"
+	"media-server/mediatype"
+	"path"
 	"path/filepath"
+	"slices"
 	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/aws/aws-sdk-go-v2/service/s3/types"
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
+	"golang.org/x/sync/singleflight"
 )
 
 // InitDB initializes the database and creates tables if not present
@@ -34,6 +36,9 @@ func InitDB(dataSourceName string) (*sql.DB, error) {
 	if err != nil {
 		return nil, fmt.Errorf("failed to create folders_table: %w", err)
 	}
+	if _, err = db.Exec(CreateFoldersPathPatternIndexSQL); err != nil {
+		return nil, fmt.Errorf("failed to index folders_table: %w", err)
+	}
 	log.Println("Created/Verified Table: folders_table")
 
 	_, err = db.Exec(CreateFilesTableSQL)
@@ -42,15 +47,59 @@ func InitDB(dataSourceName string) (*sql.DB, error) {
 	}
 	log.Println("Created/Verified Table: files_table")
 
-	return db, nil
-}
+	for _, migration := range FilesTableMigrations {
+		if _, err = db.Exec(migration); err != nil {
+			return nil, fmt.Errorf("failed to migrate files_table: %w", err)
+		}
+	}
 
-// StartSyncAndAssetGeneration runs both file sync and asset generation
-func StartSyncAndAssetGeneration(db *sql.DB, r2Client *s3.Client, bucket string) error {
-	if err := SyncFilesWithR2(db, r2Client, bucket); err != nil {
-		return err
+	_, err = db.Exec(CreateDerivedAssetsTableSQL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create derived_assets_table: %w", err)
+	}
+	if _, err = db.Exec(CreateDerivedAssetsFileIndexSQL); err != nil {
+		return nil, fmt.Errorf("failed to index derived_assets_table: %w", err)
+	}
+	log.Println("Created/Verified Table: derived_assets_table")
+
+	_, err = db.Exec(CreateUserQuotasTableSQL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create user_quotas_table: %w", err)
+	}
+	log.Println("Created/Verified Table: user_quotas_table")
+
+	if err = InitMusic(db); err != nil {
+		return nil, err
+	}
+	if err = InitSearch(db); err != nil {
+		return nil, err
+	}
+	if err = InitSubtitleCues(db); err != nil {
+		return nil, err
 	}
-	return GenerateMissingAssetsForExistingFiles(db, r2Client, bucket)
+	if err = InitSubtitleTracks(db); err != nil {
+		return nil, err
+	}
+	if err = InitAssetStatus(db); err != nil {
+		return nil, err
+	}
+	if err = InitExif(db); err != nil {
+		return nil, err
+	}
+	if err = InitSubsonic(db); err != nil {
+		return nil, err
+	}
+	if err = InitFeeds(db); err != nil {
+		return nil, err
+	}
+	if err = InitCatalog(db); err != nil {
+		return nil, err
+	}
+	if err = InitSidecarMetadata(db); err != nil {
+		return nil, err
+	}
+
+	return db, nil
 }
 
 // SyncFilesWithR2 pulls files from R2 and inserts new ones into DB
@@ -62,6 +111,7 @@ func SyncFilesWithR2(db *sql.DB, r2Client *s3.Client, bucketName string) error {
 
 	log.Println("Starting file sync from R2 bucket:", bucketName)
 	processedPaths := make(map[string]bool)
+	var sidecars, metadata []string
 
 	paginator := s3.NewListObjectsV2Paginator(r2Client, &s3.ListObjectsV2Input{
 		Bucket: aws.String(bucketName),
@@ -76,7 +126,7 @@ func SyncFilesWithR2(db *sql.DB, r2Client *s3.Client, bucketName string) error {
 		for _, obj := range page.Contents {
 			objectKey := aws.ToString(obj.Key)
 
-			if shouldSkip(objectKey) {
+			if ShouldSkip(objectKey) {
 				continue
 			}
 
@@ -90,17 +140,30 @@ func SyncFilesWithR2(db *sql.DB, r2Client *s3.Client, bucketName string) error {
 				continue
 			}
 			processedPaths[objectKey] = true
+			if IsSubtitleFile(filepath.Ext(objectKey)) {
+				sidecars = append(sidecars, objectKey)
+			}
+			if IsMetadataSidecar(objectKey) {
+				metadata = append(metadata, objectKey)
+			}
 		}
 	}
 
+	// Sidecars are attached once every video is in the DB, whatever order
+	// the listing returned them in.
+	AttachSidecarSubtitles(db, r2Client, bucketName, sidecars)
+	AttachSidecarMetadata(db, r2Client, bucketName, metadata)
+
 	log.Println("Finished syncing files from R2.")
 	return nil
 }
 
-func shouldSkip(path string) bool {
+// ShouldSkip reports whether an object key belongs to a hidden file or to one of
+// the derived asset prefixes that are never listed as media.
+func ShouldSkip(path string) bool {
 	parts := strings.Split(path, "/")
 	for _, part := range parts {
-		if strings.HasPrefix(part, ".") || part == "thumbnails" || part == "subtitles" {
+		if strings.HasPrefix(part, ".") || part == "thumbnails" || part == "subtitles" || part == "trickplay" {
 			return true
 		}
 	}
@@ -136,105 +199,173 @@ func insertFileFromR2(db *sql.DB, relPath string, obj types.Object, rootFolderID
 	fileType := filepath.Ext(fileName)
 	modTime := aws.ToTime(obj.LastModified)
 
-	var thumbnailURL, subtitleURL *string
-	var subtitleGenFailed bool
-	if IsVideoFile(fileType) {
-		thumbnailURL, _ = GenerateThumbnailAndUpload(r2Client, bucket, relPath)
-		subtitleURL, subtitleGenFailed, _ = GenerateSubtitleAndUpload(r2Client, bucket, relPath)
-	}
-
 	err = db.QueryRow(
 		`INSERT INTO files_table 
-		(ownerId, name, size, url, type, parent, created_at, thumbnail_url, subtitle_url, subtitle_gen_failed)
-		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+		(ownerId, name, size, url, type, parent, created_at, content_type)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, NULLIF($8, ''))
 		RETURNING id`,
-		"default_user", fileName, fileSize, url, fileType, parentID, modTime, thumbnailURL, subtitleURL, subtitleGenFailed, 
+		"default_user", fileName, fileSize, url, fileType, parentID, modTime, mediatype.ByExtension(fileType),
 	).Scan(&fileID)
 
 	if err != nil {
 		return 0, fmt.Errorf("failed to insert file %s: %w", relPath, err)
 	}
 
+	if err := RecognizeMedia(context.TODO(), db, fileID, relPath); err != nil {
+		log.Printf("Failed to recognize %s: %v", relPath, err)
+	}
+
+	// Assets are left to the next GenerateMissingAssetsForExistingFiles
+	// pass, so listing a large bucket isn't held up by ffmpeg.
+
 	log.Printf("Synced file: %s", relPath)
 	return fileID, nil
 }
 
 func IsVideoFile(ext string) bool {
-	ext = strings.ToLower(ext)
-	return ext == ".mp4" || ext == ".mkv" || ext == ".avi" || ext == ".mov" || ext == ".webm"
+	return slices.Contains(VideoExtensions, strings.ToLower(ext))
+}
+
+// VideoExtensions, AudioExtensions and ImageExtensions list the file types
+// recognised for each media category, lower-cased with the leading dot.
+var (
+	VideoExtensions = []string{".mp4", ".mkv", ".avi", ".mov", ".webm"}
+	AudioExtensions = []string{".mp3", ".flac", ".m4a", ".aac", ".ogg", ".opus", ".wav"}
+	ImageExtensions = []string{".jpg", ".jpeg", ".png", ".gif", ".webp", ".heic", ".heif"}
+)
+
+func IsAudioFile(ext string) bool {
+	return slices.Contains(AudioExtensions, strings.ToLower(ext))
+}
+
+func IsImageFile(ext string) bool {
+	return slices.Contains(ImageExtensions, strings.ToLower(ext))
 }
 
-func GenerateThumbnailAndUpload(r2Client *s3.Client, bucket, objectKey string) (*string, error) {
-	presignClient := s3.NewPresignClient(r2Client)
-	presigned, err := presignClient.PresignGetObject(context.TODO(), &s3.GetObjectInput{
-		Bucket: aws.String(bucket),
-		Key:    aws.String(objectKey),
-	}, s3.WithPresignExpires(5*time.Minute))
+// GenerateThumbnailAndUpload renders every thumbnail variant of a video with
+// the configured profile, stores them and records them as derived assets of
+// the file. It returns the URL of the default variant. Photos are handed to
+// generateImageAssets, which also reads their EXIF metadata, and audio files
+// get their embedded cover art.
+func GenerateThumbnailAndUpload(ctx context.Context, db *sql.DB, r2Client *s3.Client, bucket string, fileID int64, objectKey string) (*string, error) {
+	if IsImageFile(path.Ext(objectKey)) {
+		return generateImageAssets(ctx, db, r2Client, bucket, fileID, objectKey)
+	}
+	gen := assets.NewGenerator(r2Client, bucket)
+	var objects []assets.Object
+	var err error
+	if IsAudioFile(path.Ext(objectKey)) {
+		objects, err = gen.CoverArt(ctx, objectKey)
+	} else {
+		duration, _, _, probeErr := probedFile(ctx, db, r2Client, bucket, fileID, objectKey)
+		if probeErr != nil {
+			log.Printf("Failed to read duration of %s: %v", objectKey, probeErr)
+		}
+		objects, err = gen.Thumbnail(ctx, objectKey, duration)
+	}
 	if err != nil {
+		log.Printf("Thumbnail error for %s: %v", objectKey, err)
 		return nil, err
 	}
+	for _, obj := range objects {
+		if err := RecordDerivedAsset(db, fileID, AssetKindThumbnail, obj.Key, obj.ContentType, int64(len(obj.Data))); err != nil {
+			log.Printf("Thumbnail accounting error: %v", err)
+		}
+	}
 
-	thumbnailKey := "thumbnails/" + strings.TrimSuffix(objectKey, filepath.Ext(objectKey)) + ".jpg"
-	var buf bytes.Buffer
+	url := thumbnailURL(objects[0].Key)
+	return &url, nil
+}
 
-	cmd := exec.Command("ffmpeg", "-ss", "00:00:05", "-i", presigned.URL, "-vframes", "1", "-q:v", "2", "-f", "image2", "pipe:1")
-	cmd.Stdout = &buf
-	cmd.Stderr = &bytes.Buffer{}
-	if err := cmd.Run(); err != nil {
-		log.Printf("Thumbnail error: %v", err)
-		return nil, nil
+// probedFile returns the duration and dimensions of a file, probing it first
+// if that hasn't happened yet. Unknown values are 0.
+func probedFile(ctx context.Context, db *sql.DB, r2Client *s3.Client, bucket string, fileID int64, objectKey string) (duration time.Duration, width, height int, err error) {
+	var seconds sql.NullFloat64
+	var w, h sql.NullInt64
+	var probed bool
+	query := "SELECT duration, width, height, probed_at IS NOT NULL FROM files_table WHERE id = $1"
+	if err := db.QueryRowContext(ctx, query, fileID).Scan(&seconds, &w, &h, &probed); err != nil {
+		return 0, 0, 0, err
+	}
+	if !probed {
+		if err := ProbeAndStore(ctx, db, r2Client, bucket, fileID, objectKey); err != nil {
+			return 0, 0, 0, err
+		}
+		if err := db.QueryRowContext(ctx, query, fileID).Scan(&seconds, &w, &h, &probed); err != nil {
+			return 0, 0, 0, err
+		}
 	}
+	return time.Duration(seconds.Float64 * float64(time.Second)), int(w.Int64), int(h.Int64), nil
+}
 
-	uploader := manager.NewUploader(r2Client)
-	_, err = uploader.Upload(context.TODO(), &s3.PutObjectInput{
-		Bucket:      aws.String(bucket),
-		Key:         aws.String(thumbnailKey),
-		Body:        bytes.NewReader(buf.Bytes()),
-		ContentType: aws.String("image/jpeg"),
-	})
+// GeneratePreviewAndUpload renders the hover preview loop of a video, stores
+// it and records it as a derived asset of the file.
+func GeneratePreviewAndUpload(ctx context.Context, db *sql.DB, r2Client *s3.Client, bucket string, fileID int64, objectKey string) (*string, error) {
+	duration, _, _, err := probedFile(ctx, db, r2Client, bucket, fileID, objectKey)
 	if err != nil {
-		return nil, nil
+		log.Printf("Failed to read duration of %s: %v", objectKey, err)
+	}
+	obj, err := assets.NewGenerator(r2Client, bucket).PreviewLoop(ctx, objectKey, duration)
+	if err != nil {
+		log.Printf("Preview error for %s: %v", objectKey, err)
+		return nil, err
+	}
+	if err := RecordDerivedAsset(db, fileID, AssetKindPreview, obj.Key, obj.ContentType, int64(len(obj.Data))); err != nil {
+		log.Printf("Preview accounting error: %v", err)
 	}
 
-	url := fmt.Sprintf("%s/%s", config.CloudflarePublicDevURL, thumbnailKey)
+	url := fmt.Sprintf("%s/%s", config.CloudflarePublicDevURL, obj.Key)
 	return &url, nil
 }
 
-func GenerateSubtitleAndUpload(r2Client *s3.Client, bucket, objectKey string) (*string, bool, error) {
-	presignClient := s3.NewPresignClient(r2Client)
-	presigned, err := presignClient.PresignGetObject(context.TODO(), &s3.GetObjectInput{
-		Bucket: aws.String(bucket),
-		Key:    aws.String(objectKey),
-	}, s3.WithPresignExpires(5*time.Minute))
+// GenerateWaveformAndUpload computes the waveform peaks of an audio or
+// video file, stores them and records them as a derived asset of the file.
+func GenerateWaveformAndUpload(ctx context.Context, db *sql.DB, r2Client *s3.Client, bucket string, fileID int64, objectKey string) error {
+	obj, err := assets.NewGenerator(r2Client, bucket).WaveformPeaks(ctx, objectKey)
 	if err != nil {
-		return nil, false, err
+		log.Printf("Waveform error for %s: %v", objectKey, err)
+		return err
 	}
-
-	subtitleKey := "subtitles/" + strings.TrimSuffix(objectKey, filepath.Ext(objectKey)) + ".vtt"
-	var buf bytes.Buffer
-
-	cmd := exec.Command("ffmpeg", "-i", presigned.URL, "-map", "0:s:0?", "-f", "webvtt", "pipe:1")
-	cmd.Stdout = &buf
-	cmd.Stderr = &bytes.Buffer{}
-	if err := cmd.Run(); err != nil {
-		log.Printf("Subtitle error for %s: %v", objectKey, err)
-		return nil, true, nil
+	if err := RecordDerivedAsset(db, fileID, AssetKindWaveform, obj.Key, obj.ContentType, int64(len(obj.Data))); err != nil {
+		log.Printf("Waveform accounting error: %v", err)
 	}
+	return nil
+}
 
-	uploader := manager.NewUploader(r2Client)
-	_, err = uploader.Upload(context.TODO(), &s3.PutObjectInput{
-		Bucket:      aws.String(bucket),
-		Key:         aws.String(subtitleKey),
-		Body:        bytes.NewReader(buf.Bytes()),
-		ContentType: aws.String("text/vtt"),
-	})
+// GenerateTrickplayAndUpload renders the seek-preview sprite sheets of a
+// video and their WebVTT index, stores them and records them as derived
+// assets of the file.
+func GenerateTrickplayAndUpload(ctx context.Context, db *sql.DB, r2Client *s3.Client, bucket string, fileID int64, objectKey string) error {
+	duration, width, height, err := probedFile(ctx, db, r2Client, bucket, fileID, objectKey)
 	if err != nil {
-		return nil, false, nil
+		return fmt.Errorf("failed to probe: %w", err)
 	}
+	objects, err := assets.NewGenerator(r2Client, bucket).Sprites(ctx, objectKey, duration, width, height)
+	if err != nil {
+		log.Printf("Trickplay error for %s: %v", objectKey, err)
+		return err
+	}
+	for _, obj := range objects {
+		if err := RecordDerivedAsset(db, fileID, AssetKindTrickplay, obj.Key, obj.ContentType, int64(len(obj.Data))); err != nil {
+			log.Printf("Trickplay accounting error: %v", err)
+		}
+	}
+	log.Printf("Generated %d trickplay sheets for %s", len(objects)-1, objectKey)
+	return nil
+}
 
-	url := fmt.Sprintf("%s/%s", config.CloudflarePublicDevURL, subtitleKey)
-	log.Printf("Generated subtitle for %s", subtitleKey)
-	return &url, false, nil
+// GenerateSubtitleAndUpload extracts every text subtitle track of a video and
+// returns the URL of the default one, or ErrNoStream when it has none.
+func GenerateSubtitleAndUpload(ctx context.Context, db *sql.DB, r2Client *s3.Client, bucket string, fileID int64, objectKey string) (*string, error) {
+	url, noStreams, err := ExtractSubtitleTracks(ctx, db, r2Client, bucket, fileID, objectKey)
+	if err != nil {
+		log.Printf("Subtitle error for %s: %v", objectKey, err)
+		return nil, err
+	}
+	if noStreams {
+		return nil, fmt.Errorf("%w: no text subtitle streams", ErrNoStream)
+	}
+	return url, nil
 }
 
 func EnsureRootFolder(db *sql.DB) (int64, error) {
@@ -296,57 +427,201 @@ func InsertFolder(db *sql.DB, relPath string, rootID int64) (int64, error) {
 	return id, nil
 }
 
-// GenerateMissingAssetsForExistingFiles updates thumbnail/subtitle URLs for DB entries with NULLs.
+// GenerateMissingAssetsForExistingFiles generates the missing assets of
+// videos, the thumbnails and metadata of photos and the cover art and
+// waveforms of audio files, whose generation is pending or due for a retry.
 func GenerateMissingAssetsForExistingFiles(db *sql.DB, r2Client *s3.Client, bucket string) error {
-	rows, err := db.Query(`
-		SELECT id, url, type, thumbnail_url, subtitle_url
-		FROM files_table
-		WHERE (thumbnail_url IS NULL OR subtitle_url IS NULL) AND subtitle_gen_failed = FALSE
-	`)
+	rows, err := db.Query(fmt.Sprintf(`
+		SELECT f.id, f.url, f.thumbnail_url, f.subtitle_url, f.preview_url
+		FROM files_table f
+		WHERE (LOWER(f.type) = ANY($1) AND (
+			(f.thumbnail_url IS NULL AND NOT EXISTS (
+				SELECT 1 FROM asset_status_table s WHERE s.file_id = f.id AND s.kind = 'thumbnail' AND NOT %[1]s))
+			OR (f.subtitle_url IS NULL AND NOT EXISTS (
+				SELECT 1 FROM asset_status_table s WHERE s.file_id = f.id AND s.kind = 'subtitle' AND NOT %[1]s))
+			OR ($3 AND NOT EXISTS (
+				SELECT 1 FROM asset_status_table s WHERE s.file_id = f.id AND s.kind = 'trickplay' AND NOT %[1]s))
+			OR ($4 AND f.preview_url IS NULL AND NOT EXISTS (
+				SELECT 1 FROM asset_status_table s WHERE s.file_id = f.id AND s.kind = 'preview' AND NOT %[1]s))
+		)) OR (LOWER(f.type) = ANY($5) AND f.thumbnail_url IS NULL AND NOT EXISTS (
+				SELECT 1 FROM asset_status_table s WHERE s.file_id = f.id AND s.kind = 'thumbnail' AND NOT %[1]s))
+		OR ($6 AND LOWER(f.type) = ANY($7) AND NOT EXISTS (
+				SELECT 1 FROM asset_status_table s WHERE s.file_id = f.id AND s.kind = 'waveform' AND NOT %[1]s))
+	`, fmt.Sprintf(assetDueSQL, 2)), pq.Array(VideoExtensions), config.AssetMaxAttempts, config.TrickplayInterval > 0, config.PreviewClips > 0,
+		pq.Array(append(slices.Clone(ImageExtensions), AudioExtensions...)),
+		config.WaveformResolution > 0, pq.Array(append(slices.Clone(VideoExtensions), AudioExtensions...)))
 	if err != nil {
 		return err
 	}
-	defer rows.Close()
 
+	type pending struct {
+		id               int64
+		objectKey        string
+		tURL, sURL, pURL *string
+	}
+	var files []pending
 	for rows.Next() {
-		var id int64
-		var url, fileType string
-		var tURL, sURL *string
-
-		if err := rows.Scan(&id, &url, &fileType, &tURL, &sURL); err != nil {
+		var p pending
+		var url string
+		if err := rows.Scan(&p.id, &url, &p.tURL, &p.sURL, &p.pURL); err != nil {
 			log.Printf("Scan failed: %v", err)
 			continue
 		}
+		p.objectKey = strings.TrimPrefix(url, config.CloudflarePublicDevURL+"/")
+		files = append(files, p)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
 
-		if !IsVideoFile(fileType) {
-			continue
+	for _, p := range files {
+		generateMissingAssets(db, r2Client, bucket, p.id, p.objectKey, p.tURL, p.sURL, p.pURL)
+	}
+	return nil
+}
+
+// generateMissingAssets creates whichever of the thumbnail, subtitle and
+// preview are still nil for a video, and its trickplay sprites and waveform,
+// if their generation is due. Each job records its outcome and stores URLs
+// on the files_table row. Photos only get a thumbnail, audio files a
+// thumbnail and a waveform.
+func generateMissingAssets(db *sql.DB, r2Client *s3.Client, bucket string, id int64, objectKey string, tURL, sURL, pURL *string) {
+	if tURL == nil && assetDue(db, id, AssetKindThumbnail) {
+		<-StartThumbnail(db, r2Client, bucket, id, objectKey)
+	}
+	ext := path.Ext(objectKey)
+	if config.WaveformResolution > 0 && (IsVideoFile(ext) || IsAudioFile(ext)) && assetDue(db, id, AssetKindWaveform) {
+		<-StartWaveform(db, r2Client, bucket, id, objectKey)
+	}
+	if !IsVideoFile(ext) {
+		return
+	}
+	if sURL == nil && assetDue(db, id, AssetKindSubtitle) {
+		<-StartSubtitles(db, r2Client, bucket, id, objectKey)
+	}
+	if config.TrickplayInterval > 0 && assetDue(db, id, AssetKindTrickplay) {
+		<-StartTrickplay(db, r2Client, bucket, id, objectKey)
+	}
+	if config.PreviewClips > 0 && pURL == nil && assetDue(db, id, AssetKindPreview) {
+		<-StartPreview(db, r2Client, bucket, id, objectKey)
+	}
+}
+
+// StartThumbnail regenerates the thumbnail of a video or photo in the
+// background, joining a run for the same file that is already in flight. The
+// result carries the new URL as a *string.
+func StartThumbnail(db *sql.DB, r2Client *s3.Client, bucket string, fileID int64, objectKey string) <-chan singleflight.Result {
+	return assets.Start(fmt.Sprintf("%s:%d", AssetKindThumbnail, fileID), config.AssetJobTimeout, func(ctx context.Context) (any, error) {
+		return RegenerateThumbnail(ctx, db, r2Client, bucket, fileID, objectKey)
+	})
+}
+
+// StartThumbnailVariants renders the thumbnail variants of a video or photo
+// again in the background with RestoreThumbnail, joining a run for the same
+// file that is already in flight. The result carries the URL as a *string.
+func StartThumbnailVariants(db *sql.DB, r2Client *s3.Client, bucket string, fileID int64, objectKey string) <-chan singleflight.Result {
+	return assets.Start(fmt.Sprintf("%s-variants:%d", AssetKindThumbnail, fileID), config.AssetJobTimeout, func(ctx context.Context) (any, error) {
+		return RestoreThumbnail(ctx, db, r2Client, bucket, fileID, objectKey)
+	})
+}
+
+// StartProbe stores the duration and stream info of a new upload in the
+// background like StartThumbnail. The result carries no value.
+func StartProbe(db *sql.DB, r2Client *s3.Client, bucket string, fileID int64, objectKey string) <-chan singleflight.Result {
+	return assets.Start(fmt.Sprintf("probe:%d", fileID), config.AssetJobTimeout, func(ctx context.Context) (any, error) {
+		err := ProbeAndStore(ctx, db, r2Client, bucket, fileID, objectKey)
+		if err != nil {
+			log.Printf("Probe error for %s: %v", objectKey, err)
 		}
+		return nil, err
+	})
+}
+
+// StartSubtitles extracts the subtitle tracks of a video in the background
+// like StartThumbnail. The result carries the default track's URL.
+func StartSubtitles(db *sql.DB, r2Client *s3.Client, bucket string, fileID int64, objectKey string) <-chan singleflight.Result {
+	return assets.Start(fmt.Sprintf("%s:%d", AssetKindSubtitle, fileID), config.AssetJobTimeout, func(ctx context.Context) (any, error) {
+		return RegenerateSubtitles(ctx, db, r2Client, bucket, fileID, objectKey)
+	})
+}
+
+// StartTrickplay renders the sprite sheets of a video in the background like
+// StartThumbnail. The result carries no value.
+func StartTrickplay(db *sql.DB, r2Client *s3.Client, bucket string, fileID int64, objectKey string) <-chan singleflight.Result {
+	return assets.Start(fmt.Sprintf("%s:%d", AssetKindTrickplay, fileID), config.AssetJobTimeout, func(ctx context.Context) (any, error) {
+		err := GenerateTrickplayAndUpload(ctx, db, r2Client, bucket, fileID, objectKey)
+		RecordAssetResult(db, fileID, AssetKindTrickplay, err)
+		return nil, err
+	})
+}
 
-		objectKey := strings.TrimPrefix(url, config.CloudflarePublicDevURL+"/")
+// StartWaveform computes the waveform peaks of an audio or video file in the
+// background like StartThumbnail. The result carries no value.
+func StartWaveform(db *sql.DB, r2Client *s3.Client, bucket string, fileID int64, objectKey string) <-chan singleflight.Result {
+	return assets.Start(fmt.Sprintf("%s:%d", AssetKindWaveform, fileID), config.AssetJobTimeout, func(ctx context.Context) (any, error) {
+		err := GenerateWaveformAndUpload(ctx, db, r2Client, bucket, fileID, objectKey)
+		RecordAssetResult(db, fileID, AssetKindWaveform, err)
+		return nil, err
+	})
+}
 
-		if tURL == nil {
-			tURL, _ = GenerateThumbnailAndUpload(r2Client, bucket, objectKey)
+// StartPreview renders the hover preview loop of a video in the background
+// like StartThumbnail, storing its URL on the file row. The result carries
+// the URL.
+func StartPreview(db *sql.DB, r2Client *s3.Client, bucket string, fileID int64, objectKey string) <-chan singleflight.Result {
+	return assets.Start(fmt.Sprintf("%s:%d", AssetKindPreview, fileID), config.AssetJobTimeout, func(ctx context.Context) (any, error) {
+		url, err := GeneratePreviewAndUpload(ctx, db, r2Client, bucket, fileID, objectKey)
+		RecordAssetResult(db, fileID, AssetKindPreview, err)
+		if err != nil {
+			return nil, err
 		}
-		var subtitleGenFailed bool
-		if sURL == nil {
-			sURL, subtitleGenFailed, _ = GenerateSubtitleAndUpload(r2Client, bucket, objectKey)
+		if _, err := db.ExecContext(ctx, "UPDATE files_table SET preview_url = $1 WHERE id = $2", url, fileID); err != nil {
+			log.Printf("Failed to update file %d: %v", fileID, err)
 		}
+		return url, nil
+	})
+}
 
-		if tURL != nil || sURL != nil || subtitleGenFailed {
-			_, err := db.Exec(`
-				UPDATE files_table
-				SET thumbnail_url = COALESCE($1, thumbnail_url),
-				    subtitle_url = COALESCE($2, subtitle_url),
-					subtitle_gen_failed = $3
-				WHERE id = $4
-			`, tURL, sURL, subtitleGenFailed, id)
+// RegenerateThumbnail generates the thumbnail of a video on demand, records
+// the attempt and stores the new URL on the file row. A custom thumbnail is
+// replaced by the automatic one.
+func RegenerateThumbnail(ctx context.Context, db *sql.DB, r2Client *s3.Client, bucket string, fileID int64, objectKey string) (*string, error) {
+	url, err := GenerateThumbnailAndUpload(ctx, db, r2Client, bucket, fileID, objectKey)
+	RecordAssetResult(db, fileID, AssetKindThumbnail, err)
+	if err != nil {
+		return nil, err
+	}
+	_, err = db.ExecContext(ctx, `
+		UPDATE files_table SET thumbnail_url = $1, thumbnail_source = $2, thumbnail_source_key = NULL, thumbnail_frame_ms = NULL
+		WHERE id = $3
+	`, url, ThumbnailSourceAuto, fileID)
+	if err != nil {
+		log.Printf("Failed to update file %d: %v", fileID, err)
+	}
+	return url, nil
+}
 
-			if err != nil {
-				log.Printf("Failed to update file %d: %v", id, err)
-			} else {
-				log.Printf("Updated file ID %d with missing assets", id)
-			}
-		}
+// RegenerateSubtitles extracts the subtitle tracks of a video, records the
+// attempt and stores the default track's URL on the file row.
+func RegenerateSubtitles(ctx context.Context, db *sql.DB, r2Client *s3.Client, bucket string, fileID int64, objectKey string) (*string, error) {
+	url, err := GenerateSubtitleAndUpload(ctx, db, r2Client, bucket, fileID, objectKey)
+	RecordAssetResult(db, fileID, AssetKindSubtitle, err)
+	if err != nil {
+		return nil, err
 	}
-	return nil
+	if _, err := db.ExecContext(ctx, "UPDATE files_table SET subtitle_url = $1 WHERE id = $2", url, fileID); err != nil {
+		log.Printf("Failed to update file %d: %v", fileID, err)
+	}
+	return url, nil
+}
+
+// assetDue reports whether an asset of a file should be generated now.
+func assetDue(db *sql.DB, fileID int64, kind string) bool {
+	status, err := GetAssetStatus(db, fileID, kind)
+	if err != nil {
+		log.Printf("Failed to read %s status of file %d: %v", kind, fileID, err)
+		return false
+	}
+	return status.Due()
 }
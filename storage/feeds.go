@@ -0,0 +1,135 @@
+package storage
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"time"
+)
+
+// CreateFeedsTableSQL holds the podcast feeds users subscribe to folders
+// with. The token in the feed URL is its only credential, since podcast apps
+// can't send an Authorization header, and it only grants the one folder.
+const CreateFeedsTableSQL = `
+CREATE TABLE IF NOT EXISTS feeds_table (
+    id SERIAL PRIMARY KEY,
+    owner_id TEXT NOT NULL,
+    folder_id INTEGER NOT NULL,
+    title TEXT NOT NULL DEFAULT '',
+    token TEXT NOT NULL UNIQUE,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    CONSTRAINT fk_feed_folder
+        FOREIGN KEY (folder_id)
+        REFERENCES folders_table(id)
+        ON DELETE CASCADE
+);
+`
+
+// FeedsMigrations index the feeds of each user.
+var FeedsMigrations = []string{
+	`CREATE INDEX IF NOT EXISTS feeds_owner_index ON feeds_table (owner_id);`,
+}
+
+// InitFeeds creates the table behind podcast feeds.
+func InitFeeds(db *sql.DB) error {
+	if _, err := db.Exec(CreateFeedsTableSQL); err != nil {
+		return fmt.Errorf("failed to create feeds_table: %w", err)
+	}
+	log.Println("Created/Verified Table: feeds_table")
+	for _, migration := range FeedsMigrations {
+		if _, err := db.Exec(migration); err != nil {
+			return fmt.Errorf("failed to migrate feeds_table: %w", err)
+		}
+	}
+	return nil
+}
+
+// Feed is a podcast feed of a folder. An empty Title means the folder name.
+type Feed struct {
+	ID        int64     `json:"id"`
+	FolderID  int64     `json:"folder_id"`
+	Path      string    `json:"path"`
+	Title     string    `json:"title"`
+	Token     string    `json:"token"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// feedColumns are the columns read by scanFeed, from feeds_table (aliased as
+// fe) joined with folders_table (aliased as fo).
+const feedColumns = `fe.id, fe.folder_id, fo.path, fe.title, fe.token, fe.created_at`
+
+func scanFeed(row interface{ Scan(...any) error }) (*Feed, error) {
+	var f Feed
+	if err := row.Scan(&f.ID, &f.FolderID, &f.Path, &f.Title, &f.Token, &f.CreatedAt); err != nil {
+		return nil, err
+	}
+	return &f, nil
+}
+
+// CreateFeed creates a feed of a folder for a user.
+func CreateFeed(ctx context.Context, db *sql.DB, ownerID string, folderID int64, title string) (*Feed, error) {
+	secret := make([]byte, 24)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	var id int64
+	err := db.QueryRowContext(ctx, `
+		INSERT INTO feeds_table (owner_id, folder_id, title, token) VALUES ($1, $2, $3, $4)
+		RETURNING id
+	`, ownerID, folderID, title, hex.EncodeToString(secret)).Scan(&id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to store feed: %w", err)
+	}
+	return scanFeed(db.QueryRowContext(ctx, `
+		SELECT `+feedColumns+`
+		FROM feeds_table fe JOIN folders_table fo ON fo.id = fe.folder_id
+		WHERE fe.id = $1
+	`, id))
+}
+
+// ListFeeds returns the feeds of a user, newest first.
+func ListFeeds(ctx context.Context, db *sql.DB, ownerID string) ([]Feed, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT `+feedColumns+`
+		FROM feeds_table fe JOIN folders_table fo ON fo.id = fe.folder_id
+		WHERE fe.owner_id = $1
+		ORDER BY fe.created_at DESC, fe.id DESC
+	`, ownerID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	feeds := []Feed{}
+	for rows.Next() {
+		f, err := scanFeed(rows)
+		if err != nil {
+			return nil, err
+		}
+		feeds = append(feeds, *f)
+	}
+	return feeds, rows.Err()
+}
+
+// FeedByToken finds the feed a token belongs to; sql.ErrNoRows means the
+// token is unknown or revoked.
+func FeedByToken(ctx context.Context, db *sql.DB, token string) (*Feed, error) {
+	return scanFeed(db.QueryRowContext(ctx, `
+		SELECT `+feedColumns+`
+		FROM feeds_table fe JOIN folders_table fo ON fo.id = fe.folder_id
+		WHERE fe.token = $1
+	`, token))
+}
+
+// DeleteFeed revokes a feed of a user and reports whether it existed.
+func DeleteFeed(ctx context.Context, db *sql.DB, ownerID string, id int64) (bool, error) {
+	res, err := db.ExecContext(ctx, "DELETE FROM feeds_table WHERE id = $1 AND owner_id = $2", id, ownerID)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
@@ -0,0 +1,121 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"media-server/assets"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// CreateExifTableSQL holds the EXIF metadata of photos and the capture
+// metadata videos carry in their container tags. taken_at is the wall-clock
+// time in the camera's time zone, whose offset is taken_at_offset when the
+// camera recorded it.
+const CreateExifTableSQL = `
+CREATE TABLE IF NOT EXISTS exif_table (
+    file_id INTEGER PRIMARY KEY,
+    camera_make TEXT,
+    camera_model TEXT,
+    lens TEXT,
+    taken_at TIMESTAMP,
+    taken_at_offset TEXT,
+    latitude DOUBLE PRECISION,
+    longitude DOUBLE PRECISION,
+    orientation INTEGER NOT NULL DEFAULT 1,
+    CONSTRAINT fk_exif_file
+        FOREIGN KEY (file_id)
+        REFERENCES files_table(id)
+        ON DELETE CASCADE
+);
+`
+
+// ExifMigrations index the columns photos are browsed by.
+var ExifMigrations = []string{
+	`CREATE INDEX IF NOT EXISTS exif_taken_at_index ON exif_table (taken_at);`,
+	`CREATE INDEX IF NOT EXISTS exif_location_index ON exif_table (latitude, longitude) WHERE latitude IS NOT NULL;`,
+}
+
+// InitExif creates exif_table.
+func InitExif(db *sql.DB) error {
+	if _, err := db.Exec(CreateExifTableSQL); err != nil {
+		return fmt.Errorf("failed to create exif_table: %w", err)
+	}
+	for _, migration := range ExifMigrations {
+		if _, err := db.Exec(migration); err != nil {
+			return fmt.Errorf("failed to migrate exif_table: %w", err)
+		}
+	}
+	log.Println("Created/Verified Table: exif_table")
+	return nil
+}
+
+// generateImageAssets renders the thumbnail variants of a photo and, for
+// HEIC/HEIF photos, a JPEG browsers can display, records them as derived
+// assets and stores the photo's EXIF metadata and upright dimensions. It
+// returns the URL of the default thumbnail.
+func generateImageAssets(ctx context.Context, db *sql.DB, r2Client *s3.Client, bucket string, fileID int64, objectKey string) (*string, error) {
+	result, err := assets.NewGenerator(r2Client, bucket).Image(ctx, objectKey)
+	if err != nil {
+		log.Printf("Image error for %s: %v", objectKey, err)
+		return nil, err
+	}
+	for _, obj := range result.Thumbnails {
+		if err := RecordDerivedAsset(db, fileID, AssetKindThumbnail, obj.Key, obj.ContentType, int64(len(obj.Data))); err != nil {
+			log.Printf("Thumbnail accounting error: %v", err)
+		}
+	}
+	var displayURL *string
+	if obj := result.Display; obj != nil {
+		if err := RecordDerivedAsset(db, fileID, AssetKindDisplay, obj.Key, obj.ContentType, int64(len(obj.Data))); err != nil {
+			log.Printf("Display image accounting error: %v", err)
+		}
+		url := thumbnailURL(obj.Key)
+		displayURL = &url
+	}
+
+	if err := storeImageInfo(ctx, db, fileID, &result.Info, displayURL); err != nil {
+		log.Printf("Failed to store metadata of %s: %v", objectKey, err)
+	}
+
+	url := thumbnailURL(result.Thumbnails[0].Key)
+	return &url, nil
+}
+
+// storeImageInfo saves the EXIF metadata of a photo, its dimensions and its
+// browser-compatible rendition, if any.
+func storeImageInfo(ctx context.Context, db *sql.DB, fileID int64, info *assets.ImageInfo, displayURL *string) error {
+	var width, height *int
+	if info.Width > 0 && info.Height > 0 {
+		width, height = &info.Width, &info.Height
+	}
+	_, err := db.ExecContext(ctx, `
+		UPDATE files_table SET width = $1, height = $2, display_url = $3, probed_at = $4
+		WHERE id = $5
+	`, width, height, displayURL, time.Now(), fileID)
+	if err != nil {
+		return err
+	}
+	return storeExif(ctx, db, fileID, info)
+}
+
+// storeExif saves the capture metadata of a photo or video.
+func storeExif(ctx context.Context, db *sql.DB, fileID int64, info *assets.ImageInfo) error {
+	_, err := db.ExecContext(ctx, `
+		INSERT INTO exif_table (file_id, camera_make, camera_model, lens, taken_at, taken_at_offset, latitude, longitude, orientation)
+		VALUES ($1, NULLIF($2, ''), NULLIF($3, ''), NULLIF($4, ''), $5, NULLIF($6, ''), $7, $8, $9)
+		ON CONFLICT (file_id) DO UPDATE SET
+			camera_make = EXCLUDED.camera_make,
+			camera_model = EXCLUDED.camera_model,
+			lens = EXCLUDED.lens,
+			taken_at = EXCLUDED.taken_at,
+			taken_at_offset = EXCLUDED.taken_at_offset,
+			latitude = EXCLUDED.latitude,
+			longitude = EXCLUDED.longitude,
+			orientation = EXCLUDED.orientation
+	`, fileID, info.Make, info.Model, info.Lens, info.TakenAt, info.TakenAtOffset, info.Latitude, info.Longitude, info.Orientation)
+	return err
+}
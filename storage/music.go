@@ -0,0 +1,260 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// CreateArtistsTableSQL holds the artists named in audio tags. name_key is the
+// lower-cased name, so spellings differing only in case are one artist.
+const CreateArtistsTableSQL = `
+CREATE TABLE IF NOT EXISTS artists_table (
+    id SERIAL PRIMARY KEY,
+    name TEXT NOT NULL,
+    name_key TEXT NOT NULL UNIQUE
+);
+`
+
+// CreateAlbumsTableSQL holds albums, keyed by their lower-cased title and
+// album artist, which is empty when unknown.
+const CreateAlbumsTableSQL = `
+CREATE TABLE IF NOT EXISTS albums_table (
+    id SERIAL PRIMARY KEY,
+    title TEXT NOT NULL,
+    title_key TEXT NOT NULL,
+    artist_id INTEGER,
+    artist_key TEXT NOT NULL DEFAULT '',
+    year INTEGER,
+    UNIQUE (title_key, artist_key),
+    CONSTRAINT fk_album_artist
+        FOREIGN KEY (artist_id)
+        REFERENCES artists_table(id)
+        ON DELETE SET NULL
+);
+`
+
+// AssetKindTags is the asset_status_table kind that records whether the tags
+// of an audio file were stored, so failures aren't probed again on every
+// startup.
+const AssetKindTags = "tags"
+
+// CreateTracksTableSQL holds the tags of each audio file. Files without a
+// title tag are titled after their name.
+const CreateTracksTableSQL = `
+CREATE TABLE IF NOT EXISTS tracks_table (
+    file_id INTEGER PRIMARY KEY,
+    title TEXT NOT NULL,
+    artist_id INTEGER,
+    album_id INTEGER,
+    track_number INTEGER,
+    track_total INTEGER,
+    disc_number INTEGER,
+    disc_total INTEGER,
+    year INTEGER,
+    genre TEXT,
+    CONSTRAINT fk_track_file
+        FOREIGN KEY (file_id)
+        REFERENCES files_table(id)
+        ON DELETE CASCADE,
+    CONSTRAINT fk_track_artist
+        FOREIGN KEY (artist_id)
+        REFERENCES artists_table(id)
+        ON DELETE SET NULL,
+    CONSTRAINT fk_track_album
+        FOREIGN KEY (album_id)
+        REFERENCES albums_table(id)
+        ON DELETE SET NULL
+);
+`
+
+// MusicMigrations index the columns tracks are browsed by.
+var MusicMigrations = []string{
+	`CREATE INDEX IF NOT EXISTS tracks_artist_index ON tracks_table (artist_id);`,
+	`CREATE INDEX IF NOT EXISTS tracks_album_index ON tracks_table (album_id, disc_number, track_number);`,
+	`CREATE INDEX IF NOT EXISTS albums_artist_index ON albums_table (artist_id);`,
+}
+
+// InitMusic creates the artist, album and track tables.
+func InitMusic(db *sql.DB) error {
+	for _, create := range []struct{ table, sql string }{
+		{"artists_table", CreateArtistsTableSQL},
+		{"albums_table", CreateAlbumsTableSQL},
+		{"tracks_table", CreateTracksTableSQL},
+	} {
+		if _, err := db.Exec(create.sql); err != nil {
+			return fmt.Errorf("failed to create %s: %w", create.table, err)
+		}
+		log.Println("Created/Verified Table: " + create.table)
+	}
+	for _, migration := range MusicMigrations {
+		if _, err := db.Exec(migration); err != nil {
+			return fmt.Errorf("failed to migrate music tables: %w", err)
+		}
+	}
+	return nil
+}
+
+// AudioTags are the tags of an audio file. Missing values are zero.
+type AudioTags struct {
+	Title       string
+	Artist      string
+	Album       string
+	AlbumArtist string
+	TrackNumber int
+	TrackTotal  int
+	DiscNumber  int
+	DiscTotal   int
+	Year        int
+	Genre       string
+}
+
+// tag returns the first non-empty value of the named tags. ID3 and MP4 tags
+// come lower-cased from ffprobe, Vorbis comments as written, usually upper
+// case, so names are matched case-insensitively.
+func tag(tags map[string]string, names ...string) string {
+	for _, name := range names {
+		for k, v := range tags {
+			if strings.EqualFold(k, name) && strings.TrimSpace(v) != "" {
+				return strings.TrimSpace(v)
+			}
+		}
+	}
+	return ""
+}
+
+// numberOf parses "3" or "3/12" into 3 and 12.
+func numberOf(v string) (n, total int) {
+	num, tot, _ := strings.Cut(v, "/")
+	n, _ = strconv.Atoi(strings.TrimSpace(num))
+	total, _ = strconv.Atoi(strings.TrimSpace(tot))
+	return max(n, 0), max(total, 0)
+}
+
+// AudioTags returns the tags of an audio file. Ogg and Opus files keep them
+// on the audio stream rather than the container.
+func (p *ProbeResult) AudioTags() AudioTags {
+	tags := map[string]string{}
+	if a := p.FirstStream("audio"); a != nil {
+		for k, v := range a.Tags {
+			tags[k] = v
+		}
+	}
+	for k, v := range p.Format.Tags {
+		tags[k] = v
+	}
+
+	t := AudioTags{
+		Title:       tag(tags, "title"),
+		Artist:      tag(tags, "artist", "album_artist", "albumartist"),
+		Album:       tag(tags, "album"),
+		AlbumArtist: tag(tags, "album_artist", "albumartist", "album artist"),
+		Genre:       tag(tags, "genre"),
+	}
+	t.TrackNumber, t.TrackTotal = numberOf(tag(tags, "track", "tracknumber"))
+	t.DiscNumber, t.DiscTotal = numberOf(tag(tags, "disc", "discnumber"))
+	if total, _ := numberOf(tag(tags, "tracktotal", "totaltracks")); total > 0 {
+		t.TrackTotal = total
+	}
+	if total, _ := numberOf(tag(tags, "disctotal", "totaldiscs")); total > 0 {
+		t.DiscTotal = total
+	}
+	// Dates are "2019", "2019-05-03" or a full timestamp.
+	if date := tag(tags, "date", "year", "originaldate"); len(date) >= 4 {
+		if year, err := strconv.Atoi(date[:4]); err == nil && year > 0 {
+			t.Year = year
+		}
+	}
+	return t
+}
+
+// nullIfZero turns zero values into NULLs.
+func nullIfZero(n int) *int {
+	if n == 0 {
+		return nil
+	}
+	return &n
+}
+
+// upsertArtist returns the ID of the artist with the given name, creating it
+// if needed, or nil for an empty name.
+func upsertArtist(ctx context.Context, tx *sql.Tx, name string) (*int64, error) {
+	if name == "" {
+		return nil, nil
+	}
+	var id int64
+	err := tx.QueryRowContext(ctx, `
+		INSERT INTO artists_table (name, name_key) VALUES ($1, lower($1))
+		ON CONFLICT (name_key) DO UPDATE SET name = artists_table.name
+		RETURNING id
+	`, name).Scan(&id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to store artist %q: %w", name, err)
+	}
+	return &id, nil
+}
+
+// StoreAudioTags saves the tags of an audio file, creating its artists and
+// album. Untitled files are titled after their name.
+func StoreAudioTags(ctx context.Context, db *sql.DB, fileID int64, objectKey string, tags AudioTags) error {
+	if tags.Title == "" {
+		name := path.Base(objectKey)
+		tags.Title = strings.TrimSuffix(name, path.Ext(name))
+	}
+	if tags.AlbumArtist == "" {
+		tags.AlbumArtist = tags.Artist
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	artistID, err := upsertArtist(ctx, tx, tags.Artist)
+	if err != nil {
+		return err
+	}
+	albumArtistID, err := upsertArtist(ctx, tx, tags.AlbumArtist)
+	if err != nil {
+		return err
+	}
+	var albumID *int64
+	if tags.Album != "" {
+		var id int64
+		err := tx.QueryRowContext(ctx, `
+			INSERT INTO albums_table (title, title_key, artist_id, artist_key, year)
+			VALUES ($1, lower($1), $2, lower($3), $4)
+			ON CONFLICT (title_key, artist_key) DO UPDATE SET year = COALESCE(albums_table.year, EXCLUDED.year)
+			RETURNING id
+		`, tags.Album, albumArtistID, tags.AlbumArtist, nullIfZero(tags.Year)).Scan(&id)
+		if err != nil {
+			return fmt.Errorf("failed to store album %q: %w", tags.Album, err)
+		}
+		albumID = &id
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO tracks_table (file_id, title, artist_id, album_id, track_number, track_total, disc_number, disc_total, year, genre)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, NULLIF($10, ''))
+		ON CONFLICT (file_id) DO UPDATE SET
+			title = EXCLUDED.title,
+			artist_id = EXCLUDED.artist_id,
+			album_id = EXCLUDED.album_id,
+			track_number = EXCLUDED.track_number,
+			track_total = EXCLUDED.track_total,
+			disc_number = EXCLUDED.disc_number,
+			disc_total = EXCLUDED.disc_total,
+			year = EXCLUDED.year,
+			genre = EXCLUDED.genre
+	`, fileID, tags.Title, artistID, albumID, nullIfZero(tags.TrackNumber), nullIfZero(tags.TrackTotal),
+		nullIfZero(tags.DiscNumber), nullIfZero(tags.DiscTotal), nullIfZero(tags.Year), tags.Genre)
+	if err != nil {
+		return fmt.Errorf("failed to store tags of file %d: %w", fileID, err)
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,154 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+
+	"golang.org/x/text/encoding/charmap"
+)
+
+// NFO is the metadata of a Kodi-style .nfo file. Kind is the root element:
+// movie, episodedetails or tvshow. Missing values are zero.
+type NFO struct {
+	Kind    string      `json:"kind"`
+	Title   string      `json:"title,omitempty"`
+	Plot    string      `json:"plot,omitempty"`
+	Year    int         `json:"year,omitempty"`
+	Genres  []string    `json:"genres"`
+	Cast    []NFOActor  `json:"cast"`
+	Ratings []NFORating `json:"ratings"`
+}
+
+// NFOActor is a cast member, in billing order.
+type NFOActor struct {
+	Name string `json:"name"`
+	Role string `json:"role,omitempty"`
+}
+
+// NFORating is a rating from one source, such as imdb or tmdb. Max is 10
+// unless the file says otherwise.
+type NFORating struct {
+	Source  string  `json:"source,omitempty"`
+	Value   float64 `json:"value"`
+	Max     float64 `json:"max"`
+	Votes   int64   `json:"votes,omitempty"`
+	Default bool    `json:"default,omitempty"`
+}
+
+// nfoXML is the subset of Kodi's movie, episodedetails and tvshow elements
+// that is kept. <rating> is either a bare value next to <votes> (older
+// files) or one of the <ratings> of newer ones.
+type nfoXML struct {
+	XMLName   xml.Name
+	Title     string   `xml:"title"`
+	Plot      string   `xml:"plot"`
+	Outline   string   `xml:"outline"`
+	Year      string   `xml:"year"`
+	Premiered string   `xml:"premiered"`
+	Aired     string   `xml:"aired"`
+	Genres    []string `xml:"genre"`
+	Actors    []struct {
+		Name string `xml:"name"`
+		Role string `xml:"role"`
+	} `xml:"actor"`
+	Rating  string `xml:"rating"`
+	Votes   string `xml:"votes"`
+	Ratings []struct {
+		Name    string `xml:"name,attr"`
+		Max     string `xml:"max,attr"`
+		Default bool   `xml:"default,attr"`
+		Value   string `xml:"value"`
+		Votes   string `xml:"votes"`
+	} `xml:"ratings>rating"`
+}
+
+// nfoKinds are the root elements ParseNFO understands.
+var nfoKinds = []string{"movie", "episodedetails", "tvshow"}
+
+// parseVotes reads vote counts written as 12345 or 12,345.
+func parseVotes(v string) int64 {
+	n, _ := strconv.ParseInt(strings.ReplaceAll(strings.TrimSpace(v), ",", ""), 10, 64)
+	return max(n, 0)
+}
+
+// ParseNFO reads a Kodi-style .nfo file. Anything after the root element,
+// like the scraper URL some tools append, is ignored.
+func ParseNFO(data []byte) (*NFO, error) {
+	dec := xml.NewDecoder(bytes.NewReader(data))
+	dec.Strict = false
+	dec.CharsetReader = func(charset string, input io.Reader) (io.Reader, error) {
+		switch strings.ToLower(charset) {
+		case "utf-8", "utf8", "us-ascii":
+			return input, nil
+		case "iso-8859-1", "latin1":
+			return charmap.ISO8859_1.NewDecoder().Reader(input), nil
+		case "windows-1252", "cp1252":
+			return charmap.Windows1252.NewDecoder().Reader(input), nil
+		}
+		return nil, fmt.Errorf("unsupported charset %q", charset)
+	}
+	var raw nfoXML
+	if err := dec.Decode(&raw); err != nil {
+		return nil, fmt.Errorf("not an NFO file: %w", err)
+	}
+	kind := strings.ToLower(raw.XMLName.Local)
+	if !slices.Contains(nfoKinds, kind) {
+		return nil, fmt.Errorf("unsupported NFO element <%s>", raw.XMLName.Local)
+	}
+
+	nfo := &NFO{
+		Kind:    kind,
+		Title:   strings.TrimSpace(raw.Title),
+		Plot:    strings.TrimSpace(raw.Plot),
+		Genres:  []string{},
+		Cast:    []NFOActor{},
+		Ratings: []NFORating{},
+	}
+	if nfo.Plot == "" {
+		nfo.Plot = strings.TrimSpace(raw.Outline)
+	}
+	// Dates are "2019" or "2019-05-03".
+	for _, date := range []string{raw.Year, raw.Premiered, raw.Aired} {
+		if date = strings.TrimSpace(date); len(date) >= 4 {
+			if year, err := strconv.Atoi(date[:4]); err == nil && year > 0 {
+				nfo.Year = year
+				break
+			}
+		}
+	}
+	// Some scrapers put every genre in one element, as "Drama / Comedy".
+	for _, g := range raw.Genres {
+		for _, genre := range strings.Split(g, "/") {
+			if genre = strings.TrimSpace(genre); genre != "" && !slices.Contains(nfo.Genres, genre) {
+				nfo.Genres = append(nfo.Genres, genre)
+			}
+		}
+	}
+	for _, a := range raw.Actors {
+		if name := strings.TrimSpace(a.Name); name != "" {
+			nfo.Cast = append(nfo.Cast, NFOActor{Name: name, Role: strings.TrimSpace(a.Role)})
+		}
+	}
+	for _, r := range raw.Ratings {
+		value, err := strconv.ParseFloat(strings.TrimSpace(r.Value), 64)
+		if err != nil {
+			continue
+		}
+		rating := NFORating{Source: r.Name, Value: value, Max: 10, Votes: parseVotes(r.Votes), Default: r.Default}
+		if m, err := strconv.ParseFloat(r.Max, 64); err == nil && m > 0 {
+			rating.Max = m
+		}
+		nfo.Ratings = append(nfo.Ratings, rating)
+	}
+	if len(nfo.Ratings) == 0 {
+		if value, err := strconv.ParseFloat(strings.TrimSpace(raw.Rating), 64); err == nil {
+			nfo.Ratings = append(nfo.Ratings, NFORating{Value: value, Max: 10, Votes: parseVotes(raw.Votes), Default: true})
+		}
+	}
+	return nfo, nil
+}
@@ -0,0 +1,92 @@
+package storage
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseNFO(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want *NFO
+	}{
+		{
+			name: "movie",
+			in: `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<movie>
+  <title> Heat </title>
+  <outline>Short</outline>
+  <premiered>1995-12-15</premiered>
+  <genre>Crime / Drama</genre>
+  <genre>Drama</genre>
+  <actor><name>Al Pacino</name><role>Vincent Hanna</role></actor>
+  <actor><name></name></actor>
+  <ratings>
+    <rating name="imdb" max="10" default="true"><value>8.3</value><votes>700,123</votes></rating>
+    <rating name="metacritic" max="100"><value>76</value></rating>
+  </ratings>
+</movie>
+https://www.themoviedb.org/movie/949`,
+			want: &NFO{
+				Kind:   "movie",
+				Title:  "Heat",
+				Plot:   "Short",
+				Year:   1995,
+				Genres: []string{"Crime", "Drama"},
+				Cast:   []NFOActor{{Name: "Al Pacino", Role: "Vincent Hanna"}},
+				Ratings: []NFORating{
+					{Source: "imdb", Value: 8.3, Max: 10, Votes: 700123, Default: true},
+					{Source: "metacritic", Value: 76, Max: 100},
+				},
+			},
+		},
+		{
+			name: "old rating",
+			in:   `<tvshow><title>Show</title><plot>Plot</plot><year>2019</year><rating>7.5</rating><votes>42</votes></tvshow>`,
+			want: &NFO{
+				Kind:    "tvshow",
+				Title:   "Show",
+				Plot:    "Plot",
+				Year:    2019,
+				Genres:  []string{},
+				Cast:    []NFOActor{},
+				Ratings: []NFORating{{Value: 7.5, Max: 10, Votes: 42, Default: true}},
+			},
+		},
+		{
+			name: "windows-1252",
+			in:   "<?xml version=\"1.0\" encoding=\"windows-1252\"?><episodedetails><title>\x93Caf\xe9\x94 \x80</title></episodedetails>",
+			want: &NFO{Kind: "episodedetails", Title: "“Café” €", Genres: []string{}, Cast: []NFOActor{}, Ratings: []NFORating{}},
+		},
+		{
+			name: "latin1",
+			in:   "<?xml version=\"1.0\" encoding=\"ISO-8859-1\"?><movie><title>Caf\xe9</title></movie>",
+			want: &NFO{Kind: "movie", Title: "Café", Genres: []string{}, Cast: []NFOActor{}, Ratings: []NFORating{}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseNFO([]byte(tt.in))
+			if err != nil {
+				t.Fatalf("ParseNFO: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseNFO = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseNFOErrors(t *testing.T) {
+	for _, in := range []string{
+		"",
+		"https://www.imdb.com/title/tt0113277/",
+		"<musicvideo><title>x</title></musicvideo>",
+		`<?xml version="1.0" encoding="shift_jis"?><movie/>`,
+	} {
+		if _, err := ParseNFO([]byte(in)); err == nil {
+			t.Errorf("ParseNFO(%q) succeeded, want an error", in)
+		}
+	}
+}
@@ -0,0 +1,239 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"media-server/assets"
+	"media-server/config"
+	"path"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/lib/pq"
+)
+
+// probeTimeout bounds a single ffprobe run against a remote URL.
+const probeTimeout = 2 * time.Minute
+
+// ProbeStream is one stream of ffprobe's -show_streams output.
+type ProbeStream struct {
+	Index       int               `json:"index"`
+	CodecType   string            `json:"codec_type"`
+	CodecName   string            `json:"codec_name"`
+	Width       int               `json:"width"`
+	Height      int               `json:"height"`
+	Tags        map[string]string `json:"tags"`
+	Disposition map[string]int    `json:"disposition"`
+}
+
+// ProbeResult is the subset of ffprobe's JSON output the server uses.
+type ProbeResult struct {
+	Format struct {
+		Duration string            `json:"duration"`
+		Tags     map[string]string `json:"tags"`
+	} `json:"format"`
+	Streams []ProbeStream `json:"streams"`
+}
+
+// Duration returns the container duration in seconds, or 0 if unknown.
+func (p *ProbeResult) Duration() float64 {
+	d, _ := strconv.ParseFloat(p.Format.Duration, 64)
+	return d
+}
+
+// FirstStream returns the first stream of the given codec type, if any.
+func (p *ProbeResult) FirstStream(codecType string) *ProbeStream {
+	for i := range p.Streams {
+		if p.Streams[i].CodecType == codecType {
+			return &p.Streams[i]
+		}
+	}
+	return nil
+}
+
+// iso6709Pattern matches the latitude and longitude at the start of an ISO
+// 6709 location, e.g. +37.7749-122.4194+010.000/
+var iso6709Pattern = regexp.MustCompile(`^([+-]\d+(?:\.\d+)?)([+-]\d+(?:\.\d+)?)`)
+
+// Capture returns when, where and with which camera a video was recorded,
+// from the container tags phones and cameras write, and whether any of it
+// was found.
+func (p *ProbeResult) Capture() (*assets.ImageInfo, bool) {
+	tags := p.Format.Tags
+	info := &assets.ImageInfo{
+		Make:        tags["com.apple.quicktime.make"],
+		Model:       tags["com.apple.quicktime.model"],
+		Orientation: 1,
+	}
+
+	// QuickTime's creation date keeps the local time and offset;
+	// creation_time is UTC.
+	if t, err := time.Parse("2006-01-02T15:04:05-0700", tags["com.apple.quicktime.creationdate"]); err == nil {
+		wall := time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), 0, time.UTC)
+		info.TakenAt, info.TakenAtOffset = &wall, t.Format("-07:00")
+	} else if t, err := time.Parse(time.RFC3339Nano, tags["creation_time"]); err == nil && t.Year() > 1970 {
+		wall := t.UTC()
+		info.TakenAt, info.TakenAtOffset = &wall, "+00:00"
+	}
+
+	for _, tag := range []string{"com.apple.quicktime.location.ISO6709", "location", "location-eng"} {
+		m := iso6709Pattern.FindStringSubmatch(tags[tag])
+		if m == nil {
+			continue
+		}
+		lat, latErr := strconv.ParseFloat(m[1], 64)
+		lon, lonErr := strconv.ParseFloat(m[2], 64)
+		if latErr == nil && lonErr == nil && lat >= -90 && lat <= 90 && lon >= -180 && lon <= 180 {
+			info.Latitude, info.Longitude = &lat, &lon
+			break
+		}
+	}
+
+	found := info.TakenAt != nil || info.Latitude != nil || info.Make != "" || info.Model != ""
+	return info, found
+}
+
+// PresignGetURL returns a short-lived URL ffmpeg/ffprobe can read an object from.
+func PresignGetURL(ctx context.Context, r2Client *s3.Client, bucket, objectKey string) (string, error) {
+	return assets.NewGenerator(r2Client, bucket).SourceURL(ctx, objectKey)
+}
+
+// Probe runs ffprobe against a URL or local path.
+func Probe(ctx context.Context, input string) (*ProbeResult, error) {
+	release, err := assets.Acquire(ctx, assets.WeightProbe)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	ctx, cancel := context.WithTimeout(ctx, probeTimeout)
+	defer cancel()
+
+	var stdout bytes.Buffer
+	err = assets.DefaultRunner.Run(ctx, "ffprobe", []string{
+		"-v", "error",
+		"-print_format", "json",
+		"-show_format",
+		"-show_streams",
+		input,
+	}, &stdout)
+	if err != nil {
+		return nil, err
+	}
+
+	var result ProbeResult
+	if err := json.Unmarshal(stdout.Bytes(), &result); err != nil {
+		return nil, fmt.Errorf("failed to parse ffprobe output: %w", err)
+	}
+	return &result, nil
+}
+
+// ProbeObject presigns an object and probes it.
+func ProbeObject(ctx context.Context, r2Client *s3.Client, bucket, objectKey string) (*ProbeResult, error) {
+	url, err := PresignGetURL(ctx, r2Client, bucket, objectKey)
+	if err != nil {
+		return nil, err
+	}
+	return Probe(ctx, url)
+}
+
+// ProbeAndStore probes a file and saves its duration, dimensions and codecs.
+// probed_at is set even when probing fails so the file isn't retried on
+// every startup.
+func ProbeAndStore(ctx context.Context, db *sql.DB, r2Client *s3.Client, bucket string, fileID int64, objectKey string) error {
+	probe, probeErr := ProbeObject(ctx, r2Client, bucket, objectKey)
+	if probeErr != nil {
+		_, err := db.ExecContext(ctx, "UPDATE files_table SET probed_at = $1 WHERE id = $2", time.Now(), fileID)
+		if err != nil {
+			log.Printf("Failed to mark file %d as probed: %v", fileID, err)
+		}
+		return probeErr
+	}
+
+	var duration *float64
+	if d := probe.Duration(); d > 0 {
+		duration = &d
+	}
+	var width, height *int
+	var videoCodec, audioCodec *string
+	if v := probe.FirstStream("video"); v != nil {
+		width, height, videoCodec = &v.Width, &v.Height, &v.CodecName
+	}
+	if a := probe.FirstStream("audio"); a != nil {
+		audioCodec = &a.CodecName
+	}
+
+	_, err := db.ExecContext(ctx, `
+		UPDATE files_table
+		SET duration = $1, width = $2, height = $3, video_codec = $4, audio_codec = $5, probed_at = $6
+		WHERE id = $7
+	`, duration, width, height, videoCodec, audioCodec, time.Now(), fileID)
+	if err != nil {
+		return fmt.Errorf("failed to store probe data for file %d: %w", fileID, err)
+	}
+	if IsAudioFile(path.Ext(objectKey)) {
+		err := StoreAudioTags(ctx, db, fileID, objectKey, probe.AudioTags())
+		if err != nil {
+			log.Printf("Failed to store audio tags of file %d: %v", fileID, err)
+		}
+		RecordAssetResult(db, fileID, AssetKindTags, err)
+	} else if capture, ok := probe.Capture(); ok {
+		if err := storeExif(ctx, db, fileID, capture); err != nil {
+			log.Printf("Failed to store capture metadata of file %d: %v", fileID, err)
+		}
+	}
+	return RefreshSearchDocument(db, fileID)
+}
+
+// ProbeMissingMetadata probes every audio/video file that hasn't been probed
+// yet, and audio files probed before their tags were stored. Audio files
+// whose tags failed to store are retried with the backoff of other assets.
+func ProbeMissingMetadata(db *sql.DB, r2Client *s3.Client, bucket string) error {
+	exts := append(slices.Clone(VideoExtensions), AudioExtensions...)
+	rows, err := db.Query(fmt.Sprintf(`
+		SELECT f.id, f.url, f.type FROM files_table f
+		WHERE LOWER(f.type) = ANY($1) AND (f.probed_at IS NULL OR (
+			LOWER(f.type) = ANY($2) AND f.duration IS NOT NULL
+			AND NOT EXISTS (SELECT 1 FROM tracks_table t WHERE t.file_id = f.id)
+			AND NOT EXISTS (SELECT 1 FROM asset_status_table s WHERE s.file_id = f.id AND s.kind = $4 AND NOT %s)))
+	`, fmt.Sprintf(assetDueSQL, 3)), pq.Array(exts), pq.Array(AudioExtensions), config.AssetMaxAttempts, AssetKindTags)
+	if err != nil {
+		return err
+	}
+
+	type pending struct {
+		id        int64
+		objectKey string
+	}
+	var files []pending
+	for rows.Next() {
+		var id int64
+		var url, fileType string
+		if err := rows.Scan(&id, &url, &fileType); err != nil {
+			log.Printf("Scan failed: %v", err)
+			continue
+		}
+		files = append(files, pending{id, strings.TrimPrefix(url, config.CloudflarePublicDevURL+"/")})
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, f := range files {
+		if err := ProbeAndStore(context.Background(), db, r2Client, bucket, f.id, f.objectKey); err != nil {
+			log.Printf("Probe error for %s: %v", f.objectKey, err)
+			continue
+		}
+		log.Printf("Probed file: %s", f.objectKey)
+	}
+	return nil
+}
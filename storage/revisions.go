@@ -0,0 +1,221 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"math"
+	"media-server/vtt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// CreateSubtitleRevisionsTableSQL keeps retimed versions of subtitle tracks.
+// The original stays at the track's object_key as revision 0; scale and
+// offset_ms are cumulative relative to it.
+const CreateSubtitleRevisionsTableSQL = `
+CREATE TABLE IF NOT EXISTS subtitle_revisions_table (
+    id SERIAL PRIMARY KEY,
+    track_id INTEGER NOT NULL,
+    revision INTEGER NOT NULL,
+    object_key TEXT NOT NULL UNIQUE,
+    scale DOUBLE PRECISION NOT NULL DEFAULT 1,
+    offset_ms BIGINT NOT NULL DEFAULT 0,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    CONSTRAINT fk_revision_track
+        FOREIGN KEY (track_id)
+        REFERENCES subtitle_tracks_table(id)
+        ON DELETE CASCADE,
+    CONSTRAINT subtitle_revisions_unique UNIQUE (track_id, revision)
+);
+`
+
+// SubtitleRevision is one version of a subtitle track.
+type SubtitleRevision struct {
+	Revision  int       `json:"revision"`
+	Scale     float64   `json:"scale"`
+	OffsetMS  int64     `json:"offset_ms"`
+	Current   bool      `json:"current"`
+	CreatedAt time.Time `json:"created_at"`
+	ObjectKey string    `json:"-"`
+}
+
+// ListSubtitleRevisions returns every version of a track, the original
+// (revision 0) first.
+func ListSubtitleRevisions(db *sql.DB, track SubtitleTrack) ([]SubtitleRevision, error) {
+	rows, err := db.Query(`
+		SELECT revision, scale, offset_ms, created_at, object_key
+		FROM subtitle_revisions_table
+		WHERE track_id = $1
+		ORDER BY revision
+	`, track.ID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	revisions := []SubtitleRevision{{Scale: 1, Current: track.Revision == 0, ObjectKey: track.ObjectKey}}
+	for rows.Next() {
+		var r SubtitleRevision
+		if err := rows.Scan(&r.Revision, &r.Scale, &r.OffsetMS, &r.CreatedAt, &r.ObjectKey); err != nil {
+			return nil, err
+		}
+		r.Current = r.Revision == track.Revision
+		revisions = append(revisions, r)
+	}
+	return revisions, rows.Err()
+}
+
+// RetimeSubtitleTrack applies t*scale + offset to a track and stores the
+// result as a new revision, which becomes the one served. Unless
+// fromOriginal is set, the change is applied on top of the current revision.
+func RetimeSubtitleTrack(ctx context.Context, db *sql.DB, r2Client *s3.Client, bucket string, track SubtitleTrack, scale float64, offset time.Duration, fromOriginal bool) (SubtitleRevision, error) {
+	if scale <= 0 || math.IsInf(scale, 0) || math.IsNaN(scale) {
+		return SubtitleRevision{}, fmt.Errorf("invalid scale %v", scale)
+	}
+
+	// Revisions are always rendered from the original, so repeated
+	// adjustments don't accumulate rounding errors.
+	baseScale, baseOffset := 1.0, int64(0)
+	if !fromOriginal && track.Revision > 0 {
+		err := db.QueryRowContext(ctx, `
+			SELECT scale, offset_ms FROM subtitle_revisions_table WHERE track_id = $1 AND revision = $2
+		`, track.ID, track.Revision).Scan(&baseScale, &baseOffset)
+		if err != nil {
+			return SubtitleRevision{}, fmt.Errorf("failed to read current revision: %w", err)
+		}
+	}
+	rev := SubtitleRevision{
+		Scale:    baseScale * scale,
+		OffsetMS: int64(math.Round(float64(baseOffset)*scale)) + offset.Milliseconds(),
+	}
+
+	original, err := downloadObject(ctx, r2Client, bucket, track.ObjectKey)
+	if err != nil {
+		return SubtitleRevision{}, fmt.Errorf("failed to download original subtitle: %w", err)
+	}
+	cues, err := vtt.Parse(bytes.NewReader(original))
+	if err != nil {
+		return SubtitleRevision{}, err
+	}
+	var buf bytes.Buffer
+	if err := vtt.Write(&buf, vtt.Retime(cues, rev.Scale, time.Duration(rev.OffsetMS)*time.Millisecond)); err != nil {
+		return SubtitleRevision{}, err
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return SubtitleRevision{}, err
+	}
+	defer tx.Rollback()
+
+	// Locking the track serialises concurrent retimes of the same track.
+	if _, err := tx.ExecContext(ctx, "SELECT 1 FROM subtitle_tracks_table WHERE id = $1 FOR UPDATE", track.ID); err != nil {
+		return SubtitleRevision{}, err
+	}
+	err = tx.QueryRowContext(ctx, `
+		SELECT COALESCE(MAX(revision), 0) + 1 FROM subtitle_revisions_table WHERE track_id = $1
+	`, track.ID).Scan(&rev.Revision)
+	if err != nil {
+		return SubtitleRevision{}, err
+	}
+	rev.ObjectKey = fmt.Sprintf("%s.rev%d.vtt", strings.TrimSuffix(track.ObjectKey, ".vtt"), rev.Revision)
+
+	_, err = manager.NewUploader(r2Client).Upload(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(bucket),
+		Key:         aws.String(rev.ObjectKey),
+		Body:        bytes.NewReader(buf.Bytes()),
+		ContentType: aws.String("text/vtt"),
+	})
+	if err != nil {
+		return SubtitleRevision{}, fmt.Errorf("failed to upload revision: %w", err)
+	}
+	// The object is only kept if the revision is recorded.
+	committed := false
+	defer func() {
+		if committed {
+			return
+		}
+		_, err := r2Client.DeleteObject(context.Background(), &s3.DeleteObjectInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(rev.ObjectKey),
+		})
+		if err != nil {
+			log.Printf("Failed to delete unrecorded subtitle revision %s: %v", rev.ObjectKey, err)
+		}
+	}()
+
+	err = tx.QueryRowContext(ctx, `
+		INSERT INTO subtitle_revisions_table (track_id, revision, object_key, scale, offset_ms)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING created_at
+	`, track.ID, rev.Revision, rev.ObjectKey, rev.Scale, rev.OffsetMS).Scan(&rev.CreatedAt)
+	if err != nil {
+		return SubtitleRevision{}, fmt.Errorf("failed to record revision: %w", err)
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE subtitle_tracks_table SET current_revision = $1 WHERE id = $2", rev.Revision, track.ID); err != nil {
+		return SubtitleRevision{}, err
+	}
+	if err := tx.Commit(); err != nil {
+		return SubtitleRevision{}, err
+	}
+	committed = true
+	rev.Current = true
+
+	if err := RecordDerivedAsset(db, track.FileID, AssetKindSubtitle, rev.ObjectKey, "text/vtt", int64(buf.Len())); err != nil {
+		return rev, fmt.Errorf("subtitle accounting error: %w", err)
+	}
+	if err := IndexSubtitleCues(db, track.FileID, track.ID, buf.Bytes()); err != nil {
+		return rev, fmt.Errorf("subtitle indexing error: %w", err)
+	}
+	return rev, nil
+}
+
+// SetSubtitleRevision makes an existing revision (0 for the original) the one
+// served for a track and re-indexes its cues.
+func SetSubtitleRevision(ctx context.Context, db *sql.DB, r2Client *s3.Client, bucket string, track SubtitleTrack, revision int) error {
+	key := track.ObjectKey
+	if revision != 0 {
+		err := db.QueryRowContext(ctx, `
+			SELECT object_key FROM subtitle_revisions_table WHERE track_id = $1 AND revision = $2
+		`, track.ID, revision).Scan(&key)
+		if err != nil {
+			return err
+		}
+	}
+
+	if _, err := db.ExecContext(ctx, "UPDATE subtitle_tracks_table SET current_revision = $1 WHERE id = $2", revision, track.ID); err != nil {
+		return err
+	}
+
+	data, err := downloadObject(ctx, r2Client, bucket, key)
+	if err != nil {
+		return fmt.Errorf("failed to download revision %d: %w", revision, err)
+	}
+	return IndexSubtitleCues(db, track.FileID, track.ID, data)
+}
+
+// CurrentSubtitleKey maps the object key of a track to the key of the
+// revision currently served. Keys that aren't tracks are returned as is.
+func CurrentSubtitleKey(ctx context.Context, db *sql.DB, key string) (string, error) {
+	var current string
+	err := db.QueryRowContext(ctx, `
+		SELECT r.object_key
+		FROM subtitle_tracks_table t
+		JOIN subtitle_revisions_table r ON r.track_id = t.id AND r.revision = t.current_revision
+		WHERE t.object_key = $1
+	`, key).Scan(&current)
+	if err == sql.ErrNoRows {
+		return key, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return current, nil
+}
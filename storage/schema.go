@@ -58,6 +58,20 @@ CREATE TABLE IF NOT EXISTS files_table (
     thumbnail_url TEXT,
     subtitle_url TEXT,
     subtitle_gen_failed BOOLEAN NOT NULL DEFAULT FALSE, --  <-- ADD IT HERE
+    content_type TEXT,
+    type_mismatch BOOLEAN NOT NULL DEFAULT FALSE,
+    duration DOUBLE PRECISION,
+    width INTEGER,
+    height INTEGER,
+    video_codec TEXT,
+    audio_codec TEXT,
+    probed_at TIMESTAMP,
+    hidden BOOLEAN NOT NULL DEFAULT FALSE,
+    preview_url TEXT,
+    thumbnail_source TEXT NOT NULL DEFAULT 'auto',
+    display_url TEXT,
+    thumbnail_source_key TEXT,
+    thumbnail_frame_ms BIGINT,
     CONSTRAINT fk_parent
         FOREIGN KEY (parent)
         REFERENCES folders_table(id)
@@ -65,7 +79,63 @@ CREATE TABLE IF NOT EXISTS files_table (
 );
 `
 
+// CreateDerivedAssetsTableSQL tracks every object generated from a file
+// (thumbnails, subtitles, renditions, ...) so its bytes can be billed to the
+// file's owner.
+const CreateDerivedAssetsTableSQL = `
+CREATE TABLE IF NOT EXISTS derived_assets_table (
+    id SERIAL PRIMARY KEY,
+    file_id INTEGER NOT NULL,
+    kind TEXT NOT NULL,
+    object_key TEXT NOT NULL UNIQUE,
+    content_type TEXT,
+    size BIGINT NOT NULL DEFAULT 0,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    CONSTRAINT fk_derived_file
+        FOREIGN KEY (file_id)
+        REFERENCES files_table(id)
+        ON DELETE CASCADE
+);
+`
+
+// CreateUserQuotasTableSQL holds per-user overrides of the default quota
+// (USER_QUOTA_MB). A quota of 0 means unlimited.
+const CreateUserQuotasTableSQL = `
+CREATE TABLE IF NOT EXISTS user_quotas_table (
+    ownerId TEXT PRIMARY KEY,
+    quota_bytes BIGINT NOT NULL
+);
+`
+
+const CreateDerivedAssetsFileIndexSQL = `CREATE INDEX IF NOT EXISTS derived_assets_file_index ON derived_assets_table (file_id);`
 const CreateFilesParentIndexSQL = `CREATE INDEX IF NOT EXISTS files_parent_index ON files_table (parent);`
 const CreateFilesOwnerIDIndexSQL = `CREATE INDEX IF NOT EXISTS files_ownerId_index ON files_table (ownerId);`
 const CreateFoldersParentIndexSQL = `CREATE INDEX IF NOT EXISTS folders_parent_index ON folders_table (parent);`
 const CreateFoldersOwnerIDIndexSQL = `CREATE INDEX IF NOT EXISTS folders_ownerId_index ON folders_table (ownerId);`
+
+// CreateFoldersPathPatternIndexSQL lets byte-wise range scans (~>=~, ~<~)
+// and LIKE prefixes find the folders beneath a path.
+const CreateFoldersPathPatternIndexSQL = `CREATE INDEX IF NOT EXISTS folders_path_pattern_index ON folders_table (path text_pattern_ops);`
+
+// FilesTableMigrations adds columns introduced after files_table was first
+// deployed. Each statement must be safe to run on every startup.
+var FilesTableMigrations = []string{
+	`ALTER TABLE files_table ADD COLUMN IF NOT EXISTS content_type TEXT;`,
+	`ALTER TABLE files_table ADD COLUMN IF NOT EXISTS type_mismatch BOOLEAN NOT NULL DEFAULT FALSE;`,
+	`ALTER TABLE files_table ADD COLUMN IF NOT EXISTS duration DOUBLE PRECISION;`,
+	`ALTER TABLE files_table ADD COLUMN IF NOT EXISTS width INTEGER;`,
+	`ALTER TABLE files_table ADD COLUMN IF NOT EXISTS height INTEGER;`,
+	`ALTER TABLE files_table ADD COLUMN IF NOT EXISTS video_codec TEXT;`,
+	`ALTER TABLE files_table ADD COLUMN IF NOT EXISTS audio_codec TEXT;`,
+	`ALTER TABLE files_table ADD COLUMN IF NOT EXISTS probed_at TIMESTAMP;`,
+	`ALTER TABLE files_table ADD COLUMN IF NOT EXISTS hidden BOOLEAN NOT NULL DEFAULT FALSE;`,
+	`ALTER TABLE files_table ADD COLUMN IF NOT EXISTS preview_url TEXT;`,
+	`ALTER TABLE files_table ADD COLUMN IF NOT EXISTS thumbnail_source TEXT NOT NULL DEFAULT 'auto';`,
+	`ALTER TABLE files_table ADD COLUMN IF NOT EXISTS display_url TEXT;`,
+	`ALTER TABLE files_table ADD COLUMN IF NOT EXISTS thumbnail_source_key TEXT;`,
+	`ALTER TABLE files_table ADD COLUMN IF NOT EXISTS thumbnail_frame_ms BIGINT;`,
+	CreateFilesParentIndexSQL,
+	CreateFilesOwnerIDIndexSQL,
+	`CREATE INDEX IF NOT EXISTS files_parent_name_index ON files_table (parent, name, id);`,
+	`CREATE INDEX IF NOT EXISTS files_parent_created_index ON files_table (parent, created_at, id);`,
+}
@@ -0,0 +1,157 @@
+package storage
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// TrigramSearch reports whether the pg_trgm extension is available. Without
+// it search falls back to full-text matching plus plain substring matches.
+var TrigramSearch bool
+
+// CreateFileTagsTableSQL stores free-form tags attached to files.
+const CreateFileTagsTableSQL = `
+CREATE TABLE IF NOT EXISTS file_tags_table (
+    file_id INTEGER NOT NULL,
+    tag TEXT NOT NULL,
+    PRIMARY KEY (file_id, tag),
+    CONSTRAINT fk_tag_file
+        FOREIGN KEY (file_id)
+        REFERENCES files_table(id)
+        ON DELETE CASCADE
+);
+`
+
+// SearchMigrations add the search document of files_table and its full-text
+// index.
+var SearchMigrations = []string{
+	`ALTER TABLE files_table ADD COLUMN IF NOT EXISTS search_document TEXT;`,
+	`ALTER TABLE files_table ADD COLUMN IF NOT EXISTS search_vector tsvector
+		GENERATED ALWAYS AS (to_tsvector('simple', COALESCE(search_document, ''))) STORED;`,
+	`CREATE INDEX IF NOT EXISTS files_search_vector_index ON files_table USING GIN (search_vector);`,
+}
+
+// TrigramMigrations enable fuzzy matching; failures are not fatal.
+var TrigramMigrations = []string{
+	`CREATE EXTENSION IF NOT EXISTS pg_trgm;`,
+	`CREATE INDEX IF NOT EXISTS files_search_document_trgm_index ON files_table USING GIN (search_document gin_trgm_ops);`,
+	`CREATE INDEX IF NOT EXISTS folders_path_trgm_index ON folders_table USING GIN (path gin_trgm_ops);`,
+}
+
+// searchDocumentSQL builds the text indexed for each file: its name split on
+// punctuation, the words of its folder path, its tags, the title, artists,
+// album and genre of tracks, and probed stream info. The raw name comes last
+// so fuzzy matching still sees it verbatim.
+const searchDocumentSQL = `
+	SELECT f2.id, concat_ws(' ',
+		regexp_replace(f2.name, '[._\-]+', ' ', 'g'),
+		regexp_replace(fo.path, '[/._\-]+', ' ', 'g'),
+		(SELECT string_agg(t.tag, ' ') FROM file_tags_table t WHERE t.file_id = f2.id),
+		(SELECT concat_ws(' ', tr.title, ar.name, al.title, aa.name, tr.genre)
+			FROM tracks_table tr
+			LEFT JOIN artists_table ar ON ar.id = tr.artist_id
+			LEFT JOIN albums_table al ON al.id = tr.album_id
+			LEFT JOIN artists_table aa ON aa.id = al.artist_id
+			WHERE tr.file_id = f2.id),
+		f2.video_codec,
+		f2.audio_codec,
+		CASE
+			WHEN f2.height >= 2160 THEN '4k 2160p'
+			WHEN f2.height >= 1080 THEN '1080p hd'
+			WHEN f2.height >= 720 THEN '720p hd'
+		END,
+		f2.name
+	) AS doc
+	FROM files_table f2
+	JOIN folders_table fo ON fo.id = f2.parent
+`
+
+// InitSearch creates the tag table and search indexes.
+func InitSearch(db *sql.DB) error {
+	if _, err := db.Exec(CreateFileTagsTableSQL); err != nil {
+		return fmt.Errorf("failed to create file_tags_table: %w", err)
+	}
+	log.Println("Created/Verified Table: file_tags_table")
+
+	for _, migration := range SearchMigrations {
+		if _, err := db.Exec(migration); err != nil {
+			return fmt.Errorf("failed to create search index: %w", err)
+		}
+	}
+
+	TrigramSearch = true
+	for _, migration := range TrigramMigrations {
+		if _, err := db.Exec(migration); err != nil {
+			log.Printf("Warning: trigram search unavailable, using full-text only: %v", err)
+			TrigramSearch = false
+			break
+		}
+	}
+	return nil
+}
+
+// RefreshSearchDocuments rebuilds the search document of every file whose
+// name, folder, tags or probe data changed.
+func RefreshSearchDocuments(db *sql.DB) error {
+	res, err := db.Exec(`
+		UPDATE files_table f SET search_document = d.doc
+		FROM (` + searchDocumentSQL + `) d
+		WHERE f.id = d.id AND f.search_document IS DISTINCT FROM d.doc
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to refresh search documents: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		log.Printf("Refreshed search documents for %d files", n)
+	}
+	return nil
+}
+
+// RefreshSearchDocument rebuilds the search document of a single file.
+func RefreshSearchDocument(db *sql.DB, fileID int64) error {
+	_, err := db.Exec(`
+		UPDATE files_table f SET search_document = d.doc
+		FROM (`+searchDocumentSQL+` WHERE f2.id = $1) d
+		WHERE f.id = d.id
+	`, fileID)
+	if err != nil {
+		return fmt.Errorf("failed to refresh search document of file %d: %w", fileID, err)
+	}
+	return nil
+}
+
+// SetFileTags replaces the tags of a file. Tags are trimmed, lower-cased and
+// de-duplicated.
+func SetFileTags(db *sql.DB, fileID int64, tags []string) ([]string, error) {
+	seen := map[string]bool{}
+	clean := []string{}
+	for _, tag := range tags {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag == "" || seen[tag] {
+			continue
+		}
+		seen[tag] = true
+		clean = append(clean, tag)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM file_tags_table WHERE file_id = $1", fileID); err != nil {
+		return nil, fmt.Errorf("failed to clear tags: %w", err)
+	}
+	for _, tag := range clean {
+		if _, err := tx.Exec("INSERT INTO file_tags_table (file_id, tag) VALUES ($1, $2)", fileID, tag); err != nil {
+			return nil, fmt.Errorf("failed to insert tag %q: %w", tag, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return clean, RefreshSearchDocument(db, fileID)
+}
@@ -0,0 +1,483 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"media-server/config"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/lib/pq"
+)
+
+// CreateNFOTableSQL holds the parsed .nfo sidecars. A sidecar describes a
+// video (file_id), a folder (folder_id), or both when it is the movie.nfo of
+// a folder holding a single video.
+const CreateNFOTableSQL = `
+CREATE TABLE IF NOT EXISTS nfo_table (
+    sidecar_id INTEGER PRIMARY KEY,
+    file_id INTEGER,
+    folder_id INTEGER,
+    kind TEXT NOT NULL,
+    title TEXT NOT NULL DEFAULT '',
+    plot TEXT NOT NULL DEFAULT '',
+    year INTEGER,
+    genres TEXT[] NOT NULL DEFAULT '{}',
+    cast_members JSONB NOT NULL DEFAULT '[]',
+    ratings JSONB NOT NULL DEFAULT '[]',
+    parsed_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    CONSTRAINT fk_nfo_sidecar
+        FOREIGN KEY (sidecar_id)
+        REFERENCES files_table(id)
+        ON DELETE CASCADE,
+    CONSTRAINT fk_nfo_file
+        FOREIGN KEY (file_id)
+        REFERENCES files_table(id)
+        ON DELETE CASCADE,
+    CONSTRAINT fk_nfo_folder
+        FOREIGN KEY (folder_id)
+        REFERENCES folders_table(id)
+        ON DELETE CASCADE
+);
+`
+
+// CreateArtworkTableSQL holds the sidecar images, like poster.jpg or
+// movie-fanart.jpg, and what they illustrate, as nfo_table does.
+const CreateArtworkTableSQL = `
+CREATE TABLE IF NOT EXISTS artwork_table (
+    sidecar_id INTEGER PRIMARY KEY,
+    file_id INTEGER,
+    folder_id INTEGER,
+    kind TEXT NOT NULL,
+    attached_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    CONSTRAINT fk_artwork_sidecar
+        FOREIGN KEY (sidecar_id)
+        REFERENCES files_table(id)
+        ON DELETE CASCADE,
+    CONSTRAINT fk_artwork_file
+        FOREIGN KEY (file_id)
+        REFERENCES files_table(id)
+        ON DELETE CASCADE,
+    CONSTRAINT fk_artwork_folder
+        FOREIGN KEY (folder_id)
+        REFERENCES folders_table(id)
+        ON DELETE CASCADE
+);
+`
+
+// SidecarMetadataMigrations index the videos and folders sidecars describe.
+var SidecarMetadataMigrations = []string{
+	`CREATE INDEX IF NOT EXISTS nfo_file_index ON nfo_table (file_id);`,
+	`CREATE INDEX IF NOT EXISTS nfo_folder_index ON nfo_table (folder_id);`,
+	`CREATE INDEX IF NOT EXISTS artwork_file_index ON artwork_table (file_id);`,
+	`CREATE INDEX IF NOT EXISTS artwork_folder_index ON artwork_table (folder_id);`,
+}
+
+// InitSidecarMetadata creates the NFO and artwork tables.
+func InitSidecarMetadata(db *sql.DB) error {
+	for _, create := range []struct{ table, sql string }{
+		{"nfo_table", CreateNFOTableSQL},
+		{"artwork_table", CreateArtworkTableSQL},
+	} {
+		if _, err := db.Exec(create.sql); err != nil {
+			return fmt.Errorf("failed to create %s: %w", create.table, err)
+		}
+		log.Println("Created/Verified Table: " + create.table)
+	}
+	for _, migration := range SidecarMetadataMigrations {
+		if _, err := db.Exec(migration); err != nil {
+			return fmt.Errorf("failed to migrate sidecar metadata tables: %w", err)
+		}
+	}
+	return nil
+}
+
+// artworkKinds maps the Kodi artwork names to the kind they are stored as:
+// poster.jpg, folder.jpg, or movie-poster.jpg next to movie.mkv.
+var artworkKinds = map[string]string{
+	"poster":     "poster",
+	"folder":     "poster",
+	"cover":      "poster",
+	"fanart":     "fanart",
+	"backdrop":   "fanart",
+	"background": "fanart",
+	"banner":     "banner",
+	"landscape":  "landscape",
+	"thumb":      "thumb",
+	"clearlogo":  "clearlogo",
+	"logo":       "clearlogo",
+	"clearart":   "clearart",
+	"disc":       "disc",
+	"discart":    "disc",
+}
+
+// thumbnailArtwork are the artwork kinds that replace generated thumbnails.
+var thumbnailArtwork = []string{"poster", "thumb"}
+
+// IsMetadataSidecar reports whether an object looks like an NFO or artwork
+// sidecar by its name. Whether it belongs to a video is only known once it
+// is attached.
+func IsMetadataSidecar(key string) bool {
+	name := path.Base(key)
+	ext := strings.ToLower(path.Ext(name))
+	if ext == ".nfo" {
+		return true
+	}
+	if !IsImageFile(ext) {
+		return false
+	}
+	_, kind := artworkName(strings.TrimSuffix(name, path.Ext(name)))
+	return kind != ""
+}
+
+// artworkName splits an image name into the video it names, if any, and its
+// artwork kind: "poster" is ("", "poster"), "Movie-fanart" is ("Movie",
+// "fanart").
+func artworkName(stem string) (video, kind string) {
+	if kind, ok := artworkKinds[strings.ToLower(stem)]; ok {
+		return "", kind
+	}
+	if i := strings.LastIndex(stem, "-"); i > 0 {
+		if kind, ok := artworkKinds[strings.ToLower(stem[i+1:])]; ok {
+			return stem[:i], kind
+		}
+	}
+	return "", ""
+}
+
+// sidecarTarget is what a metadata sidecar describes. Zero IDs are unset.
+type sidecarTarget struct {
+	fileID   int64
+	folderID int64
+}
+
+func (t sidecarTarget) args() (sql.NullInt64, sql.NullInt64) {
+	return sql.NullInt64{Int64: t.fileID, Valid: t.fileID != 0}, sql.NullInt64{Int64: t.folderID, Valid: t.folderID != 0}
+}
+
+// folderTarget targets a folder recognized as a movie's folder, one that
+// holds a movie, or as a show's folder. Other folders, like photo albums or
+// the library root, have no folder-level sidecars. With withVideo, the only
+// video directly in a movie folder is targeted too, as its movie.
+func folderTarget(ctx context.Context, db *sql.DB, folderID int64, withVideo bool) (sidecarTarget, bool, error) {
+	var videos, videoID int64
+	var movie, show bool
+	err := db.QueryRowContext(ctx, `
+		SELECT
+			(SELECT COUNT(*) FROM files_table WHERE parent = $1 AND NOT hidden AND LOWER(type) = ANY($2)),
+			(SELECT COALESCE(MIN(id), 0) FROM files_table WHERE parent = $1 AND NOT hidden AND LOWER(type) = ANY($2)),
+			EXISTS (SELECT 1 FROM movies_table m JOIN files_table f ON f.id = m.file_id WHERE f.parent = $1 AND NOT f.hidden),
+			EXISTS (SELECT 1 FROM shows_table WHERE folder_id = $1)
+	`, folderID, pq.Array(VideoExtensions)).Scan(&videos, &videoID, &movie, &show)
+	if err != nil || (!movie && !show) {
+		return sidecarTarget{}, false, err
+	}
+	t := sidecarTarget{folderID: folderID}
+	if withVideo && movie && videos == 1 {
+		t.fileID = videoID
+	}
+	return t, true, nil
+}
+
+// matchMetadataSidecar finds what a sidecar in folder parentID describes:
+// movie.nfo and tvshow.nfo describe the folder, name.nfo the video
+// name.*, generic artwork the folder and named artwork the video.
+func matchMetadataSidecar(ctx context.Context, db *sql.DB, parentID int64, name string) (sidecarTarget, string, bool, error) {
+	ext := strings.ToLower(path.Ext(name))
+	stem := strings.TrimSuffix(name, path.Ext(name))
+	kind, video := "nfo", stem
+	if ext == ".nfo" {
+		switch strings.ToLower(stem) {
+		case "movie":
+			t, ok, err := folderTarget(ctx, db, parentID, true)
+			return t, kind, ok, err
+		case "tvshow":
+			t, ok, err := folderTarget(ctx, db, parentID, false)
+			return t, kind, ok, err
+		}
+	} else {
+		video, kind = artworkName(stem)
+		if kind == "" {
+			return sidecarTarget{}, "", false, nil
+		}
+		if video == "" {
+			t, ok, err := folderTarget(ctx, db, parentID, true)
+			return t, kind, ok, err
+		}
+	}
+	videoID, _, err := findSidecarVideo(ctx, db, parentID, []string{video})
+	if err != nil || videoID == 0 {
+		return sidecarTarget{}, "", false, err
+	}
+	return sidecarTarget{fileID: videoID}, kind, true, nil
+}
+
+// AttachSidecarMetadata parses .nfo sidecars and attaches them and sidecar
+// artwork to the video or folder they describe, hiding them from listings.
+// Artwork of a video replaces its generated thumbnail. Sidecars that describe
+// nothing, or .nfo files that aren't Kodi XML, stay regular files. Sidecars
+// already attached are only matched again, and parsed again if replaced.
+func AttachSidecarMetadata(db *sql.DB, r2Client *s3.Client, bucket string, keys []string) {
+	for _, key := range keys {
+		if err := attachMetadataSidecar(context.Background(), db, r2Client, bucket, key); err != nil {
+			log.Printf("Failed to attach sidecar %s: %v", key, err)
+		}
+	}
+}
+
+// AttachFolderSidecars attaches the metadata sidecars of a folder again, such
+// as after a video was added to it.
+func AttachFolderSidecars(db *sql.DB, r2Client *s3.Client, bucket string, folderID int64) {
+	rows, err := db.Query("SELECT url FROM files_table WHERE parent = $1", folderID)
+	if err != nil {
+		log.Printf("Failed to list sidecars of folder %d: %v", folderID, err)
+		return
+	}
+	var keys []string
+	for rows.Next() {
+		var url string
+		if err := rows.Scan(&url); err == nil {
+			if key := strings.TrimPrefix(url, config.CloudflarePublicDevURL+"/"); IsMetadataSidecar(key) {
+				keys = append(keys, key)
+			}
+		}
+	}
+	rows.Close()
+	AttachSidecarMetadata(db, r2Client, bucket, keys)
+}
+
+func attachMetadataSidecar(ctx context.Context, db *sql.DB, r2Client *s3.Client, bucket, key string) error {
+	var sidecarID, parentID int64
+	var modifiedAt time.Time
+	err := db.QueryRowContext(ctx, "SELECT id, parent, created_at FROM files_table WHERE url = $1",
+		config.CloudflarePublicDevURL+"/"+key).Scan(&sidecarID, &parentID, &modifiedAt)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	target, kind, ok, err := matchMetadataSidecar(ctx, db, parentID, path.Base(key))
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return detachMetadataSidecar(ctx, db, sidecarID)
+	}
+	fileID, folderID := target.args()
+
+	if kind == "nfo" {
+		var current bool
+		err := db.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM nfo_table WHERE sidecar_id = $1 AND parsed_at >= $2)",
+			sidecarID, modifiedAt).Scan(&current)
+		if err != nil {
+			return err
+		}
+		if current {
+			_, err = db.ExecContext(ctx, "UPDATE nfo_table SET file_id = $1, folder_id = $2 WHERE sidecar_id = $3", fileID, folderID, sidecarID)
+		} else {
+			err = storeNFO(ctx, db, r2Client, bucket, key, sidecarID, target)
+		}
+		if err != nil {
+			return err
+		}
+	} else {
+		var previous sql.NullInt64
+		var attachedAt time.Time
+		err := db.QueryRowContext(ctx, "SELECT file_id, attached_at FROM artwork_table WHERE sidecar_id = $1", sidecarID).Scan(&previous, &attachedAt)
+		if err != nil && err != sql.ErrNoRows {
+			return err
+		}
+		changed := err == sql.ErrNoRows || previous != fileID || attachedAt.Before(modifiedAt)
+		_, err = db.ExecContext(ctx, `
+			INSERT INTO artwork_table (sidecar_id, file_id, folder_id, kind, attached_at) VALUES ($1, $2, $3, $4, $5)
+			ON CONFLICT (sidecar_id) DO UPDATE SET
+				file_id = EXCLUDED.file_id, folder_id = EXCLUDED.folder_id, kind = EXCLUDED.kind, attached_at = EXCLUDED.attached_at
+		`, sidecarID, fileID, folderID, kind, time.Now())
+		if err != nil {
+			return fmt.Errorf("failed to store artwork: %w", err)
+		}
+		if target.fileID != 0 && slices.Contains(thumbnailArtwork, kind) {
+			if err := applyArtworkThumbnail(ctx, db, r2Client, bucket, target.fileID, key, changed); err != nil {
+				log.Printf("Failed to use %s as thumbnail of file %d: %v", key, target.fileID, err)
+			}
+		}
+	}
+
+	if _, err := db.ExecContext(ctx, "UPDATE files_table SET hidden = TRUE WHERE id = $1", sidecarID); err != nil {
+		return err
+	}
+	log.Printf("Attached sidecar %s", key)
+	return nil
+}
+
+// detachMetadataSidecar turns a sidecar that was attached but no longer
+// describes anything, such as artwork in a folder that isn't a movie's or a
+// show's, back into a regular file.
+func detachMetadataSidecar(ctx context.Context, db *sql.DB, sidecarID int64) error {
+	_, err := db.ExecContext(ctx, `
+		WITH nfo AS (
+			DELETE FROM nfo_table WHERE sidecar_id = $1 RETURNING sidecar_id
+		), artwork AS (
+			DELETE FROM artwork_table WHERE sidecar_id = $1 RETURNING sidecar_id
+		)
+		UPDATE files_table SET hidden = FALSE
+		WHERE id = $1 AND (EXISTS (SELECT 1 FROM nfo) OR EXISTS (SELECT 1 FROM artwork))
+	`, sidecarID)
+	return err
+}
+
+// storeNFO downloads, parses and stores an .nfo sidecar.
+func storeNFO(ctx context.Context, db *sql.DB, r2Client *s3.Client, bucket, key string, sidecarID int64, target sidecarTarget) error {
+	data, err := downloadObject(ctx, r2Client, bucket, key)
+	if err != nil {
+		return err
+	}
+	nfo, err := ParseNFO(data)
+	if err != nil {
+		return err
+	}
+	cast, err := json.Marshal(nfo.Cast)
+	if err != nil {
+		return err
+	}
+	ratings, err := json.Marshal(nfo.Ratings)
+	if err != nil {
+		return err
+	}
+	fileID, folderID := target.args()
+	_, err = db.ExecContext(ctx, `
+		INSERT INTO nfo_table (sidecar_id, file_id, folder_id, kind, title, plot, year, genres, cast_members, ratings, parsed_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+		ON CONFLICT (sidecar_id) DO UPDATE SET
+			file_id = EXCLUDED.file_id,
+			folder_id = EXCLUDED.folder_id,
+			kind = EXCLUDED.kind,
+			title = EXCLUDED.title,
+			plot = EXCLUDED.plot,
+			year = EXCLUDED.year,
+			genres = EXCLUDED.genres,
+			cast_members = EXCLUDED.cast_members,
+			ratings = EXCLUDED.ratings,
+			parsed_at = EXCLUDED.parsed_at
+	`, sidecarID, fileID, folderID, nfo.Kind, nfo.Title, nfo.Plot, nullIfZero(nfo.Year), pq.Array(nfo.Genres), cast, ratings, time.Now())
+	if err != nil {
+		return fmt.Errorf("failed to store NFO: %w", err)
+	}
+	return nil
+}
+
+// applyArtworkThumbnail makes sidecar artwork the thumbnail of a video, unless
+// a user picked one. A generated thumbnail is always replaced, as it is
+// after the video was overwritten; a sidecar one only if the artwork changed.
+func applyArtworkThumbnail(ctx context.Context, db *sql.DB, r2Client *s3.Client, bucket string, videoID int64, imageKey string, changed bool) error {
+	var source, url string
+	err := db.QueryRowContext(ctx, "SELECT thumbnail_source, url FROM files_table WHERE id = $1", videoID).Scan(&source, &url)
+	if err != nil {
+		return err
+	}
+	if source != ThumbnailSourceAuto && (source != ThumbnailSourceSidecar || !changed) {
+		return nil
+	}
+	image, err := downloadObject(ctx, r2Client, bucket, imageKey)
+	if err != nil {
+		return err
+	}
+	_, err = setImageThumbnail(ctx, db, r2Client, bucket, videoID, strings.TrimPrefix(url, config.CloudflarePublicDevURL+"/"), image, thumbnailOrigin{Source: ThumbnailSourceSidecar, Key: imageKey})
+	return err
+}
+
+// SidecarMetadata is the NFO and artwork URLs, by kind, of a video or folder.
+type SidecarMetadata struct {
+	NFO     *NFO
+	Artwork map[string]string
+}
+
+// SidecarMetadataOfFiles returns the sidecar metadata of videos, by file ID.
+func SidecarMetadataOfFiles(ctx context.Context, db *sql.DB, ids []int64) (map[int64]*SidecarMetadata, error) {
+	return sidecarMetadataOf(ctx, db, "file_id", ids)
+}
+
+// SidecarMetadataOfFolders returns the sidecar metadata of folders, by folder
+// ID.
+func SidecarMetadataOfFolders(ctx context.Context, db *sql.DB, ids []int64) (map[int64]*SidecarMetadata, error) {
+	return sidecarMetadataOf(ctx, db, "folder_id", ids)
+}
+
+// sidecarMetadataOf reads the sidecars whose column is one of ids. A
+// sidecar named after a video wins over the folder's generic one.
+func sidecarMetadataOf(ctx context.Context, db *sql.DB, column string, ids []int64) (map[int64]*SidecarMetadata, error) {
+	result := map[int64]*SidecarMetadata{}
+	if len(ids) == 0 {
+		return result, nil
+	}
+	get := func(id int64) *SidecarMetadata {
+		if result[id] == nil {
+			result[id] = &SidecarMetadata{Artwork: map[string]string{}}
+		}
+		return result[id]
+	}
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT n.`+column+`, n.kind, n.title, n.plot, n.year, n.genres, n.cast_members, n.ratings
+		FROM nfo_table n
+		JOIN files_table s ON s.id = n.sidecar_id
+		WHERE n.`+column+` = ANY($1)
+		ORDER BY n.folder_id IS NULL, n.sidecar_id
+	`, pq.Array(ids))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int64
+		var nfo NFO
+		var year sql.NullInt64
+		var cast, ratings []byte
+		if err := rows.Scan(&id, &nfo.Kind, &nfo.Title, &nfo.Plot, &year, pq.Array(&nfo.Genres), &cast, &ratings); err != nil {
+			return nil, err
+		}
+		nfo.Year = int(year.Int64)
+		if nfo.Genres == nil {
+			nfo.Genres = []string{}
+		}
+		if err := json.Unmarshal(cast, &nfo.Cast); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(ratings, &nfo.Ratings); err != nil {
+			return nil, err
+		}
+		get(id).NFO = &nfo
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	artRows, err := db.QueryContext(ctx, `
+		SELECT a.`+column+`, a.kind, s.url
+		FROM artwork_table a
+		JOIN files_table s ON s.id = a.sidecar_id
+		WHERE a.`+column+` = ANY($1)
+		ORDER BY a.folder_id IS NULL, a.sidecar_id
+	`, pq.Array(ids))
+	if err != nil {
+		return nil, err
+	}
+	defer artRows.Close()
+	for artRows.Next() {
+		var id int64
+		var kind, url string
+		if err := artRows.Scan(&id, &kind, &url); err != nil {
+			return nil, err
+		}
+		get(id).Artwork[kind] = url
+	}
+	return result, artRows.Err()
+}
@@ -0,0 +1,166 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"media-server/config"
+	"media-server/vtt"
+	"path"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/lib/pq"
+)
+
+// SubtitleExtensions are the sidecar subtitle formats converted to WebVTT.
+var SubtitleExtensions = []string{".srt", ".ass", ".ssa", ".vtt"}
+
+// IsSubtitleFile reports whether ext is a sidecar subtitle extension.
+func IsSubtitleFile(ext string) bool {
+	ext = strings.ToLower(ext)
+	for _, e := range SubtitleExtensions {
+		if e == ext {
+			return true
+		}
+	}
+	return false
+}
+
+// SidecarTrackKey is the object key of the WebVTT track converted from the
+// sidecar at sidecarKey.
+func SidecarTrackKey(sidecarKey string) string {
+	return "subtitles/" + sidecarKey + ".vtt"
+}
+
+// sidecarTags describes a sidecar from the name parts that follow the video
+// name, as in movie.en.forced.srt.
+type sidecarTags struct {
+	language string
+	title    string
+	forced   bool
+}
+
+func parseSidecarTags(parts []string) sidecarTags {
+	var t sidecarTags
+	var rest []string
+	for _, p := range parts {
+		switch strings.ToLower(p) {
+		case "forced":
+			t.forced = true
+		case "sdh", "cc", "hi":
+			rest = append(rest, "SDH")
+		case "default":
+			// Defaults are decided per video, not by the file name.
+		default:
+			if t.language == "" && NormalizeLanguage(p) != "und" {
+				t.language = p
+			} else {
+				rest = append(rest, p)
+			}
+		}
+	}
+	t.title = strings.Join(rest, " ")
+	return t
+}
+
+// AttachSidecarSubtitles converts sidecar subtitle files to WebVTT tracks of
+// the video they belong to and hides the raw sidecars from listings. A
+// sidecar belongs to the video in the same folder whose name is the longest
+// dot-separated prefix of the sidecar name: movie.en.srt -> movie.mkv.
+// Sidecars already converted are skipped.
+func AttachSidecarSubtitles(db *sql.DB, r2Client *s3.Client, bucket string, keys []string) {
+	for _, key := range keys {
+		if err := attachSidecar(context.Background(), db, r2Client, bucket, key); err != nil {
+			log.Printf("Failed to attach sidecar subtitle %s: %v", key, err)
+		}
+	}
+}
+
+func attachSidecar(ctx context.Context, db *sql.DB, r2Client *s3.Client, bucket, key string) error {
+	var sidecarID, parentID int64
+	err := db.QueryRowContext(ctx, "SELECT id, parent FROM files_table WHERE url = $1",
+		config.CloudflarePublicDevURL+"/"+key).Scan(&sidecarID, &parentID)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var attached bool
+	err = db.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM subtitle_tracks_table WHERE object_key = $1)",
+		SidecarTrackKey(key)).Scan(&attached)
+	if err != nil {
+		return err
+	}
+	if attached {
+		_, err := db.ExecContext(ctx, "UPDATE files_table SET hidden = TRUE WHERE id = $1", sidecarID)
+		return err
+	}
+
+	name := path.Base(key)
+	ext := path.Ext(name)
+	parts := strings.Split(strings.TrimSuffix(name, ext), ".")
+
+	videoID, n, err := findSidecarVideo(ctx, db, parentID, parts)
+	if err != nil || videoID == 0 {
+		return err
+	}
+	tags := parseSidecarTags(parts[n:])
+
+	raw, err := downloadObject(ctx, r2Client, bucket, key)
+	if err != nil {
+		return err
+	}
+	data, err := vtt.Convert(ext, raw)
+	if err != nil {
+		return fmt.Errorf("failed to convert: %w", err)
+	}
+
+	_, err = AddSubtitleTrack(ctx, db, r2Client, bucket, NewSubtitleTrack{
+		FileID:        videoID,
+		Language:      tags.language,
+		Title:         tags.title,
+		Source:        SubtitleSourceSidecar,
+		ObjectKey:     SidecarTrackKey(key),
+		IsForced:      tags.forced,
+		SidecarFileID: sidecarID,
+	}, data)
+	if err != nil {
+		return err
+	}
+	if _, err := db.ExecContext(ctx, "UPDATE files_table SET hidden = TRUE WHERE id = $1", sidecarID); err != nil {
+		return err
+	}
+	log.Printf("Attached sidecar subtitle %s", key)
+	return nil
+}
+
+// findSidecarVideo looks for the video named by the longest prefix of parts
+// in folder parentID and returns its ID and the prefix length.
+func findSidecarVideo(ctx context.Context, db *sql.DB, parentID int64, parts []string) (int64, int, error) {
+	for n := len(parts); n > 0; n-- {
+		base := strings.ToLower(strings.Join(parts[:n], "."))
+		var names []string
+		for _, ext := range VideoExtensions {
+			names = append(names, base+ext)
+		}
+
+		var id int64
+		err := db.QueryRowContext(ctx, `
+			SELECT id FROM files_table
+			WHERE parent = $1 AND LOWER(name) = ANY($2)
+			ORDER BY id
+			LIMIT 1
+		`, parentID, pq.Array(names)).Scan(&id)
+		if err == nil {
+			return id, n, nil
+		}
+		if err != sql.ErrNoRows {
+			return 0, 0, err
+		}
+	}
+	return 0, 0, nil
+}
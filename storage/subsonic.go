@@ -0,0 +1,244 @@
+package storage
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// CreateSubsonicUsersTableSQL maps signed-in users to the name they log into
+// Subsonic clients with.
+const CreateSubsonicUsersTableSQL = `
+CREATE TABLE IF NOT EXISTS subsonic_users_table (
+    owner_id TEXT PRIMARY KEY,
+    username TEXT NOT NULL UNIQUE
+);
+`
+
+// CreateAPITokensTableSQL holds the tokens Subsonic clients use as password.
+// Subsonic's token authentication sends md5(password + salt), so the server
+// needs the token itself rather than a hash of it.
+const CreateAPITokensTableSQL = `
+CREATE TABLE IF NOT EXISTS api_tokens_table (
+    id SERIAL PRIMARY KEY,
+    owner_id TEXT NOT NULL,
+    name TEXT NOT NULL DEFAULT '',
+    token TEXT NOT NULL UNIQUE,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    last_used_at TIMESTAMP,
+    CONSTRAINT fk_token_user
+        FOREIGN KEY (owner_id)
+        REFERENCES subsonic_users_table(owner_id)
+        ON DELETE CASCADE
+);
+`
+
+// CreatePlaylistsTableSQL holds the playlists made in Subsonic clients.
+const CreatePlaylistsTableSQL = `
+CREATE TABLE IF NOT EXISTS playlists_table (
+    id SERIAL PRIMARY KEY,
+    owner_id TEXT NOT NULL,
+    name TEXT NOT NULL,
+    comment TEXT NOT NULL DEFAULT '',
+    public BOOLEAN NOT NULL DEFAULT FALSE,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    changed_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+`
+
+// CreatePlaylistEntriesTableSQL holds the files of each playlist in order.
+// Positions keep gaps left by deleted files.
+const CreatePlaylistEntriesTableSQL = `
+CREATE TABLE IF NOT EXISTS playlist_entries_table (
+    playlist_id INTEGER NOT NULL,
+    position INTEGER NOT NULL,
+    file_id INTEGER NOT NULL,
+    PRIMARY KEY (playlist_id, position),
+    CONSTRAINT fk_entry_playlist
+        FOREIGN KEY (playlist_id)
+        REFERENCES playlists_table(id)
+        ON DELETE CASCADE,
+    CONSTRAINT fk_entry_file
+        FOREIGN KEY (file_id)
+        REFERENCES files_table(id)
+        ON DELETE CASCADE
+);
+`
+
+// CreateScrobblesTableSQL records every play reported by a Subsonic client.
+const CreateScrobblesTableSQL = `
+CREATE TABLE IF NOT EXISTS scrobbles_table (
+    id SERIAL PRIMARY KEY,
+    owner_id TEXT NOT NULL,
+    file_id INTEGER NOT NULL,
+    played_at TIMESTAMP NOT NULL,
+    CONSTRAINT fk_scrobble_file
+        FOREIGN KEY (file_id)
+        REFERENCES files_table(id)
+        ON DELETE CASCADE
+);
+`
+
+// SubsonicMigrations index the columns tokens, playlists and plays are looked
+// up by.
+var SubsonicMigrations = []string{
+	`CREATE INDEX IF NOT EXISTS api_tokens_owner_index ON api_tokens_table (owner_id);`,
+	`CREATE INDEX IF NOT EXISTS playlists_owner_index ON playlists_table (owner_id);`,
+	`CREATE INDEX IF NOT EXISTS scrobbles_owner_file_index ON scrobbles_table (owner_id, file_id);`,
+}
+
+// InitSubsonic creates the tables behind the Subsonic API.
+func InitSubsonic(db *sql.DB) error {
+	for _, create := range []struct{ table, sql string }{
+		{"subsonic_users_table", CreateSubsonicUsersTableSQL},
+		{"api_tokens_table", CreateAPITokensTableSQL},
+		{"playlists_table", CreatePlaylistsTableSQL},
+		{"playlist_entries_table", CreatePlaylistEntriesTableSQL},
+		{"scrobbles_table", CreateScrobblesTableSQL},
+	} {
+		if _, err := db.Exec(create.sql); err != nil {
+			return fmt.Errorf("failed to create %s: %w", create.table, err)
+		}
+		log.Println("Created/Verified Table: " + create.table)
+	}
+	for _, migration := range SubsonicMigrations {
+		if _, err := db.Exec(migration); err != nil {
+			return fmt.Errorf("failed to migrate subsonic tables: %w", err)
+		}
+	}
+	return nil
+}
+
+// ErrUsernameTaken is returned when a Subsonic username belongs to another
+// user.
+var ErrUsernameTaken = errors.New("username is taken")
+
+// ErrUsernameRequired is returned when a user's first token is created
+// without a username.
+var ErrUsernameRequired = errors.New("username is required")
+
+// APIToken is a token a user logs into Subsonic clients with. Token is only
+// set when the token is created.
+type APIToken struct {
+	ID         int64      `json:"id"`
+	Name       string     `json:"name"`
+	Username   string     `json:"username"`
+	Token      string     `json:"token,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+}
+
+// CreateAPIToken creates a token for a user. The username is chosen with the
+// user's first token and kept for later ones, whatever they ask for.
+func CreateAPIToken(ctx context.Context, db *sql.DB, ownerID, username, name string) (*APIToken, error) {
+	secret := make([]byte, 24)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	token := APIToken{Name: name, Token: hex.EncodeToString(secret)}
+	err = tx.QueryRowContext(ctx, "SELECT username FROM subsonic_users_table WHERE owner_id = $1", ownerID).Scan(&token.Username)
+	if err == sql.ErrNoRows {
+		if username == "" {
+			return nil, ErrUsernameRequired
+		}
+		_, err = tx.ExecContext(ctx, "INSERT INTO subsonic_users_table (owner_id, username) VALUES ($1, $2)", ownerID, username)
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+			return nil, ErrUsernameTaken
+		}
+		token.Username = username
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.QueryRowContext(ctx, `
+		INSERT INTO api_tokens_table (owner_id, name, token) VALUES ($1, $2, $3)
+		RETURNING id, created_at
+	`, ownerID, name, token.Token).Scan(&token.ID, &token.CreatedAt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to store token: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return &token, nil
+}
+
+// ListAPITokens returns the tokens of a user, newest first, without their
+// secret.
+func ListAPITokens(ctx context.Context, db *sql.DB, ownerID string) ([]APIToken, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT t.id, t.name, u.username, t.created_at, t.last_used_at
+		FROM api_tokens_table t
+		JOIN subsonic_users_table u ON u.owner_id = t.owner_id
+		WHERE t.owner_id = $1
+		ORDER BY t.created_at DESC, t.id DESC
+	`, ownerID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tokens := []APIToken{}
+	for rows.Next() {
+		var t APIToken
+		if err := rows.Scan(&t.ID, &t.Name, &t.Username, &t.CreatedAt, &t.LastUsedAt); err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, t)
+	}
+	return tokens, rows.Err()
+}
+
+// DeleteAPIToken revokes a token of a user and reports whether it existed.
+func DeleteAPIToken(ctx context.Context, db *sql.DB, ownerID string, id int64) (bool, error) {
+	res, err := db.ExecContext(ctx, "DELETE FROM api_tokens_table WHERE id = $1 AND owner_id = $2", id, ownerID)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// SetPlaylistEntries replaces the files of a playlist, skipping IDs of files
+// that don't exist, and marks it changed.
+func SetPlaylistEntries(ctx context.Context, tx *sql.Tx, playlistID int64, fileIDs []int64) error {
+	if _, err := tx.ExecContext(ctx, "DELETE FROM playlist_entries_table WHERE playlist_id = $1", playlistID); err != nil {
+		return err
+	}
+	_, err := tx.ExecContext(ctx, `
+		INSERT INTO playlist_entries_table (playlist_id, position, file_id)
+		SELECT $1, e.position, e.file_id
+		FROM unnest(CAST($2 AS integer[])) WITH ORDINALITY AS e(file_id, position)
+		JOIN files_table f ON f.id = e.file_id
+	`, playlistID, pq.Array(fileIDs))
+	if err != nil {
+		return fmt.Errorf("failed to store entries of playlist %d: %w", playlistID, err)
+	}
+	_, err = tx.ExecContext(ctx, "UPDATE playlists_table SET changed_at = $1 WHERE id = $2", time.Now(), playlistID)
+	return err
+}
+
+// RecordScrobble records that a user played a file.
+func RecordScrobble(ctx context.Context, db *sql.DB, ownerID string, fileID int64, playedAt time.Time) error {
+	_, err := db.ExecContext(ctx, `
+		INSERT INTO scrobbles_table (owner_id, file_id, played_at)
+		SELECT $1, id, $3 FROM files_table WHERE id = $2
+	`, ownerID, fileID, playedAt)
+	return err
+}
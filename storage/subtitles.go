@@ -0,0 +1,367 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"media-server/assets"
+	"media-server/config"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// Sources of subtitle tracks.
+const (
+	SubtitleSourceEmbedded = "embedded"
+	SubtitleSourceSidecar  = "sidecar"
+	SubtitleSourceUpload   = "upload"
+)
+
+// CreateSubtitleTracksTableSQL lists every subtitle track available for a
+// video. stream_index is the ffprobe stream index for embedded tracks.
+const CreateSubtitleTracksTableSQL = `
+CREATE TABLE IF NOT EXISTS subtitle_tracks_table (
+    id SERIAL PRIMARY KEY,
+    file_id INTEGER NOT NULL,
+    stream_index INTEGER,
+    language TEXT NOT NULL DEFAULT 'und',
+    title TEXT,
+    codec TEXT,
+    source TEXT NOT NULL DEFAULT 'embedded',
+    object_key TEXT NOT NULL UNIQUE,
+    is_default BOOLEAN NOT NULL DEFAULT FALSE,
+    is_forced BOOLEAN NOT NULL DEFAULT FALSE,
+    sidecar_file_id INTEGER REFERENCES files_table(id) ON DELETE CASCADE,
+    current_revision INTEGER NOT NULL DEFAULT 0,
+    cues_indexed_at TIMESTAMP,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    CONSTRAINT fk_track_file
+        FOREIGN KEY (file_id)
+        REFERENCES files_table(id)
+        ON DELETE CASCADE,
+    CONSTRAINT subtitle_tracks_stream_unique UNIQUE (file_id, stream_index)
+);
+`
+
+// SubtitleTracksMigrations link cues to the track they came from and tracks
+// to the sidecar file they were converted from.
+var SubtitleTracksMigrations = []string{
+	`CREATE INDEX IF NOT EXISTS subtitle_tracks_file_index ON subtitle_tracks_table (file_id);`,
+	`ALTER TABLE subtitle_cues_table ADD COLUMN IF NOT EXISTS track_id INTEGER REFERENCES subtitle_tracks_table(id) ON DELETE CASCADE;`,
+	`ALTER TABLE subtitle_tracks_table ADD COLUMN IF NOT EXISTS sidecar_file_id INTEGER REFERENCES files_table(id) ON DELETE CASCADE;`,
+	`ALTER TABLE subtitle_tracks_table ADD COLUMN IF NOT EXISTS current_revision INTEGER NOT NULL DEFAULT 0;`,
+}
+
+// SubtitleTrack is a row of subtitle_tracks_table.
+type SubtitleTrack struct {
+	ID          int64  `json:"id"`
+	FileID      int64  `json:"file_id"`
+	StreamIndex *int   `json:"stream_index,omitempty"`
+	Language    string `json:"language"`
+	Title       string `json:"title,omitempty"`
+	Codec       string `json:"codec,omitempty"`
+	Source      string `json:"source"`
+	ObjectKey   string `json:"-"`
+	IsDefault   bool   `json:"default"`
+	IsForced    bool   `json:"forced"`
+	Revision    int    `json:"revision"` // 0 while the original is served
+}
+
+// InitSubtitleTracks creates the track and revision tables.
+func InitSubtitleTracks(db *sql.DB) error {
+	if _, err := db.Exec(CreateSubtitleTracksTableSQL); err != nil {
+		return fmt.Errorf("failed to create subtitle_tracks_table: %w", err)
+	}
+	for _, migration := range SubtitleTracksMigrations {
+		if _, err := db.Exec(migration); err != nil {
+			return fmt.Errorf("failed to migrate subtitle_tracks_table: %w", err)
+		}
+	}
+	log.Println("Created/Verified Table: subtitle_tracks_table")
+
+	if _, err := db.Exec(CreateSubtitleRevisionsTableSQL); err != nil {
+		return fmt.Errorf("failed to create subtitle_revisions_table: %w", err)
+	}
+	log.Println("Created/Verified Table: subtitle_revisions_table")
+	return nil
+}
+
+// subtitleTrackColumns are the columns scanned by scanSubtitleTrack.
+const subtitleTrackColumns = `id, file_id, stream_index, language, COALESCE(title, ''), COALESCE(codec, ''),
+	source, object_key, is_default, is_forced, current_revision`
+
+func scanSubtitleTrack(scan func(dest ...any) error) (SubtitleTrack, error) {
+	var t SubtitleTrack
+	var streamIndex sql.NullInt64
+	err := scan(&t.ID, &t.FileID, &streamIndex, &t.Language, &t.Title, &t.Codec,
+		&t.Source, &t.ObjectKey, &t.IsDefault, &t.IsForced, &t.Revision)
+	if err != nil {
+		return t, err
+	}
+	if streamIndex.Valid {
+		idx := int(streamIndex.Int64)
+		t.StreamIndex = &idx
+	}
+	return t, nil
+}
+
+// ListSubtitleTracks returns the tracks of a file, default track first.
+func ListSubtitleTracks(db *sql.DB, fileID int64) ([]SubtitleTrack, error) {
+	rows, err := db.Query(`
+		SELECT `+subtitleTrackColumns+`
+		FROM subtitle_tracks_table
+		WHERE file_id = $1
+		ORDER BY is_default DESC, stream_index NULLS LAST, id
+	`, fileID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tracks := []SubtitleTrack{}
+	for rows.Next() {
+		t, err := scanSubtitleTrack(rows.Scan)
+		if err != nil {
+			return nil, err
+		}
+		tracks = append(tracks, t)
+	}
+	return tracks, rows.Err()
+}
+
+// GetSubtitleTrack returns a track by ID, or sql.ErrNoRows.
+func GetSubtitleTrack(db *sql.DB, id int64) (SubtitleTrack, error) {
+	row := db.QueryRow("SELECT "+subtitleTrackColumns+" FROM subtitle_tracks_table WHERE id = $1", id)
+	return scanSubtitleTrack(row.Scan)
+}
+
+// ExtractSubtitleTracks converts every text subtitle stream of a video to its
+// own WebVTT object, records the tracks and indexes their cues. It returns
+// the URL of the default track, or noStreams=true when the video has no text
+// subtitles at all.
+func ExtractSubtitleTracks(ctx context.Context, db *sql.DB, r2Client *s3.Client, bucket string, fileID int64, objectKey string) (defaultURL *string, noStreams bool, err error) {
+	gen := assets.NewGenerator(r2Client, bucket)
+	url, err := gen.SourceURL(ctx, objectKey)
+	if err != nil {
+		return nil, false, err
+	}
+	probe, err := Probe(ctx, url)
+	if err != nil {
+		return nil, false, err
+	}
+
+	var streams []ProbeStream
+	var indexes []int
+	for _, s := range probe.Streams {
+		if s.CodecType == "subtitle" && gen.Subtitles.Codecs[s.CodecName] {
+			streams = append(streams, s)
+			indexes = append(indexes, s.Index)
+		}
+	}
+	if len(streams) == 0 {
+		return nil, true, nil
+	}
+
+	rendered, err := gen.RenderSubtitles(ctx, url, indexes)
+	if err != nil {
+		return nil, false, err
+	}
+
+	// A track that is already the default, whether picked here before or
+	// chosen by the user, stays so; re-extracted tracks keep their flag.
+	defaultIndex := pickDefaultStream(streams)
+	var hasDefault bool
+	err = db.QueryRowContext(ctx, `
+		SELECT EXISTS (SELECT 1 FROM subtitle_tracks_table WHERE file_id = $1 AND is_default)
+	`, fileID).Scan(&hasDefault)
+	if err != nil {
+		return nil, false, err
+	}
+	if hasDefault {
+		defaultIndex = -1
+	}
+
+	stored := 0
+	for _, s := range streams {
+		data, ok := rendered[s.Index]
+		if !ok {
+			log.Printf("Subtitle stream %d of %s produced no output", s.Index, objectKey)
+			continue
+		}
+
+		language := NormalizeLanguage(s.Tags["language"])
+		key := assets.SubtitleTrackKey(objectKey, s.Index)
+		if err := gen.Put(ctx, assets.Object{Key: key, ContentType: "text/vtt", Data: data}); err != nil {
+			log.Printf("Error uploading subtitle %s: %v", key, err)
+			continue
+		}
+
+		var trackID int64
+		err = db.QueryRowContext(ctx, `
+			INSERT INTO subtitle_tracks_table (file_id, stream_index, language, title, codec, source, object_key, is_default, is_forced)
+			VALUES ($1, $2, $3, NULLIF($4, ''), $5, $6, $7, $8, $9)
+			ON CONFLICT (file_id, stream_index) DO UPDATE SET
+				language = EXCLUDED.language,
+				title = EXCLUDED.title,
+				codec = EXCLUDED.codec,
+				object_key = EXCLUDED.object_key,
+				is_forced = EXCLUDED.is_forced
+			RETURNING id
+		`, fileID, s.Index, language, s.Tags["title"], s.CodecName, SubtitleSourceEmbedded, key,
+			s.Index == defaultIndex, s.Disposition["forced"] == 1).Scan(&trackID)
+		if err != nil {
+			log.Printf("Failed to record subtitle track %s: %v", key, err)
+			continue
+		}
+
+		if err := RecordDerivedAsset(db, fileID, AssetKindSubtitle, key, "text/vtt", int64(len(data))); err != nil {
+			log.Printf("Subtitle accounting error: %v", err)
+		}
+		if err := IndexSubtitleCues(db, fileID, trackID, data); err != nil {
+			log.Printf("Subtitle indexing error: %v", err)
+		}
+		log.Printf("Generated subtitle track %s", key)
+		stored++
+	}
+
+	if stored == 0 {
+		return nil, false, fmt.Errorf("no subtitle track of %s could be stored", objectKey)
+	}
+	var key string
+	err = db.QueryRowContext(ctx, `
+		SELECT object_key FROM subtitle_tracks_table
+		WHERE file_id = $1
+		ORDER BY is_default DESC, stream_index NULLS LAST, id
+		LIMIT 1
+	`, fileID).Scan(&key)
+	if err != nil {
+		return nil, false, err
+	}
+	url = fmt.Sprintf("%s/%s", config.CloudflarePublicDevURL, key)
+	return &url, false, nil
+}
+
+// NewSubtitleTrack describes a track converted from a subtitle file.
+type NewSubtitleTrack struct {
+	FileID        int64
+	Language      string
+	Title         string
+	Source        string
+	ObjectKey     string
+	IsForced      bool
+	SidecarFileID int64 // Set when the track comes from a sidecar file
+}
+
+// AddSubtitleTrack stores a WebVTT document as a track of a video. The track
+// becomes the default when the video has none yet. Storing the same key again
+// replaces the track, moving it to t.FileID if the sidecar was re-paired.
+func AddSubtitleTrack(ctx context.Context, db *sql.DB, r2Client *s3.Client, bucket string, t NewSubtitleTrack, data []byte) (SubtitleTrack, error) {
+	err := assets.NewGenerator(r2Client, bucket).Put(ctx, assets.Object{Key: t.ObjectKey, ContentType: "text/vtt", Data: data})
+	if err != nil {
+		return SubtitleTrack{}, err
+	}
+
+	var sidecarFileID *int64
+	if t.SidecarFileID != 0 {
+		sidecarFileID = &t.SidecarFileID
+	}
+	track := SubtitleTrack{
+		FileID:    t.FileID,
+		Language:  NormalizeLanguage(t.Language),
+		Title:     t.Title,
+		Codec:     "webvtt",
+		Source:    t.Source,
+		ObjectKey: t.ObjectKey,
+		IsForced:  t.IsForced,
+	}
+	err = db.QueryRowContext(ctx, `
+		INSERT INTO subtitle_tracks_table (file_id, language, title, codec, source, object_key, is_default, is_forced, sidecar_file_id)
+		VALUES ($1, $2, NULLIF($3, ''), $4, $5, $6,
+			NOT EXISTS (SELECT 1 FROM subtitle_tracks_table WHERE file_id = $1 AND is_default), $7, $8)
+		ON CONFLICT (object_key) DO UPDATE SET
+			file_id = EXCLUDED.file_id,
+			language = EXCLUDED.language,
+			title = EXCLUDED.title,
+			codec = EXCLUDED.codec,
+			source = EXCLUDED.source,
+			is_default = CASE WHEN subtitle_tracks_table.file_id = EXCLUDED.file_id
+				THEN subtitle_tracks_table.is_default ELSE EXCLUDED.is_default END,
+			is_forced = EXCLUDED.is_forced,
+			sidecar_file_id = EXCLUDED.sidecar_file_id
+		RETURNING id, is_default
+	`, track.FileID, track.Language, track.Title, track.Codec, track.Source, track.ObjectKey, track.IsForced, sidecarFileID).Scan(&track.ID, &track.IsDefault)
+	if err != nil {
+		return SubtitleTrack{}, fmt.Errorf("failed to record subtitle track %s: %w", t.ObjectKey, err)
+	}
+
+	if track.IsDefault {
+		url := fmt.Sprintf("%s/%s", config.CloudflarePublicDevURL, t.ObjectKey)
+		if _, err := db.ExecContext(ctx, "UPDATE files_table SET subtitle_url = COALESCE(subtitle_url, $1) WHERE id = $2", url, t.FileID); err != nil {
+			log.Printf("Failed to store subtitle URL for file ID %d: %v", t.FileID, err)
+		}
+	}
+	if err := RecordDerivedAsset(db, t.FileID, AssetKindSubtitle, t.ObjectKey, "text/vtt", int64(len(data))); err != nil {
+		log.Printf("Subtitle accounting error: %v", err)
+	}
+	if err := IndexSubtitleCues(db, t.FileID, track.ID, data); err != nil {
+		log.Printf("Subtitle indexing error: %v", err)
+	}
+	return track, nil
+}
+
+// pickDefaultStream prefers the stream flagged default, then the first one
+// that isn't forced (forced tracks only cover foreign-language lines).
+func pickDefaultStream(streams []ProbeStream) int {
+	for _, s := range streams {
+		if s.Disposition["default"] == 1 && s.Disposition["forced"] != 1 {
+			return s.Index
+		}
+	}
+	for _, s := range streams {
+		if s.Disposition["forced"] != 1 {
+			return s.Index
+		}
+	}
+	return streams[0].Index
+}
+
+// languageAliases maps ISO 639-1 codes to the ISO 639-2 codes containers use.
+var languageAliases = map[string]string{
+	"ar": "ara", "cs": "ces", "da": "dan", "de": "deu", "el": "ell",
+	"en": "eng", "es": "spa", "fi": "fin", "fr": "fra", "he": "heb",
+	"hi": "hin", "hu": "hun", "id": "ind", "it": "ita", "ja": "jpn",
+	"ko": "kor", "nl": "nld", "no": "nor", "pl": "pol", "pt": "por",
+	"ro": "ron", "ru": "rus", "sv": "swe", "th": "tha", "tr": "tur",
+	"uk": "ukr", "vi": "vie", "zh": "zho",
+}
+
+// bibliographicLanguages maps ISO 639-2/B codes to their /T equivalents.
+var bibliographicLanguages = map[string]string{
+	"ger": "deu", "fre": "fra", "dut": "nld", "gre": "ell", "chi": "zho",
+	"cze": "ces", "rum": "ron", "per": "fas",
+}
+
+// NormalizeLanguage turns a language tag into a lower-case ISO 639-2/T code,
+// or "und" when it is missing or unusable.
+func NormalizeLanguage(lang string) string {
+	lang = strings.ToLower(strings.TrimSpace(lang))
+	lang, _, _ = strings.Cut(strings.ReplaceAll(lang, "_", "-"), "-")
+	if alias, ok := languageAliases[lang]; ok {
+		return alias
+	}
+	if alias, ok := bibliographicLanguages[lang]; ok {
+		return alias
+	}
+	if len(lang) < 2 || len(lang) > 3 || strings.ContainsFunc(lang, func(r rune) bool { return r < 'a' || r > 'z' }) {
+		return "und"
+	}
+	return lang
+}
+
+// LanguageMatches reports whether a track language matches a requested one,
+// accepting both two- and three-letter codes ("en" matches "eng").
+func LanguageMatches(trackLanguage, wanted string) bool {
+	return NormalizeLanguage(trackLanguage) == NormalizeLanguage(wanted)
+}
@@ -0,0 +1,184 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"media-server/assets"
+	"media-server/config"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// Sources of a file's thumbnail, stored in files_table.thumbnail_source.
+const (
+	ThumbnailSourceAuto    = "auto"    // Picked by the generator
+	ThumbnailSourceUpload  = "upload"  // Image uploaded by a user
+	ThumbnailSourceFrame   = "frame"   // Frame picked by a user
+	ThumbnailSourceSidecar = "sidecar" // Artwork next to the video, as poster.jpg
+)
+
+// thumbnailOrigin is what a custom thumbnail was rendered from, so that its
+// variants can be rendered again: Key is the image of uploaded and sidecar
+// thumbnails, FrameMS the time of a picked frame.
+type thumbnailOrigin struct {
+	Source  string
+	Key     string
+	FrameMS int64
+}
+
+// thumbnailSourceKey is where the image of an uploaded thumbnail is kept.
+func thumbnailSourceKey(objectKey string) string {
+	return "thumbnails/" + strings.TrimSuffix(objectKey, path.Ext(objectKey)) + ".source"
+}
+
+// thumbnailURL is the public URL of a thumbnail object. Replaced thumbnails
+// keep their keys, so the URL carries a version to get past caches.
+func thumbnailURL(key string) string {
+	return fmt.Sprintf("%s/%s?v=%d", config.CloudflarePublicDevURL, key, time.Now().Unix())
+}
+
+// SetUploadedThumbnail renders an uploaded image into every thumbnail variant
+// of a video, replacing its thumbnail, and returns the new URL. The image is
+// kept to render variants added later.
+func SetUploadedThumbnail(ctx context.Context, db *sql.DB, r2Client *s3.Client, bucket string, fileID int64, objectKey string, image []byte) (string, error) {
+	key := thumbnailSourceKey(objectKey)
+	contentType := http.DetectContentType(image)
+	_, err := manager.NewUploader(r2Client).Upload(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(bucket),
+		Key:         aws.String(key),
+		Body:        bytes.NewReader(image),
+		ContentType: aws.String(contentType),
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to store image: %w", err)
+	}
+	if err := RecordDerivedAsset(db, fileID, AssetKindThumbnailSource, key, contentType, int64(len(image))); err != nil {
+		log.Printf("Thumbnail accounting error: %v", err)
+	}
+	return setImageThumbnail(ctx, db, r2Client, bucket, fileID, objectKey, image, thumbnailOrigin{Source: ThumbnailSourceUpload, Key: key})
+}
+
+// setImageThumbnail renders an image into every thumbnail variant of a video
+// and makes it the thumbnail, recording where it came from.
+func setImageThumbnail(ctx context.Context, db *sql.DB, r2Client *s3.Client, bucket string, fileID int64, objectKey string, image []byte, origin thumbnailOrigin) (string, error) {
+	tmp, err := os.CreateTemp("", "poster-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(image)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", err
+	}
+
+	gen := assets.NewGenerator(r2Client, bucket)
+	orientation := 1
+	if info, err := gen.ReadImageInfo(ctx, tmp.Name()); err != nil {
+		log.Printf("Failed to read metadata of thumbnail image: %v", err)
+	} else {
+		orientation = info.Orientation
+	}
+	images, err := gen.RenderImage(ctx, tmp.Name(), orientation)
+	if err != nil {
+		return "", fmt.Errorf("failed to render image: %w", err)
+	}
+	return storeThumbnail(ctx, db, gen, fileID, objectKey, images, origin)
+}
+
+// SetThumbnailFrame makes the frame of a video at the given time its
+// thumbnail and returns the new URL. It fails with ErrNoStream when there is
+// no frame at that time.
+func SetThumbnailFrame(ctx context.Context, db *sql.DB, r2Client *s3.Client, bucket string, fileID int64, objectKey string, at time.Duration) (string, error) {
+	gen := assets.NewGenerator(r2Client, bucket)
+	url, err := gen.SourceURL(ctx, objectKey)
+	if err != nil {
+		return "", err
+	}
+	images, err := gen.RenderFrame(ctx, url, at)
+	if err != nil {
+		return "", err
+	}
+	return storeThumbnail(ctx, db, gen, fileID, objectKey, images, thumbnailOrigin{Source: ThumbnailSourceFrame, FrameMS: at.Milliseconds()})
+}
+
+// RestoreThumbnail renders the thumbnail variants of a file again, e.g. when
+// one is missing after THUMBNAIL_SIZES changed. Automatic thumbnails are
+// regenerated; custom ones are rendered from the image or frame they were
+// made of, and kept as they are if that wasn't recorded.
+func RestoreThumbnail(ctx context.Context, db *sql.DB, r2Client *s3.Client, bucket string, fileID int64, objectKey string) (*string, error) {
+	var origin thumbnailOrigin
+	var key, current sql.NullString
+	var frameMS sql.NullInt64
+	err := db.QueryRowContext(ctx, `
+		SELECT thumbnail_source, thumbnail_source_key, thumbnail_frame_ms, thumbnail_url FROM files_table WHERE id = $1
+	`, fileID).Scan(&origin.Source, &key, &frameMS, &current)
+	if err != nil {
+		return nil, err
+	}
+	origin.Key, origin.FrameMS = key.String, frameMS.Int64
+
+	var url string
+	switch {
+	case origin.Source == ThumbnailSourceAuto:
+		return RegenerateThumbnail(ctx, db, r2Client, bucket, fileID, objectKey)
+	case origin.Source == ThumbnailSourceFrame && frameMS.Valid:
+		url, err = SetThumbnailFrame(ctx, db, r2Client, bucket, fileID, objectKey, time.Duration(origin.FrameMS)*time.Millisecond)
+	case key.Valid:
+		var image []byte
+		image, err = downloadObject(ctx, r2Client, bucket, origin.Key)
+		if err == nil {
+			url, err = setImageThumbnail(ctx, db, r2Client, bucket, fileID, objectKey, image, origin)
+		}
+	default:
+		log.Printf("No source recorded for the %s thumbnail of %s, keeping it", origin.Source, objectKey)
+		return &current.String, nil
+	}
+	if err != nil {
+		log.Printf("Failed to render the %s thumbnail of %s again: %v", origin.Source, objectKey, err)
+		RecordAssetResult(db, fileID, AssetKindThumbnail, err)
+		return nil, err
+	}
+	return &url, nil
+}
+
+// storeThumbnail uploads rendered variants over the current thumbnail and
+// points the file at them.
+func storeThumbnail(ctx context.Context, db *sql.DB, gen *assets.Generator, fileID int64, objectKey string, images map[assets.ThumbnailVariant][]byte, origin thumbnailOrigin) (string, error) {
+	objects, err := gen.PutThumbnail(ctx, objectKey, images)
+	if err != nil {
+		return "", err
+	}
+	for _, obj := range objects {
+		if err := RecordDerivedAsset(db, fileID, AssetKindThumbnail, obj.Key, obj.ContentType, int64(len(obj.Data))); err != nil {
+			log.Printf("Thumbnail accounting error: %v", err)
+		}
+	}
+
+	url := thumbnailURL(objects[0].Key)
+	var frameMS any
+	if origin.Source == ThumbnailSourceFrame {
+		frameMS = origin.FrameMS
+	}
+	_, err = db.ExecContext(ctx, `
+		UPDATE files_table SET thumbnail_url = $1, thumbnail_source = $2, thumbnail_source_key = NULLIF($3, ''), thumbnail_frame_ms = $4
+		WHERE id = $5
+	`, url, origin.Source, origin.Key, frameMS, fileID)
+	if err != nil {
+		return "", err
+	}
+	RecordAssetResult(db, fileID, AssetKindThumbnail, nil)
+	return url, nil
+}
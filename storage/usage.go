@@ -0,0 +1,218 @@
+package storage
+
+import (
+	"database/sql"
+	"fmt"
+	"media-server/config"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// Kinds of derived assets recorded in derived_assets_table.
+const (
+	AssetKindThumbnail       = "thumbnail"
+	AssetKindThumbnailSource = "thumbnail_source" // Uploaded image a thumbnail is rendered from
+	AssetKindSubtitle        = "subtitle"
+	AssetKindTrickplay       = "trickplay"
+	AssetKindPreview         = "preview"
+	AssetKindDisplay         = "display"
+	AssetKindWaveform        = "waveform"
+)
+
+// FolderUsage is the storage consumed by one folder for one owner.
+type FolderUsage struct {
+	ID           int64  `json:"id"`
+	Path         string `json:"path"`
+	FileCount    int64  `json:"file_count"`
+	FileBytes    int64  `json:"file_bytes"`
+	DerivedBytes int64  `json:"derived_bytes"`
+	// TotalBytes includes the files and derived assets of all subfolders.
+	TotalBytes int64 `json:"total_bytes"`
+}
+
+// Usage summarises the storage consumed by an owner.
+type Usage struct {
+	OwnerID       string           `json:"owner_id"`
+	UsedBytes     int64            `json:"used_bytes"`
+	QuotaBytes    int64            `json:"quota_bytes"` // 0 = unlimited
+	FileBytes     int64            `json:"file_bytes"`
+	DerivedBytes  int64            `json:"derived_bytes"`
+	DerivedByKind map[string]int64 `json:"derived_by_kind"`
+	Folders       []FolderUsage    `json:"folders"`
+}
+
+// RecordDerivedAsset registers (or refreshes) an object generated from a file
+// so that its size counts towards the file owner's usage.
+func RecordDerivedAsset(db *sql.DB, fileID int64, kind, objectKey, contentType string, size int64) error {
+	_, err := db.Exec(`
+		INSERT INTO derived_assets_table (file_id, kind, object_key, content_type, size)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (object_key) DO UPDATE SET
+			file_id = EXCLUDED.file_id,
+			kind = EXCLUDED.kind,
+			content_type = EXCLUDED.content_type,
+			size = EXCLUDED.size,
+			created_at = CURRENT_TIMESTAMP
+	`, fileID, kind, objectKey, contentType, size)
+	if err != nil {
+		return fmt.Errorf("failed to record %s %s: %w", kind, objectKey, err)
+	}
+	return nil
+}
+
+// UsedBytes returns the total size of the files owned by ownerID plus every
+// asset derived from them.
+func UsedBytes(db *sql.DB, ownerID string) (int64, error) {
+	var used int64
+	err := db.QueryRow(`
+		SELECT
+			(SELECT COALESCE(SUM(size), 0) FROM files_table WHERE ownerId = $1) +
+			(SELECT COALESCE(SUM(d.size), 0) FROM derived_assets_table d
+				JOIN files_table f ON f.id = d.file_id
+				WHERE f.ownerId = $1)
+	`, ownerID).Scan(&used)
+	if err != nil {
+		return 0, fmt.Errorf("failed to compute usage for %s: %w", ownerID, err)
+	}
+	return used, nil
+}
+
+// QuotaBytes returns the storage quota of ownerID: its override in
+// user_quotas_table if any, otherwise the configured default. 0 means
+// unlimited.
+func QuotaBytes(db *sql.DB, ownerID string) (int64, error) {
+	var quota int64
+	err := db.QueryRow("SELECT quota_bytes FROM user_quotas_table WHERE ownerId = $1", ownerID).Scan(&quota)
+	if err == sql.ErrNoRows {
+		return config.UserQuotaBytes, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to read quota for %s: %w", ownerID, err)
+	}
+	return quota, nil
+}
+
+// GetUsage computes the usage report of ownerID with a per-folder breakdown.
+func GetUsage(db *sql.DB, ownerID string) (*Usage, error) {
+	quota, err := QuotaBytes(db, ownerID)
+	if err != nil {
+		return nil, err
+	}
+	usage := &Usage{
+		OwnerID:       ownerID,
+		QuotaBytes:    quota,
+		DerivedByKind: map[string]int64{},
+		Folders:       []FolderUsage{},
+	}
+
+	rows, err := db.Query(`
+		SELECT d.kind, COALESCE(SUM(d.size), 0)
+		FROM derived_assets_table d
+		JOIN files_table f ON f.id = d.file_id
+		WHERE f.ownerId = $1
+		GROUP BY d.kind
+	`, ownerID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query derived usage: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var kind string
+		var bytes int64
+		if err := rows.Scan(&kind, &bytes); err != nil {
+			return nil, fmt.Errorf("failed to scan derived usage: %w", err)
+		}
+		usage.DerivedByKind[kind] = bytes
+		usage.DerivedBytes += bytes
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read derived usage: %w", err)
+	}
+
+	folderRows, err := db.Query(`
+		SELECT fo.id, fo.path, COUNT(f.id), COALESCE(SUM(f.size), 0), COALESCE(SUM(d.bytes), 0)
+		FROM files_table f
+		JOIN folders_table fo ON fo.id = f.parent
+		LEFT JOIN (
+			SELECT file_id, SUM(size) AS bytes FROM derived_assets_table GROUP BY file_id
+		) d ON d.file_id = f.id
+		WHERE f.ownerId = $1
+		GROUP BY fo.id, fo.path
+		ORDER BY fo.path
+	`, ownerID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query folder usage: %w", err)
+	}
+	defer folderRows.Close()
+
+	// Totals per path, rolled up into every ancestor folder.
+	totals := map[string]int64{}
+	for folderRows.Next() {
+		var f FolderUsage
+		if err := folderRows.Scan(&f.ID, &f.Path, &f.FileCount, &f.FileBytes, &f.DerivedBytes); err != nil {
+			return nil, fmt.Errorf("failed to scan folder usage: %w", err)
+		}
+		usage.Folders = append(usage.Folders, f)
+		usage.FileBytes += f.FileBytes
+
+		for p := f.Path; ; p = parentFolderPath(p) {
+			totals[p] += f.FileBytes + f.DerivedBytes
+			if p == "" {
+				break
+			}
+		}
+	}
+	if err := folderRows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read folder usage: %w", err)
+	}
+
+	// Folders holding only subfolders are listed too, so the breakdown adds
+	// up to the total.
+	listed := map[string]bool{}
+	for _, f := range usage.Folders {
+		listed[f.Path] = true
+	}
+	var ancestors []string
+	for p := range totals {
+		if !listed[p] {
+			ancestors = append(ancestors, p)
+		}
+	}
+	if len(ancestors) > 0 {
+		ancestorRows, err := db.Query("SELECT id, path FROM folders_table WHERE path = ANY($1)", pq.Array(ancestors))
+		if err != nil {
+			return nil, fmt.Errorf("failed to query parent folders: %w", err)
+		}
+		defer ancestorRows.Close()
+		for ancestorRows.Next() {
+			var f FolderUsage
+			if err := ancestorRows.Scan(&f.ID, &f.Path); err != nil {
+				return nil, fmt.Errorf("failed to scan parent folder: %w", err)
+			}
+			usage.Folders = append(usage.Folders, f)
+		}
+		if err := ancestorRows.Err(); err != nil {
+			return nil, fmt.Errorf("failed to read parent folders: %w", err)
+		}
+		slices.SortFunc(usage.Folders, func(a, b FolderUsage) int { return strings.Compare(a.Path, b.Path) })
+	}
+
+	for i := range usage.Folders {
+		usage.Folders[i].TotalBytes = totals[usage.Folders[i].Path]
+	}
+	usage.UsedBytes = usage.FileBytes + usage.DerivedBytes
+	return usage, nil
+}
+
+// parentFolderPath returns the folders_table path of p's parent ("" for the
+// root and top-level folders).
+func parentFolderPath(p string) string {
+	parent := path.Dir(p)
+	if parent == "." || parent == "/" {
+		return ""
+	}
+	return parent
+}
@@ -0,0 +1,271 @@
+package vtt
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/unicode"
+	"golang.org/x/text/transform"
+)
+
+// Subtitle formats accepted by Convert, keyed by file extension.
+var formats = map[string]func(io.Reader) ([]Cue, error){
+	".vtt": Parse,
+	".srt": ParseSRT,
+	".ass": ParseASS,
+	".ssa": ParseASS,
+}
+
+// Supported reports whether Convert understands files with extension ext.
+func Supported(ext string) bool {
+	_, ok := formats[strings.ToLower(ext)]
+	return ok
+}
+
+// Convert decodes a subtitle file of the format named by its extension and
+// re-encodes it as WebVTT.
+func Convert(ext string, data []byte) ([]byte, error) {
+	parse, ok := formats[strings.ToLower(ext)]
+	if !ok {
+		return nil, fmt.Errorf("unsupported subtitle format %q", ext)
+	}
+	text, err := decodeText(data)
+	if err != nil {
+		return nil, err
+	}
+	cues, err := parse(strings.NewReader(text))
+	if err != nil {
+		return nil, err
+	}
+	if len(cues) == 0 {
+		return nil, fmt.Errorf("no cues found")
+	}
+
+	var buf bytes.Buffer
+	if err := Write(&buf, cues); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// decodeText returns subtitle data as UTF-8. Files with a UTF-16 BOM are
+// transcoded; anything else that isn't valid UTF-8 is assumed to be
+// Windows-1252, which most legacy SRT files use.
+func decodeText(data []byte) (string, error) {
+	if bytes.HasPrefix(data, []byte{0xff, 0xfe}) || bytes.HasPrefix(data, []byte{0xfe, 0xff}) {
+		decoder := unicode.UTF16(unicode.LittleEndian, unicode.UseBOM).NewDecoder()
+		out, _, err := transform.Bytes(decoder, data)
+		if err != nil {
+			return "", fmt.Errorf("invalid UTF-16 subtitle: %w", err)
+		}
+		return string(out), nil
+	}
+	if utf8.Valid(data) {
+		return string(data), nil
+	}
+	out, _, err := transform.Bytes(charmap.Windows1252.NewDecoder(), data)
+	if err != nil {
+		return "", err
+	}
+	return string(out), nil
+}
+
+// Write renders cues as a WebVTT document.
+func Write(w io.Writer, cues []Cue) error {
+	bw := bufio.NewWriter(w)
+	bw.WriteString("WEBVTT\n")
+	for _, cue := range cues {
+		bw.WriteString("\n")
+		if cue.ID != "" {
+			bw.WriteString(cue.ID + "\n")
+		}
+		bw.WriteString(FormatTimestamp(cue.Start) + " --> " + FormatTimestamp(cue.End))
+		if cue.Settings != "" {
+			bw.WriteString(" " + cue.Settings)
+		}
+		bw.WriteString("\n" + cue.Text + "\n")
+	}
+	return bw.Flush()
+}
+
+// srtTagPattern matches SRT markup other than the <b>, <i> and <u> tags that
+// WebVTT supports too, e.g. <font color="...">.
+var srtTagPattern = regexp.MustCompile(`(?i)</?(?:font|span)[^>]*>`)
+
+// escapedTagPattern matches the <b>, <i> and <u> tags once escaped, so they
+// can be restored.
+var escapedTagPattern = regexp.MustCompile(`(?i)&lt;(/?)([biu])&gt;`)
+
+// escapeText escapes the characters WebVTT reserves in cue text.
+var escapeText = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;").Replace
+
+// srtText converts SubRip cue text to WebVTT cue text, keeping the <b>, <i>
+// and <u> tags.
+func srtText(text string) string {
+	text = escapeText(srtTagPattern.ReplaceAllString(text, ""))
+	return escapedTagPattern.ReplaceAllStringFunc(text, func(tag string) string {
+		m := escapedTagPattern.FindStringSubmatch(tag)
+		return "<" + m[1] + strings.ToLower(m[2]) + ">"
+	})
+}
+
+// joinLines drops the blank lines of cue text, which would end the cue.
+func joinLines(text string) string {
+	var lines []string
+	for _, line := range strings.Split(text, "\n") {
+		if strings.TrimSpace(line) != "" {
+			lines = append(lines, line)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// ParseSRT reads a SubRip document. Cue numbers and positioning coordinates
+// are dropped.
+func ParseSRT(r io.Reader) ([]Cue, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+
+	var cues []Cue
+	var block []string
+	flush := func() error {
+		defer func() { block = nil }()
+		timing := -1
+		for i, line := range block {
+			if strings.Contains(line, "-->") {
+				timing = i
+				break
+			}
+		}
+		if timing < 0 {
+			return nil
+		}
+		start, end, _, err := parseTiming(block[timing])
+		if err != nil {
+			return err
+		}
+		text := joinLines(srtText(strings.Join(block[timing+1:], "\n")))
+		if text == "" {
+			return nil
+		}
+		cues = append(cues, Cue{Start: start, End: end, Text: text})
+		return nil
+	}
+
+	first := true
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if first {
+			line = strings.TrimPrefix(line, "\ufeff")
+			first = false
+		}
+		if strings.TrimSpace(line) == "" {
+			if err := flush(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		block = append(block, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if err := flush(); err != nil {
+		return nil, err
+	}
+	return cues, nil
+}
+
+// assOverridePattern matches ASS override blocks such as {\an8} or {\i1}.
+var assOverridePattern = regexp.MustCompile(`\{[^}]*\}`)
+
+// ParseASS reads the [Events] section of an ASS/SSA script. Styling is
+// dropped; cues are returned in start order.
+func ParseASS(r io.Reader) ([]Cue, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+
+	var cues []Cue
+	var fields []string
+	inEvents := false
+	for scanner.Scan() {
+		line := strings.TrimSpace(strings.TrimPrefix(scanner.Text(), "\ufeff"))
+		if strings.HasPrefix(line, "[") {
+			inEvents = strings.EqualFold(line, "[Events]")
+			continue
+		}
+		if !inEvents {
+			continue
+		}
+
+		kind, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		switch strings.TrimSpace(kind) {
+		case "Format":
+			fields = nil
+			for _, f := range strings.Split(value, ",") {
+				fields = append(fields, strings.ToLower(strings.TrimSpace(f)))
+			}
+		case "Dialogue":
+			if len(fields) == 0 {
+				return nil, fmt.Errorf("dialogue before event format line")
+			}
+			cue, err := parseDialogue(fields, value)
+			if err != nil {
+				return nil, err
+			}
+			if cue.Text != "" {
+				cues = append(cues, cue)
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(cues, func(i, j int) bool { return cues[i].Start < cues[j].Start })
+	return cues, nil
+}
+
+// parseDialogue parses the value of a Dialogue line; the last field (Text)
+// may itself contain commas.
+func parseDialogue(fields []string, value string) (Cue, error) {
+	values := strings.SplitN(value, ",", len(fields))
+	if len(values) != len(fields) {
+		return Cue{}, fmt.Errorf("malformed dialogue line %q", value)
+	}
+
+	var cue Cue
+	for i, field := range fields {
+		v := strings.TrimSpace(values[i])
+		var err error
+		switch field {
+		case "start":
+			cue.Start, err = ParseTimestamp(v)
+		case "end":
+			cue.End, err = ParseTimestamp(v)
+		case "text":
+			cue.Text = assText(values[i])
+		}
+		if err != nil {
+			return Cue{}, err
+		}
+	}
+	return cue, nil
+}
+
+// assText converts ASS dialogue text to WebVTT cue text.
+func assText(text string) string {
+	text = escapeText(assOverridePattern.ReplaceAllString(text, ""))
+	text = strings.NewReplacer(`\N`, "\n", `\n`, "\n", `\h`, " ").Replace(text)
+	return joinLines(strings.TrimSpace(text))
+}
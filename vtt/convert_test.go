@@ -0,0 +1,156 @@
+package vtt
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConvert(t *testing.T) {
+	tests := []struct {
+		name string
+		ext  string
+		in   string
+		want string
+	}{
+		{
+			name: "srt",
+			ext:  ".srt",
+			in:   "1\r\n00:00:01,000 --> 00:00:02,500\r\nHello\r\nworld\r\n\r\n2\r\n00:00:03,000 --> 00:00:04,000\r\nBye\r\n",
+			want: "WEBVTT\n\n00:00:01.000 --> 00:00:02.500\nHello\nworld\n\n00:00:03.000 --> 00:00:04.000\nBye\n",
+		},
+		{
+			name: "srt escapes text but keeps b, i and u",
+			ext:  ".srt",
+			in:   "1\n00:00:01,000 --> 00:00:02,000\n<I>Tom & Jerry</I> <font color=\"red\">a < b</font> -->\n",
+			want: "WEBVTT\n\n00:00:01.000 --> 00:00:02.000\n<i>Tom &amp; Jerry</i> a &lt; b --&gt;\n",
+		},
+		{
+			name: "ass",
+			ext:  ".ass",
+			in: "[Script Info]\nTitle: x\n\n[Events]\n" +
+				"Format: Layer, Start, End, Style, Name, MarginL, MarginR, MarginV, Effect, Text\n" +
+				"Dialogue: 0,0:00:05.00,0:00:06.00,Default,,0,0,0,,Second\n" +
+				"Dialogue: 0,0:00:01.50,0:00:02.00,Default,,0,0,0,,{\\i1}First, line{\\i0}\\Nnext\n",
+			want: "WEBVTT\n\n00:00:01.500 --> 00:00:02.000\nFirst, line\nnext\n\n00:00:05.000 --> 00:00:06.000\nSecond\n",
+		},
+		{
+			name: "ass collapses blank lines and escapes",
+			ext:  ".ssa",
+			in: "[Events]\nFormat: Start, End, Text\n" +
+				"Dialogue: 0:00:01.00,0:00:02.00,A & B\\N\\N<c>\n",
+			want: "WEBVTT\n\n00:00:01.000 --> 00:00:02.000\nA &amp; B\n&lt;c&gt;\n",
+		},
+		{
+			name: "windows-1252",
+			ext:  ".srt",
+			in:   "1\n00:00:01,000 --> 00:00:02,000\n\x93caf\xe9\x94 \x80\n",
+			want: "WEBVTT\n\n00:00:01.000 --> 00:00:02.000\n“café” €\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Convert(tt.ext, []byte(tt.in))
+			if err != nil {
+				t.Fatalf("Convert: %v", err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("Convert = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConvertErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		ext  string
+		in   string
+	}{
+		{"unsupported", ".sub", "x"},
+		{"no cues", ".srt", "just text\n"},
+		{"bad timing", ".srt", "1\n00:00:xx,000 --> 00:00:02,000\nHi\n"},
+		{"dialogue before format", ".ass", "[Events]\nDialogue: 0,0:00:01.00,0:00:02.00,,,0,0,0,,Hi\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := Convert(tt.ext, []byte(tt.in)); err == nil {
+				t.Error("Convert succeeded, want an error")
+			}
+		})
+	}
+}
+
+func TestParse(t *testing.T) {
+	in := "WEBVTT\n\nNOTE a comment\n\nintro\n00:01.000 --> 00:02.000 align:start\n<i>Hi</i> &amp; bye\n\n01:00:00.000 --> 01:00:01.250\nLater\n"
+	cues, err := Parse(strings.NewReader(in))
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	want := []Cue{
+		{ID: "intro", Start: time.Second, End: 2 * time.Second, Settings: "align:start", Text: "<i>Hi</i> &amp; bye"},
+		{Start: time.Hour, End: time.Hour + 1250*time.Millisecond, Text: "Later"},
+	}
+	if len(cues) != len(want) {
+		t.Fatalf("Parse returned %d cues, want %d: %+v", len(cues), len(want), cues)
+	}
+	for i := range want {
+		if cues[i] != want[i] {
+			t.Errorf("cue %d = %+v, want %+v", i, cues[i], want[i])
+		}
+	}
+	if got := PlainText(cues[0].Text); got != "Hi & bye" {
+		t.Errorf("PlainText = %q, want %q", got, "Hi & bye")
+	}
+	if _, err := Parse(strings.NewReader("1\n00:01.000 --> 00:02.000\nHi\n")); err == nil {
+		t.Error("Parse accepted a document without WEBVTT header")
+	}
+}
+
+func TestTimestamps(t *testing.T) {
+	tests := []struct {
+		in   string
+		want time.Duration
+		out  string
+	}{
+		{"00:01.500", 1500 * time.Millisecond, "00:00:01.500"},
+		{"01:02:03.004", time.Hour + 2*time.Minute + 3*time.Second + 4*time.Millisecond, "01:02:03.004"},
+		{"00:00:05,250", 5250 * time.Millisecond, "00:00:05.250"},
+	}
+	for _, tt := range tests {
+		got, err := ParseTimestamp(tt.in)
+		if err != nil {
+			t.Errorf("ParseTimestamp(%q): %v", tt.in, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParseTimestamp(%q) = %v, want %v", tt.in, got, tt.want)
+		}
+		if out := FormatTimestamp(got); out != tt.out {
+			t.Errorf("FormatTimestamp(%v) = %q, want %q", got, out, tt.out)
+		}
+	}
+	for _, bad := range []string{"", "12", "aa:bb.000", "1:2:3:4"} {
+		if _, err := ParseTimestamp(bad); err == nil {
+			t.Errorf("ParseTimestamp accepted %q", bad)
+		}
+	}
+}
+
+func TestRetime(t *testing.T) {
+	cues := []Cue{
+		{Start: time.Second, End: 2 * time.Second},
+		{Start: 10 * time.Second, End: 12 * time.Second},
+	}
+	got := Retime(cues, 2, -3*time.Second)
+	want := []Cue{
+		{Start: 0, End: time.Second},
+		{Start: 17 * time.Second, End: 21 * time.Second},
+	}
+	if len(got) != len(want) || got[0] != want[0] || got[1] != want[1] {
+		t.Errorf("Retime = %+v, want %+v", got, want)
+	}
+	if got := Retime(cues, 1, -2*time.Second); len(got) != 1 {
+		t.Errorf("Retime kept %d cues, want the one ending after zero", len(got))
+	}
+}
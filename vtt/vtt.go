@@ -0,0 +1,180 @@
+package vtt
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Cue is a single timed subtitle entry.
+type Cue struct {
+	ID       string
+	Start    time.Duration
+	End      time.Duration
+	Settings string // Positioning settings after the end timestamp, if any
+	Text     string // Cue payload, may contain WebVTT markup and newlines
+}
+
+// tagPattern matches WebVTT cue markup such as <i>, </c.yellow> or <00:01.000>.
+var tagPattern = regexp.MustCompile(`<[^>]*>`)
+
+// Parse reads a WebVTT document and returns its cues in file order. NOTE,
+// STYLE and REGION blocks are skipped.
+func Parse(r io.Reader) ([]Cue, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+
+	var blocks [][]string
+	var block []string
+	first := true
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if first {
+			line = strings.TrimPrefix(line, "\ufeff")
+			if !strings.HasPrefix(line, "WEBVTT") {
+				return nil, fmt.Errorf("missing WEBVTT header")
+			}
+			first = false
+		}
+		if strings.TrimSpace(line) == "" {
+			if len(block) > 0 {
+				blocks = append(blocks, block)
+				block = nil
+			}
+			continue
+		}
+		block = append(block, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if first {
+		return nil, fmt.Errorf("empty document")
+	}
+	if len(block) > 0 {
+		blocks = append(blocks, block)
+	}
+
+	var cues []Cue
+	// The first block is the header.
+	for _, b := range blocks[1:] {
+		cue, ok, err := parseBlock(b)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			cues = append(cues, cue)
+		}
+	}
+	return cues, nil
+}
+
+// parseBlock turns a block of lines into a cue. ok is false for blocks that
+// aren't cues.
+func parseBlock(lines []string) (Cue, bool, error) {
+	switch {
+	case strings.HasPrefix(lines[0], "NOTE"), lines[0] == "STYLE", lines[0] == "REGION":
+		return Cue{}, false, nil
+	}
+
+	var cue Cue
+	timing := 0
+	if !strings.Contains(lines[0], "-->") {
+		if len(lines) < 2 || !strings.Contains(lines[1], "-->") {
+			return Cue{}, false, nil
+		}
+		cue.ID = lines[0]
+		timing = 1
+	}
+
+	start, end, settings, err := parseTiming(lines[timing])
+	if err != nil {
+		return Cue{}, false, err
+	}
+	cue.Start, cue.End, cue.Settings = start, end, settings
+	cue.Text = strings.Join(lines[timing+1:], "\n")
+	return cue, true, nil
+}
+
+// parseTiming parses "start --> end [settings]".
+func parseTiming(line string) (time.Duration, time.Duration, string, error) {
+	left, right, _ := strings.Cut(line, "-->")
+	start, err := ParseTimestamp(strings.TrimSpace(left))
+	if err != nil {
+		return 0, 0, "", err
+	}
+	fields := strings.Fields(right)
+	if len(fields) == 0 {
+		return 0, 0, "", fmt.Errorf("missing end timestamp in %q", line)
+	}
+	end, err := ParseTimestamp(fields[0])
+	if err != nil {
+		return 0, 0, "", err
+	}
+	return start, end, strings.Join(fields[1:], " "), nil
+}
+
+// ParseTimestamp parses "hh:mm:ss.ttt" or "mm:ss.ttt". A comma is accepted as
+// the decimal separator so SRT timestamps parse too.
+func ParseTimestamp(s string) (time.Duration, error) {
+	s = strings.Replace(s, ",", ".", 1)
+	parts := strings.Split(s, ":")
+	if len(parts) < 2 || len(parts) > 3 {
+		return 0, fmt.Errorf("invalid timestamp %q", s)
+	}
+
+	var hours, minutes int
+	var err error
+	if len(parts) == 3 {
+		if hours, err = strconv.Atoi(parts[0]); err != nil {
+			return 0, fmt.Errorf("invalid timestamp %q", s)
+		}
+		parts = parts[1:]
+	}
+	if minutes, err = strconv.Atoi(parts[0]); err != nil {
+		return 0, fmt.Errorf("invalid timestamp %q", s)
+	}
+	seconds, err := strconv.ParseFloat(parts[1], 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid timestamp %q", s)
+	}
+
+	d := time.Duration(hours)*time.Hour + time.Duration(minutes)*time.Minute
+	return d + time.Duration(seconds*float64(time.Second)).Round(time.Millisecond), nil
+}
+
+// FormatTimestamp renders d as "hh:mm:ss.ttt".
+func FormatTimestamp(d time.Duration) string {
+	if d < 0 {
+		d = 0
+	}
+	ms := d.Milliseconds()
+	return fmt.Sprintf("%02d:%02d:%02d.%03d", ms/3600000, ms/60000%60, ms/1000%60, ms%1000)
+}
+
+// PlainText strips markup from cue text and joins its lines with spaces.
+func PlainText(text string) string {
+	text = tagPattern.ReplaceAllString(text, "")
+	replacer := strings.NewReplacer("&amp;", "&", "&lt;", "<", "&gt;", ">", "&nbsp;", " ", "&lrm;", "", "&rlm;", "")
+	return strings.Join(strings.Fields(replacer.Replace(text)), " ")
+}
+
+// Retime maps every cue time t to t*scale + offset. Cues that end up entirely
+// before zero are dropped and starts are clamped to zero.
+func Retime(cues []Cue, scale float64, offset time.Duration) []Cue {
+	out := make([]Cue, 0, len(cues))
+	for _, cue := range cues {
+		cue.Start = time.Duration(float64(cue.Start)*scale).Round(time.Millisecond) + offset
+		cue.End = time.Duration(float64(cue.End)*scale).Round(time.Millisecond) + offset
+		if cue.End <= 0 {
+			continue
+		}
+		cue.Start = max(cue.Start, 0)
+		out = append(out, cue)
+	}
+	return out
+}